@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/kvpb"
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcServer serves the KVService API over gRPC from the same store as the
+// HTTP API, with the same capability checks.
+type grpcServer struct {
+	kvpb.UnimplementedKVServiceServer
+	kvStore store.Store
+}
+
+// newGRPCServer returns a gRPC server serving kvStore.
+func newGRPCServer(kvStore store.Store) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(recoverUnary), grpc.ChainStreamInterceptor(recoverStream))
+	kvpb.RegisterKVServiceServer(server, &grpcServer{kvStore: kvStore})
+	return server
+}
+
+// recoverUnary fails a call that panics, as a store does when it can't
+// persist a write, with an Internal error, as gin's recovery middleware does
+// for HTTP requests, rather than crashing the server.
+func recoverUnary(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (_ any, err error) {
+	defer recoverCall(info.FullMethod, &err)
+	return handler(ctx, request)
+}
+
+// recoverStream does what recoverUnary does for streaming calls.
+func recoverStream(server any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverCall(info.FullMethod, &err)
+	return handler(server, stream)
+}
+
+// recoverCall, deferred, replaces the error of a call to method with an
+// Internal one if it panicked.
+func recoverCall(method string, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("panic serving %s: %v\n%s", method, r, debug.Stack())
+		*err = status.Error(codes.Internal, "internal error")
+	}
+}
+
+// keyspace returns the store for namespace, as keyspaceMiddleware does for
+// HTTP requests, creating the namespace only for writes.
+func (s *grpcServer) keyspace(namespace string, write bool) (store.Store, error) {
+	namespacedStore, ok := s.kvStore.(store.NamespacedStore)
+	switch {
+	case ok:
+		if namespace == "" {
+			namespace = store.DefaultNamespace
+		}
+		var keyspace store.Store
+		var err error
+		found := true
+		if write {
+			keyspace, err = namespacedStore.Namespace(namespace)
+		} else {
+			keyspace, found, err = namespacedStore.LookupNamespace(namespace)
+		}
+		switch {
+		case errors.Is(err, store.ErrInvalidNamespace):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, store.ErrTooManyNamespaces):
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case err != nil:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !found {
+			return nil, status.Error(codes.NotFound, "Namespace not found.")
+		}
+		return keyspace, nil
+	case namespace == "" || namespace == store.DefaultNamespace:
+		return s.kvStore, nil
+	default:
+		return nil, status.Error(codes.Unimplemented, "Store does not support namespaces.")
+	}
+}
+
+// checkLeader rejects writes to a follower of a replicated store. Unlike the
+// HTTP API, which forwards them, the gRPC API only knows the leader's HTTP
+// address.
+func (s *grpcServer) checkLeader() error {
+	replicatedStore, ok := s.kvStore.(store.ReplicatedStore)
+	if !ok || replicatedStore.IsLeader() {
+		return nil
+	}
+	if leaderAddr, known := replicatedStore.LeaderAddr(); known {
+		return status.Errorf(codes.FailedPrecondition, "This node is not the leader; send writes to %s.", leaderAddr)
+	}
+	return status.Error(codes.Unavailable, "No leader is available.")
+}
+
+func (s *grpcServer) Get(_ context.Context, request *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	kvStore, err := s.keyspace(request.Namespace, false)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	var version uint64
+	var found bool
+	if versionedStore, ok := kvStore.(store.VersionedStore); ok {
+		value, version = versionedStore.GetWithVersion(request.Key)
+		found = version != 0
+	} else {
+		value, found = kvStore.Lookup(request.Key)
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, "Key not found.")
+	}
+	protoValue, err := newProtoValue(value)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "value of %q is not a JSON value: %v", request.Key, err)
+	}
+	return &kvpb.GetResponse{Value: protoValue, Version: version, Type: store.CollectionType(value)}, nil
+}
+
+func (s *grpcServer) Set(_ context.Context, request *kvpb.SetRequest) (*kvpb.SetResponse, error) {
+	// a null value is set, unlike a missing one
+	if request.Value == nil {
+		return nil, status.Error(codes.InvalidArgument, "value is required")
+	}
+	if request.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must be positive")
+	}
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	kvStore, err := s.keyspace(request.Namespace, true)
+	if err != nil {
+		return nil, err
+	}
+	value := request.Value.AsInterface()
+	if request.Type != "" {
+		if _, ok := kvStore.(store.CollectionStore); !ok {
+			return nil, status.Error(codes.Unimplemented, "Store does not support collections.")
+		}
+		if value, err = store.DecodeCollection(request.Type, value); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	switch {
+	case request.IfVersion != nil:
+		versionedStore, ok := kvStore.(store.VersionedStore)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "Store does not support conditional writes.")
+		}
+		var version uint64
+		if request.TtlSeconds > 0 {
+			expiringStore, ok := kvStore.(store.ExpiringVersionedStore)
+			if !ok {
+				return nil, status.Error(codes.Unimplemented, "Store does not support TTLs.")
+			}
+			version, err = expiringStore.CompareAndSwapWithTTL(request.Key, *request.IfVersion, value, time.Duration(request.TtlSeconds)*time.Second)
+		} else {
+			version, err = versionedStore.CompareAndSwap(request.Key, *request.IfVersion, value)
+		}
+		switch {
+		case errors.Is(err, store.ErrVersionMismatch):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case err != nil:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &kvpb.SetResponse{Version: version}, nil
+	case request.TtlSeconds > 0:
+		expiringStore, ok := kvStore.(store.ExpiringStore)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "Store does not support TTLs.")
+		}
+		expiringStore.SetWithTTL(request.Key, value, time.Duration(request.TtlSeconds)*time.Second)
+	default:
+		kvStore.Set(request.Key, value)
+	}
+	return &kvpb.SetResponse{}, nil
+}
+
+func (s *grpcServer) Delete(_ context.Context, request *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	kvStore, err := s.keyspace(request.Namespace, false)
+	if err != nil {
+		return nil, err
+	}
+	if request.IfVersion == nil {
+		kvStore.Delete(request.Key)
+		return &kvpb.DeleteResponse{}, nil
+	}
+	versionedStore, ok := kvStore.(store.VersionedStore)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "Store does not support conditional writes.")
+	}
+	err = versionedStore.CompareAndDelete(request.Key, *request.IfVersion)
+	switch {
+	case errors.Is(err, store.ErrVersionMismatch):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+// watchEventTypes maps store event types to their protobuf enum values.
+var watchEventTypes = map[store.EventType]kvpb.WatchEvent_Type{
+	store.EventSet:    kvpb.WatchEvent_TYPE_SET,
+	store.EventDelete: kvpb.WatchEvent_TYPE_DELETE,
+	store.EventExpire: kvpb.WatchEvent_TYPE_EXPIRE,
+	store.EventEvict:  kvpb.WatchEvent_TYPE_EVICT,
+	store.EventUpdate: kvpb.WatchEvent_TYPE_UPDATE,
+}
+
+func (s *grpcServer) Watch(request *kvpb.WatchRequest, stream grpc.ServerStreamingServer[kvpb.WatchEvent]) error {
+	kvStore, err := s.keyspace(request.Namespace, false)
+	if err != nil {
+		return err
+	}
+	watchableStore, ok := kvStore.(store.WatchableStore)
+	if !ok {
+		return status.Error(codes.Unimplemented, "Store does not support watching keys.")
+	}
+	events, err := watchableStore.Watch(stream.Context(), request.Prefix, request.FromRevision)
+	if errors.Is(err, store.ErrCompacted) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for event := range events {
+		message := &kvpb.WatchEvent{Type: watchEventTypes[event.Type], Key: event.Key, Revision: event.Revision}
+		switch event.Type {
+		case store.EventSet:
+			if message.Value, err = newProtoValue(event.Value); err != nil {
+				return status.Errorf(codes.Internal, "value of %q is not a JSON value: %v", event.Key, err)
+			}
+			message.CollectionType = store.CollectionType(event.Value)
+		case store.EventUpdate:
+			if message.Change, err = newProtoValue(event.Change); err != nil {
+				return status.Errorf(codes.Internal, "change to %q is not a JSON value: %v", event.Key, err)
+			}
+		}
+		if err := stream.Send(message); err != nil {
+			return err
+		}
+	}
+	// the channel closes when the client goes away or falls too far behind
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.ResourceExhausted, "The watcher fell too far behind.")
+}
+
+// newProtoValue returns value as a protobuf Value. Values other than those
+// decoded from JSON, such as collections, are converted through their JSON
+// encoding.
+func newProtoValue(value any) (*structpb.Value, error) {
+	protoValue, err := structpb.NewValue(value)
+	if err == nil {
+		return protoValue, nil
+	}
+	data, marshalErr := json.Marshal(value)
+	if marshalErr != nil {
+		return nil, err
+	}
+	protoValue = &structpb.Value{}
+	return protoValue, protojson.Unmarshal(data, protoValue)
+}
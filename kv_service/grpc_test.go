@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/kvpb"
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type grpcTestSuite struct {
+	suite.Suite
+	kvStore store.NamespacedStore
+	server  *grpc.Server
+	conn    *grpc.ClientConn
+	client  kvpb.KVServiceClient
+}
+
+func (s *grpcTestSuite) SetupTest() {
+	s.kvStore = store.NewNamespacedStore()
+	s.serve(s.kvStore)
+}
+
+func (s *grpcTestSuite) TearDownTest() {
+	s.conn.Close()
+	s.server.Stop()
+	s.server = nil
+}
+
+// serve serves kvStore over an in-memory connection that s.client uses.
+func (s *grpcTestSuite) serve(kvStore store.Store) {
+	if s.server != nil {
+		s.TearDownTest()
+	}
+	listener := bufconn.Listen(1 << 20)
+	s.server = newGRPCServer(kvStore)
+	go s.server.Serve(listener)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	s.Require().NoError(err)
+	s.conn = conn
+	s.client = kvpb.NewKVServiceClient(conn)
+}
+
+func (s *grpcTestSuite) value(v any) *structpb.Value {
+	value, err := structpb.NewValue(v)
+	s.Require().NoError(err)
+	return value
+}
+
+func (s *grpcTestSuite) assertCode(code codes.Code, err error) {
+	assert.Equal(s.T(), code, status.Code(err), "error: %v", err)
+}
+
+func (s *grpcTestSuite) TestSetAndGet() {
+	ctx := context.Background()
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value(map[string]any{"nested": []any{"a", 1.5}})})
+	s.Require().NoError(err)
+
+	response, err := s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"nested": []any{"a", 1.5}}, response.Value.AsInterface())
+	assert.Equal(s.T(), uint64(1), response.Version)
+	// the HTTP and gRPC APIs share the store
+	keyspace, _ := s.kvStore.Namespace(store.DefaultNamespace)
+	assert.Equal(s.T(), map[string]any{"nested": []any{"a", 1.5}}, keyspace.Get("key"))
+}
+
+func (s *grpcTestSuite) TestGet_NotFound() {
+	_, err := s.client.Get(context.Background(), &kvpb.GetRequest{Key: "missing"})
+	s.assertCode(codes.NotFound, err)
+}
+
+func (s *grpcTestSuite) TestSetAndGet_Null() {
+	ctx := context.Background()
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: structpb.NewNullValue()})
+	s.Require().NoError(err)
+
+	response, err := s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.Require().NoError(err)
+	assert.Nil(s.T(), response.Value.AsInterface())
+	assert.Equal(s.T(), uint64(1), response.Version)
+}
+
+func (s *grpcTestSuite) TestSet_RequiresValue() {
+	_, err := s.client.Set(context.Background(), &kvpb.SetRequest{Key: "key"})
+	s.assertCode(codes.InvalidArgument, err)
+}
+
+func (s *grpcTestSuite) TestSet_WithTTL() {
+	ctx := context.Background()
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value"), TtlSeconds: 60})
+	s.Require().NoError(err)
+	keyspace, _ := s.kvStore.Namespace(store.DefaultNamespace)
+	entries, _ := keyspace.(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+
+	_, err = s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value"), TtlSeconds: -1})
+	s.assertCode(codes.InvalidArgument, err)
+}
+
+func (s *grpcTestSuite) TestSet_IfVersion() {
+	ctx := context.Background()
+	response, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("one"), IfVersion: proto.Uint64(0)})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), uint64(1), response.Version)
+
+	_, err = s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("two"), IfVersion: proto.Uint64(0)})
+	s.assertCode(codes.FailedPrecondition, err)
+	response, err = s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("two"), IfVersion: proto.Uint64(1)})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), uint64(2), response.Version)
+
+	// a conditional write can set a TTL
+	response, err = s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("three"), IfVersion: proto.Uint64(2), TtlSeconds: 60})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), uint64(3), response.Version)
+	keyspace, _ := s.kvStore.Namespace(store.DefaultNamespace)
+	entries, _ := keyspace.(store.ScannableStore).Scan("key", "", 1)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *grpcTestSuite) TestDelete() {
+	ctx := context.Background()
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value")})
+	s.Require().NoError(err)
+
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Key: "key", IfVersion: proto.Uint64(5)})
+	s.assertCode(codes.FailedPrecondition, err)
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Key: "key", IfVersion: proto.Uint64(1)})
+	s.Require().NoError(err)
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Key: "missing"})
+	s.Require().NoError(err)
+
+	_, err = s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.assertCode(codes.NotFound, err)
+}
+
+func (s *grpcTestSuite) TestNamespaces() {
+	ctx := context.Background()
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Namespace: "users", Key: "key", Value: s.value("user")})
+	s.Require().NoError(err)
+
+	_, err = s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.assertCode(codes.NotFound, err)
+	response, err := s.client.Get(ctx, &kvpb.GetRequest{Namespace: "users", Key: "key"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "user", response.Value.AsInterface())
+
+	_, err = s.client.Get(ctx, &kvpb.GetRequest{Namespace: "not/valid", Key: "key"})
+	s.assertCode(codes.InvalidArgument, err)
+
+	// reading from a namespace that doesn't exist doesn't create it
+	_, err = s.client.Get(ctx, &kvpb.GetRequest{Namespace: "unknown", Key: "key"})
+	s.assertCode(codes.NotFound, err)
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Namespace: "unknown", Key: "key"})
+	s.assertCode(codes.NotFound, err)
+	assert.Equal(s.T(), []string{store.DefaultNamespace, "users"}, s.kvStore.Namespaces())
+}
+
+func (s *grpcTestSuite) TestUnsupportedStore() {
+	s.serve(basicStore{store.NewInMemoryStore()})
+	ctx := context.Background()
+
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value")})
+	s.Require().NoError(err)
+	response, err := s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "value", response.Value.AsInterface())
+	assert.Equal(s.T(), uint64(0), response.Version)
+
+	_, err = s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value"), TtlSeconds: 60})
+	s.assertCode(codes.Unimplemented, err)
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Key: "key", IfVersion: proto.Uint64(1)})
+	s.assertCode(codes.Unimplemented, err)
+	_, err = s.client.Get(ctx, &kvpb.GetRequest{Namespace: "users", Key: "key"})
+	s.assertCode(codes.Unimplemented, err)
+	stream, err := s.client.Watch(ctx, &kvpb.WatchRequest{})
+	s.Require().NoError(err)
+	_, err = stream.Recv()
+	s.assertCode(codes.Unimplemented, err)
+}
+
+func (s *grpcTestSuite) TestFollowerRejectsWrites() {
+	s.serve(replicaStore{Store: store.NewInMemoryStore(), leaderAddr: "http://leader:8080"})
+	ctx := context.Background()
+
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value")})
+	s.assertCode(codes.FailedPrecondition, err)
+	assert.Contains(s.T(), err.Error(), "http://leader:8080")
+	// reads are served by the follower
+	_, err = s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.assertCode(codes.NotFound, err)
+
+	s.serve(replicaStore{Store: store.NewInMemoryStore()})
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Key: "key"})
+	s.assertCode(codes.Unavailable, err)
+}
+
+func (s *grpcTestSuite) TestWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Namespace: "users", Key: "user/1", Value: s.value("before")})
+	s.Require().NoError(err)
+
+	stream, err := s.client.Watch(ctx, &kvpb.WatchRequest{Namespace: "users", Prefix: "user/", FromRevision: 1})
+	s.Require().NoError(err)
+	_, err = s.client.Set(ctx, &kvpb.SetRequest{Namespace: "users", Key: "other", Value: s.value("ignored")})
+	s.Require().NoError(err)
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Namespace: "users", Key: "user/1"})
+	s.Require().NoError(err)
+
+	for _, expected := range []*kvpb.WatchEvent{
+		{Type: kvpb.WatchEvent_TYPE_SET, Key: "user/1", Value: s.value("before"), Revision: 1},
+		{Type: kvpb.WatchEvent_TYPE_DELETE, Key: "user/1", Revision: 3},
+	} {
+		event, err := stream.Recv()
+		s.Require().NoError(err)
+		assert.True(s.T(), proto.Equal(expected, event), "expected %v, got %v", expected, event)
+	}
+}
+
+func (s *grpcTestSuite) TestWatch_Compacted() {
+	mockStore := &mockStore{}
+	mockStore.On("Watch", mock.Anything, "", uint64(1)).Return(nil, store.ErrCompacted)
+	s.serve(mockStore)
+
+	stream, err := s.client.Watch(context.Background(), &kvpb.WatchRequest{FromRevision: 1})
+	s.Require().NoError(err)
+	_, err = stream.Recv()
+	s.assertCode(codes.OutOfRange, err)
+}
+
+func (s *grpcTestSuite) TestStoreErrors() {
+	mockStore := &mockStore{}
+	mockStore.On("CompareAndSwap", "key", uint64(1), "value").Return(uint64(0), errors.New("disk full"))
+	mockStore.On("CompareAndDelete", "key", uint64(1)).Return(errors.New("disk full"))
+	s.serve(mockStore)
+	ctx := context.Background()
+
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value"), IfVersion: proto.Uint64(1)})
+	s.assertCode(codes.Internal, err)
+	_, err = s.client.Delete(ctx, &kvpb.DeleteRequest{Key: "key", IfVersion: proto.Uint64(1)})
+	s.assertCode(codes.Internal, err)
+}
+
+func (s *grpcTestSuite) TestRecoversFromPanics() {
+	// a store panics when it can't persist a write
+	mockStore := &mockStore{}
+	mockStore.On("Set", "key", "value").Run(func(mock.Arguments) { panic("disk full") })
+	mockStore.On("Watch", mock.Anything, "", uint64(0)).Run(func(mock.Arguments) { panic("disk full") })
+	mockStore.On("GetWithVersion", "key").Return("value", uint64(1))
+	s.serve(mockStore)
+	ctx := context.Background()
+
+	_, err := s.client.Set(ctx, &kvpb.SetRequest{Key: "key", Value: s.value("value")})
+	s.assertCode(codes.Internal, err)
+	stream, err := s.client.Watch(ctx, &kvpb.WatchRequest{})
+	s.Require().NoError(err)
+	_, err = stream.Recv()
+	s.assertCode(codes.Internal, err)
+
+	// and carries on serving
+	response, err := s.client.Get(ctx, &kvpb.GetRequest{Key: "key"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "value", response.Value.AsInterface())
+}
+
+func TestGRPCTestSuite(t *testing.T) {
+	suite.Run(t, new(grpcTestSuite))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+)
+
+// errLineTooLong is returned by readLine for a line over its limit.
+var errLineTooLong = errors.New("line too long")
+
+// tcpServer accepts connections for one of the plain TCP protocols served
+// alongside the HTTP API, and keeps track of them so Close can end them all.
+type tcpServer struct {
+	connMu   sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// serve accepts connections on listener, handling each on its own goroutine,
+// until Close is called.
+func (s *tcpServer) serve(listener net.Listener, handle func(conn net.Conn)) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.connMu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		s.connMu.Lock()
+		if s.closed {
+			s.connMu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			s.connMu.Unlock()
+			return err
+		}
+		if s.conns == nil {
+			s.conns = map[net.Conn]struct{}{}
+		}
+		s.conns[conn] = struct{}{}
+		s.connMu.Unlock()
+
+		go func() {
+			defer func() {
+				s.connMu.Lock()
+				delete(s.conns, conn)
+				s.connMu.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections and closes every open one.
+func (s *tcpServer) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// readLine reads a line of at most maxLength bytes, without its line ending.
+func readLine(r *bufio.Reader, maxLength int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLength {
+			return "", errLineTooLong
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// defaultKeyspace returns the store the TCP protocols serve: kvStore's
+// default namespace if it has namespaces, or kvStore itself. It is looked up
+// for every command, as dropping the default namespace replaces it.
+func defaultKeyspace(kvStore store.Store) (store.Store, error) {
+	namespacedStore, ok := kvStore.(store.NamespacedStore)
+	if !ok {
+		return kvStore, nil
+	}
+	return namespacedStore.Namespace(store.DefaultNamespace)
+}
@@ -1,12 +1,379 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/awgraves/key-value-store/kv_service/store"
+	"google.golang.org/grpc"
 )
 
+// getDataDir returns the directory the store persists its data to.
+// Uses environment variable KV_SERVICE_DATA_DIR; empty means keep data in memory only.
+func getDataDir() string {
+	return os.Getenv("KV_SERVICE_DATA_DIR")
+}
+
+// defaultWALCompactSize is the log size past which a write-ahead log store
+// compacts, unless KV_SERVICE_WAL_COMPACT_SIZE says otherwise.
+const defaultWALCompactSize = 64 << 20
+
+// getWALOptions returns the write-ahead log settings for a persistent store.
+// Uses environment variable KV_SERVICE_WAL_SYNC, which is one of "always"
+// (the default), "never", or a duration such as "100ms" to fsync periodically,
+// and KV_SERVICE_WAL_COMPACT_SIZE, the log size in bytes that triggers compaction.
+func getWALOptions() (store.WALOptions, error) {
+	var opts store.WALOptions
+	switch policy := os.Getenv("KV_SERVICE_WAL_SYNC"); policy {
+	case "", "always":
+		opts.SyncPolicy = store.SyncAlways
+	case "never":
+		opts.SyncPolicy = store.SyncNever
+	default:
+		interval, err := time.ParseDuration(policy)
+		if err != nil || interval <= 0 {
+			return store.WALOptions{}, fmt.Errorf("invalid KV_SERVICE_WAL_SYNC %q: want always, never or a positive duration", policy)
+		}
+		opts.SyncPolicy, opts.SyncInterval = store.SyncInterval, interval
+	}
+	compactSize, err := getLimit("KV_SERVICE_WAL_COMPACT_SIZE")
+	if err != nil {
+		return store.WALOptions{}, err
+	}
+	opts.CompactSize = cmp.Or(compactSize, defaultWALCompactSize)
+	return opts, nil
+}
+
+// getStorageEngine returns the on-disk format for a persistent store.
+// Uses environment variable KV_SERVICE_STORAGE_ENGINE, which is "wal" (the
+// default) to hold data in memory behind a write-ahead log, or "lsm" for an
+// LSM tree that holds only recent writes in memory.
+func getStorageEngine() (string, error) {
+	switch engine := os.Getenv("KV_SERVICE_STORAGE_ENGINE"); engine {
+	case "", "wal":
+		return "wal", nil
+	case "lsm":
+		return engine, nil
+	default:
+		return "", fmt.Errorf("invalid KV_SERVICE_STORAGE_ENGINE %q: want wal or lsm", engine)
+	}
+}
+
+// getRaftOptions returns this node's cluster settings, if it is part of one.
+// Uses environment variables KV_SERVICE_RAFT_NODE_ID for the node's ID and
+// KV_SERVICE_RAFT_PEERS for every node of the cluster, as comma-separated
+// id=raft_address=http_address triples, e.g.
+// "kv1=kv1:7000=http://kv1:8080,kv2=kv2:7000=http://kv2:8080".
+func getRaftOptions(dataDir string) (store.RaftOptions, bool, error) {
+	opts := store.RaftOptions{NodeID: os.Getenv("KV_SERVICE_RAFT_NODE_ID"), DataDir: filepath.Join(dataDir, "raft")}
+	peers := os.Getenv("KV_SERVICE_RAFT_PEERS")
+	if opts.NodeID == "" && peers == "" {
+		return opts, false, nil
+	}
+	if opts.NodeID == "" || peers == "" {
+		return opts, false, errors.New("KV_SERVICE_RAFT_NODE_ID and KV_SERVICE_RAFT_PEERS must be set together")
+	}
+	for _, peer := range strings.Split(peers, ",") {
+		fields := strings.SplitN(strings.TrimSpace(peer), "=", 3)
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+			return opts, false, fmt.Errorf("invalid KV_SERVICE_RAFT_PEERS entry %q: want id=raft_address=http_address", peer)
+		}
+		opts.Peers = append(opts.Peers, store.RaftPeer{ID: fields[0], RaftAddr: fields[1], HTTPAddr: fields[2]})
+	}
+	return opts, true, nil
+}
+
+// getPrimary returns the base URL of the primary this node is a replica of,
+// if it is one. Uses environment variable KV_SERVICE_REPLICA_OF, e.g.
+// "http://kv1:8080".
+func getPrimary() string {
+	return os.Getenv("KV_SERVICE_REPLICA_OF")
+}
+
+// getPartitionOptions returns this node's base URL and those of every node
+// of its partitioned cluster, if it is part of one. Uses environment
+// variables KV_SERVICE_PARTITION_SELF and KV_SERVICE_PARTITION_NODES, a
+// comma-separated list such as "http://kv1:8080,http://kv2:8080".
+func getPartitionOptions() (string, []string, bool, error) {
+	self := os.Getenv("KV_SERVICE_PARTITION_SELF")
+	nodes := os.Getenv("KV_SERVICE_PARTITION_NODES")
+	if self == "" && nodes == "" {
+		return "", nil, false, nil
+	}
+	if self == "" || nodes == "" {
+		return "", nil, false, errors.New("KV_SERVICE_PARTITION_SELF and KV_SERVICE_PARTITION_NODES must be set together")
+	}
+	var urls []string
+	for _, node := range strings.Split(nodes, ",") {
+		urls = append(urls, strings.TrimSpace(node))
+	}
+	return self, urls, true, nil
+}
+
+// getListenAddr returns the address an optional listener listens on, if it
+// is served. Listeners are opt-in, served only when environment variable
+// name is set, so a deployment only opens the ports it means to.
+func getListenAddr(name string) (string, bool) {
+	addr := os.Getenv(name)
+	return addr, addr != ""
+}
+
+// getMissingKeysAsNull reports whether reading a missing key over HTTP
+// returns a null value, as it used to, rather than a 404. Uses environment
+// variable KV_SERVICE_MISSING_KEYS_AS_NULL, "true" or "false" (the default).
+func getMissingKeysAsNull() (bool, error) {
+	value := os.Getenv("KV_SERVICE_MISSING_KEYS_AS_NULL")
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid KV_SERVICE_MISSING_KEYS_AS_NULL %q: want true or false", value)
+	}
+	return enabled, nil
+}
+
+// defaultMaxNamespaces is how many namespaces a store with a memory budget
+// holds, unless KV_SERVICE_MAX_NAMESPACES says otherwise. Each has its own
+// budget, so this bounds the memory used by all of them.
+const defaultMaxNamespaces = 16
+
+// getBoundedOptions returns the memory budget for each namespace, if one is set.
+// Uses environment variables KV_SERVICE_MAX_ENTRIES and KV_SERVICE_MAX_BYTES
+// for the budget, and KV_SERVICE_EVICTION_POLICY for the policy: "lru" (the
+// default), "lfu", "random" or "arc".
+func getBoundedOptions() (store.BoundedOptions, bool, error) {
+	var opts store.BoundedOptions
+	maxEntries, err := getLimit("KV_SERVICE_MAX_ENTRIES")
+	if err != nil {
+		return opts, false, err
+	}
+	opts.MaxEntries = int(maxEntries)
+	if opts.MaxBytes, err = getLimit("KV_SERVICE_MAX_BYTES"); err != nil {
+		return opts, false, err
+	}
+
+	switch policy := os.Getenv("KV_SERVICE_EVICTION_POLICY"); policy {
+	case "", "lru":
+		opts.NewPolicy = store.NewLRUPolicy
+	case "lfu":
+		opts.NewPolicy = store.NewLFUPolicy
+	case "random":
+		opts.NewPolicy = store.NewRandomPolicy
+	case "arc":
+		opts.NewPolicy = store.NewARCPolicy
+	default:
+		return opts, false, fmt.Errorf("invalid KV_SERVICE_EVICTION_POLICY %q: want lru, lfu, random or arc", policy)
+	}
+	return opts, opts.MaxEntries > 0 || opts.MaxBytes > 0, nil
+}
+
+// getLimit returns the positive integer in environment variable name, or 0 if it is unset.
+func getLimit(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: want a positive integer", name, value)
+	}
+	return limit, nil
+}
+
+// newStore builds the Store selected by the environment, with a separate
+// keyspace per namespace.
+func newStore() (store.Store, error) {
+	boundedOpts, bounded, err := getBoundedOptions()
+	if err != nil {
+		return nil, err
+	}
+	shards, err := getLimit("KV_SERVICE_SHARDS")
+	if err != nil {
+		return nil, err
+	}
+	dataDir := getDataDir()
+	if bounded && dataDir != "" {
+		// evicting from a cache is expected; from a durable store it is data loss
+		return nil, errors.New("a memory budget cannot be combined with KV_SERVICE_DATA_DIR")
+	}
+	if shards > 0 && (bounded || dataDir != "") {
+		return nil, errors.New("KV_SERVICE_SHARDS cannot be combined with a memory budget or KV_SERVICE_DATA_DIR")
+	}
+	raftOpts, clustered, err := getRaftOptions(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if clustered && (dataDir == "" || bounded || shards > 0) {
+		return nil, errors.New("a Raft cluster needs KV_SERVICE_DATA_DIR, and cannot be combined with a memory budget or KV_SERVICE_SHARDS")
+	}
+	if primary := getPrimary(); primary != "" {
+		if dataDir != "" || bounded || shards > 0 || clustered {
+			// a replica copies its primary again when it restarts
+			return nil, errors.New("a replica holds data in memory only, so cannot be combined with KV_SERVICE_DATA_DIR, a memory budget, KV_SERVICE_SHARDS or a Raft cluster")
+		}
+		// a replica follows its primary's default namespace, and its primary
+		// refuses to replicate once it holds any other
+		return store.NewReplicaStore(primary), nil
+	}
+	if bounded {
+		maxNamespaces, err := getLimit("KV_SERVICE_MAX_NAMESPACES")
+		if err != nil {
+			return nil, err
+		}
+		if maxNamespaces == 0 {
+			maxNamespaces = defaultMaxNamespaces
+		}
+		return store.NewNamespacedBoundedStore(boundedOpts, int(maxNamespaces))
+	}
+	if shards > 0 {
+		return store.NewNamespacedShardedStore(int(shards)), nil
+	}
+	if dataDir == "" {
+		return store.NewNamespacedStore(), nil
+	}
+	engine, err := getStorageEngine()
+	if err != nil {
+		return nil, err
+	}
+	if clustered {
+		if engine != "wal" {
+			return nil, errors.New("a Raft cluster cannot be combined with KV_SERVICE_STORAGE_ENGINE=lsm")
+		}
+		// a cluster replicates a single keyspace, so has no namespaces
+		return store.NewRaftStore(raftOpts)
+	}
+	opts, err := getWALOptions()
+	if err != nil {
+		return nil, err
+	}
+	if engine == "lsm" {
+		return store.NewNamespacedLSMStore(dataDir, store.LSMOptions{WAL: opts})
+	}
+	return store.NewNamespacedWALStore(dataDir, opts)
+}
+
 func main() {
-	kvStore := store.NewInMemoryStore()
-	r := setupRouter(kvStore)
+	kvStore, err := newStore()
+	if err != nil {
+		log.Fatalf("failed to open store: %v", err)
+	}
+	self, nodes, partitioned, err := getPartitionOptions()
+	if err != nil {
+		log.Fatalf("failed to configure partitioning: %v", err)
+	}
+	var opts routerOptions
+	if opts.missingKeysAsNull, err = getMissingKeysAsNull(); err != nil {
+		log.Fatalf("failed to configure the API: %v", err)
+	}
+	if partitioned {
+		if _, ok := kvStore.(store.ReplicatedStore); ok {
+			log.Fatal("failed to configure partitioning: a Raft cluster or replica cannot also be partitioned")
+		}
+		if opts.partitioner, err = newPartitioner(self, nodes, kvStore); err != nil {
+			log.Fatalf("failed to configure partitioning: %v", err)
+		}
+	}
+	if replica, ok := kvStore.(store.ReplicaStore); ok {
+		opts.follower = startFollower(replica, getPrimary())
+	}
+	r := newRouter(kvStore, opts)
+	// the gRPC, Redis protocol and memcached APIs can be served alongside
+	// the HTTP API
+	grpcAddr, serveGRPC := getListenAddr("KV_SERVICE_GRPC_ADDR")
+	respAddr, serveRESP := getListenAddr("KV_SERVICE_RESP_ADDR")
+	memcachedAddr, serveMemcached := getListenAddr("KV_SERVICE_MEMCACHED_ADDR")
+	if partitioned && (serveGRPC || serveRESP || serveMemcached) {
+		// only the HTTP API routes keys to the node that holds them
+		log.Print("not serving gRPC, the Redis protocol or memcached: a partitioned node only serves the HTTP API")
+		serveGRPC, serveRESP, serveMemcached = false, false, false
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+	var grpcSrv *grpc.Server
+	if serveGRPC {
+		listener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatalf("failed to listen for gRPC: %v", err)
+		}
+		grpcSrv = newGRPCServer(kvStore)
+		go func() {
+			if err := grpcSrv.Serve(listener); err != nil {
+				log.Fatalf("gRPC server error: %v", err)
+			}
+		}()
+	}
+	var respSrv *respServer
+	if serveRESP {
+		listener, err := net.Listen("tcp", respAddr)
+		if err != nil {
+			log.Fatalf("failed to listen for the Redis protocol: %v", err)
+		}
+		respSrv = newRESPServer(kvStore)
+		go func() {
+			if err := respSrv.Serve(listener); err != nil {
+				log.Fatalf("Redis protocol server error: %v", err)
+			}
+		}()
+	}
+	var memcachedSrv *memcachedServer
+	if serveMemcached {
+		listener, err := net.Listen("tcp", memcachedAddr)
+		if err != nil {
+			log.Fatalf("failed to listen for memcached: %v", err)
+		}
+		memcachedSrv = newMemcachedServer(kvStore)
+		go func() {
+			if err := memcachedSrv.Serve(listener); err != nil {
+				log.Fatalf("memcached server error: %v", err)
+			}
+		}()
+	}
 
-	r.Run(":8080")
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+	if grpcSrv != nil {
+		// GracefulStop would wait for watchers, which never finish on their own
+		grpcSrv.Stop()
+	}
+	if respSrv != nil {
+		respSrv.Close()
+	}
+	if memcachedSrv != nil {
+		memcachedSrv.Close()
+	}
+	if opts.follower != nil {
+		opts.follower.stop()
+	}
+	// persistent stores flush outstanding writes on close
+	if closer, ok := kvStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("store close: %v", err)
+		}
+	}
 }
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+)
+
+const (
+	// maxMemcachedLineLength is the longest command line read.
+	maxMemcachedLineLength = 8 << 10
+	// maxMemcachedKeyLength is the longest key memcached allows.
+	maxMemcachedKeyLength = 250
+	// maxMemcachedItemSize is the largest value that can be stored, as in
+	// memcached's default configuration.
+	maxMemcachedItemSize = 1 << 20
+	// maxMemcachedRelativeExptime is the largest exptime taken as a number
+	// of seconds from now; larger ones are unix times.
+	maxMemcachedRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// memcachedServer serves the default namespace of a store over memcached's
+// text protocol, so memcached clients can use it. An item stored with flags,
+// or whose data isn't UTF-8, is kept as an object holding both, so HTTP
+// clients see an item with no flags as a plain string.
+type memcachedServer struct {
+	tcpServer
+	kvStore store.Store // namespaced or not; see defaultKeyspace
+}
+
+// newMemcachedServer returns a memcached server for kvStore, or for its
+// default namespace if it has namespaces.
+func newMemcachedServer(kvStore store.Store) *memcachedServer {
+	return &memcachedServer{kvStore: kvStore}
+}
+
+// Serve accepts connections on listener until Close is called.
+func (s *memcachedServer) Serve(listener net.Listener) error {
+	return s.serve(listener, s.serveConn)
+}
+
+// memcachedConn is one client connection.
+type memcachedConn struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	quit   bool
+	// noreply is set while running a command that asked for no reply
+	noreply bool
+	// kvStore is the keyspace the command being run reads and writes
+	kvStore store.Store
+}
+
+// reply writes a reply to a command, unless it asked for none.
+func (c *memcachedConn) reply(line string) {
+	if !c.noreply {
+		c.writer.WriteString(line + "\r\n")
+	}
+}
+
+// error writes an error, which is sent even if the command asked for no reply.
+func (c *memcachedConn) error(line string) {
+	c.writer.WriteString(line + "\r\n")
+}
+
+func (s *memcachedServer) serveConn(conn net.Conn) {
+	c := &memcachedConn{reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	defer func() {
+		// a command that panics, as a store does when it can't persist a
+		// write, fails and ends its connection rather than the server
+		if r := recover(); r != nil {
+			log.Printf("memcached: panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+			c.error("SERVER_ERROR internal error")
+			c.writer.Flush()
+		}
+	}()
+	for !c.quit {
+		line, err := readLine(c.reader, maxMemcachedLineLength)
+		if errors.Is(err, errLineTooLong) {
+			c.error("CLIENT_ERROR line too long")
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("memcached: reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := s.execute(c, strings.Fields(line)); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("memcached: reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		// replies to pipelined commands are sent together
+		if c.reader.Buffered() == 0 || c.quit {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs one command, writing its reply. It returns an error only if
+// reading the data of a storage command failed.
+func (s *memcachedServer) execute(c *memcachedConn, args []string) error {
+	if len(args) == 0 {
+		c.error("ERROR")
+		return nil
+	}
+	c.noreply = false
+	kvStore, err := defaultKeyspace(s.kvStore)
+	if err != nil {
+		c.error("SERVER_ERROR " + err.Error())
+		return nil
+	}
+	c.kvStore = kvStore
+	switch args[0] {
+	case "get", "gets":
+		s.get(c, args)
+	case "set", "add", "replace", "cas":
+		return s.store(c, args)
+	case "delete":
+		s.delete(c, args)
+	case "incr", "decr":
+		s.incr(c, args)
+	case "flush_all":
+		s.flushAll(c, args)
+	case "version":
+		c.reply("VERSION kv_service")
+	case "quit":
+		c.quit = true
+	default:
+		c.error("ERROR")
+	}
+	return nil
+}
+
+// checkLeader rejects writes to a follower of a replicated store, reporting
+// whether the write may go ahead.
+func (s *memcachedServer) checkLeader(c *memcachedConn) bool {
+	if replicatedStore, ok := c.kvStore.(store.ReplicatedStore); ok && !replicatedStore.IsLeader() {
+		c.error("SERVER_ERROR This node is read only; send writes to the leader.")
+		return false
+	}
+	return true
+}
+
+// validKey reports whether key is one memcached would accept.
+func validKey(key string) bool {
+	if key == "" || len(key) > maxMemcachedKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNoreply reports whether args, the arguments a command takes followed
+// by its optional ones, end with noreply.
+func hasNoreply(args []string, n int) bool {
+	return len(args) == n+1 && args[n] == "noreply"
+}
+
+// get handles get <key>* and gets <key>*, which also returns each item's
+// cas unique: its version.
+func (s *memcachedServer) get(c *memcachedConn, args []string) {
+	if len(args) < 2 {
+		c.error("ERROR")
+		return
+	}
+	gets := args[0] == "gets"
+	versionedStore, ok := c.kvStore.(store.VersionedStore)
+	if gets && !ok {
+		c.error("SERVER_ERROR Store does not support conditional writes.")
+		return
+	}
+	for _, key := range args[1:] {
+		if !validKey(key) {
+			c.error("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+	for _, key := range args[1:] {
+		var value any
+		var version uint64
+		var found bool
+		if ok {
+			value, version = versionedStore.GetWithVersion(key)
+			found = version != 0
+		} else {
+			value, found = c.kvStore.Lookup(key)
+		}
+		// a key set to null is a hit, reading as its JSON encoding
+		if !found {
+			continue
+		}
+		item := decodeMemcachedItem(value)
+		if gets {
+			fmt.Fprintf(c.writer, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.data), version)
+		} else {
+			fmt.Fprintf(c.writer, "VALUE %s %d %d\r\n", key, item.flags, len(item.data))
+		}
+		c.writer.Write(item.data)
+		c.writer.WriteString("\r\n")
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// store handles the storage commands:
+//
+//	set|add|replace <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// each followed by a line of data.
+func (s *memcachedServer) store(c *memcachedConn, args []string) error {
+	n := 5
+	if args[0] == "cas" {
+		n = 6
+	}
+	if len(args) != n && !hasNoreply(args, n) {
+		c.error("ERROR")
+		return nil
+	}
+	c.noreply = hasNoreply(args, n)
+	key := args[1]
+	flags, flagsErr := strconv.ParseUint(args[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[3], 10, 64)
+	length, lengthErr := strconv.Atoi(args[4])
+	var unique uint64
+	var uniqueErr error
+	if args[0] == "cas" {
+		unique, uniqueErr = strconv.ParseUint(args[5], 10, 64)
+	}
+	if !validKey(key) || flagsErr != nil || exptimeErr != nil || lengthErr != nil || length < 0 || uniqueErr != nil {
+		c.error("CLIENT_ERROR bad command line format")
+		return nil
+	}
+	if length > maxMemcachedItemSize {
+		// the data is still sent, and has to be skipped
+		if _, err := c.reader.Discard(length + 2); err != nil {
+			return err
+		}
+		c.error("SERVER_ERROR object too large for cache")
+		return nil
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return err
+	}
+	if string(data[length:]) != "\r\n" {
+		c.error("CLIENT_ERROR bad data chunk")
+		return nil
+	}
+	if !s.checkLeader(c) {
+		return nil
+	}
+	value := encodeMemcachedItem(memcachedItem{data: data[:length], flags: uint32(flags)})
+	ttl := memcachedTTL(exptime)
+
+	if args[0] == "set" {
+		if ttl == 0 {
+			c.kvStore.Set(key, value)
+			c.reply("STORED")
+			return nil
+		}
+		expiringStore, ok := c.kvStore.(store.ExpiringStore)
+		if !ok {
+			c.error("SERVER_ERROR Store does not support TTLs.")
+			return nil
+		}
+		expiringStore.SetWithTTL(key, value, ttl)
+		c.reply("STORED")
+		return nil
+	}
+
+	versionedStore, ok := c.kvStore.(store.VersionedStore)
+	if !ok {
+		c.error("SERVER_ERROR Store does not support conditional writes.")
+		return nil
+	}
+	if _, ok := c.kvStore.(store.ExpiringVersionedStore); ttl != 0 && !ok {
+		c.error("SERVER_ERROR Store does not support conditional writes with a TTL.")
+		return nil
+	}
+	switch args[0] {
+	case "add", "replace":
+		if !setIf(versionedStore, key, value, ttl, args[0] == "replace") {
+			c.reply("NOT_STORED")
+			return nil
+		}
+	case "cas":
+		if unique == 0 {
+			// no item has version 0, and to CompareAndSwap it means the
+			// key must not exist
+			unique = math.MaxUint64
+		}
+		var err error
+		if ttl == 0 {
+			_, err = versionedStore.CompareAndSwap(key, unique, value)
+		} else {
+			_, err = versionedStore.(store.ExpiringVersionedStore).CompareAndSwapWithTTL(key, unique, value, ttl)
+		}
+		if err != nil {
+			if _, version := versionedStore.GetWithVersion(key); version == 0 {
+				c.reply("NOT_FOUND")
+			} else {
+				c.reply("EXISTS")
+			}
+			return nil
+		}
+	}
+	c.reply("STORED")
+	return nil
+}
+
+// memcachedTTL returns how long an item with the given exptime lives, or
+// zero if it never expires. An exptime in the past stores the item already
+// expired, as memcached does.
+func memcachedTTL(exptime int64) time.Duration {
+	var ttl time.Duration
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+	case exptime <= maxMemcachedRelativeExptime:
+		ttl = time.Duration(exptime) * time.Second
+	default:
+		ttl = time.Until(time.Unix(exptime, 0))
+	}
+	// the stores expire a key with a TTL of zero or less straight away, but
+	// a zero TTL here means none
+	return max(ttl, time.Nanosecond)
+}
+
+// delete handles delete <key> [0] [noreply]; the 0 is an expiry time older
+// clients send, which must be zero.
+func (s *memcachedServer) delete(c *memcachedConn, args []string) {
+	n := 2
+	if len(args) > 2 && args[2] == "0" {
+		n = 3
+	}
+	if (len(args) != n && !hasNoreply(args, n)) || !validKey(args[1]) {
+		c.error("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]")
+		return
+	}
+	c.noreply = hasNoreply(args, n)
+	if !s.checkLeader(c) {
+		return
+	}
+	if deleteKey(c.kvStore, args[1]) {
+		c.reply("DELETED")
+		return
+	}
+	c.reply("NOT_FOUND")
+}
+
+// incr handles incr|decr <key> <delta> [noreply], for items whose data is
+// a decimal number. Incrementing wraps at 64 bits, and decrementing stops
+// at zero, as in memcached. The item keeps its flags and expiry.
+func (s *memcachedServer) incr(c *memcachedConn, args []string) {
+	if len(args) != 3 && !hasNoreply(args, 3) {
+		c.error("ERROR")
+		return
+	}
+	c.noreply = hasNoreply(args, 3)
+	key := args[1]
+	if !validKey(key) {
+		c.error("CLIENT_ERROR bad command line format")
+		return
+	}
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		c.error("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	if !s.checkLeader(c) {
+		return
+	}
+	versionedStore, ok := c.kvStore.(store.VersionedStore)
+	if !ok {
+		c.error("SERVER_ERROR Store does not support conditional writes.")
+		return
+	}
+	for {
+		value, version, expiresAt := s.lookup(versionedStore, key)
+		if version == 0 {
+			c.reply("NOT_FOUND")
+			return
+		}
+		item := decodeMemcachedItem(value)
+		n, err := strconv.ParseUint(string(item.data), 10, 64)
+		if err != nil {
+			c.error("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return
+		}
+		switch {
+		case args[0] == "incr":
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		item.data = strconv.AppendUint(nil, n, 10)
+		value = encodeMemcachedItem(item)
+		if expiresAt.IsZero() {
+			_, err = versionedStore.CompareAndSwap(key, version, value)
+		} else {
+			_, err = versionedStore.(store.ExpiringVersionedStore).CompareAndSwapWithTTL(key, version, value, max(time.Until(expiresAt), time.Nanosecond))
+		}
+		if err == nil {
+			c.reply(strconv.FormatUint(n, 10))
+			return
+		}
+		// the item changed since it was read; try again
+	}
+}
+
+// lookup returns key's value and version, and when it expires if the store
+// can say and could set the same expiry again.
+func (s *memcachedServer) lookup(versionedStore store.VersionedStore, key string) (any, uint64, time.Time) {
+	scannableStore, scannable := versionedStore.(store.ScannableStore)
+	_, expiring := versionedStore.(store.ExpiringVersionedStore)
+	if !scannable || !expiring {
+		value, version := versionedStore.GetWithVersion(key)
+		return value, version, time.Time{}
+	}
+	// a key sorts before every other key it's a prefix of
+	entries, _ := scannableStore.Scan(key, "", 1)
+	if len(entries) == 0 || entries[0].Key != key {
+		return nil, 0, time.Time{}
+	}
+	return entries[0].Value, entries[0].Version, entries[0].ExpiresAt
+}
+
+// flushAll handles flush_all [delay] [noreply]; only an immediate flush is
+// supported.
+func (s *memcachedServer) flushAll(c *memcachedConn, args []string) {
+	n := 1
+	if len(args) > 1 && args[1] != "noreply" {
+		if delay, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+			c.error("CLIENT_ERROR bad command line format")
+			return
+		} else if delay != 0 {
+			c.error("CLIENT_ERROR delayed flush_all is not supported")
+			return
+		}
+		n = 2
+	}
+	if len(args) != n && !hasNoreply(args, n) {
+		c.error("ERROR")
+		return
+	}
+	c.noreply = hasNoreply(args, n)
+	if !s.checkLeader(c) {
+		return
+	}
+	clearableStore, ok := c.kvStore.(store.ClearableStore)
+	if !ok {
+		c.error("SERVER_ERROR Store does not support flushing.")
+		return
+	}
+	clearableStore.Flush()
+	c.reply("OK")
+}
+
+// memcachedItem is the data and flags of a memcached item.
+type memcachedItem struct {
+	data  []byte
+	flags uint32
+}
+
+// encodeMemcachedItem returns the value item is stored as: its data, as a
+// string, if it has no flags and is UTF-8, or else an object holding the
+// flags and the data, base64 encoded if it isn't UTF-8.
+func encodeMemcachedItem(item memcachedItem) any {
+	valid := utf8.Valid(item.data)
+	if item.flags == 0 && valid {
+		return string(item.data)
+	}
+	// numbers are float64, as if the value had been set over HTTP
+	value := map[string]any{"flags": float64(item.flags)}
+	if valid {
+		value["data"] = string(item.data)
+	} else {
+		value["base64"] = base64.StdEncoding.EncodeToString(item.data)
+	}
+	return value
+}
+
+// decodeMemcachedItem returns the item value is stored as. A value that
+// isn't one, such as a JSON number set over HTTP, reads as its JSON encoding
+// with no flags.
+func decodeMemcachedItem(value any) memcachedItem {
+	if object, ok := value.(map[string]any); ok && len(object) == 2 {
+		flags, ok := object["flags"].(float64)
+		if ok && flags >= 0 && flags <= math.MaxUint32 && flags == math.Trunc(flags) {
+			if data, ok := object["data"].(string); ok {
+				return memcachedItem{data: []byte(data), flags: uint32(flags)}
+			}
+			if encoded, ok := object["base64"].(string); ok {
+				if data, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+					return memcachedItem{data: data, flags: uint32(flags)}
+				}
+			}
+		}
+	}
+	return memcachedItem{data: []byte(respString(value))}
+}
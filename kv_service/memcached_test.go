@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type memcachedTestSuite struct {
+	suite.Suite
+	kvStore store.NamespacedStore
+	server  *memcachedServer
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func (s *memcachedTestSuite) SetupTest() {
+	s.kvStore = store.NewNamespacedStore()
+	s.serve(s.kvStore)
+}
+
+func (s *memcachedTestSuite) TearDownTest() {
+	s.conn.Close()
+	s.server.Close()
+	s.server = nil
+}
+
+// serve serves kvStore on a local port and connects to it.
+func (s *memcachedTestSuite) serve(kvStore store.Store) {
+	if s.server != nil {
+		s.TearDownTest()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.server = newMemcachedServer(kvStore)
+	go s.server.Serve(listener)
+	s.conn, err = net.Dial("tcp", listener.Addr().String())
+	s.Require().NoError(err)
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	s.reader = bufio.NewReader(s.conn)
+}
+
+// do sends request and returns the first line of the reply, or every line
+// up to END for a retrieval command.
+func (s *memcachedTestSuite) do(request string) string {
+	s.send(request)
+	return s.reply(strings.HasPrefix(request, "get"))
+}
+
+func (s *memcachedTestSuite) send(request string) {
+	_, err := io.WriteString(s.conn, request)
+	s.Require().NoError(err)
+}
+
+func (s *memcachedTestSuite) reply(retrieval bool) string {
+	var reply string
+	for {
+		line, err := s.reader.ReadString('\n')
+		s.Require().NoError(err)
+		reply += line
+		if !retrieval || line == "END\r\n" || strings.HasPrefix(line, "SERVER_ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") {
+			return reply
+		}
+	}
+}
+
+// casUnique returns the cas unique gets reports for key.
+func (s *memcachedTestSuite) casUnique(key string) string {
+	fields := strings.Fields(s.do("gets " + key + "\r\n"))
+	s.Require().GreaterOrEqual(len(fields), 5)
+	return fields[4]
+}
+
+func (s *memcachedTestSuite) defaultKeyspace() store.Store {
+	keyspace, _ := s.kvStore.Namespace(store.DefaultNamespace)
+	return keyspace
+}
+
+func (s *memcachedTestSuite) TestSetAndGet() {
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 0 0 5\r\nvalue\r\n"))
+	assert.Equal(s.T(), "VALUE key 0 5\r\nvalue\r\nEND\r\n", s.do("get key\r\n"))
+	assert.Equal(s.T(), "END\r\n", s.do("get missing\r\n"))
+	assert.Equal(s.T(), "value", s.defaultKeyspace().Get("key"))
+
+	s.do("set other 0 0 3\r\ntwo\r\n")
+	assert.Equal(s.T(), "VALUE key 0 5\r\nvalue\r\nVALUE other 0 3\r\ntwo\r\nEND\r\n", s.do("get key missing other\r\n"))
+}
+
+func (s *memcachedTestSuite) TestSet_FlagsAndBinaryData() {
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 42 0 3\r\nabc\r\n"))
+	assert.Equal(s.T(), "VALUE key 42 3\r\nabc\r\nEND\r\n", s.do("get key\r\n"))
+	assert.Equal(s.T(), map[string]any{"flags": float64(42), "data": "abc"}, s.defaultKeyspace().Get("key"))
+
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 0 0 4\r\n\xff\x00\r\n\r\n"))
+	assert.Equal(s.T(), "VALUE key 0 4\r\n\xff\x00\r\n\r\nEND\r\n", s.do("get key\r\n"))
+	assert.Equal(s.T(), map[string]any{"flags": float64(0), "base64": "/wANCg=="}, s.defaultKeyspace().Get("key"))
+}
+
+func (s *memcachedTestSuite) TestGet_NonStringValue() {
+	s.defaultKeyspace().Set("key", map[string]any{"nested": "data"})
+	assert.Equal(s.T(), "VALUE key 0 17\r\n{\"nested\":\"data\"}\r\nEND\r\n", s.do("get key\r\n"))
+}
+
+func (s *memcachedTestSuite) TestGet_NullValue() {
+	// a key set to null is there, unlike a missing one
+	s.defaultKeyspace().Set("key", nil)
+	assert.Equal(s.T(), "VALUE key 0 4\r\nnull\r\nEND\r\n", s.do("get key missing\r\n"))
+}
+
+func (s *memcachedTestSuite) TestDroppedDefaultNamespace() {
+	s.do("set key 0 0 5\r\nvalue\r\n")
+	s.Require().True(s.kvStore.DropNamespace(store.DefaultNamespace))
+
+	// the connection moves to the new default namespace the HTTP API uses
+	assert.Equal(s.T(), "END\r\n", s.do("get key\r\n"))
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 0 0 3\r\nnew\r\n"))
+	assert.Equal(s.T(), "new", s.defaultKeyspace().Get("key"))
+}
+
+func (s *memcachedTestSuite) TestSet_Errors() {
+	assert.Equal(s.T(), "CLIENT_ERROR bad data chunk\r\n", s.do("set key 0 0 2\r\nvalue\r\n"))
+	// the rest of the data is read as a command
+	assert.Equal(s.T(), "ERROR\r\n", s.reply(false))
+	assert.Equal(s.T(), "ERROR\r\n", s.do("\r\n"))
+	assert.Equal(s.T(), "CLIENT_ERROR bad command line format\r\n", s.do("set key x 0 5\r\n"))
+	assert.Equal(s.T(), "ERROR\r\n", s.do("set key 0 0\r\n"))
+	assert.Equal(s.T(), "CLIENT_ERROR bad command line format\r\n", s.do(fmt.Sprintf("set %s 0 0 1\r\n", strings.Repeat("k", 251))))
+	assert.Equal(s.T(), "ERROR\r\n", s.do("unknown\r\n"))
+
+	// a value that's too large is skipped, rather than read as commands
+	s.send(fmt.Sprintf("set key 0 0 %d\r\n%s\r\n", maxMemcachedItemSize+1, strings.Repeat("x", maxMemcachedItemSize+1)))
+	assert.Equal(s.T(), "SERVER_ERROR object too large for cache\r\n", s.reply(false))
+	assert.Equal(s.T(), "END\r\n", s.do("get key\r\n"))
+}
+
+func (s *memcachedTestSuite) TestSet_Exptime() {
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 0 60 5\r\nvalue\r\n"))
+	entries, _ := s.defaultKeyspace().(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+
+	// an exptime over 30 days is a unix time
+	s.do(fmt.Sprintf("set key 0 %d 5\r\nvalue\r\n", time.Now().Add(time.Hour).Unix()))
+	entries, _ = s.defaultKeyspace().(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Hour), entries[0].ExpiresAt, 5*time.Second)
+
+	// one in the past expires the item straight away
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 0 -1 5\r\nvalue\r\n"))
+	assert.Eventually(s.T(), func() bool { return s.do("get key\r\n") == "END\r\n" }, time.Second, time.Millisecond)
+}
+
+func (s *memcachedTestSuite) TestAddAndReplace() {
+	assert.Equal(s.T(), "NOT_STORED\r\n", s.do("replace key 0 0 3\r\none\r\n"))
+	assert.Equal(s.T(), "STORED\r\n", s.do("add key 0 0 3\r\none\r\n"))
+	assert.Equal(s.T(), "NOT_STORED\r\n", s.do("add key 0 0 3\r\ntwo\r\n"))
+	assert.Equal(s.T(), "STORED\r\n", s.do("replace key 0 0 3\r\ntwo\r\n"))
+	assert.Equal(s.T(), "VALUE key 0 3\r\ntwo\r\nEND\r\n", s.do("get key\r\n"))
+}
+
+func (s *memcachedTestSuite) TestAdd_WithExptime() {
+	// the usual way to take a lock
+	assert.Equal(s.T(), "STORED\r\n", s.do("add lock 0 1 5\r\nowner\r\n"))
+	entries, _ := s.defaultKeyspace().(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.False(s.T(), entries[0].ExpiresAt.IsZero())
+	assert.Equal(s.T(), "NOT_STORED\r\n", s.do("add lock 0 1 5\r\nother\r\n"))
+}
+
+func (s *memcachedTestSuite) TestCas() {
+	assert.Equal(s.T(), "NOT_FOUND\r\n", s.do("cas key 0 0 3 1\r\none\r\n"))
+	s.do("set key 0 0 3\r\none\r\n")
+	unique := s.casUnique("key")
+
+	assert.Equal(s.T(), "STORED\r\n", s.do("cas key 0 0 3 "+unique+"\r\ntwo\r\n"))
+	assert.Equal(s.T(), "EXISTS\r\n", s.do("cas key 0 0 5 "+unique+"\r\nthree\r\n"))
+	assert.Equal(s.T(), "EXISTS\r\n", s.do("cas key 0 0 5 0\r\nthree\r\n"))
+	assert.Equal(s.T(), "VALUE key 0 3 "+s.casUnique("key")+"\r\ntwo\r\nEND\r\n", s.do("gets key\r\n"))
+}
+
+func (s *memcachedTestSuite) TestDelete() {
+	s.do("set key 0 0 5\r\nvalue\r\n")
+	assert.Equal(s.T(), "DELETED\r\n", s.do("delete key\r\n"))
+	assert.Equal(s.T(), "NOT_FOUND\r\n", s.do("delete key\r\n"))
+	assert.Equal(s.T(), "NOT_FOUND\r\n", s.do("delete key 0\r\n"))
+	assert.Equal(s.T(), "CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]\r\n", s.do("delete key 10\r\n"))
+}
+
+func (s *memcachedTestSuite) TestIncrAndDecr() {
+	assert.Equal(s.T(), "NOT_FOUND\r\n", s.do("incr counter 1\r\n"))
+	s.do("set counter 5 60 2\r\n10\r\n")
+	assert.Equal(s.T(), "15\r\n", s.do("incr counter 5\r\n"))
+	assert.Equal(s.T(), "12\r\n", s.do("decr counter 3\r\n"))
+	assert.Equal(s.T(), "0\r\n", s.do("decr counter 100\r\n"))
+	assert.Equal(s.T(), "VALUE counter 5 1\r\n0\r\nEND\r\n", s.do("get counter\r\n"))
+
+	// the counter keeps its expiry
+	entries, _ := s.defaultKeyspace().(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+
+	s.do("set counter 0 0 20\r\n18446744073709551615\r\n")
+	assert.Equal(s.T(), "1\r\n", s.do("incr counter 2\r\n"))
+
+	s.do("set text 0 0 3\r\nabc\r\n")
+	assert.Equal(s.T(), "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n", s.do("incr text 1\r\n"))
+	assert.Equal(s.T(), "CLIENT_ERROR invalid numeric delta argument\r\n", s.do("incr counter -1\r\n"))
+}
+
+func (s *memcachedTestSuite) TestNoreply() {
+	s.send("set key 0 0 1 noreply\r\n1\r\n")
+	s.send("add key 0 0 1 noreply\r\n5\r\n")
+	s.send("incr key 1 noreply\r\n")
+	s.send("delete other noreply\r\n")
+	assert.Equal(s.T(), "VALUE key 0 1\r\n2\r\nEND\r\n", s.do("get key\r\n"))
+}
+
+func (s *memcachedTestSuite) TestFlushAll() {
+	s.do("set a 0 0 1\r\n1\r\n")
+	s.do("set b 0 0 1\r\n2\r\n")
+	assert.Equal(s.T(), "OK\r\n", s.do("flush_all\r\n"))
+	assert.Equal(s.T(), "END\r\n", s.do("get a b\r\n"))
+	assert.Equal(s.T(), "OK\r\n", s.do("flush_all 0\r\n"))
+	assert.Equal(s.T(), "CLIENT_ERROR delayed flush_all is not supported\r\n", s.do("flush_all 10\r\n"))
+}
+
+func (s *memcachedTestSuite) TestVersionAndQuit() {
+	assert.Equal(s.T(), "VERSION kv_service\r\n", s.do("version\r\n"))
+	s.send("quit\r\n")
+	_, err := s.reader.ReadString('\n')
+	assert.ErrorIs(s.T(), err, io.EOF)
+}
+
+func (s *memcachedTestSuite) TestUnsupportedStore() {
+	s.serve(basicStore{store.NewInMemoryStore()})
+
+	assert.Equal(s.T(), "STORED\r\n", s.do("set key 0 0 5\r\nvalue\r\n"))
+	assert.Equal(s.T(), "VALUE key 0 5\r\nvalue\r\nEND\r\n", s.do("get key\r\n"))
+	assert.Equal(s.T(), "DELETED\r\n", s.do("delete key\r\n"))
+	assert.Equal(s.T(), "SERVER_ERROR Store does not support TTLs.\r\n", s.do("set key 0 1 5\r\nvalue\r\n"))
+	assert.Equal(s.T(), "SERVER_ERROR Store does not support conditional writes.\r\n", s.do("add key 0 0 5\r\nvalue\r\n"))
+	assert.Equal(s.T(), "SERVER_ERROR Store does not support conditional writes.\r\n", s.do("gets key\r\n"))
+	assert.Equal(s.T(), "SERVER_ERROR Store does not support conditional writes.\r\n", s.do("incr key 1\r\n"))
+	assert.Equal(s.T(), "SERVER_ERROR Store does not support flushing.\r\n", s.do("flush_all\r\n"))
+}
+
+func (s *memcachedTestSuite) TestFollowerRejectsWrites() {
+	s.serve(replicaStore{Store: store.NewInMemoryStore(), leaderAddr: "http://leader:8080"})
+
+	assert.Equal(s.T(), "SERVER_ERROR This node is read only; send writes to the leader.\r\n", s.do("set key 0 0 5\r\nvalue\r\n"))
+	assert.Equal(s.T(), "SERVER_ERROR This node is read only; send writes to the leader.\r\n", s.do("delete key\r\n"))
+	assert.Equal(s.T(), "END\r\n", s.do("get key\r\n"))
+}
+
+func (s *memcachedTestSuite) TestRecoversFromPanics() {
+	// a store panics when it can't persist a write
+	mockStore := &mockStore{}
+	mockStore.On("Set", "key", "value").Run(func(mock.Arguments) { panic("disk full") })
+	s.serve(mockStore)
+
+	assert.Equal(s.T(), "SERVER_ERROR internal error\r\n", s.do("set key 0 0 5\r\nvalue\r\n"))
+	_, err := s.reader.ReadString('\n')
+	assert.ErrorIs(s.T(), err, io.EOF)
+
+	// and carries on serving other connections
+	conn, err := net.Dial("tcp", s.server.listener.Addr().String())
+	s.Require().NoError(err)
+	s.conn.Close()
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.True(s.T(), strings.HasPrefix(s.do("version\r\n"), "VERSION "))
+}
+
+func TestMemcachedTestSuite(t *testing.T) {
+	suite.Run(t, new(memcachedTestSuite))
+}
+
+func TestMemcachedItem(t *testing.T) {
+	for _, item := range []memcachedItem{
+		{data: []byte("text")},
+		{data: []byte("text"), flags: 7},
+		{data: []byte{0xff, 0xfe}},
+		{data: []byte{}},
+	} {
+		assert.Equal(t, item, decodeMemcachedItem(encodeMemcachedItem(item)))
+	}
+	// an object that isn't an item reads as its JSON encoding
+	assert.Equal(t, memcachedItem{data: []byte(`{"flags":1}`)}, decodeMemcachedItem(map[string]any{"flags": float64(1)}))
+	assert.Equal(t, memcachedItem{data: []byte("42")}, decodeMemcachedItem(float64(42)))
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultVirtualNodes is how many points each node has on the hash ring.
+	// More points spread keys more evenly across nodes.
+	defaultVirtualNodes = 128
+	// migrationBatchSize is how many keys are read at a time when migrating.
+	migrationBatchSize = 100
+)
+
+// hashRing assigns keys to nodes by consistent hashing. Each node is placed
+// at many points on a ring of hashes, and a key belongs to the node at the
+// first point at or after the key's hash, so a node joining or leaving only
+// moves the keys next to its own points.
+type hashRing struct {
+	nodes  []string // sorted
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func newHashRing(nodes []string, virtualNodes int) *hashRing {
+	r := &hashRing{nodes: slices.Compact(slices.Sorted(slices.Values(nodes)))}
+	for _, node := range r.nodes {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.node, b.node))
+	})
+	return r
+}
+
+// owner returns the node key belongs to, or "" if the ring has no nodes.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	i, _ := slices.BinarySearchFunc(r.points, hash, func(p ringPoint, hash uint64) int {
+		return cmp.Compare(p.hash, hash)
+	})
+	if i == len(r.points) {
+		i = 0 // past the last point, wrapping around to the first
+	}
+	return r.points[i].node
+}
+
+// ringHash hashes s the same way on every node. FNV-1a alone maps similar
+// strings, such as one node's point names, to nearby hashes, so its output
+// is scrambled with the splitmix64 finalizer.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+var (
+	errRebalancing        = errors.New("keys are still migrating after the last membership change")
+	errPreconditionFailed = errors.New("precondition failed")
+)
+
+// partitioner spreads keys across the nodes of a partitioned cluster, each
+// node holding only the keys the hash ring assigns it, and forwards
+// requests for other keys to their owners.
+//
+// After a membership change each node migrates away the keys it no longer
+// owns. Until it has, the ring from before the change is kept, and a new
+// owner forwards reads of keys it doesn't have yet to their previous owner.
+type partitioner struct {
+	self         string // this node's base URL, as it appears in the ring
+	virtualNodes int
+	kvStore      store.Store
+	client       *http.Client
+
+	mu          sync.Mutex
+	ring        *hashRing
+	previous    *hashRing // nil once every key has been migrated
+	rebalancing bool
+	migrated    int
+	err         error // why the last migration failed
+}
+
+func newPartitioner(self string, nodes []string, kvStore store.Store) (*partitioner, error) {
+	if err := validateNodes([]string{self}); err != nil {
+		return nil, err
+	}
+	if err := validateNodes(nodes); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(nodes, self) {
+		// it would own no keys, and forward every request away
+		return nil, fmt.Errorf("this node, %s, is not one of the cluster's nodes", self)
+	}
+	if _, ok := kvStore.(store.NamespacedStore); !ok {
+		if _, ok := kvStore.(store.ScannableStore); !ok {
+			return nil, errors.New("partitioning needs a store whose keys can be listed, to migrate them")
+		}
+	}
+	return &partitioner{
+		self:         self,
+		virtualNodes: defaultVirtualNodes,
+		kvStore:      kvStore,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		ring:         newHashRing(nodes, defaultVirtualNodes),
+	}, nil
+}
+
+// validateNodes checks nodes are base URLs, such as http://kv1:8080.
+func validateNodes(nodes []string) error {
+	if len(nodes) == 0 {
+		return errors.New("a partitioned cluster needs at least one node")
+	}
+	for _, node := range nodes {
+		u, err := url.Parse(node)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			return fmt.Errorf("invalid node %q: want a base URL such as http://kv1:8080", node)
+		}
+	}
+	return nil
+}
+
+// rings returns the current ring and, while keys are migrating, the one
+// before it.
+func (p *partitioner) rings() (*hashRing, *hashRing) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ring, p.previous
+}
+
+// partitionKey is what key is placed on the ring by. Namespace names can't
+// contain "/", so keys in different namespaces never collide.
+func partitionKey(namespace, key string) string {
+	if namespace == "" {
+		namespace = store.DefaultNamespace
+	}
+	return namespace + "/" + key
+}
+
+// fallbackHeader marks a request a key's new owner passes on to its
+// previous owner during a migration, which serves it from whatever it still
+// holds. A request forwarded to a key's owner is checked against the
+// previous owner as well, but one passed on like this never goes further.
+const fallbackHeader = "X-Kv-Fallback"
+
+// middleware forwards requests for a single key to the node that owns it.
+// A forwarded request is served here regardless, so nodes whose rings
+// briefly disagree don't pass it back and forth.
+func (p *partitioner) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		if key == "" || c.GetHeader(fallbackHeader) != "" {
+			c.Next()
+			return
+		}
+		ring, previous := p.rings()
+		namespace := c.Param("namespace")
+		owner := ring.owner(partitionKey(namespace, key))
+		if owner != p.self {
+			if c.GetHeader(forwardedHeader) != "" {
+				c.Next()
+			} else {
+				forwardRequest(c, owner)
+			}
+			return
+		}
+		if previous == nil {
+			c.Next()
+			return
+		}
+		previousOwner := previous.owner(partitionKey(namespace, key))
+		if previousOwner == p.self {
+			c.Next()
+			return
+		}
+		// the key may not have been migrated here yet
+		whole := strings.HasSuffix(c.FullPath(), "/:key")
+		switch {
+		case whole && c.Request.Method == http.MethodDelete:
+			// delete the previous owner's copy too, so migration can't revive it
+			header := http.Header{fallbackHeader: {"true"}}
+			if err := p.send(c.Request.Context(), http.MethodDelete, previousOwner, keyPath(namespace, key), nil, header); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+		case whole && c.Request.Method == http.MethodPost:
+			// a set replaces whatever the previous owner holds
+		default:
+			// reads, and changes to part of a value, such as an increment,
+			// patch or push, are served by the previous owner until the key
+			// arrives, rather than starting a new value migration wouldn't
+			// overwrite
+			if !p.holds(namespace, key) {
+				c.Request.Header.Set(fallbackHeader, "true")
+				forwardRequest(c, previousOwner)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// holds reports whether this node has key in namespace, without creating
+// the namespace if it doesn't exist.
+func (p *partitioner) holds(namespace, key string) bool {
+	keyspace := p.kvStore
+	if namespacedStore, ok := p.kvStore.(store.NamespacedStore); ok {
+		var found bool
+		keyspace, found, _ = namespacedStore.LookupNamespace(cmp.Or(namespace, store.DefaultNamespace))
+		if !found {
+			return false
+		}
+	}
+	_, ok := keyspace.Lookup(key)
+	return ok
+}
+
+// setNodes makes nodes the cluster's membership and starts migrating the
+// keys this node no longer owns to their new owners. Setting the current
+// membership again is a no-op, unless its migration failed, which it retries.
+func (p *partitioner) setNodes(nodes []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ring := newHashRing(nodes, p.virtualNodes)
+	unchanged := slices.Equal(ring.nodes, p.ring.nodes)
+	switch {
+	case unchanged && (p.rebalancing || p.previous == nil):
+		return nil
+	case p.rebalancing:
+		return errRebalancing
+	case !unchanged:
+		// if the last migration failed, its keys can't be read until this one
+		// moves them, as reads only fall back to the ring being replaced
+		p.previous, p.ring = p.ring, ring
+	}
+	p.rebalancing, p.migrated, p.err = true, 0, nil
+	go p.rebalance(ring)
+	return nil
+}
+
+func (p *partitioner) rebalance(ring *hashRing) {
+	err := p.migrateAll(ring)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebalancing, p.err = false, err
+	if err == nil {
+		p.previous = nil
+	}
+}
+
+// migrateAll moves every local key that ring assigns another node to it.
+func (p *partitioner) migrateAll(ring *hashRing) error {
+	namespaces := []string{store.DefaultNamespace}
+	namespacedStore, namespaced := p.kvStore.(store.NamespacedStore)
+	if namespaced {
+		namespaces = namespacedStore.Namespaces()
+	}
+	for _, namespace := range namespaces {
+		keyspace := p.kvStore
+		if namespaced {
+			var err error
+			if keyspace, err = namespacedStore.Namespace(namespace); err != nil {
+				return err
+			}
+		}
+		scannableStore, ok := keyspace.(store.ScannableStore)
+		if !ok {
+			return fmt.Errorf("namespace %q does not support listing keys", namespace)
+		}
+		startAfter := ""
+		for {
+			entries, more := scannableStore.Scan("", startAfter, migrationBatchSize)
+			for _, entry := range entries {
+				owner := ring.owner(partitionKey(namespace, entry.Key))
+				if owner == p.self {
+					continue
+				}
+				if err := p.migrate(keyspace, namespace, owner, entry); err != nil {
+					return fmt.Errorf("migrating %q to %s: %w", entry.Key, owner, err)
+				}
+			}
+			if !more {
+				break
+			}
+			startAfter = entries[len(entries)-1].Key
+		}
+	}
+	return nil
+}
+
+// migrate copies entry to owner, then removes the local copy.
+func (p *partitioner) migrate(keyspace store.Store, namespace, owner string, entry store.Entry) error {
+	body := gin.H{"value": entry.Value}
+	if collection := store.CollectionType(entry.Value); collection != "" {
+		body["type"] = collection
+	}
+	if !entry.ExpiresAt.IsZero() {
+		body["ttl_seconds"] = max(1, int64(math.Ceil(time.Until(entry.ExpiresAt).Seconds())))
+	}
+	// don't overwrite a write the owner has taken since the change
+	header := http.Header{"If-None-Match": {"*"}}
+	err := p.send(context.Background(), http.MethodPost, owner, keyPath(namespace, entry.Key), body, header)
+	if err != nil && !errors.Is(err, errPreconditionFailed) {
+		return err
+	}
+
+	// leave the local copy if it was rewritten while being copied
+	if versionedStore, ok := keyspace.(store.VersionedStore); ok && entry.Version != 0 {
+		if err := versionedStore.CompareAndDelete(entry.Key, entry.Version); err != nil && !errors.Is(err, store.ErrVersionMismatch) {
+			return err
+		}
+	} else {
+		keyspace.Delete(entry.Key)
+	}
+	p.mu.Lock()
+	p.migrated++
+	p.mu.Unlock()
+	return nil
+}
+
+// send makes a request to node, marked as forwarded so node serves it itself.
+func (p *partitioner) send(ctx context.Context, method, node, path string, body any, header http.Header) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, node+path, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set(forwardedHeader, "true")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errPreconditionFailed
+	default:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s%s: %s: %s", method, node, path, resp.Status, bytes.TrimSpace(message))
+	}
+}
+
+// keyPath is the API path of key in namespace.
+func keyPath(namespace, key string) string {
+	if namespace == "" || namespace == store.DefaultNamespace {
+		return "/api/v1/keys/" + url.PathEscape(key)
+	}
+	return "/api/v1/ns/" + namespace + "/keys/" + url.PathEscape(key)
+}
+
+// ringHandler reports the cluster's membership and any migration in progress
+func (p *partitioner) ringHandler(c *gin.Context) {
+	p.mu.Lock()
+	response := gin.H{"self": p.self, "nodes": p.ring.nodes, "rebalancing": p.rebalancing, "migrated": p.migrated}
+	if p.previous != nil {
+		response["previous_nodes"] = p.previous.nodes
+	}
+	if p.err != nil {
+		response["error"] = p.err.Error()
+	}
+	p.mu.Unlock()
+	c.JSON(http.StatusOK, response)
+}
+
+// setRingHandler handles changing the cluster's membership. The change is
+// passed on to every node that is or was a member, so all of them migrate
+// their keys, unless it was itself passed on from another node.
+func (p *partitioner) setRingHandler(c *gin.Context) {
+	var request struct {
+		Nodes []string `json:"nodes" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateNodes(request.Nodes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ring, _ := p.rings()
+	if err := p.setNodes(request.Nodes); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	failed := gin.H{}
+	if c.GetHeader(forwardedHeader) == "" {
+		members := slices.Compact(slices.Sorted(slices.Values(append(slices.Clone(ring.nodes), request.Nodes...))))
+		for _, node := range members {
+			if node == p.self {
+				continue
+			}
+			if err := p.send(c.Request.Context(), http.MethodPut, node, "/api/v1/admin/ring", gin.H{"nodes": request.Nodes}, nil); err != nil {
+				failed[node] = err.Error()
+			}
+		}
+	}
+	if len(failed) > 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Some nodes did not accept the change; retry it.", "failed": failed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Membership changed.", "nodes": request.Nodes})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestHashRing_SpreadsKeysEvenly(t *testing.T) {
+	ring := newHashRing([]string{"http://a", "http://b", "http://c"}, defaultVirtualNodes)
+	counts := map[string]int{}
+	for i := 0; i < 30000; i++ {
+		counts[ring.owner(fmt.Sprint("key", i))]++
+	}
+	assert.Len(t, counts, 3)
+	for node, count := range counts {
+		assert.InDelta(t, 10000, count, 2000, node)
+	}
+}
+
+func TestHashRing_JoiningMovesKeysOnlyToNewNode(t *testing.T) {
+	before := newHashRing([]string{"http://a", "http://b", "http://c"}, defaultVirtualNodes)
+	after := newHashRing([]string{"http://a", "http://b", "http://c", "http://d"}, defaultVirtualNodes)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint("key", i)
+		if owner := after.owner(key); owner != before.owner(key) {
+			assert.Equal(t, "http://d", owner, key)
+			moved++
+		}
+	}
+	assert.InDelta(t, 2500, moved, 700)
+}
+
+func TestHashRing_IgnoresNodeOrderAndDuplicates(t *testing.T) {
+	a := newHashRing([]string{"http://a", "http://b", "http://c"}, defaultVirtualNodes)
+	b := newHashRing([]string{"http://c", "http://a", "http://b", "http://a"}, defaultVirtualNodes)
+	assert.Equal(t, a, b)
+}
+
+func TestHashRing_Empty(t *testing.T) {
+	assert.Equal(t, "", newHashRing(nil, defaultVirtualNodes).owner("key"))
+}
+
+func TestNewPartitioner_InvalidNodes(t *testing.T) {
+	kvStore := store.NewNamespacedStore()
+	_, err := newPartitioner("http://a", nil, kvStore)
+	assert.EqualError(t, err, "a partitioned cluster needs at least one node")
+	_, err = newPartitioner("a:8080", []string{"http://a"}, kvStore)
+	assert.EqualError(t, err, `invalid node "a:8080": want a base URL such as http://kv1:8080`)
+	_, err = newPartitioner("http://a", []string{"http://a/api"}, kvStore)
+	assert.EqualError(t, err, `invalid node "http://a/api": want a base URL such as http://kv1:8080`)
+	_, err = newPartitioner("http://a", []string{"http://b", "http://c"}, kvStore)
+	assert.EqualError(t, err, "this node, http://a, is not one of the cluster's nodes")
+}
+
+// partitionTestNode is a node of a partitioned cluster served over HTTP.
+type partitionTestNode struct {
+	server      *httptest.Server
+	router      http.Handler
+	store       store.NamespacedStore
+	partitioner *partitioner
+}
+
+type partitionTestSuite struct {
+	suite.Suite
+	nodes   []*partitionTestNode // those still in the cluster
+	servers []*httptest.Server
+}
+
+func (s *partitionTestSuite) TearDownTest() {
+	for _, server := range s.servers {
+		server.Close()
+	}
+}
+
+// startCluster starts n nodes whose ring holds the first members of them.
+// The others are started as nodes about to join, with that ring and
+// themselves.
+func (s *partitionTestSuite) startCluster(n, members int) {
+	s.nodes, s.servers = nil, nil
+	var urls []string
+	for i := 0; i < n; i++ {
+		node := &partitionTestNode{store: store.NewNamespacedStore()}
+		// the router needs the node's URL, which is only known once it is serving
+		node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			node.router.ServeHTTP(w, r)
+		}))
+		s.nodes = append(s.nodes, node)
+		s.servers = append(s.servers, node.server)
+		urls = append(urls, node.server.URL)
+	}
+	for _, node := range s.nodes {
+		var err error
+		nodes := urls[:members:members]
+		if !slices.Contains(nodes, node.server.URL) {
+			nodes = append(nodes, node.server.URL)
+		}
+		node.partitioner, err = newPartitioner(node.server.URL, nodes, node.store)
+		s.Require().NoError(err)
+		node.router = newRouter(node.store, routerOptions{partitioner: node.partitioner})
+	}
+}
+
+func (s *partitionTestSuite) request(method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", jsonPatchContentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	return resp.StatusCode, string(data)
+}
+
+// owner returns the node the cluster's ring assigns key in namespace.
+func (s *partitionTestSuite) owner(namespace, key string) *partitionTestNode {
+	ring, _ := s.nodes[0].partitioner.rings()
+	owner := ring.owner(partitionKey(namespace, key))
+	for _, node := range s.nodes {
+		if node.server.URL == owner {
+			return node
+		}
+	}
+	s.FailNow("no owner", key)
+	return nil
+}
+
+// local returns the value key has in node's own store.
+func (s *partitionTestSuite) local(node *partitionTestNode, namespace, key string) any {
+	keyspace, err := node.store.Namespace(namespace)
+	s.Require().NoError(err)
+	return keyspace.Get(key)
+}
+
+// entries returns the keys with prefix in node's own default namespace.
+func (s *partitionTestSuite) entries(node *partitionTestNode, prefix string) []store.Entry {
+	keyspace, err := node.store.Namespace(store.DefaultNamespace)
+	s.Require().NoError(err)
+	entries, _ := keyspace.(store.ScannableStore).Scan(prefix, "", 0)
+	return entries
+}
+
+// rebalanced waits for every node to have finished migrating keys.
+func (s *partitionTestSuite) rebalanced() {
+	s.Require().Eventually(func() bool {
+		for _, node := range s.nodes {
+			if _, previous := node.partitioner.rings(); previous != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// assertPlaced checks keys 0 to n-1 are stored by their owners only.
+func (s *partitionTestSuite) assertPlaced(n int) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key", i)
+		owner := s.owner(store.DefaultNamespace, key)
+		for _, node := range s.nodes {
+			if node == owner {
+				assert.Equal(s.T(), float64(i), s.local(node, store.DefaultNamespace, key), key)
+			} else {
+				assert.Nil(s.T(), s.local(node, store.DefaultNamespace, key), key)
+			}
+		}
+	}
+}
+
+func (s *partitionTestSuite) setKeys(n int) {
+	for i := 0; i < n; i++ {
+		code, _ := s.request("POST", s.nodes[0].server.URL+"/api/v1/keys/key"+fmt.Sprint(i), fmt.Sprintf(`{"value":%d}`, i))
+		s.Require().Equal(http.StatusOK, code)
+	}
+}
+
+func (s *partitionTestSuite) TestRoutesKeysToOwners() {
+	s.startCluster(3, 3)
+	s.setKeys(30)
+	s.assertPlaced(30)
+
+	// any node serves any key
+	for _, node := range s.nodes {
+		code, body := s.request("GET", node.server.URL+"/api/v1/keys/key7", "")
+		assert.Equal(s.T(), http.StatusOK, code)
+		assert.JSONEq(s.T(), `{"value":7}`, body)
+	}
+	code, _ := s.request("DELETE", s.nodes[1].server.URL+"/api/v1/keys/key7", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Nil(s.T(), s.local(s.owner(store.DefaultNamespace, "key7"), store.DefaultNamespace, "key7"))
+}
+
+func (s *partitionTestSuite) TestRoutesNamespacedKeys() {
+	s.startCluster(3, 3)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint("key", i)
+		code, _ := s.request("POST", s.nodes[0].server.URL+"/api/v1/ns/users/keys/"+key, `{"value":"user"}`)
+		s.Require().Equal(http.StatusOK, code)
+		assert.Equal(s.T(), "user", s.local(s.owner("users", key), "users", key), key)
+	}
+}
+
+func (s *partitionTestSuite) TestDoesNotServeMultiKeyRoutes() {
+	s.startCluster(3, 3)
+	s.setKeys(10)
+
+	// the keys may be held by any node, so a node can't serve these alone
+	for _, route := range []struct{ method, path, body string }{
+		{"GET", "/api/v1/keys", ""},
+		{"DELETE", "/api/v1/keys?confirm=true", ""},
+		{"POST", "/api/v1/batch", `{"ops":[{"op":"set","key":"key1","value":"x"},{"op":"set","key":"key2","value":"x"}]}`},
+		{"POST", "/api/v1/txn", `{"writes":[{"key":"key1","value":"x"},{"key":"key2","value":"x"}]}`},
+		{"GET", "/api/v1/ns/users/keys", ""},
+		{"POST", "/api/v1/ns/users/batch", `{"ops":[{"op":"get","key":"key1"}]}`},
+	} {
+		code, _ := s.request(route.method, s.nodes[0].server.URL+route.path, route.body)
+		assert.Equal(s.T(), http.StatusNotFound, code, route.method+" "+route.path)
+	}
+	// nothing was written or deleted
+	s.assertPlaced(10)
+}
+
+func (s *partitionTestSuite) TestRing() {
+	s.startCluster(2, 2)
+	code, body := s.request("GET", s.nodes[0].server.URL+"/api/v1/admin/ring", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	var ring struct {
+		Self        string   `json:"self"`
+		Nodes       []string `json:"nodes"`
+		Rebalancing bool     `json:"rebalancing"`
+	}
+	s.Require().NoError(json.Unmarshal([]byte(body), &ring))
+	assert.Equal(s.T(), s.nodes[0].server.URL, ring.Self)
+	assert.ElementsMatch(s.T(), []string{s.nodes[0].server.URL, s.nodes[1].server.URL}, ring.Nodes)
+	assert.False(s.T(), ring.Rebalancing)
+}
+
+func (s *partitionTestSuite) TestNodeJoins() {
+	s.startCluster(3, 2)
+	s.setKeys(60)
+	assert.Nil(s.T(), s.local(s.nodes[2], store.DefaultNamespace, "key0"))
+	ttlKey, _ := s.request("POST", s.nodes[0].server.URL+"/api/v1/keys/expiring", `{"value":"v","ttl_seconds":3600}`)
+	s.Require().Equal(http.StatusOK, ttlKey)
+
+	all := fmt.Sprintf(`{"nodes":["%s","%s","%s"]}`, s.nodes[0].server.URL, s.nodes[1].server.URL, s.nodes[2].server.URL)
+	code, body := s.request("PUT", s.nodes[1].server.URL+"/api/v1/admin/ring", all)
+	s.Require().Equal(http.StatusOK, code, body)
+	s.rebalanced()
+
+	s.assertPlaced(60)
+	owner := s.owner(store.DefaultNamespace, "expiring")
+	entries := s.entries(owner, "expiring")
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Hour), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *partitionTestSuite) TestMigrationKeepsNewerWrites() {
+	s.startCluster(2, 1)
+	// keys the joining node will own, which it has already been written
+	joining, _ := s.nodes[1].partitioner.rings()
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprint("key", i); joining.owner(partitionKey(store.DefaultNamespace, key)) == s.nodes[1].server.URL {
+			keys = append(keys, key)
+		}
+	}
+	previousOwner, _ := s.nodes[0].store.Namespace(store.DefaultNamespace)
+	previousOwner.Set(keys[0], "old")
+	previousOwner.(store.ExpiringStore).SetWithTTL(keys[1], "old", time.Hour)
+	newOwner, _ := s.nodes[1].store.Namespace(store.DefaultNamespace)
+	newOwner.Set(keys[0], "new")
+	newOwner.Set(keys[1], "new")
+
+	both := fmt.Sprintf(`{"nodes":["%s","%s"]}`, s.nodes[0].server.URL, s.nodes[1].server.URL)
+	code, body := s.request("PUT", s.nodes[0].server.URL+"/api/v1/admin/ring", both)
+	s.Require().Equal(http.StatusOK, code, body)
+	s.rebalanced()
+
+	// the copies, with a TTL or not, don't overwrite the newer writes
+	for _, key := range keys {
+		assert.Equal(s.T(), "new", s.local(s.nodes[1], store.DefaultNamespace, key), key)
+		assert.Nil(s.T(), s.local(s.nodes[0], store.DefaultNamespace, key), key)
+	}
+}
+
+func (s *partitionTestSuite) TestNodeLeaves() {
+	s.startCluster(3, 3)
+	s.setKeys(60)
+
+	remaining := fmt.Sprintf(`{"nodes":["%s","%s"]}`, s.nodes[0].server.URL, s.nodes[1].server.URL)
+	code, body := s.request("PUT", s.nodes[2].server.URL+"/api/v1/admin/ring", remaining)
+	s.Require().Equal(http.StatusOK, code, body)
+	s.rebalanced()
+
+	assert.Empty(s.T(), s.entries(s.nodes[2], ""))
+	s.nodes = s.nodes[:2]
+	s.assertPlaced(60)
+}
+
+func (s *partitionTestSuite) TestServesKeysNotYetMigrated() {
+	s.startCluster(2, 1)
+	s.setKeys(20)
+	// change node 1's ring without migrating, as if node 0 hadn't got to it yet
+	newOwner := s.nodes[1]
+	newOwner.partitioner.ring, newOwner.partitioner.previous = newHashRing([]string{s.nodes[0].server.URL, newOwner.server.URL}, defaultVirtualNodes), s.nodes[0].partitioner.ring
+	s.nodes[0].partitioner.ring = newOwner.partitioner.ring
+	i := 0
+	for s.owner(store.DefaultNamespace, fmt.Sprint("key", i)) != newOwner {
+		i++
+	}
+	key := fmt.Sprint("key", i)
+
+	code, body := s.request("GET", newOwner.server.URL+"/api/v1/keys/"+key, "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.JSONEq(s.T(), fmt.Sprintf(`{"value":%d}`, i), body)
+
+	// increments add to the previous owner's copy until it is migrated
+	code, body = s.request("POST", newOwner.server.URL+"/api/v1/keys/"+key+"/incr", `{"delta":10}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.JSONEq(s.T(), fmt.Sprintf(`{"value":%d}`, i+10), body)
+	assert.Equal(s.T(), float64(i+10), s.local(s.nodes[0], store.DefaultNamespace, key))
+	assert.Nil(s.T(), s.local(newOwner, store.DefaultNamespace, key))
+	// and so do patches
+	code, _ = s.request("PATCH", newOwner.server.URL+"/api/v1/keys/"+key, `[{"op":"test","path":"","value":`+fmt.Sprint(i+10)+`}]`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Nil(s.T(), s.local(newOwner, store.DefaultNamespace, key))
+
+	code, _ = s.request("DELETE", s.nodes[0].server.URL+"/api/v1/keys/"+key, "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Nil(s.T(), s.local(s.nodes[0], store.DefaultNamespace, key))
+	code, _ = s.request("GET", newOwner.server.URL+"/api/v1/keys/"+key, "")
+	assert.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *partitionTestSuite) TestServesCollectionsNotYetMigrated() {
+	s.startCluster(2, 1)
+	code, _ := s.request("POST", s.nodes[0].server.URL+"/api/v1/keys/hash", `{"type":"hash","value":{"a":1,"b":2}}`)
+	s.Require().Equal(http.StatusOK, code)
+	newOwner := s.nodes[1]
+	newOwner.partitioner.ring, newOwner.partitioner.previous = newHashRing([]string{newOwner.server.URL}, defaultVirtualNodes), s.nodes[0].partitioner.ring
+	s.nodes[0].partitioner.ring = newOwner.partitioner.ring
+
+	code, body := s.request("POST", newOwner.server.URL+"/api/v1/keys/hash/hash", `{"fields":{"c":3}}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.JSONEq(s.T(), `{"added":1}`, body)
+	// deleting a field leaves the rest of the previous owner's copy
+	code, body = s.request("DELETE", newOwner.server.URL+"/api/v1/keys/hash/hash/a", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.JSONEq(s.T(), `{"deleted":1}`, body)
+	code, body = s.request("GET", newOwner.server.URL+"/api/v1/keys/hash/hash", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.JSONEq(s.T(), `{"fields":{"b":2,"c":3}}`, body)
+	assert.Nil(s.T(), s.local(newOwner, store.DefaultNamespace, "hash"))
+
+	// intersections can't be served, as the other sets may be on other nodes
+	code, _ = s.request("GET", newOwner.server.URL+"/api/v1/keys/a/set/intersect?with=b", "")
+	assert.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *partitionTestSuite) TestRejectsChangeWhileRebalancing() {
+	s.startCluster(2, 2)
+	s.nodes[0].partitioner.rebalancing = true
+	code, body := s.request("PUT", s.nodes[0].server.URL+"/api/v1/admin/ring", fmt.Sprintf(`{"nodes":["%s"]}`, s.nodes[0].server.URL))
+	assert.Equal(s.T(), http.StatusConflict, code)
+	assert.Equal(s.T(), `{"error":"keys are still migrating after the last membership change"}`, body)
+}
+
+func (s *partitionTestSuite) TestInvalidRing() {
+	s.startCluster(1, 1)
+	code, _ := s.request("PUT", s.nodes[0].server.URL+"/api/v1/admin/ring", `{"nodes":[]}`)
+	assert.Equal(s.T(), http.StatusBadRequest, code)
+	code, body := s.request("PUT", s.nodes[0].server.URL+"/api/v1/admin/ring", `{"nodes":["kv1"]}`)
+	assert.Equal(s.T(), http.StatusBadRequest, code)
+	assert.Equal(s.T(), `{"error":"invalid node \"kv1\": want a base URL such as http://kv1:8080"}`, body)
+}
+
+func (s *partitionTestSuite) TestRetriesFailedMigration() {
+	s.startCluster(3, 2)
+	s.setKeys(60)
+	// node 2 is down when it is added
+	down := s.nodes[2]
+	down.server.Close()
+	all := fmt.Sprintf(`{"nodes":["%s","%s","%s"]}`, s.nodes[0].server.URL, s.nodes[1].server.URL, down.server.URL)
+	code, body := s.request("PUT", s.nodes[0].server.URL+"/api/v1/admin/ring", all)
+	assert.Equal(s.T(), http.StatusBadGateway, code)
+	assert.Contains(s.T(), body, down.server.URL)
+	s.Require().Eventually(func() bool {
+		_, body := s.request("GET", s.nodes[0].server.URL+"/api/v1/admin/ring", "")
+		return strings.Contains(body, `"error"`) && strings.Contains(body, `"rebalancing":false`)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// taking it out again moves every key back where it belongs, though it
+	// still can't be told of the change
+	remaining := fmt.Sprintf(`{"nodes":["%s","%s"]}`, s.nodes[0].server.URL, s.nodes[1].server.URL)
+	code, body = s.request("PUT", s.nodes[0].server.URL+"/api/v1/admin/ring", remaining)
+	s.Require().Equal(http.StatusBadGateway, code, body)
+	s.nodes = s.nodes[:2]
+	s.rebalanced()
+	s.assertPlaced(60)
+}
+
+func TestPartitionTestSuite(t *testing.T) {
+	suite.Run(t, new(partitionTestSuite))
+}
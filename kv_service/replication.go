@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// replicationBatchSize is how many entries each event of a checkpoint holds.
+	replicationBatchSize = 100
+	// maxReplicationEvent bounds the size of an event a replica reads.
+	maxReplicationEvent = 64 << 20
+)
+
+var (
+	// replicationHeartbeatInterval is how often an idle replication stream
+	// sends a ping with the primary's revision, by which a replica measures
+	// its lag and notices a dead connection.
+	replicationHeartbeatInterval = time.Second
+	// replicaTimeout is how long a replica waits to hear from its primary
+	// before reconnecting.
+	replicaTimeout = 5 * time.Second
+	// replicaRetryInterval is how long a replica waits between attempts to
+	// connect to its primary.
+	replicaRetryInterval = time.Second
+)
+
+// replicatedEntry is a key of a checkpoint, as sent to replicas.
+type replicatedEntry struct {
+	Key        string    `json:"key"`
+	Value      any       `json:"value"`
+	Collection string    `json:"collection,omitempty"` // the type of collection Value holds, if it is one
+	Version    uint64    `json:"version"`
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`
+}
+
+// replicatedChange is a change to a key, as sent to replicas.
+type replicatedChange struct {
+	Type       store.EventType         `json:"type"`
+	Key        string                  `json:"key"`
+	Value      any                     `json:"value,omitempty"`
+	Collection string                  `json:"collection,omitempty"` // the type of collection Value holds, if it is one
+	Change     *store.CollectionChange `json:"change,omitempty"`     // made to the key's collection, for an update
+	ExpiresAt  time.Time               `json:"expires_at,omitzero"`
+}
+
+// replicationMessage is the data of a replication stream event.
+type replicationMessage struct {
+	Revision uint64             `json:"revision,omitempty"`
+	Entries  []replicatedEntry  `json:"entries,omitempty"`
+	Changes  []replicatedChange `json:"changes,omitempty"`
+	Error    string             `json:"error,omitempty"` // why the stream is ending
+}
+
+// replicationSource returns the keyspace replicas of kvStore follow: the
+// default namespace, if kvStore has namespaces.
+func replicationSource(kvStore store.Store) (store.ReplicationSource, bool) {
+	if namespacedStore, ok := kvStore.(store.NamespacedStore); ok {
+		defaultStore, err := namespacedStore.Namespace(store.DefaultNamespace)
+		if err != nil {
+			return nil, false
+		}
+		kvStore = defaultStore
+	}
+	source, ok := kvStore.(store.ReplicationSource)
+	return source, ok
+}
+
+// unreplicatedNamespaces returns the namespaces of kvStore other than the
+// default, which a replica has no keyspace to copy into.
+func unreplicatedNamespaces(kvStore store.Store) []string {
+	namespacedStore, ok := kvStore.(store.NamespacedStore)
+	if !ok {
+		return nil
+	}
+	return slices.DeleteFunc(namespacedStore.Namespaces(), func(name string) bool {
+		return name == store.DefaultNamespace
+	})
+}
+
+// replicationStreamHandler handles streaming the store's changes to a
+// replica as Server-Sent Events. Unless the replica resumes from a revision
+// whose changes are still held, the stream starts with a checkpoint of every
+// key: "entries" events, then a "checkpoint" event with the revision they
+// are current as of. Each "changes" event then holds every change made at
+// one revision, which the replica applies together.
+//
+// Replicas hold the default namespace only, so a store holding any other
+// namespace refuses to stream, and a stream ends with an "error" event once
+// another namespace is created, rather than leave the replica silently
+// missing its keys.
+func replicationStreamHandler(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		source, ok := replicationSource(kvStore)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support replication."})
+			return
+		}
+		if names := unreplicatedNamespaces(kvStore); len(names) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": unreplicatedError(names)})
+			return
+		}
+		var request struct {
+			FromRevision uint64 `form:"from_revision"`
+		}
+		if err := c.ShouldBindQuery(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		var entries []store.Entry
+		var revision uint64
+		var events <-chan store.Event
+		var err error
+		// a replica ahead of the store is following a primary that lost writes
+		checkpoint := request.FromRevision == 0 || request.FromRevision > source.Revision()+1
+		if !checkpoint {
+			events, err = source.Watch(ctx, "", request.FromRevision)
+			checkpoint = errors.Is(err, store.ErrCompacted)
+		}
+		if checkpoint {
+			entries, revision, events, err = source.Checkpoint(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream;charset=utf-8")
+		c.Header("Cache-Control", "no-cache")
+		c.Status(http.StatusOK)
+		if checkpoint {
+			for batch := range slices.Chunk(entries, replicationBatchSize) {
+				message := replicationMessage{Entries: make([]replicatedEntry, 0, len(batch))}
+				for _, entry := range batch {
+					message.Entries = append(message.Entries, replicatedEntry{Key: entry.Key, Value: entry.Value, Collection: store.CollectionType(entry.Value), Version: entry.Version, ExpiresAt: entry.ExpiresAt})
+				}
+				c.Render(-1, sse.Event{Event: "entries", Data: message})
+			}
+			c.Render(-1, sse.Event{Event: "checkpoint", Data: replicationMessage{Revision: revision}})
+		}
+		c.Writer.Flush()
+
+		var changes []store.Event
+		send := func() {
+			message := replicationMessage{Revision: changes[0].Revision}
+			for _, event := range changes {
+				message.Changes = append(message.Changes, replicatedChange{Type: event.Type, Key: event.Key, Value: event.Value, Collection: store.CollectionType(event.Value), Change: event.Change, ExpiresAt: event.ExpiresAt})
+			}
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(message.Revision, 10), Event: "changes", Data: message})
+			changes = nil
+		}
+		heartbeat := time.NewTicker(replicationHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				// a revision's changes are all published before the store's
+				// lock is released, so once Revision has taken the lock the
+				// rest of this one's are queued
+				source.Revision()
+				changes = append(changes, event)
+			queued:
+				for {
+					select {
+					case event, ok := <-events:
+						if !ok {
+							return
+						}
+						if event.Revision != changes[0].Revision {
+							send()
+							source.Revision()
+						}
+						changes = append(changes, event)
+					default:
+						break queued
+					}
+				}
+				send()
+			case <-heartbeat.C:
+				if names := unreplicatedNamespaces(kvStore); len(names) > 0 {
+					c.Render(-1, sse.Event{Event: "error", Data: replicationMessage{Error: unreplicatedError(names)}})
+					return
+				}
+				c.Render(-1, sse.Event{Event: "ping", Data: replicationMessage{Revision: source.Revision()}})
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// unreplicatedError explains why a store holding the namespaces names can't
+// be replicated.
+func unreplicatedError(names []string) string {
+	return fmt.Sprintf("Replicas hold the default namespace only, but this store also holds namespace(s) %s.", strings.Join(names, ", "))
+}
+
+// follower keeps a replica up to date with its primary, reconnecting to the
+// primary's replication stream whenever it drops.
+type follower struct {
+	replica store.ReplicaStore
+	primary string // base URL of the primary's API
+	client  *http.Client
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu              sync.Mutex
+	connected       bool
+	primaryRevision uint64    // the latest the primary has reported
+	caughtUp        time.Time // when the replica last had every reported change
+	lastContact     time.Time
+	err             error // why the last connection failed
+}
+
+// startFollower starts replica following the primary at primary.
+func startFollower(replica store.ReplicaStore, primary string) *follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		replica:  replica,
+		primary:  strings.TrimSuffix(primary, "/"),
+		client:   &http.Client{},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		caughtUp: time.Now(),
+	}
+	go f.run(ctx)
+	return f
+}
+
+// stop stops following the primary, waiting for any change being applied.
+func (f *follower) stop() {
+	f.cancel()
+	<-f.done
+}
+
+func (f *follower) run(ctx context.Context) {
+	defer close(f.done)
+	for {
+		err := f.follow(ctx)
+		f.mu.Lock()
+		f.connected = false
+		if ctx.Err() == nil {
+			f.err = err
+		}
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// follow applies the primary's replication stream until it ends.
+func (f *follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	streamURL := f.primary + "/api/v1/admin/replication/stream"
+	if revision := f.replica.Revision(); revision > 0 {
+		streamURL += "?from_revision=" + strconv.FormatUint(revision+1, 10)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: %s: %s", streamURL, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	// a primary that stops sending pings is presumed gone
+	watchdog := time.AfterFunc(replicaTimeout, cancel)
+	defer watchdog.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxReplicationEvent)
+	var event string
+	var checkpoint []store.Entry
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			watchdog.Reset(replicaTimeout)
+			var message replicationMessage
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &message); err != nil {
+				return fmt.Errorf("invalid %s event: %w", event, err)
+			}
+			if err := f.handle(event, message, &checkpoint); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("GET %s: %w", streamURL, io.ErrUnexpectedEOF)
+}
+
+// handle applies one event of the replication stream. Entries are gathered
+// in checkpoint until the checkpoint is complete.
+func (f *follower) handle(event string, message replicationMessage, checkpoint *[]store.Entry) error {
+	switch event {
+	case "error":
+		return fmt.Errorf("primary: %s", message.Error)
+	case "entries":
+		for _, entry := range message.Entries {
+			value, err := replicatedValue(entry.Key, entry.Value, entry.Collection)
+			if err != nil {
+				return err
+			}
+			*checkpoint = append(*checkpoint, store.Entry{Key: entry.Key, Value: value, Version: entry.Version, ExpiresAt: entry.ExpiresAt})
+		}
+	case "checkpoint":
+		if err := f.replica.Load(*checkpoint, message.Revision); err != nil {
+			return err
+		}
+		*checkpoint = nil
+	case "changes":
+		changes := make([]store.Event, 0, len(message.Changes))
+		for _, change := range message.Changes {
+			value, err := replicatedValue(change.Key, change.Value, change.Collection)
+			if err != nil {
+				return err
+			}
+			if change.Type == store.EventUpdate && change.Change == nil {
+				return fmt.Errorf("update of %q has no change", change.Key)
+			}
+			changes = append(changes, store.Event{Type: change.Type, Key: change.Key, Value: value, Change: change.Change, ExpiresAt: change.ExpiresAt})
+		}
+		if err := f.replica.Apply(message.Revision, changes); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected, f.lastContact, f.err = true, now, nil
+	f.primaryRevision = max(f.primaryRevision, message.Revision)
+	if f.replica.Revision() >= f.primaryRevision {
+		f.caughtUp = now
+	}
+	return nil
+}
+
+// replicatedValue returns the value the primary sent for key, as the
+// collection of type collection if it names one.
+func replicatedValue(key string, value any, collection string) (any, error) {
+	if collection == "" {
+		return value, nil
+	}
+	value, err := store.DecodeCollection(collection, value)
+	if err != nil {
+		return nil, fmt.Errorf("value of %q: %w", key, err)
+	}
+	return value, nil
+}
+
+// status reports the replica's connection to its primary and how far it
+// lags behind it, in revisions and in time.
+func (f *follower) status() gin.H {
+	revision := f.replica.Revision()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := gin.H{
+		"role":             "replica",
+		"primary":          f.primary,
+		"connected":        f.connected,
+		"revision":         revision,
+		"primary_revision": f.primaryRevision,
+		"lag":              uint64(0),
+		"lag_seconds":      float64(0),
+	}
+	if f.primaryRevision > revision {
+		status["lag"] = f.primaryRevision - revision
+		status["lag_seconds"] = time.Since(f.caughtUp).Seconds()
+	}
+	if !f.lastContact.IsZero() {
+		status["last_contact"] = f.lastContact
+	}
+	if f.err != nil {
+		status["error"] = f.err.Error()
+	}
+	return status
+}
+
+// replicationStatusHandler reports whether this node is a primary or a
+// replica, and how far a replica lags behind its primary
+func replicationStatusHandler(kvStore store.Store, f *follower) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		source, ok := replicationSource(kvStore)
+		switch {
+		case f != nil && !f.replica.IsLeader():
+			c.JSON(http.StatusOK, f.status())
+		case ok:
+			c.JSON(http.StatusOK, gin.H{"role": "primary", "revision": source.Revision()})
+		default:
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support replication."})
+		}
+	}
+}
+
+// promoteHandler handles making a replica the primary. It stops following
+// the old primary, which should be stopped or made a replica of this node,
+// so that the two don't both take writes.
+func promoteHandler(f *follower) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if f == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "This node is not a replica."})
+			return
+		}
+		f.stop()
+		f.replica.Promote()
+		c.JSON(http.StatusOK, gin.H{"message": "Promoted to primary.", "revision": f.replica.Revision()})
+	}
+}
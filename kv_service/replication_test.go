@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type replicationTestSuite struct {
+	suite.Suite
+	primaryStore store.NamespacedStore
+	primary      *httptest.Server
+	replicaStore store.ReplicaStore
+	follower     *follower
+	replica      *httptest.Server
+}
+
+func (s *replicationTestSuite) SetupSuite() {
+	heartbeat, timeout, retry := replicationHeartbeatInterval, replicaTimeout, replicaRetryInterval
+	replicationHeartbeatInterval, replicaTimeout, replicaRetryInterval = 20*time.Millisecond, 200*time.Millisecond, 20*time.Millisecond
+	s.T().Cleanup(func() {
+		replicationHeartbeatInterval, replicaTimeout, replicaRetryInterval = heartbeat, timeout, retry
+	})
+}
+
+func (s *replicationTestSuite) SetupTest() {
+	s.primaryStore = store.NewNamespacedStore()
+	s.primary = httptest.NewServer(setupRouter(s.primaryStore))
+	s.replicaStore = store.NewReplicaStore(s.primary.URL)
+}
+
+func (s *replicationTestSuite) TearDownTest() {
+	if s.follower != nil {
+		s.follower.stop()
+		s.follower = nil
+	}
+	if s.replica != nil {
+		s.replica.Close()
+		s.replica = nil
+	}
+	s.primary.Close()
+}
+
+// startReplica starts following the primary and serving the replica.
+func (s *replicationTestSuite) startReplica() {
+	s.follower = startFollower(s.replicaStore, s.primary.URL)
+	s.replica = httptest.NewServer(newRouter(s.replicaStore, routerOptions{follower: s.follower}))
+}
+
+func (s *replicationTestSuite) request(method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	return resp.StatusCode, string(data)
+}
+
+// caughtUp waits for the replica to have applied every change the primary has made.
+func (s *replicationTestSuite) caughtUp() {
+	primary, _ := replicationSource(s.primaryStore)
+	s.Require().Eventually(func() bool {
+		return s.replicaStore.Revision() == primary.Revision()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func (s *replicationTestSuite) TestCopiesExistingKeys() {
+	for i := 0; i < 250; i++ {
+		s.primaryStore.Set(fmt.Sprint("key", i), float64(i))
+	}
+	s.startReplica()
+	s.caughtUp()
+
+	entries, _ := s.replicaStore.Scan("", "", 0)
+	assert.Len(s.T(), entries, 250)
+	assert.Equal(s.T(), float64(249), s.replicaStore.Get("key249"))
+}
+
+func (s *replicationTestSuite) TestAppliesChanges() {
+	s.startReplica()
+	code, _ := s.request("POST", s.primary.URL+"/api/v1/keys/a", `{"value":"one"}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, _ = s.request("POST", s.primary.URL+"/api/v1/keys/b", `{"value":{"nested":[1,2]},"ttl_seconds":60}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, _ = s.request("DELETE", s.primary.URL+"/api/v1/keys/a", "")
+	s.Require().Equal(http.StatusOK, code)
+	s.caughtUp()
+
+	assert.Nil(s.T(), s.replicaStore.Get("a"))
+	entries, _ := s.replicaStore.Scan("b", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), map[string]any{"nested": []any{float64(1), float64(2)}}, entries[0].Value)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+
+	// versions match the primary's, so reads from the replica condition writes
+	req, _ := http.NewRequest("GET", s.replica.URL+"/api/v1/keys/b", nil)
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	req, _ = http.NewRequest("GET", s.primary.URL+"/api/v1/keys/b", nil)
+	primaryResp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	primaryResp.Body.Close()
+	assert.Equal(s.T(), primaryResp.Header.Get("ETag"), resp.Header.Get("ETag"))
+}
+
+func (s *replicationTestSuite) TestReplicatesCollections() {
+	code, _ := s.request("POST", s.primary.URL+"/api/v1/keys/list", `{"type":"list","value":["a","b"]}`)
+	s.Require().Equal(http.StatusOK, code)
+	s.startReplica()
+	s.caughtUp()
+	// a plain value shaped like a collection stays plain
+	code, _ = s.request("POST", s.primary.URL+"/api/v1/keys/plain", `{"value":["a"]}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, _ = s.request("POST", s.primary.URL+"/api/v1/keys/list/list/pop", `{"front":true}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, _ = s.request("POST", s.primary.URL+"/api/v1/keys/set/set/add", `{"members":["x","y"]}`)
+	s.Require().Equal(http.StatusOK, code)
+	s.caughtUp()
+
+	assert.Equal(s.T(), store.ListValue{"b"}, s.replicaStore.Get("list"))
+	assert.Equal(s.T(), store.SetValue{"x", "y"}, s.replicaStore.Get("set"))
+	assert.Equal(s.T(), []any{"a"}, s.replicaStore.Get("plain"))
+}
+
+func (s *replicationTestSuite) TestAppliesBatchesTogether() {
+	s.startReplica()
+	s.caughtUp()
+	events, err := s.replicaStore.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	code, body := s.request("POST", s.primary.URL+"/api/v1/batch", `{"ops":[{"op":"set","key":"a","value":"one"},{"op":"set","key":"b","value":"two"}]}`)
+	s.Require().Equal(http.StatusOK, code, body)
+	s.caughtUp()
+
+	first, second := <-events, <-events
+	assert.Equal(s.T(), first.Revision, second.Revision)
+	assert.Equal(s.T(), "two", s.replicaStore.Get("b"))
+}
+
+func (s *replicationTestSuite) TestForwardsWritesToPrimary() {
+	s.startReplica()
+	code, body := s.request("POST", s.replica.URL+"/api/v1/keys/a", `{"value":"one"}`)
+	s.Require().Equal(http.StatusOK, code, body)
+	assert.Equal(s.T(), "one", s.primaryStore.Get("a"))
+	s.caughtUp()
+	assert.Equal(s.T(), "one", s.replicaStore.Get("a"))
+}
+
+func (s *replicationTestSuite) TestStrongReadsGoToPrimary() {
+	// a replica that isn't following, so never sees the write
+	s.replica = httptest.NewServer(setupRouter(s.replicaStore))
+	s.primaryStore.Set("a", "one")
+
+	code, _ := s.request("GET", s.replica.URL+"/api/v1/keys/a", "")
+	assert.Equal(s.T(), http.StatusNotFound, code)
+	code, _ = s.request("GET", s.replica.URL+"/api/v1/keys/a?consistency=eventual", "")
+	assert.Equal(s.T(), http.StatusNotFound, code)
+	code, body := s.request("GET", s.replica.URL+"/api/v1/keys/a?consistency=strong", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"value":"one"}`, body)
+}
+
+func (s *replicationTestSuite) TestResumesAfterReconnecting() {
+	s.startReplica()
+	s.primaryStore.Set("a", "one")
+	s.caughtUp()
+
+	// drop the stream; the replica reconnects and carries on where it left off
+	s.primary.CloseClientConnections()
+	s.primaryStore.Set("b", "two")
+	s.caughtUp()
+	assert.Equal(s.T(), "one", s.replicaStore.Get("a"))
+	assert.Equal(s.T(), "two", s.replicaStore.Get("b"))
+}
+
+func (s *replicationTestSuite) TestStreamResumesWithoutCheckpoint() {
+	s.primaryStore.Set("a", "one")
+	s.primaryStore.Set("b", "two")
+
+	assert.Equal(s.T(), []string{"entries", "checkpoint", "ping"}, s.streamEvents(""))
+	assert.Equal(s.T(), []string{"changes", "ping"}, s.streamEvents("?from_revision=2"))
+	// a replica ahead of the primary is sent a checkpoint to start again from
+	assert.Equal(s.T(), []string{"entries", "checkpoint", "ping"}, s.streamEvents("?from_revision=10"))
+}
+
+// streamEvents returns the names of the primary's replication stream's
+// events, up to its first ping.
+func (s *replicationTestSuite) streamEvents(query string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.primary.URL+"/api/v1/admin/replication/stream"+query, nil)
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event:"); ok {
+			events = append(events, event)
+			if event == "ping" {
+				break
+			}
+		}
+	}
+	return events
+}
+
+func (s *replicationTestSuite) TestStatus() {
+	code, body := s.request("GET", s.primary.URL+"/api/v1/admin/replication", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"revision":0,"role":"primary"}`, body)
+
+	s.startReplica()
+	s.primaryStore.Set("a", "one")
+	s.caughtUp()
+	var status struct {
+		Role            string  `json:"role"`
+		Primary         string  `json:"primary"`
+		Connected       bool    `json:"connected"`
+		Revision        uint64  `json:"revision"`
+		PrimaryRevision uint64  `json:"primary_revision"`
+		Lag             uint64  `json:"lag"`
+		LagSeconds      float64 `json:"lag_seconds"`
+	}
+	s.Require().Eventually(func() bool {
+		code, body = s.request("GET", s.replica.URL+"/api/v1/admin/replication", "")
+		s.Require().NoError(json.Unmarshal([]byte(body), &status))
+		return status.Connected && status.PrimaryRevision == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), "replica", status.Role)
+	assert.Equal(s.T(), s.primary.URL, status.Primary)
+	assert.Equal(s.T(), uint64(1), status.Revision)
+	assert.Zero(s.T(), status.Lag)
+	assert.Zero(s.T(), status.LagSeconds)
+}
+
+func (s *replicationTestSuite) TestStatusReportsLag() {
+	s.follower = startFollower(s.replicaStore, "http://primary.invalid")
+	// as if the primary had reported changes the replica hasn't received
+	s.Require().NoError(s.follower.handle("ping", replicationMessage{Revision: 10}, nil))
+	time.Sleep(10 * time.Millisecond)
+
+	status := s.follower.status()
+	assert.Equal(s.T(), uint64(10), status["lag"])
+	assert.Greater(s.T(), status["lag_seconds"], float64(0))
+}
+
+func (s *replicationTestSuite) TestPromote() {
+	s.startReplica()
+	s.primaryStore.Set("a", "one")
+	s.caughtUp()
+
+	code, body := s.request("POST", s.replica.URL+"/api/v1/admin/replication/promote", "")
+	s.Require().Equal(http.StatusOK, code, body)
+	assert.Equal(s.T(), `{"message":"Promoted to primary.","revision":1}`, body)
+
+	// writes are now taken by the replica itself
+	code, _ = s.request("POST", s.replica.URL+"/api/v1/keys/b", `{"value":"two"}`)
+	s.Require().Equal(http.StatusOK, code)
+	assert.Equal(s.T(), "two", s.replicaStore.Get("b"))
+	assert.Nil(s.T(), s.primaryStore.Get("b"))
+	code, body = s.request("GET", s.replica.URL+"/api/v1/admin/replication", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"revision":2,"role":"primary"}`, body)
+}
+
+func (s *replicationTestSuite) TestPromoteNotAReplica() {
+	code, body := s.request("POST", s.primary.URL+"/api/v1/admin/replication/promote", "")
+	assert.Equal(s.T(), http.StatusConflict, code)
+	assert.Equal(s.T(), `{"error":"This node is not a replica."}`, body)
+}
+
+func (s *replicationTestSuite) TestRefusesOtherNamespaces() {
+	orders, err := s.primaryStore.Namespace("orders")
+	s.Require().NoError(err)
+	orders.Set("a", "one")
+
+	code, body := s.request("GET", s.primary.URL+"/api/v1/admin/replication/stream", "")
+	assert.Equal(s.T(), http.StatusConflict, code)
+	assert.Equal(s.T(), `{"error":"Replicas hold the default namespace only, but this store also holds namespace(s) orders."}`, body)
+}
+
+func (s *replicationTestSuite) TestStopsOnceAnotherNamespaceIsCreated() {
+	s.startReplica()
+	s.primaryStore.Set("a", "one")
+	s.caughtUp()
+
+	_, err := s.primaryStore.Namespace("orders")
+	s.Require().NoError(err)
+	s.Require().Eventually(func() bool {
+		status := s.follower.status()
+		return !status["connected"].(bool) && strings.Contains(fmt.Sprint(status["error"]), "namespace(s) orders")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and carries on once it's dropped again
+	_, err = s.primaryStore.DropNamespace("orders")
+	s.Require().NoError(err)
+	s.primaryStore.Set("b", "two")
+	s.caughtUp()
+	assert.Equal(s.T(), "two", s.replicaStore.Get("b"))
+}
+
+func (s *replicationTestSuite) TestUnsupportedStore() {
+	unsupported := httptest.NewServer(setupRouter(basicStore{new(mockStore)}))
+	defer unsupported.Close()
+	code, body := s.request("GET", unsupported.URL+"/api/v1/admin/replication/stream", "")
+	assert.Equal(s.T(), http.StatusNotImplemented, code)
+	assert.Equal(s.T(), `{"error":"Store does not support replication."}`, body)
+}
+
+func TestReplicationTestSuite(t *testing.T) {
+	suite.Run(t, new(replicationTestSuite))
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+)
+
+const (
+	// maxRESPInlineLength is the longest inline command or line header read.
+	maxRESPInlineLength = 64 << 10
+	// maxRESPBulkLength is the largest argument a command may carry.
+	maxRESPBulkLength = 64 << 20
+	// maxRESPArgs is the most arguments a command may carry.
+	maxRESPArgs = 1 << 20
+	// maxRESPCursors is how many SCAN cursors are remembered; older ones
+	// are forgotten, and continuing from them is an error.
+	maxRESPCursors = 4096
+	// defaultRESPScanCount is how many keys SCAN looks at by default.
+	defaultRESPScanCount = 10
+)
+
+// errRESPProtocol is returned for a malformed request, after which the
+// connection is closed, as Redis does.
+var errRESPProtocol = errors.New("Protocol error")
+
+// respServer serves the default namespace of a store over the Redis
+// serialization protocol (RESP2, or RESP3 after HELLO 3), so Redis clients
+// can use it. Values are strings: a value that isn't one, such as a JSON
+// object set over HTTP, reads as its JSON encoding.
+type respServer struct {
+	tcpServer
+	kvStore store.Store // namespaced or not; see defaultKeyspace
+
+	mu sync.Mutex
+	// SCAN cursors are numbers, as clients parse them, each standing for
+	// the key the scan continues after
+	cursors     map[uint64]string
+	cursorOrder []uint64
+	nextCursor  uint64
+}
+
+// newRESPServer returns a RESP server for kvStore, or for its default
+// namespace if it has namespaces.
+func newRESPServer(kvStore store.Store) *respServer {
+	return &respServer{kvStore: kvStore, cursors: map[uint64]string{}}
+}
+
+// Serve accepts connections on listener until Close is called.
+func (s *respServer) Serve(listener net.Listener) error {
+	return s.serve(listener, s.serveConn)
+}
+
+// respConn is one client connection.
+type respConn struct {
+	reader *bufio.Reader
+	writer *respWriter
+	quit   bool
+	// kvStore is the keyspace the command being run reads and writes
+	kvStore store.Store
+}
+
+func (s *respServer) serveConn(conn net.Conn) {
+	c := &respConn{reader: bufio.NewReader(conn), writer: &respWriter{Writer: bufio.NewWriter(conn)}}
+	defer func() {
+		// a command that panics, as a store does when it can't persist a
+		// write, fails and ends its connection rather than the server
+		if r := recover(); r != nil {
+			log.Printf("resp: panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+			c.writer.error("ERR internal error")
+			c.writer.Flush()
+		}
+	}()
+	for !c.quit {
+		args, err := readRESPCommand(c.reader)
+		if errors.Is(err, errRESPProtocol) {
+			c.writer.error("ERR " + err.Error())
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("resp: reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.execute(c, args)
+		}
+		// replies to pipelined commands are sent together
+		if c.reader.Buffered() == 0 || c.quit {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRESPCommand reads a command, either as an array of bulk strings, as
+// clients send them, or inline, as typed into telnet. An empty command
+// reads as no arguments.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	prefix, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != '*' {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	// grown as arguments arrive, as the count is the client's to choose
+	var args []string
+	for range count {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errRESPProtocol, line[:min(len(line), 1)])
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxRESPBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if string(arg[length:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: expected CRLF after bulk string", errRESPProtocol)
+		}
+		args = append(args, string(arg[:length]))
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line, without its line ending.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := readLine(r, maxRESPInlineLength)
+	if errors.Is(err, errLineTooLong) {
+		return "", fmt.Errorf("%w: too big request", errRESPProtocol)
+	}
+	return line, err
+}
+
+// respWriter writes replies, in RESP3 once the client has asked for it.
+type respWriter struct {
+	*bufio.Writer
+	resp3 bool
+}
+
+func (w *respWriter) simple(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w *respWriter) error(message string) {
+	// a line break would end the reply early
+	fmt.Fprintf(w, "-%s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(message))
+}
+
+func (w *respWriter) integer(n int) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w *respWriter) bulk(s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *respWriter) null() {
+	if w.resp3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) array(n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+// dict starts a reply of n key-value pairs: a map in RESP3, or an array of
+// 2n elements in RESP2.
+func (w *respWriter) dict(n int) {
+	if w.resp3 {
+		fmt.Fprintf(w, "%%%d\r\n", n)
+		return
+	}
+	w.array(2 * n)
+}
+
+// value writes a stored value as a bulk string, or null if it wasn't found.
+func (w *respWriter) value(value any, found bool) {
+	if !found {
+		w.null()
+		return
+	}
+	// a key set to null reads as "null", so isn't mistaken for a missing one
+	w.bulk(respString(value))
+}
+
+// respString returns the string a stored value reads as over RESP.
+func respString(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// respCommand is a command the server supports. A negative arity is the
+// minimum number of arguments, counting the command name, as in Redis.
+type respCommand struct {
+	arity int
+	write bool
+	run   func(s *respServer, c *respConn, args []string)
+}
+
+// respCommands are the supported commands, by name.
+var respCommands = map[string]respCommand{
+	"PING":    {arity: -1, run: (*respServer).ping},
+	"ECHO":    {arity: 2, run: (*respServer).echo},
+	"HELLO":   {arity: -1, run: (*respServer).hello},
+	"SELECT":  {arity: 2, run: (*respServer).selectDB},
+	"CLIENT":  {arity: -2, run: (*respServer).client},
+	"COMMAND": {arity: -1, run: (*respServer).command},
+	"QUIT":    {arity: -1, run: (*respServer).quit},
+	"GET":     {arity: 2, run: (*respServer).get},
+	"SET":     {arity: -3, write: true, run: (*respServer).set},
+	"SETNX":   {arity: 3, write: true, run: (*respServer).setNX},
+	"DEL":     {arity: -2, write: true, run: (*respServer).del},
+	"EXISTS":  {arity: -2, run: (*respServer).exists},
+	"KEYS":    {arity: 2, run: (*respServer).keys},
+	"SCAN":    {arity: -2, run: (*respServer).scan},
+	"MGET":    {arity: -2, run: (*respServer).mget},
+	"MSET":    {arity: -3, write: true, run: (*respServer).mset},
+	"FLUSHDB": {arity: -1, write: true, run: (*respServer).flushDB},
+}
+
+// execute runs one command, writing its reply.
+func (s *respServer) execute(c *respConn, args []string) {
+	name := strings.ToUpper(args[0])
+	command, ok := respCommands[name]
+	if !ok {
+		c.writer.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (command.arity > 0 && len(args) != command.arity) || len(args) < -command.arity {
+		c.writer.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	kvStore, err := defaultKeyspace(s.kvStore)
+	if err != nil {
+		c.writer.error("ERR " + err.Error())
+		return
+	}
+	c.kvStore = kvStore
+	if command.write {
+		// a replica or Raft follower would forward an HTTP write to the
+		// leader, but a RESP client has to be pointed at it
+		if replicatedStore, ok := c.kvStore.(store.ReplicatedStore); ok && !replicatedStore.IsLeader() {
+			c.writer.error("READONLY You can't write against a read only replica.")
+			return
+		}
+	}
+	command.run(s, c, args)
+}
+
+func (s *respServer) ping(c *respConn, args []string) {
+	switch len(args) {
+	case 1:
+		c.writer.simple("PONG")
+	case 2:
+		c.writer.bulk(args[1])
+	default:
+		c.writer.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *respServer) echo(c *respConn, args []string) {
+	c.writer.bulk(args[1])
+}
+
+// hello switches protocol version and describes the server.
+func (s *respServer) hello(c *respConn, args []string) {
+	if len(args) > 1 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			c.writer.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if version != 2 && version != 3 {
+			c.writer.error("NOPROTO unsupported protocol version")
+			return
+		}
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "SETNAME":
+				if i+1 >= len(args) {
+					c.writer.error("ERR syntax error")
+					return
+				}
+				i++
+			case "AUTH":
+				c.writer.error("ERR AUTH called without any password configured")
+				return
+			default:
+				c.writer.error("ERR syntax error")
+				return
+			}
+		}
+		c.writer.resp3 = version == 3
+	}
+	protocol := 2
+	if c.writer.resp3 {
+		protocol = 3
+	}
+	c.writer.dict(6)
+	c.writer.bulk("server")
+	c.writer.bulk("kv_service")
+	// the Redis version whose commands are followed
+	c.writer.bulk("version")
+	c.writer.bulk("7.0.0")
+	c.writer.bulk("proto")
+	c.writer.integer(protocol)
+	c.writer.bulk("mode")
+	c.writer.bulk("standalone")
+	c.writer.bulk("role")
+	c.writer.bulk("master")
+	c.writer.bulk("modules")
+	c.writer.array(0)
+}
+
+// selectDB only accepts database 0, the default namespace.
+func (s *respServer) selectDB(c *respConn, args []string) {
+	if args[1] != "0" {
+		c.writer.error("ERR DB index is out of range")
+		return
+	}
+	c.writer.simple("OK")
+}
+
+// client accepts the CLIENT subcommands client libraries send on connecting.
+func (s *respServer) client(c *respConn, args []string) {
+	switch strings.ToUpper(args[1]) {
+	case "SETNAME", "SETINFO":
+		c.writer.simple("OK")
+	default:
+		c.writer.error(fmt.Sprintf("ERR unknown subcommand '%s'.", args[1]))
+	}
+}
+
+// command describes no commands, which clients such as redis-cli accept.
+func (s *respServer) command(c *respConn, args []string) {
+	c.writer.array(0)
+}
+
+func (s *respServer) quit(c *respConn, args []string) {
+	c.writer.simple("OK")
+	c.quit = true
+}
+
+func (s *respServer) get(c *respConn, args []string) {
+	c.writer.value(c.kvStore.Lookup(args[1]))
+}
+
+// set handles SET key value [NX | XX] [EX seconds | PX milliseconds].
+func (s *respServer) set(c *respConn, args []string) {
+	key, value := args[1], args[2]
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if ttl != 0 || i+1 >= len(args) {
+				c.writer.error("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				c.writer.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			c.writer.error("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		c.writer.error("ERR syntax error")
+		return
+	}
+
+	switch {
+	case nx || xx:
+		versionedStore, ok := c.kvStore.(store.VersionedStore)
+		if !ok {
+			c.writer.error("ERR Store does not support conditional writes.")
+			return
+		}
+		if _, ok := c.kvStore.(store.ExpiringVersionedStore); ttl != 0 && !ok {
+			c.writer.error("ERR Store does not support conditional writes with a TTL.")
+			return
+		}
+		if !setIf(versionedStore, key, value, ttl, xx) {
+			c.writer.null()
+			return
+		}
+	case ttl != 0:
+		expiringStore, ok := c.kvStore.(store.ExpiringStore)
+		if !ok {
+			c.writer.error("ERR Store does not support TTLs.")
+			return
+		}
+		expiringStore.SetWithTTL(key, value, ttl)
+	default:
+		c.kvStore.Set(key, value)
+	}
+	c.writer.simple("OK")
+}
+
+// setNX handles SETNX key value, the older form of SET key value NX that
+// some clients still send.
+func (s *respServer) setNX(c *respConn, args []string) {
+	versionedStore, ok := c.kvStore.(store.VersionedStore)
+	if !ok {
+		c.writer.error("ERR Store does not support conditional writes.")
+		return
+	}
+	if setIf(versionedStore, args[1], args[2], 0, false) {
+		c.writer.integer(1)
+		return
+	}
+	c.writer.integer(0)
+}
+
+// setIf sets key to value, expiring it after ttl unless ttl is zero, only
+// if it exists (exists is true) or only if it doesn't, reporting whether it
+// did. Setting a TTL needs an ExpiringVersionedStore.
+func setIf(versionedStore store.VersionedStore, key string, value any, ttl time.Duration, exists bool) bool {
+	for {
+		var version uint64
+		if exists {
+			if _, version = versionedStore.GetWithVersion(key); version == 0 {
+				return false
+			}
+		}
+		var err error
+		if ttl == 0 {
+			_, err = versionedStore.CompareAndSwap(key, version, value)
+		} else {
+			_, err = versionedStore.(store.ExpiringVersionedStore).CompareAndSwapWithTTL(key, version, value, ttl)
+		}
+		if err == nil {
+			return true
+		}
+		if !exists {
+			return false
+		}
+		// the key changed since it was read; try again unless it was deleted
+	}
+}
+
+func (s *respServer) del(c *respConn, args []string) {
+	deleted := 0
+	for _, key := range args[1:] {
+		if deleteKey(c.kvStore, key) {
+			deleted++
+		}
+	}
+	c.writer.integer(deleted)
+}
+
+// deleteKey deletes key, reporting whether it existed.
+func deleteKey(kvStore store.Store, key string) bool {
+	versionedStore, ok := kvStore.(store.VersionedStore)
+	if !ok {
+		_, existed := kvStore.Lookup(key)
+		kvStore.Delete(key)
+		return existed
+	}
+	for {
+		_, version := versionedStore.GetWithVersion(key)
+		if version == 0 {
+			return false
+		}
+		if versionedStore.CompareAndDelete(key, version) == nil {
+			return true
+		}
+	}
+}
+
+func (s *respServer) exists(c *respConn, args []string) {
+	count := 0
+	for _, key := range args[1:] {
+		if _, ok := c.kvStore.Lookup(key); ok {
+			count++
+		}
+	}
+	c.writer.integer(count)
+}
+
+func (s *respServer) keys(c *respConn, args []string) {
+	scannableStore, ok := c.kvStore.(store.ScannableStore)
+	if !ok {
+		c.writer.error("ERR Store does not support listing keys.")
+		return
+	}
+	pattern := args[1]
+	entries, _ := scannableStore.Scan(globPrefix(pattern), "", 0)
+	var keys []string
+	for _, entry := range entries {
+		if globMatch(pattern, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	c.writer.array(len(keys))
+	for _, key := range keys {
+		c.writer.bulk(key)
+	}
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. Keys are scanned
+// in order, so a key present for the whole scan is returned exactly once.
+func (s *respServer) scan(c *respConn, args []string) {
+	scannableStore, ok := c.kvStore.(store.ScannableStore)
+	if !ok {
+		c.writer.error("ERR Store does not support listing keys.")
+		return
+	}
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.writer.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultRESPScanCount
+	for i := 2; i < len(args); i++ {
+		if i+1 >= len(args) {
+			c.writer.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				c.writer.error("ERR value is out of range, must be positive")
+				return
+			}
+		default:
+			c.writer.error("ERR syntax error")
+			return
+		}
+		i++
+	}
+	startAfter := ""
+	if cursor != 0 {
+		if startAfter, ok = s.cursorKey(cursor); !ok {
+			c.writer.error("ERR invalid cursor")
+			return
+		}
+	}
+
+	entries, more := scannableStore.Scan(globPrefix(pattern), startAfter, count)
+	var keys []string
+	for _, entry := range entries {
+		if globMatch(pattern, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	next := uint64(0)
+	if more {
+		next = s.newCursor(entries[len(entries)-1].Key)
+	}
+	c.writer.array(2)
+	c.writer.bulk(strconv.FormatUint(next, 10))
+	c.writer.array(len(keys))
+	for _, key := range keys {
+		c.writer.bulk(key)
+	}
+}
+
+// newCursor returns a SCAN cursor continuing after key.
+func (s *respServer) newCursor(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextCursor++
+	s.cursors[s.nextCursor] = key
+	s.cursorOrder = append(s.cursorOrder, s.nextCursor)
+	if len(s.cursorOrder) > maxRESPCursors {
+		delete(s.cursors, s.cursorOrder[0])
+		s.cursorOrder = s.cursorOrder[1:]
+	}
+	return s.nextCursor
+}
+
+// cursorKey returns the key a SCAN cursor continues after.
+func (s *respServer) cursorKey(cursor uint64) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.cursors[cursor]
+	return key, ok
+}
+
+func (s *respServer) mget(c *respConn, args []string) {
+	keys := args[1:]
+	var values []any
+	var found []bool
+	if batchStore, ok := c.kvStore.(store.BatchStore); ok {
+		values, found = batchStore.MLookup(keys)
+	} else {
+		for _, key := range keys {
+			value, ok := c.kvStore.Lookup(key)
+			values, found = append(values, value), append(found, ok)
+		}
+	}
+	c.writer.array(len(values))
+	for i, value := range values {
+		c.writer.value(value, found[i])
+	}
+}
+
+func (s *respServer) mset(c *respConn, args []string) {
+	if len(args)%2 != 1 {
+		c.writer.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	batchStore, ok := c.kvStore.(store.BatchStore)
+	if !ok {
+		c.writer.error("ERR Store does not support batches.")
+		return
+	}
+	values := make(map[string]any, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		values[args[i]] = args[i+1] // a later value for the same key wins
+	}
+	batchStore.MSet(values)
+	c.writer.simple("OK")
+}
+
+// flushDB handles FLUSHDB [ASYNC | SYNC]; both flush synchronously.
+func (s *respServer) flushDB(c *respConn, args []string) {
+	if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "ASYNC") && !strings.EqualFold(args[1], "SYNC")) {
+		c.writer.error("ERR syntax error")
+		return
+	}
+	clearableStore, ok := c.kvStore.(store.ClearableStore)
+	if !ok {
+		c.writer.error("ERR Store does not support deleting keys in bulk.")
+		return
+	}
+	clearableStore.Flush()
+	c.writer.simple("OK")
+}
+
+// globPrefix returns the literal prefix of a glob pattern, which every key
+// it matches starts with.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch reports whether s matches a Redis glob pattern: * matches any
+// run of bytes, ? any single byte, [abc], [^abc] and [a-z] a byte in (or
+// not in) the set, and \ escapes the next byte.
+func globMatch(pattern, s string) bool {
+	// on a mismatch, backtrack to the last * and let it match one more byte
+	starPattern, starS := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starS = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, matched := globClass(pattern, p, s[i]); matched {
+					p = end
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starPattern < 0 {
+			return false
+		}
+		starS++
+		p, i = starPattern+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globClass matches b against the character class starting at pattern[start],
+// returning the index after the class and whether b is in it.
+func globClass(pattern string, start int, b byte) (int, bool) {
+	p := start + 1
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			matched = matched || pattern[p+1] == b
+			p += 2
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= b && b <= hi)
+			p += 3
+		default:
+			matched = matched || pattern[p] == b
+			p++
+		}
+	}
+	if p >= len(pattern) {
+		// an unclosed class matches nothing
+		return p, false
+	}
+	return p + 1, matched != negate
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type respTestSuite struct {
+	suite.Suite
+	kvStore store.NamespacedStore
+	server  *respServer
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func (s *respTestSuite) SetupTest() {
+	s.kvStore = store.NewNamespacedStore()
+	s.serve(s.kvStore)
+}
+
+func (s *respTestSuite) TearDownTest() {
+	s.conn.Close()
+	s.server.Close()
+	s.server = nil
+}
+
+// serve serves kvStore on a local port and connects to it.
+func (s *respTestSuite) serve(kvStore store.Store) {
+	if s.server != nil {
+		s.TearDownTest()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.server = newRESPServer(kvStore)
+	go s.server.Serve(listener)
+	s.conn, err = net.Dial("tcp", listener.Addr().String())
+	s.Require().NoError(err)
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	s.reader = bufio.NewReader(s.conn)
+}
+
+// do sends a command as an array of bulk strings and returns the raw reply.
+func (s *respTestSuite) do(args ...string) string {
+	s.send(args...)
+	return s.reply()
+}
+
+func (s *respTestSuite) send(args ...string) {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(s.conn, command.String())
+	s.Require().NoError(err)
+}
+
+// reply reads one whole reply, including the elements of an aggregate.
+func (s *respTestSuite) reply() string {
+	line, err := s.reader.ReadString('\n')
+	s.Require().NoError(err)
+	switch line[0] {
+	case '$':
+		length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if length < 0 {
+			return line
+		}
+		data := make([]byte, length+2)
+		_, err := io.ReadFull(s.reader, data)
+		s.Require().NoError(err)
+		return line + string(data)
+	case '*', '%':
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if line[0] == '%' {
+			count *= 2
+		}
+		for range count {
+			line += s.reply()
+		}
+	}
+	return line
+}
+
+func (s *respTestSuite) defaultKeyspace() store.Store {
+	keyspace, _ := s.kvStore.Namespace(store.DefaultNamespace)
+	return keyspace
+}
+
+func (s *respTestSuite) TestPing() {
+	assert.Equal(s.T(), "+PONG\r\n", s.do("PING"))
+	assert.Equal(s.T(), "$5\r\nhello\r\n", s.do("ping", "hello"))
+	assert.Equal(s.T(), "$5\r\nhello\r\n", s.do("ECHO", "hello"))
+}
+
+func (s *respTestSuite) TestInlineCommands() {
+	_, err := io.WriteString(s.conn, "SET key value\r\n\r\nGET key\n")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "+OK\r\n", s.reply())
+	assert.Equal(s.T(), "$5\r\nvalue\r\n", s.reply())
+}
+
+func (s *respTestSuite) TestPipelining() {
+	s.send("SET", "a", "1")
+	s.send("SET", "b", "2")
+	s.send("MGET", "a", "b")
+	assert.Equal(s.T(), "+OK\r\n", s.reply())
+	assert.Equal(s.T(), "+OK\r\n", s.reply())
+	assert.Equal(s.T(), "*2\r\n$1\r\n1\r\n$1\r\n2\r\n", s.reply())
+}
+
+func (s *respTestSuite) TestProtocolError() {
+	_, err := io.WriteString(s.conn, "*1\r\n+GET\r\n")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "-ERR Protocol error: expected '$', got '+'\r\n", s.reply())
+	_, err = s.reader.ReadString('\n')
+	assert.ErrorIs(s.T(), err, io.EOF)
+}
+
+func (s *respTestSuite) TestUnknownCommand() {
+	assert.Equal(s.T(), "-ERR unknown command 'RENAME'\r\n", s.do("RENAME", "a", "b"))
+	assert.Equal(s.T(), "-ERR wrong number of arguments for 'get' command\r\n", s.do("GET"))
+	assert.Equal(s.T(), "-ERR wrong number of arguments for 'get' command\r\n", s.do("GET", "a", "b"))
+}
+
+func (s *respTestSuite) TestGetAndSet() {
+	assert.Equal(s.T(), "$-1\r\n", s.do("GET", "key"))
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "value with spaces"))
+	assert.Equal(s.T(), "$17\r\nvalue with spaces\r\n", s.do("GET", "key"))
+	// the HTTP API sees the same keys
+	assert.Equal(s.T(), "value with spaces", s.defaultKeyspace().Get("key"))
+}
+
+func (s *respTestSuite) TestGet_NonStringValue() {
+	s.defaultKeyspace().Set("key", map[string]any{"nested": "data"})
+	assert.Equal(s.T(), "$17\r\n{\"nested\":\"data\"}\r\n", s.do("GET", "key"))
+}
+
+func (s *respTestSuite) TestGet_NullValue() {
+	// a key set to null is there, unlike a missing one
+	s.defaultKeyspace().Set("key", nil)
+	assert.Equal(s.T(), "$4\r\nnull\r\n", s.do("GET", "key"))
+	assert.Equal(s.T(), "*2\r\n$4\r\nnull\r\n$-1\r\n", s.do("MGET", "key", "missing"))
+	assert.Equal(s.T(), ":1\r\n", s.do("EXISTS", "key"))
+}
+
+func (s *respTestSuite) TestDroppedDefaultNamespace() {
+	s.do("SET", "key", "value")
+	s.Require().True(s.kvStore.DropNamespace(store.DefaultNamespace))
+
+	// the connection moves to the new default namespace the HTTP API uses
+	assert.Equal(s.T(), "$-1\r\n", s.do("GET", "key"))
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "new"))
+	assert.Equal(s.T(), "new", s.defaultKeyspace().Get("key"))
+}
+
+func (s *respTestSuite) TestSet_Expiry() {
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "value", "EX", "60"))
+	entries, _ := s.defaultKeyspace().(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "value", "px", "1"))
+	assert.Eventually(s.T(), func() bool { return s.defaultKeyspace().Get("key") == nil }, time.Second, time.Millisecond)
+
+	assert.Equal(s.T(), "-ERR invalid expire time in 'set' command\r\n", s.do("SET", "key", "value", "EX", "0"))
+	assert.Equal(s.T(), "-ERR syntax error\r\n", s.do("SET", "key", "value", "EX"))
+	assert.Equal(s.T(), "-ERR syntax error\r\n", s.do("SET", "key", "value", "EX", "1", "PX", "1"))
+}
+
+func (s *respTestSuite) TestSet_NXAndXX() {
+	assert.Equal(s.T(), "$-1\r\n", s.do("SET", "key", "one", "XX"))
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "one", "NX"))
+	assert.Equal(s.T(), "$-1\r\n", s.do("SET", "key", "two", "NX"))
+	assert.Equal(s.T(), "$3\r\none\r\n", s.do("GET", "key"))
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "two", "XX"))
+	assert.Equal(s.T(), "$3\r\ntwo\r\n", s.do("GET", "key"))
+
+	assert.Equal(s.T(), ":0\r\n", s.do("SETNX", "key", "three"))
+	assert.Equal(s.T(), ":1\r\n", s.do("SETNX", "other", "three"))
+
+	assert.Equal(s.T(), "-ERR syntax error\r\n", s.do("SET", "key", "three", "NX", "XX"))
+	assert.Equal(s.T(), "-ERR syntax error\r\n", s.do("SET", "key", "three", "KEEPTTL"))
+}
+
+func (s *respTestSuite) TestSet_NXWithExpiry() {
+	// the usual way to take a lock
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "lock", "owner", "NX", "PX", "50"))
+	assert.Equal(s.T(), "$-1\r\n", s.do("SET", "lock", "other", "NX", "PX", "50"))
+	assert.Eventually(s.T(), func() bool { return s.do("SET", "lock", "other", "NX", "PX", "50") == "+OK\r\n" }, time.Second, 5*time.Millisecond)
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "lock", "renewed", "XX", "EX", "60"))
+	assert.Equal(s.T(), "$7\r\nrenewed\r\n", s.do("GET", "lock"))
+}
+
+func (s *respTestSuite) TestDelAndExists() {
+	s.do("MSET", "a", "1", "b", "2")
+	assert.Equal(s.T(), ":3\r\n", s.do("EXISTS", "a", "b", "missing", "a"))
+	assert.Equal(s.T(), ":2\r\n", s.do("DEL", "a", "b", "missing"))
+	assert.Equal(s.T(), ":0\r\n", s.do("EXISTS", "a", "b"))
+}
+
+func (s *respTestSuite) TestMGetAndMSet() {
+	assert.Equal(s.T(), "+OK\r\n", s.do("MSET", "a", "1", "b", "2", "a", "3"))
+	assert.Equal(s.T(), "*3\r\n$1\r\n3\r\n$-1\r\n$1\r\n2\r\n", s.do("MGET", "a", "missing", "b"))
+	assert.Equal(s.T(), "-ERR wrong number of arguments for 'mset' command\r\n", s.do("MSET", "a", "1", "b"))
+}
+
+func (s *respTestSuite) TestKeys() {
+	s.do("MSET", "user:1", "a", "user:2", "b", "user:10", "c", "order:1", "d")
+	assert.Equal(s.T(), "*2\r\n$6\r\nuser:1\r\n$6\r\nuser:2\r\n", s.do("KEYS", "user:?"))
+	assert.Equal(s.T(), "*2\r\n$7\r\norder:1\r\n$6\r\nuser:1\r\n", s.do("KEYS", "*:1"))
+	assert.Equal(s.T(), "*0\r\n", s.do("KEYS", "nothing*"))
+}
+
+func (s *respTestSuite) TestScan() {
+	for i := range 25 {
+		s.defaultKeyspace().Set(fmt.Sprintf("key:%02d", i), "value")
+	}
+	s.defaultKeyspace().Set("other", "value")
+
+	var keys []string
+	cursor := "0"
+	for {
+		s.send("SCAN", cursor, "MATCH", "key:*", "COUNT", "10")
+		line, err := s.reader.ReadString('\n')
+		s.Require().NoError(err)
+		s.Require().Equal("*2\r\n", line)
+		s.reader.ReadString('\n')
+		cursor, _ = s.reader.ReadString('\n')
+		cursor = strings.TrimSpace(cursor)
+		count, _ := s.reader.ReadString('\n')
+		n, _ := strconv.Atoi(strings.TrimSpace(count[1:]))
+		for range n {
+			s.reader.ReadString('\n')
+			key, _ := s.reader.ReadString('\n')
+			keys = append(keys, strings.TrimSpace(key))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	s.Require().Len(keys, 25)
+	assert.Equal(s.T(), "key:00", keys[0])
+	assert.Equal(s.T(), "key:24", keys[24])
+
+	assert.Equal(s.T(), "-ERR invalid cursor\r\n", s.do("SCAN", "123456"))
+	assert.Equal(s.T(), "-ERR invalid cursor\r\n", s.do("SCAN", "abc"))
+	assert.Equal(s.T(), "-ERR value is out of range, must be positive\r\n", s.do("SCAN", "0", "COUNT", "0"))
+}
+
+func (s *respTestSuite) TestFlushDB() {
+	s.do("MSET", "a", "1", "b", "2")
+	assert.Equal(s.T(), "+OK\r\n", s.do("FLUSHDB", "ASYNC"))
+	assert.Equal(s.T(), ":0\r\n", s.do("EXISTS", "a", "b"))
+	assert.Equal(s.T(), "-ERR syntax error\r\n", s.do("FLUSHDB", "NOW"))
+}
+
+func (s *respTestSuite) TestHello() {
+	assert.Equal(s.T(), "$-1\r\n", s.do("GET", "missing"))
+	reply := s.do("HELLO", "3", "SETNAME", "tool")
+	assert.True(s.T(), strings.HasPrefix(reply, "%6\r\n$6\r\nserver\r\n$10\r\nkv_service\r\n"), reply)
+	assert.Contains(s.T(), reply, "$5\r\nproto\r\n:3\r\n")
+	// RESP3 has a null type of its own
+	assert.Equal(s.T(), "_\r\n", s.do("GET", "missing"))
+
+	assert.Equal(s.T(), "-NOPROTO unsupported protocol version\r\n", s.do("HELLO", "4"))
+	assert.True(s.T(), strings.HasPrefix(s.do("HELLO", "2"), "*12\r\n"))
+	assert.Equal(s.T(), "$-1\r\n", s.do("GET", "missing"))
+}
+
+func (s *respTestSuite) TestConnectionCommands() {
+	assert.Equal(s.T(), "+OK\r\n", s.do("SELECT", "0"))
+	assert.Equal(s.T(), "-ERR DB index is out of range\r\n", s.do("SELECT", "1"))
+	assert.Equal(s.T(), "+OK\r\n", s.do("CLIENT", "SETINFO", "lib-name", "redis-py"))
+	assert.Equal(s.T(), "*0\r\n", s.do("COMMAND", "DOCS"))
+	assert.Equal(s.T(), "+OK\r\n", s.do("QUIT"))
+	_, err := s.reader.ReadString('\n')
+	assert.ErrorIs(s.T(), err, io.EOF)
+}
+
+func (s *respTestSuite) TestUnsupportedStore() {
+	s.serve(basicStore{store.NewInMemoryStore()})
+
+	assert.Equal(s.T(), "+OK\r\n", s.do("SET", "key", "value"))
+	assert.Equal(s.T(), "*2\r\n$5\r\nvalue\r\n$-1\r\n", s.do("MGET", "key", "missing"))
+	assert.Equal(s.T(), ":1\r\n", s.do("DEL", "key", "missing"))
+	assert.Equal(s.T(), "-ERR Store does not support TTLs.\r\n", s.do("SET", "key", "value", "EX", "1"))
+	assert.Equal(s.T(), "-ERR Store does not support conditional writes.\r\n", s.do("SET", "key", "value", "NX"))
+	assert.Equal(s.T(), "-ERR Store does not support listing keys.\r\n", s.do("KEYS", "*"))
+	assert.Equal(s.T(), "-ERR Store does not support batches.\r\n", s.do("MSET", "a", "1"))
+	assert.Equal(s.T(), "-ERR Store does not support deleting keys in bulk.\r\n", s.do("FLUSHDB"))
+}
+
+func (s *respTestSuite) TestFollowerRejectsWrites() {
+	s.serve(replicaStore{Store: store.NewInMemoryStore(), leaderAddr: "http://leader:8080"})
+
+	assert.Equal(s.T(), "-READONLY You can't write against a read only replica.\r\n", s.do("SET", "key", "value"))
+	assert.Equal(s.T(), "-READONLY You can't write against a read only replica.\r\n", s.do("DEL", "key"))
+	assert.Equal(s.T(), "$-1\r\n", s.do("GET", "key"))
+}
+
+func (s *respTestSuite) TestRecoversFromPanics() {
+	// a store panics when it can't persist a write
+	mockStore := &mockStore{}
+	mockStore.On("Set", "key", "value").Run(func(mock.Arguments) { panic("disk full") })
+	s.serve(mockStore)
+
+	assert.Equal(s.T(), "-ERR internal error\r\n", s.do("SET", "key", "value"))
+	_, err := s.reader.ReadString('\n')
+	assert.ErrorIs(s.T(), err, io.EOF)
+
+	// and carries on serving other connections
+	conn, err := net.Dial("tcp", s.server.listener.Addr().String())
+	s.Require().NoError(err)
+	s.conn.Close()
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(s.T(), "+PONG\r\n", s.do("PING"))
+}
+
+func TestRESPTestSuite(t *testing.T) {
+	suite.Run(t, new(respTestSuite))
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:10", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"h[ello", "hello", false},
+	} {
+		assert.Equal(t, test.match, globMatch(test.pattern, test.s), "%q against %q", test.pattern, test.s)
+	}
+	assert.Equal(t, "user:", globPrefix("user:*"))
+	assert.Equal(t, "key", globPrefix("key"))
+	assert.Equal(t, "", globPrefix("[ab]*"))
+}
+
+func TestReadRESPCommand_LargeArrayHeader(t *testing.T) {
+	// a header alone doesn't have the server allocate for arguments never sent
+	request := fmt.Sprintf("*%d\r\n$4\r\nPING\r\n", maxRESPArgs)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readRESPCommand(bufio.NewReader(strings.NewReader(request)))
+	runtime.ReadMemStats(&after)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
@@ -1,45 +1,1475 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
+// keyNotFoundCode is the code of the error returned for a missing key, which
+// tells it apart from a 404 for a route that doesn't exist.
+const keyNotFoundCode = "key_not_found"
+
+// pathNotFoundCode is the code of the error returned when the part of a
+// key's value asked for doesn't exist.
+const pathNotFoundCode = "path_not_found"
+
+// fieldNotFoundCode is the code of the error returned for a missing field
+// of a hash.
+const fieldNotFoundCode = "field_not_found"
+
+// memberNotFoundCode is the code of the error returned for a missing member
+// of a sorted set.
+const memberNotFoundCode = "member_not_found"
+
+// namespaceNotFoundCode is the code of the error returned for reading from
+// a namespace that doesn't exist.
+const namespaceNotFoundCode = "namespace_not_found"
+
+// Content types of the patches a key's value can be changed with.
+const (
+	jsonPatchContentType  = "application/json-patch+json"
+	mergePatchContentType = "application/merge-patch+json"
+)
+
+// getKeyHandler handles retrieving a key's value, or with the path query
+// param, the part of it that JSON Pointer refers to. A missing key is a
+// 404, unless missingKeysAsNull is set, which returns a null value for it,
+// as the API did before keys set to null could be told apart from missing ones.
+func getKeyHandler(missingKeysAsNull bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kvStore := requestStore(c)
+		key := c.Param("key")
+		var value any
+		var found bool
+		if versionedStore, ok := kvStore.(store.VersionedStore); ok {
+			var version uint64
+			value, version = versionedStore.GetWithVersion(key)
+			if found = version != 0; found {
+				c.Header("ETag", formatETag(version))
+			}
+		} else {
+			value, found = kvStore.Lookup(key)
+		}
+		if !found && !missingKeysAsNull {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Key not found.", "code": keyNotFoundCode, "key": key})
+			return
+		}
+		if path, ok := c.GetQuery("path"); ok {
+			var err error
+			value, err = store.ResolvePointer(value, path)
+			if errors.Is(err, store.ErrInvalidPointer) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Path not found.", "code": pathNotFoundCode, "key": key, "path": path})
+				return
+			}
+		}
+		response := gin.H{"value": value}
+		if collection := store.CollectionType(value); collection != "" {
+			response["type"] = collection
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// setKeyHandler handles setting a key's value, optionally with a TTL or
+// conditioned on the key's current version. With a type, the value is the
+// elements of a collection of that type, as a read of one returns it.
+func setKeyHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	key := c.Param("key")
+	var request struct {
+		// raw, so a value of null is told apart from a missing one
+		Value      json.RawMessage `json:"value" binding:"required"`
+		Type       string          `json:"type"`
+		TTLSeconds *int64          `json:"ttl_seconds" binding:"omitempty,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var value any
+	if err := json.Unmarshal(request.Value, &value); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Type != "" {
+		if _, ok := collectionStore(c); !ok {
+			return
+		}
+		var err error
+		if value, err = store.DecodeCollection(request.Type, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	expectedVersion, conditional, err := preconditionVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case conditional:
+		versionedStore, ok := kvStore.(store.VersionedStore)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support conditional writes."})
+			return
+		}
+		var version uint64
+		if request.TTLSeconds != nil {
+			expiringStore, ok := kvStore.(store.ExpiringVersionedStore)
+			if !ok {
+				c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support TTLs."})
+				return
+			}
+			version, err = expiringStore.CompareAndSwapWithTTL(key, expectedVersion, value, time.Duration(*request.TTLSeconds)*time.Second)
+		} else {
+			version, err = versionedStore.CompareAndSwap(key, expectedVersion, value)
+		}
+		switch {
+		case errors.Is(err, store.ErrVersionMismatch):
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("ETag", formatETag(version))
+	case request.TTLSeconds != nil:
+		expiringStore, ok := kvStore.(store.ExpiringStore)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support TTLs."})
+			return
+		}
+		expiringStore.SetWithTTL(key, value, time.Duration(*request.TTLSeconds)*time.Second)
+	default:
+		kvStore.Set(key, value)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Key set."})
+}
+
+// deleteKeyHandler handles deleting a key, optionally conditioned on its
+// current version
+func deleteKeyHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	key := c.Param("key")
+	expectedVersion, conditional, err := preconditionVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !conditional {
+		kvStore.Delete(key)
+		c.JSON(http.StatusOK, gin.H{"message": "Key deleted."})
+		return
+	}
+	versionedStore, ok := kvStore.(store.VersionedStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support conditional writes."})
+		return
+	}
+	err = versionedStore.CompareAndDelete(key, expectedVersion)
+	switch {
+	case errors.Is(err, store.ErrVersionMismatch):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Key deleted."})
+}
+
+// patchKeyHandler handles changing part of a key's JSON value, with a JSON
+// Patch (RFC 6902) or a JSON Merge Patch (RFC 7396), told apart by the
+// Content-Type. The patch is applied atomically to the current value, and
+// the new value is returned.
+func patchKeyHandler(c *gin.Context) {
+	key := c.Param("key")
+	_, conditional, err := preconditionVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if conditional {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Patches cannot be conditional; use a JSON Patch test operation instead."})
+		return
+	}
+	documentStore, ok := requestStore(c).(store.DocumentStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support patches."})
+		return
+	}
+
+	var value any
+	var version uint64
+	switch c.ContentType() {
+	case jsonPatchContentType:
+		var patch []store.PatchOperation
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		value, version, err = documentStore.JSONPatch(key, patch)
+	case mergePatchContentType:
+		var patch any
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		value, version, err = documentStore.MergePatch(key, patch)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("Content-Type must be %s or %s.", jsonPatchContentType, mergePatchContentType)})
+		return
+	}
+	switch {
+	case errors.Is(err, store.ErrKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found.", "code": keyNotFoundCode, "key": key})
+		return
+	case errors.Is(err, store.ErrInvalidPatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, store.ErrPatchConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		// the patch was valid, but the store failed to apply it
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to patch key: %s", err)})
+		return
+	}
+	c.Header("ETag", formatETag(version))
+	c.JSON(http.StatusOK, gin.H{"value": value})
+}
+
+// incrKeyHandler handles atomically adding a delta, 1 unless the body gives
+// one, to a key's numeric value. An integer delta needs the value to be an
+// integer too; a fractional one, such as 0.5 or 1.0, adds to any number.
+func incrKeyHandler(c *gin.Context) {
+	key := c.Param("key")
+	var request struct {
+		Delta *json.Number `json:"delta"`
+	}
+	if c.Request.Body != nil {
+		// an empty body increments by 1
+		if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	counterStore, ok := requestStore(c).(store.CounterStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support counters."})
+		return
+	}
+
+	var value any
+	var err error
+	if request.Delta == nil {
+		value, err = counterStore.Incr(key)
+	} else if delta, intErr := request.Delta.Int64(); intErr == nil {
+		value, err = counterStore.IncrBy(key, delta)
+	} else if delta, floatErr := request.Delta.Float64(); floatErr == nil {
+		value, err = counterStore.IncrByFloat(key, delta)
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid delta %s", request.Delta)})
+		return
+	}
+	switch {
+	case errors.Is(err, store.ErrNotNumber) || errors.Is(err, store.ErrOutOfRange):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"value": value})
+}
+
+// collectionStore returns the request's store as a CollectionStore, or
+// responds that it doesn't support collections.
+func collectionStore(c *gin.Context) (store.CollectionStore, bool) {
+	collectionStore, ok := requestStore(c).(store.CollectionStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support collections."})
+	}
+	return collectionStore, ok
+}
+
+// collectionFailed responds to err from a collection operation, if any.
+func collectionFailed(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, store.ErrWrongType):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return true
+}
+
+// listPushHandler handles adding values to the back of a key's list, or
+// with front set, to its front, creating the list if the key isn't set.
+func listPushHandler(c *gin.Context) {
+	var request struct {
+		Values []any `json:"values" binding:"required,min=1"`
+		Front  bool  `json:"front"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	length, err := collectionStore.ListPush(c.Param("key"), request.Front, request.Values...)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"length": length})
+}
+
+// listPopHandler handles removing and returning up to count values, 1
+// unless the body gives a count, from the back or front of a key's list.
+func listPopHandler(c *gin.Context) {
+	request := struct {
+		Count int  `json:"count"`
+		Front bool `json:"front"`
+	}{Count: 1}
+	if c.Request.Body != nil {
+		// an empty body pops one value from the back
+		if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Count < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be at least 1"})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	values, err := collectionStore.ListPop(c.Param("key"), request.Front, request.Count)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"values": values})
+}
+
+// listRangeHandler handles reading a key's list from index start to stop,
+// inclusive, the whole list by default. Negative indexes count back from
+// the end, -1 being the last.
+func listRangeHandler(c *gin.Context) {
+	request := struct {
+		Start int `form:"start"`
+		Stop  int `form:"stop"`
+	}{Stop: -1}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	values, err := collectionStore.ListRange(c.Param("key"), request.Start, request.Stop)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"values": values})
+}
+
+// setAddHandler handles adding members to a key's set, creating the set if
+// the key isn't set.
+func setAddHandler(c *gin.Context) {
+	var request struct {
+		Members []string `json:"members" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	added, err := collectionStore.SetAdd(c.Param("key"), request.Members...)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// setRemoveHandler handles removing members from a key's set.
+func setRemoveHandler(c *gin.Context) {
+	var request struct {
+		Members []string `json:"members" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	removed, err := collectionStore.SetRemove(c.Param("key"), request.Members...)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// setMembersHandler handles reading a key's set, in lexicographic order.
+func setMembersHandler(c *gin.Context) {
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	members, err := collectionStore.SetMembers(c.Param("key"))
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// setIntersectHandler handles reading the members a key's set has in common
+// with the sets of each key given by the with query param.
+func setIntersectHandler(c *gin.Context) {
+	var request struct {
+		With []string `form:"with" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	members, err := collectionStore.SetIntersect(append([]string{c.Param("key")}, request.With...)...)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// hashGetAllHandler handles reading every field of a key's hash.
+func hashGetAllHandler(c *gin.Context) {
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	fields, err := collectionStore.HashGetAll(c.Param("key"))
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"fields": fields})
+}
+
+// hashGetHandler handles reading one field of a key's hash.
+func hashGetHandler(c *gin.Context) {
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	key, field := c.Param("key"), c.Param("field")
+	value, found, err := collectionStore.HashGet(key, field)
+	if collectionFailed(c, err) {
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Field not found.", "code": fieldNotFoundCode, "key": key, "field": field})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"value": value})
+}
+
+// hashSetHandler handles setting fields of a key's hash, creating the hash
+// if the key isn't set.
+func hashSetHandler(c *gin.Context) {
+	var request struct {
+		Fields map[string]any `json:"fields" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	added, err := collectionStore.HashSet(c.Param("key"), request.Fields)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// hashDeleteHandler handles deleting one field of a key's hash.
+func hashDeleteHandler(c *gin.Context) {
+	collectionStore, ok := collectionStore(c)
+	if !ok {
+		return
+	}
+	deleted, err := collectionStore.HashDelete(c.Param("key"), c.Param("field"))
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// sortedSetStore returns the request's store as a SortedSetStore, or
+// responds that it doesn't support sorted sets.
+func sortedSetStore(c *gin.Context) (store.SortedSetStore, bool) {
+	sortedSetStore, ok := requestStore(c).(store.SortedSetStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support sorted sets."})
+	}
+	return sortedSetStore, ok
+}
+
+// sortedSetAddHandler handles adding members with their scores to a key's
+// sorted set, updating the scores of those already in it.
+func sortedSetAddHandler(c *gin.Context) {
+	var request struct {
+		Members map[string]float64 `json:"members" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sortedSetStore, ok := sortedSetStore(c)
+	if !ok {
+		return
+	}
+	added, err := sortedSetStore.SortedSetAdd(c.Param("key"), request.Members)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// sortedSetRemoveHandler handles removing members from a key's sorted set.
+func sortedSetRemoveHandler(c *gin.Context) {
+	var request struct {
+		Members []string `json:"members" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sortedSetStore, ok := sortedSetStore(c)
+	if !ok {
+		return
+	}
+	removed, err := sortedSetStore.SortedSetRemove(c.Param("key"), request.Members...)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// sortedSetPopHandler handles removing and returning up to count members,
+// 1 unless the body gives a count, with the lowest scores of a key's sorted
+// set, or with max set, the highest.
+func sortedSetPopHandler(c *gin.Context) {
+	request := struct {
+		Count int  `json:"count"`
+		Max   bool `json:"max"`
+	}{Count: 1}
+	if c.Request.Body != nil {
+		// an empty body pops the member with the lowest score
+		if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Count < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be at least 1"})
+		return
+	}
+	sortedSetStore, ok := sortedSetStore(c)
+	if !ok {
+		return
+	}
+	members, err := sortedSetStore.SortedSetPop(c.Param("key"), request.Max, request.Count)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// sortedSetRangeHandler handles reading a key's sorted set from rank start
+// to stop, inclusive, the whole set by default, from the lowest score, or
+// with reverse, from the highest.
+func sortedSetRangeHandler(c *gin.Context) {
+	request := struct {
+		Start   int  `form:"start"`
+		Stop    int  `form:"stop"`
+		Reverse bool `form:"reverse"`
+	}{Stop: -1}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sortedSetStore, ok := sortedSetStore(c)
+	if !ok {
+		return
+	}
+	members, err := sortedSetStore.SortedSetRange(c.Param("key"), request.Start, request.Stop, request.Reverse)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// sortedSetRangeByScoreHandler handles reading the members of a key's
+// sorted set with scores from min to max, from the lowest, up to limit of
+// them if given.
+func sortedSetRangeByScoreHandler(c *gin.Context) {
+	var request struct {
+		Limit int `form:"limit" binding:"min=0"`
+	}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var scores store.ScoreRange
+	var err error
+	if scores.Min, scores.MinExclusive, err = parseScoreBound(c.DefaultQuery("min", "-inf")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if scores.Max, scores.MaxExclusive, err = parseScoreBound(c.DefaultQuery("max", "inf")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sortedSetStore, ok := sortedSetStore(c)
+	if !ok {
+		return
+	}
+	members, err := sortedSetStore.SortedSetRangeByScore(c.Param("key"), scores, request.Limit)
+	if collectionFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// parseScoreBound parses a score range's bound: a number, inf or -inf,
+// excluded from the range if it follows a "(".
+func parseScoreBound(bound string) (score float64, exclusive bool, err error) {
+	number, exclusive := strings.CutPrefix(bound, "(")
+	score, err = strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false, fmt.Errorf("invalid score bound %q: want a number, inf or -inf, optionally after a ( to exclude it", bound)
+	}
+	return score, exclusive, nil
+}
+
+// sortedSetMemberHandler handles reading a member's score and rank in a
+// key's sorted set, counting from the lowest score, or with reverse, from
+// the highest.
+func sortedSetMemberHandler(c *gin.Context) {
+	var request struct {
+		Reverse bool `form:"reverse"`
+	}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sortedSetStore, ok := sortedSetStore(c)
+	if !ok {
+		return
+	}
+	key, member := c.Param("key"), c.Param("member")
+	score, rank, found, err := sortedSetStore.SortedSetMember(key, member, request.Reverse)
+	if collectionFailed(c, err) {
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found.", "code": memberNotFoundCode, "key": key, "member": member})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"score": score, "rank": rank})
+}
+
+// defaultListLimit is the page size used when a list request sets no limit.
+const defaultListLimit = 100
+
+// listKeysHandler handles listing keys in lexicographic order, a page at a time
+func listKeysHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	var request struct {
+		Prefix string `form:"prefix"`
+		Cursor string `form:"cursor"`
+		Limit  *int   `form:"limit" binding:"omitempty,min=1,max=1000"`
+		Values bool   `form:"values"`
+	}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit := defaultListLimit
+	if request.Limit != nil {
+		limit = *request.Limit
+	}
+	startAfter, err := decodeCursor(request.Cursor)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	scannableStore, ok := kvStore.(store.ScannableStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support listing keys."})
+		return
+	}
+
+	entries, more := scannableStore.Scan(request.Prefix, startAfter, limit)
+	keys := make([]gin.H, 0, len(entries))
+	for _, entry := range entries {
+		key := gin.H{"key": entry.Key}
+		if request.Values {
+			key["value"] = entry.Value
+		}
+		keys = append(keys, key)
+	}
+	response := gin.H{"keys": keys}
+	if more {
+		response["next_cursor"] = encodeCursor(entries[len(entries)-1].Key)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// deleteKeysHandler handles deleting every key, or every key with a prefix.
+// Requires confirm=true so a stray request can't wipe the store.
+func deleteKeysHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	var request struct {
+		Prefix  string `form:"prefix"`
+		Confirm bool   `form:"confirm"`
+	}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !request.Confirm {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Deleting keys in bulk requires confirm=true."})
+		return
+	}
+	clearableStore, ok := kvStore.(store.ClearableStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support deleting keys in bulk."})
+		return
+	}
+
+	var deleted int
+	if request.Prefix == "" {
+		deleted = clearableStore.Flush()
+	} else {
+		deleted = clearableStore.DeletePrefix(request.Prefix)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Keys deleted.", "deleted": deleted})
+}
+
+// batchOp is one operation in a batch request.
+type batchOp struct {
+	Op  string `json:"op" binding:"required,oneof=get set delete"`
+	Key string `json:"key" binding:"required"`
+	// raw, so a value of null is told apart from a missing one
+	Value json.RawMessage `json:"value" binding:"required_if=Op set"`
+}
+
+// batchHandler handles applying a list of get, set and delete operations in
+// order. Consecutive operations of the same kind are applied together, as a
+// single atomic store call.
+func batchHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	var request struct {
+		Ops []batchOp `json:"ops" binding:"required,min=1,max=1000,dive"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	values := make([]any, len(request.Ops))
+	for i, op := range request.Ops {
+		if op.Op != "set" {
+			continue
+		}
+		if err := json.Unmarshal(op.Value, &values[i]); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	batchStore, ok := kvStore.(store.BatchStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support batches."})
+		return
+	}
+
+	results := make([]gin.H, 0, len(request.Ops))
+	for start := 0; start < len(request.Ops); {
+		end := start + 1
+		for end < len(request.Ops) && request.Ops[end].Op == request.Ops[start].Op {
+			end++
+		}
+		run := request.Ops[start:end]
+		keys := make([]string, len(run))
+		for i, op := range run {
+			keys[i] = op.Key
+		}
+
+		switch run[0].Op {
+		case "get":
+			values, found := batchStore.MLookup(keys)
+			for i, value := range values {
+				results = append(results, gin.H{"op": "get", "key": keys[i], "value": value, "found": found[i]})
+			}
+		case "set":
+			updates := make(map[string]any, len(run))
+			for i, op := range run {
+				updates[op.Key] = values[start+i] // a later set of the same key wins
+			}
+			batchStore.MSet(updates)
+			for _, key := range keys {
+				results = append(results, gin.H{"op": "set", "key": key})
+			}
+		case "delete":
+			batchStore.MDelete(keys)
+			for _, key := range keys {
+				results = append(results, gin.H{"op": "delete", "key": key})
+			}
+		}
+		start = end
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// txnHandler handles committing a multi-key transaction. The commit is
+// rejected with a report of the conflicting keys if any key in the read set
+// has changed version.
+func txnHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	var request struct {
+		Reads []struct {
+			Key     string  `json:"key" binding:"required"`
+			Version *uint64 `json:"version" binding:"required"`
+		} `json:"reads" binding:"dive"`
+		Writes []struct {
+			Key string `json:"key" binding:"required"`
+			// raw, so a value of null is told apart from a missing one
+			Value  json.RawMessage `json:"value" binding:"required_without=Delete,excluded_with=Delete"`
+			Delete bool            `json:"delete"`
+		} `json:"writes" binding:"max=1000,dive"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	transactionalStore, ok := kvStore.(store.TransactionalStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support transactions."})
+		return
+	}
+
+	var txn store.Txn
+	for _, read := range request.Reads {
+		txn.Read(read.Key, *read.Version)
+	}
+	for _, write := range request.Writes {
+		var value any
+		if !write.Delete {
+			if err := json.Unmarshal(write.Value, &value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		txn.Writes = append(txn.Writes, store.TxnWrite{Key: write.Key, Value: value, Delete: write.Delete})
+	}
+	revision, err := transactionalStore.Commit(txn)
+	var conflictErr *store.ConflictError
+	if errors.As(err, &conflictErr) {
+		conflicts := make([]gin.H, len(conflictErr.Conflicts))
+		for i, conflict := range conflictErr.Conflicts {
+			conflicts[i] = gin.H{
+				"key":              conflict.Key,
+				"expected_version": conflict.ExpectedVersion,
+				"actual_version":   conflict.ActualVersion,
+			}
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "conflicts": conflicts})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transaction committed.", "revision": revision})
+}
+
+// snapshotHandler handles downloading a snapshot of the entire store,
+// streamed as it is written.
+func snapshotHandler(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		snapshotter, ok := kvStore.(store.Snapshotter)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support snapshots."})
+			return
+		}
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Disposition", `attachment; filename="kv-snapshot.bin"`)
+		if err := snapshotter.Snapshot(c.Writer); err != nil {
+			if !c.Writer.Written() {
+				c.Header("Content-Disposition", "")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			// too late to report an error status; the truncated snapshot
+			// has no footer, so it will not restore
+			_ = c.Error(err)
+		}
+	}
+}
+
+// restoreHandler handles replacing the entire store with an uploaded snapshot.
+func restoreHandler(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		snapshotter, ok := kvStore.(store.Snapshotter)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support snapshots."})
+			return
+		}
+		err := snapshotter.Restore(c.Request.Body)
+		if errors.Is(err, store.ErrInvalidSnapshot) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Store restored."})
+	}
+}
+
+// statsHandler handles reporting each namespace's usage of its memory
+// budget and how many keys it has evicted to stay within it.
+func statsHandler(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		spaces := map[string]store.Store{store.DefaultNamespace: kvStore}
+		if namespacedStore, ok := kvStore.(store.NamespacedStore); ok {
+			spaces = make(map[string]store.Store)
+			for _, name := range namespacedStore.Namespaces() {
+				space, err := namespacedStore.Namespace(name)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				spaces[name] = space
+			}
+		}
+
+		namespaces := make(map[string]gin.H, len(spaces))
+		for name, space := range spaces {
+			boundedStore, ok := space.(store.BoundedStore)
+			if !ok {
+				c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not report stats."})
+				return
+			}
+			stats := boundedStore.Stats()
+			namespaces[name] = gin.H{
+				"entries":       stats.Entries,
+				"bytes":         stats.Bytes,
+				"max_entries":   stats.MaxEntries,
+				"max_bytes":     stats.MaxBytes,
+				"evictions":     stats.Evictions,
+				"evicted_bytes": stats.EvictedBytes,
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"namespaces": namespaces})
+	}
+}
+
+// watchHeartbeatInterval is how often an idle watch stream sends a ping
+// event, which keeps proxies from timing it out and reports the current revision.
+var watchHeartbeatInterval = 15 * time.Second
+
+// watchHandler handles streaming changes to keys as Server-Sent Events. Each
+// event's id is its revision, so a client reconnecting with Last-Event-ID
+// resumes where it left off.
+func watchHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	var request struct {
+		Prefix       string  `form:"prefix"`
+		FromRevision *uint64 `form:"from_revision"`
+	}
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// events of a revision are numbered from 0, so a stream resumed part way
+	// through a batch or transaction skips the ones already delivered
+	var fromRevision uint64
+	skip := -1
+	if request.FromRevision != nil {
+		fromRevision = *request.FromRevision
+	} else if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		lastRevision, lastIndex, err := parseEventID(lastEventID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if lastIndex < 0 {
+			fromRevision = lastRevision + 1
+		} else {
+			fromRevision, skip = lastRevision, lastIndex
+		}
+	}
+	watchableStore, ok := kvStore.(store.WatchableStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support watching keys."})
+		return
+	}
+
+	events, err := watchableStore.Watch(c.Request.Context(), request.Prefix, fromRevision)
+	if errors.Is(err, store.ErrCompacted) {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream;charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeatInterval)
+	defer heartbeat.Stop()
+	var revision uint64
+	var index int
+	for {
+		select {
+		case event, ok := <-events:
+			// closed when the client disconnects or falls too far behind
+			if !ok {
+				return
+			}
+			if event.Revision == revision {
+				index++
+			} else {
+				revision, index = event.Revision, 0
+			}
+			if revision == fromRevision && index <= skip {
+				continue
+			}
+			data := gin.H{"key": event.Key, "revision": event.Revision}
+			addEventValue(data, event)
+			c.Render(-1, sse.Event{Id: formatEventID(revision, index), Event: string(event.Type), Data: data})
+		case <-heartbeat.C:
+			c.Render(-1, sse.Event{Event: "ping", Data: gin.H{"revision": watchableStore.Revision()}})
+		}
+		c.Writer.Flush()
+	}
+}
+
+// addEventValue adds what event changed its key to, to data: the value of a
+// set event, with its type if it is a collection, or the change an update
+// event made to a collection.
+func addEventValue(data gin.H, event store.Event) {
+	switch event.Type {
+	case store.EventSet:
+		data["value"] = event.Value
+		if collection := store.CollectionType(event.Value); collection != "" {
+			data["type"] = collection
+		}
+	case store.EventUpdate:
+		data["change"] = event.Change
+	}
+}
+
+// formatEventID returns the id of a watch event: its revision and its index
+// among the events of that revision, which a batch or transaction shares.
+func formatEventID(revision uint64, index int) string {
+	return fmt.Sprintf("%d.%d", revision, index)
+}
+
+// parseEventID returns the revision and index of a watch event id from
+// formatEventID. A bare revision, with an index of -1, stands for every
+// event of it.
+func parseEventID(id string) (revision uint64, index int, err error) {
+	revisionPart, indexPart, indexed := strings.Cut(id, ".")
+	revision, err = strconv.ParseUint(revisionPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+	}
+	if !indexed {
+		return revision, -1, nil
+	}
+	index, err = strconv.Atoi(indexPart)
+	if err != nil || index < 0 {
+		return 0, 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+	}
+	return revision, index, nil
+}
+
+// encodeCursor turns the last key of a page into an opaque continuation cursor.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor returns the key a cursor from encodeCursor continues after.
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return string(key), nil
+}
+
+// preconditionVersion reads the key version a write is conditioned on from
+// the If-Match ("<version>": the key must be at that version) or
+// If-None-Match (*: the key must not exist) request headers.
+func preconditionVersion(c *gin.Context) (version uint64, conditional bool, err error) {
+	ifMatch, ifNoneMatch := c.GetHeader("If-Match"), c.GetHeader("If-None-Match")
+	switch {
+	case ifMatch != "" && ifNoneMatch != "":
+		return 0, false, errors.New("If-Match and If-None-Match cannot be combined")
+	case ifMatch != "":
+		version, err := parseETag(ifMatch)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid If-Match header: %w", err)
+		}
+		return version, true, nil
+	case ifNoneMatch != "":
+		if strings.TrimSpace(ifNoneMatch) != "*" {
+			return 0, false, errors.New(`invalid If-None-Match header: only "*" is supported`)
+		}
+		return 0, true, nil
+	}
+	return 0, false, nil
+}
+
+// formatETag formats a key version as a strong entity tag.
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parseETag parses an entity tag produced by formatETag.
+func parseETag(tag string) (uint64, error) {
+	unquoted, err := strconv.Unquote(strings.TrimSpace(tag))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a quoted entity tag", tag)
+	}
+	version, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("%q is not a key version", tag)
+	}
+	return version, nil
+}
+
+// storeContextKey is the gin context key holding the store a request operates on.
+const storeContextKey = "kvStore"
+
+// keyspaceMiddleware picks the store a request operates on: the namespace
+// named in the path, or the default namespace for the un-namespaced routes.
+// Namespaces are created by the first write to them; reads and deletes of
+// one that doesn't exist get a 404 rather than creating it. Stores without
+// namespace support only serve the default namespace.
+func keyspaceMiddleware(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		namespace := c.Param("namespace")
+		namespacedStore, ok := kvStore.(store.NamespacedStore)
+		switch {
+		case ok && namespace != "":
+			var keyspace store.Store
+			var err error
+			found := true
+			if createsNamespace(c.Request) {
+				keyspace, err = namespacedStore.Namespace(namespace)
+			} else {
+				keyspace, found, err = namespacedStore.LookupNamespace(namespace)
+			}
+			switch {
+			case errors.Is(err, store.ErrInvalidNamespace):
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			case errors.Is(err, store.ErrTooManyNamespaces):
+				c.AbortWithStatusJSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+				return
+			case err != nil:
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !found {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Namespace not found.", "code": namespaceNotFoundCode, "namespace": namespace})
+				return
+			}
+			c.Set(storeContextKey, keyspace)
+		case ok:
+			keyspace, _ := namespacedStore.Namespace(store.DefaultNamespace)
+			c.Set(storeContextKey, keyspace)
+		case namespace == "" || namespace == store.DefaultNamespace:
+			c.Set(storeContextKey, kvStore)
+		default:
+			c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": "Store does not support namespaces."})
+			return
+		}
+		c.Next()
+	}
+}
+
+// createsNamespace reports whether request may write to its namespace, and
+// so creates it if it doesn't exist. WebSocket sessions can write, though
+// they open with a GET.
+func createsNamespace(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return websocket.IsWebSocketUpgrade(request)
+	default:
+		return true
+	}
+}
+
+// forwardedHeader marks a request one node has forwarded to another, which
+// the receiving node serves itself rather than forwarding it again.
+const forwardedHeader = "X-Kv-Forwarded"
+
+// leaderMiddleware forwards writes made to a follower of a replicated store
+// to the leader, so clients can send any request to any node. Reads are
+// served by whichever node receives them, unless they ask for
+// consistency=strong, which forwards them to the leader too, so they see
+// every write it has acknowledged. A leader that can, first confirms it
+// still leads, as one cut off from the rest may not have heard it was replaced.
+func leaderMiddleware(kvStore store.Store) gin.HandlerFunc {
+	replicatedStore, ok := kvStore.(store.ReplicatedStore)
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		read := method == http.MethodGet || method == http.MethodHead
+		consistency := c.Query("consistency")
+		if read && consistency != "" && consistency != "eventual" && consistency != "strong" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid consistency %q: want eventual or strong", consistency)})
+			return
+		}
+		if !ok || (read && consistency != "strong") || (replicatedStore.IsLeader() && (!read || verifyLeader(replicatedStore))) {
+			c.Next()
+			return
+		}
+		leaderAddr, known := replicatedStore.LeaderAddr()
+		if !known || c.GetHeader(forwardedHeader) != "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "No leader is available."})
+			return
+		}
+		forwardRequest(c, leaderAddr)
+	}
+}
+
+// verifyLeader reports whether replicatedStore, which believes it leads,
+// confirms it still does, if it is a store that can.
+func verifyLeader(replicatedStore store.ReplicatedStore) bool {
+	linearizableStore, ok := replicatedStore.(store.LinearizableStore)
+	return !ok || linearizableStore.VerifyLeader() == nil
+}
+
+// forwardRequest proxies the request to the node at addr, marking it as
+// forwarded, and aborts the local handler chain.
+func forwardRequest(c *gin.Context, addr string) {
+	defer c.Abort()
+	target, err := url.Parse(addr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			r.Out.Header.Set(forwardedHeader, "true")
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Forwarding to %s failed: %v", addr, err)})
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// requestStore returns the store chosen for the request by keyspaceMiddleware.
+func requestStore(c *gin.Context) store.Store {
+	return c.MustGet(storeContextKey).(store.Store)
+}
+
+// listNamespacesHandler handles listing namespaces
+func listNamespacesHandler(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		namespacedStore, ok := kvStore.(store.NamespacedStore)
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{"namespaces": []string{store.DefaultNamespace}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"namespaces": namespacedStore.Namespaces()})
+	}
+}
+
+// dropNamespaceHandler handles deleting a namespace and all of its keys.
+// Requires confirm=true, as with deleting keys in bulk.
+func dropNamespaceHandler(kvStore store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Confirm bool `form:"confirm"`
+		}
+		if err := c.ShouldBindQuery(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !request.Confirm {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Deleting a namespace requires confirm=true."})
+			return
+		}
+		namespacedStore, ok := kvStore.(store.NamespacedStore)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Store does not support namespaces."})
+			return
+		}
+		dropped, err := namespacedStore.DropNamespace(c.Param("namespace"))
+		if errors.Is(err, store.ErrInvalidNamespace) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !dropped {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Namespace not found."})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Namespace deleted."})
+	}
+}
+
+// registerKeyspaceRoutes registers the routes that operate on a single
+// keyspace under group.
+func registerKeyspaceRoutes(group *gin.RouterGroup, opts routerOptions) {
+	group.GET("/watch", watchHandler)
+	if opts.partitioner == nil {
+		// a partitioned node routes each HTTP request for a key to the node
+		// holding it, which it can't do for a WebSocket's requests, or for
+		// requests covering many keys, which may be held by many nodes
+		group.POST("/batch", batchHandler)
+		group.POST("/txn", txnHandler)
+		group.GET("/ws", websocketHandler)
+	}
+
+	keys := group.Group("/keys")
+	{
+		if opts.partitioner == nil {
+			keys.GET("", listKeysHandler)
+			keys.DELETE("", deleteKeysHandler)
+		}
+		keys.GET("/:key", getKeyHandler(opts.missingKeysAsNull))
+		keys.POST("/:key", setKeyHandler)
+		keys.DELETE("/:key", deleteKeyHandler)
+		keys.PATCH("/:key", patchKeyHandler)
+		keys.POST("/:key/incr", incrKeyHandler)
+
+		keys.GET("/:key/list", listRangeHandler)
+		keys.POST("/:key/list/push", listPushHandler)
+		keys.POST("/:key/list/pop", listPopHandler)
+		keys.GET("/:key/set", setMembersHandler)
+		keys.POST("/:key/set/add", setAddHandler)
+		keys.POST("/:key/set/remove", setRemoveHandler)
+		if opts.partitioner == nil {
+			// the other sets may be held by other nodes
+			keys.GET("/:key/set/intersect", setIntersectHandler)
+		}
+		keys.GET("/:key/hash", hashGetAllHandler)
+		keys.POST("/:key/hash", hashSetHandler)
+		keys.GET("/:key/hash/:field", hashGetHandler)
+		keys.DELETE("/:key/hash/:field", hashDeleteHandler)
+		keys.GET("/:key/zset", sortedSetRangeHandler)
+		keys.GET("/:key/zset/by-score", sortedSetRangeByScoreHandler)
+		keys.GET("/:key/zset/members/:member", sortedSetMemberHandler)
+		keys.POST("/:key/zset/add", sortedSetAddHandler)
+		keys.POST("/:key/zset/remove", sortedSetRemoveHandler)
+		keys.POST("/:key/zset/pop", sortedSetPopHandler)
+	}
+}
+
 func setupRouter(kvStore store.Store) *gin.Engine {
+	return newRouter(kvStore, routerOptions{})
+}
+
+// routerOptions are the parts of a node's setup, other than its store, that
+// the router serves.
+type routerOptions struct {
+	// partitioner, if set, routes each key to the node of a partitioned
+	// cluster that holds it
+	partitioner *partitioner
+	// follower, if set, keeps the store, a replica, up to date with its primary
+	follower *follower
+	// missingKeysAsNull makes reading a missing key return a null value
+	// rather than a 404
+	missingKeysAsNull bool
+}
+
+func newRouter(kvStore store.Store, opts routerOptions) *gin.Engine {
 	r := gin.Default()
 
-	v1 := r.Group("/api/v1")
+	// a partitioned cluster sends requests on to the node holding their
+	// key first, as only it knows whether the key's namespace exists
+	var keyspace []gin.HandlerFunc
+	if opts.partitioner != nil {
+		keyspace = append(keyspace, opts.partitioner.middleware())
+	}
+	keyspace = append(keyspace, keyspaceMiddleware(kvStore))
+
+	v1 := r.Group("/api/v1", leaderMiddleware(kvStore))
 	{
-		keys := v1.Group("/keys")
-		{
-			keys.GET("/:key", func(c *gin.Context) {
-				key := c.Param("key")
-				value := kvStore.Get(key)
-				c.JSON(http.StatusOK, gin.H{"value": value})
-			})
-
-			keys.POST("/:key", func(c *gin.Context) {
-				key := c.Param("key")
-				var request struct {
-					Value any `json:"value" binding:"required"`
-				}
-				if err := c.ShouldBindJSON(&request); err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-					return
-				}
-				kvStore.Set(key, request.Value)
-				c.JSON(http.StatusOK, gin.H{"message": "Key set."})
-			})
+		// the un-namespaced routes operate on the default namespace
+		registerKeyspaceRoutes(v1.Group("", keyspace...), opts)
+
+		v1.GET("/ns", listNamespacesHandler(kvStore))
+		v1.DELETE("/ns/:namespace", dropNamespaceHandler(kvStore))
+		registerKeyspaceRoutes(v1.Group("/ns/:namespace", keyspace...), opts)
 
-			keys.DELETE("/:key", func(c *gin.Context) {
-				key := c.Param("key")
-				kvStore.Delete(key)
-				c.JSON(http.StatusOK, gin.H{"message": "Key deleted."})
-			})
+		admin := v1.Group("/admin")
+		admin.GET("/snapshot", snapshotHandler(kvStore))
+		admin.POST("/restore", restoreHandler(kvStore))
+		admin.GET("/stats", statsHandler(kvStore))
+		admin.GET("/replication", replicationStatusHandler(kvStore, opts.follower))
+		admin.GET("/replication/stream", replicationStreamHandler(kvStore))
+		if opts.partitioner != nil {
+			admin.GET("/ring", opts.partitioner.ringHandler)
+			admin.PUT("/ring", opts.partitioner.setRingHandler)
 		}
 	}
+	// outside leaderMiddleware, which would forward it to the primary
+	r.POST("/api/v1/admin/replication/promote", promoteHandler(opts.follower))
 
 	return r
 }
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/awgraves/key-value-store/kv_service/store"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -21,6 +31,11 @@ func (m *mockStore) Get(key string) any {
 	return args.Get(0)
 }
 
+func (m *mockStore) Lookup(key string) (any, bool) {
+	args := m.Called(key)
+	return args.Get(0), args.Bool(1)
+}
+
 func (m *mockStore) Set(key string, value any) {
 	m.Called(key, value)
 }
@@ -29,6 +44,181 @@ func (m *mockStore) Delete(key string) {
 	m.Called(key)
 }
 
+func (m *mockStore) SetWithTTL(key string, value any, ttl time.Duration) {
+	m.Called(key, value, ttl)
+}
+
+func (m *mockStore) GetWithVersion(key string) (any, uint64) {
+	args := m.Called(key)
+	return args.Get(0), args.Get(1).(uint64)
+}
+
+func (m *mockStore) CompareAndSwap(key string, expectedVersion uint64, value any) (uint64, error) {
+	args := m.Called(key, expectedVersion, value)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *mockStore) CompareAndSwapWithTTL(key string, expectedVersion uint64, value any, ttl time.Duration) (uint64, error) {
+	args := m.Called(key, expectedVersion, value, ttl)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *mockStore) CompareAndDelete(key string, expectedVersion uint64) error {
+	args := m.Called(key, expectedVersion)
+	return args.Error(0)
+}
+
+func (m *mockStore) Scan(prefix, startAfter string, limit int) ([]store.Entry, bool) {
+	args := m.Called(prefix, startAfter, limit)
+	return args.Get(0).([]store.Entry), args.Bool(1)
+}
+
+func (m *mockStore) Flush() int {
+	args := m.Called()
+	return args.Int(0)
+}
+
+func (m *mockStore) DeletePrefix(prefix string) int {
+	args := m.Called(prefix)
+	return args.Int(0)
+}
+
+func (m *mockStore) MGet(keys []string) []any {
+	args := m.Called(keys)
+	return args.Get(0).([]any)
+}
+
+func (m *mockStore) MLookup(keys []string) ([]any, []bool) {
+	args := m.Called(keys)
+	return args.Get(0).([]any), args.Get(1).([]bool)
+}
+
+func (m *mockStore) MSet(values map[string]any) {
+	m.Called(values)
+}
+
+func (m *mockStore) MDelete(keys []string) {
+	m.Called(keys)
+}
+
+func (m *mockStore) Commit(txn store.Txn) (uint64, error) {
+	args := m.Called(txn)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *mockStore) Incr(key string) (int64, error) {
+	args := m.Called(key)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockStore) IncrBy(key string, delta int64) (int64, error) {
+	args := m.Called(key, delta)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockStore) IncrByFloat(key string, delta float64) (float64, error) {
+	args := m.Called(key, delta)
+	return args.Get(0).(float64), args.Error(1)
+}
+
+func (m *mockStore) JSONPatch(key string, patch []store.PatchOperation) (any, uint64, error) {
+	args := m.Called(key, patch)
+	return args.Get(0), args.Get(1).(uint64), args.Error(2)
+}
+
+func (m *mockStore) MergePatch(key string, patch any) (any, uint64, error) {
+	args := m.Called(key, patch)
+	return args.Get(0), args.Get(1).(uint64), args.Error(2)
+}
+
+func (m *mockStore) Watch(ctx context.Context, prefix string, fromRevision uint64) (<-chan store.Event, error) {
+	args := m.Called(ctx, prefix, fromRevision)
+	events, _ := args.Get(0).(chan store.Event)
+	return events, args.Error(1)
+}
+
+func (m *mockStore) Revision() uint64 {
+	args := m.Called()
+	return args.Get(0).(uint64)
+}
+
+func (m *mockStore) Snapshot(w io.Writer) error {
+	args := m.Called(w)
+	return args.Error(0)
+}
+
+func (m *mockStore) Restore(r io.Reader) error {
+	args := m.Called(r)
+	return args.Error(0)
+}
+
+func (m *mockStore) Stats() store.BoundedStats {
+	args := m.Called()
+	return args.Get(0).(store.BoundedStats)
+}
+
+type mockNamespacedStore struct {
+	mockStore
+}
+
+func (m *mockNamespacedStore) Namespace(name string) (store.Store, error) {
+	args := m.Called(name)
+	keyspace, _ := args.Get(0).(store.Store)
+	return keyspace, args.Error(1)
+}
+
+func (m *mockNamespacedStore) LookupNamespace(name string) (store.Store, bool, error) {
+	args := m.Called(name)
+	keyspace, _ := args.Get(0).(store.Store)
+	return keyspace, args.Bool(1), args.Error(2)
+}
+
+func (m *mockNamespacedStore) Namespaces() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+func (m *mockNamespacedStore) DropNamespace(name string) (bool, error) {
+	args := m.Called(name)
+	return args.Bool(0), args.Error(1)
+}
+
+// basicStore hides every optional capability of the wrapped store.
+type basicStore struct {
+	store.Store
+}
+
+// versionedOnlyStore hides every capability of the wrapped store but
+// versions, so its conditional writes can't set a TTL.
+type versionedOnlyStore struct {
+	store.VersionedStore
+}
+
+// replicaStore makes the wrapped store one node of a replicated store.
+type replicaStore struct {
+	store.Store
+	leader     bool
+	leaderAddr string
+}
+
+func (r replicaStore) IsLeader() bool {
+	return r.leader
+}
+
+func (r replicaStore) LeaderAddr() (string, bool) {
+	return r.leaderAddr, r.leaderAddr != ""
+}
+
+// deposedLeaderStore is a replicaStore that believes it leads, but finds it
+// doesn't when it checks.
+type deposedLeaderStore struct {
+	replicaStore
+}
+
+func (deposedLeaderStore) VerifyLeader() error {
+	return errors.New("node is not the leader")
+}
+
 type routerTestSuite struct {
 	suite.Suite
 	mockStore *mockStore
@@ -40,14 +230,86 @@ func (s *routerTestSuite) SetupTest() {
 	s.router = setupRouter(s.mockStore)
 }
 func (s *routerTestSuite) TestGetKey() {
-	call := s.mockStore.On("Get", "foo").Return("bar")
+	call := s.mockStore.On("GetWithVersion", "foo").Return("bar", uint64(3))
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":"bar"}`, resp.Body.String())
+	assert.Equal(s.T(), `"3"`, resp.Header().Get("ETag"))
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestGetKey_NotFound() {
+	call := s.mockStore.On("GetWithVersion", "foo").Return(nil, uint64(0))
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotFound, resp.Code)
+	assert.Equal(s.T(), `{"code":"key_not_found","error":"Key not found.","key":"foo"}`, resp.Body.String())
+	assert.Empty(s.T(), resp.Header().Get("ETag"))
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestGetKey_NullValue() {
+	call := s.mockStore.On("GetWithVersion", "foo").Return(nil, uint64(2))
 
 	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
 	resp := httptest.NewRecorder()
 	s.router.ServeHTTP(resp, req)
 
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":null}`, resp.Body.String())
+	assert.Equal(s.T(), `"2"`, resp.Header().Get("ETag"))
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestGetKey_MissingKeysAsNull() {
+	call := s.mockStore.On("GetWithVersion", "foo").Return(nil, uint64(0))
+	router := newRouter(s.mockStore, routerOptions{missingKeysAsNull: true})
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":null}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestGetKey_UnversionedStoreNotFound() {
+	call := s.mockStore.On("Lookup", "foo").Return(nil, false)
+	router := setupRouter(basicStore{s.mockStore})
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotFound, resp.Code)
+	assert.Contains(s.T(), resp.Body.String(), `"code":"key_not_found"`)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestGetKey_UnversionedStore() {
+	call := s.mockStore.On("Lookup", "foo").Return("bar", true)
+	router := setupRouter(basicStore{s.mockStore})
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
 	assert.Equal(s.T(), http.StatusOK, resp.Code)
 	assert.Equal(s.T(), `{"value":"bar"}`, resp.Body.String())
+	assert.Empty(s.T(), resp.Header().Get("ETag"))
 
 	call.Unset()
 }
@@ -65,6 +327,18 @@ func (s *routerTestSuite) TestSetKey() {
 
 	call.Unset()
 }
+func (s *routerTestSuite) TestSetKey_NullValue() {
+	call := s.mockStore.On("Set", "foo", nil).Return()
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":null}`))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	s.mockStore.AssertExpectations(s.T())
+
+	call.Unset()
+}
+
 func (s *routerTestSuite) TestSetKey_InvalidBody() {
 	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"invalid":"bar"}`))
 	resp := httptest.NewRecorder()
@@ -74,20 +348,1485 @@ func (s *routerTestSuite) TestSetKey_InvalidBody() {
 	s.Contains(resp.Body.String(), `"error"`)
 }
 
-func (s *routerTestSuite) TestDeleteKey() {
-	call := s.mockStore.On("Delete", "foo").Return()
-	req, _ := http.NewRequest("DELETE", "/api/v1/keys/foo", nil)
+func (s *routerTestSuite) TestSetKey_WithTTL() {
+	call := s.mockStore.On("SetWithTTL", "foo", "bar", 30*time.Second).Return()
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar","ttl_seconds":30}`))
 	resp := httptest.NewRecorder()
 	s.router.ServeHTTP(resp, req)
 
 	assert.Equal(s.T(), http.StatusOK, resp.Code)
-	assert.Equal(s.T(), `{"message":"Key deleted."}`, resp.Body.String())
+	assert.Equal(s.T(), `{"message":"Key set."}`, resp.Body.String())
 
-	s.mockStore.AssertCalled(s.T(), "Delete", "foo")
+	s.mockStore.AssertCalled(s.T(), "SetWithTTL", "foo", "bar", 30*time.Second)
+	s.mockStore.AssertNotCalled(s.T(), "Set", "foo", "bar")
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSetKey_InvalidTTL() {
+	for _, body := range []string{`{"value":"bar","ttl_seconds":0}`, `{"value":"bar","ttl_seconds":-5}`, `{"value":"bar","ttl_seconds":"soon"}`} {
+		req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, body)
+		s.Contains(resp.Body.String(), `"error"`)
+	}
+}
+
+func (s *routerTestSuite) TestSetKey_TTLUnsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar","ttl_seconds":30}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+	s.Contains(resp.Body.String(), `"error"`)
+}
+
+func (s *routerTestSuite) TestSetKey_IfMatch() {
+	call := s.mockStore.On("CompareAndSwap", "foo", uint64(3), "bar").Return(uint64(7), nil)
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"message":"Key set."}`, resp.Body.String())
+	assert.Equal(s.T(), `"7"`, resp.Header().Get("ETag"))
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSetKey_IfNoneMatch() {
+	call := s.mockStore.On("CompareAndSwap", "foo", uint64(0), "bar").Return(uint64(1), nil)
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	req.Header.Set("If-None-Match", "*")
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	s.mockStore.AssertCalled(s.T(), "CompareAndSwap", "foo", uint64(0), "bar")
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSetKey_IfMatchWithTTL() {
+	call := s.mockStore.On("CompareAndSwapWithTTL", "foo", uint64(3), "bar", 30*time.Second).Return(uint64(7), nil)
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar","ttl_seconds":30}`))
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `"7"`, resp.Header().Get("ETag"))
+	s.mockStore.AssertNotCalled(s.T(), "CompareAndSwap", mock.Anything, mock.Anything, mock.Anything)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSetKey_ConditionalTTLUnsupported() {
+	router := setupRouter(versionedOnlyStore{s.mockStore})
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar","ttl_seconds":30}`))
+	req.Header.Set("If-None-Match", "*")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+	assert.Equal(s.T(), `{"error":"Store does not support TTLs."}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestSetKey_PreconditionFailed() {
+	call := s.mockStore.On("CompareAndSwap", "foo", uint64(3), "bar").Return(uint64(0), store.ErrVersionMismatch)
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusPreconditionFailed, resp.Code)
+	s.Contains(resp.Body.String(), `"error"`)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSetKey_ConditionalStoreError() {
+	call := s.mockStore.On("CompareAndSwap", "foo", uint64(3), "bar").Return(uint64(0), errors.New("disk full"))
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusInternalServerError, resp.Code)
+	assert.Equal(s.T(), `{"error":"disk full"}`, resp.Body.String())
+	assert.Empty(s.T(), resp.Header().Get("ETag"))
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSetKey_InvalidPreconditions() {
+	for _, headers := range []map[string]string{
+		{"If-Match": "3"},
+		{"If-Match": `"0"`},
+		{"If-Match": `"abc"`},
+		{"If-None-Match": `"3"`},
+		{"If-Match": `"3"`, "If-None-Match": "*"},
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, headers)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "CompareAndSwap", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (s *routerTestSuite) TestSetKey_ConditionalUnsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+func (s *routerTestSuite) TestGetKey_Path() {
+	call := s.mockStore.On("GetWithVersion", "doc").Return(map[string]any{"a": map[string]any{"b": []any{"x", "y"}}}, uint64(4))
+
+	for path, expected := range map[string]string{
+		"/a/b/1": `{"value":"y"}`,
+		"/a":     `{"value":{"b":["x","y"]}}`,
+		"":       `{"value":{"a":{"b":["x","y"]}}}`,
+	} {
+		req, _ := http.NewRequest("GET", "/api/v1/keys/doc?path="+url.QueryEscape(path), nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		assert.Equal(s.T(), http.StatusOK, resp.Code, path)
+		assert.Equal(s.T(), expected, resp.Body.String(), path)
+		assert.Equal(s.T(), `"4"`, resp.Header().Get("ETag"), path)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/doc?path=/a/c", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusNotFound, resp.Code)
+	assert.Equal(s.T(), `{"code":"path_not_found","error":"Path not found.","key":"doc","path":"/a/c"}`, resp.Body.String())
+
+	req, _ = http.NewRequest("GET", "/api/v1/keys/doc?path=a", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusBadRequest, resp.Code)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestPatchKey_JSONPatch() {
+	patch := []store.PatchOperation{{Op: "add", Path: "/tags/-", Value: "new"}}
+	call := s.mockStore.On("JSONPatch", "doc", patch).Return(map[string]any{"tags": []any{"new"}}, uint64(7), nil)
+
+	req, _ := http.NewRequest("PATCH", "/api/v1/keys/doc", strings.NewReader(`[{"op":"add","path":"/tags/-","value":"new"}]`))
+	req.Header.Set("Content-Type", "application/json-patch+json")
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":{"tags":["new"]}}`, resp.Body.String())
+	assert.Equal(s.T(), `"7"`, resp.Header().Get("ETag"))
+	s.mockStore.AssertExpectations(s.T())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestPatchKey_MergePatch() {
+	call := s.mockStore.On("MergePatch", "doc", map[string]any{"a": nil, "b": float64(2)}).Return(map[string]any{"b": float64(2)}, uint64(3), nil)
+
+	req, _ := http.NewRequest("PATCH", "/api/v1/keys/doc", strings.NewReader(`{"a":null,"b":2}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":{"b":2}}`, resp.Body.String())
+	s.mockStore.AssertExpectations(s.T())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestPatchKey_Errors() {
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: %q", store.ErrKeyNotFound, "doc"), http.StatusNotFound},
+		{fmt.Errorf("operation 0: %w: unknown op", store.ErrInvalidPatch), http.StatusBadRequest},
+		{fmt.Errorf("operation 0: %w: test failed", store.ErrPatchConflict), http.StatusConflict},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	} {
+		call := s.mockStore.On("JSONPatch", "doc", mock.Anything).Return(nil, uint64(0), test.err)
+		req, _ := http.NewRequest("PATCH", "/api/v1/keys/doc", strings.NewReader(`[]`))
+		req.Header.Set("Content-Type", "application/json-patch+json")
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), test.code, resp.Code, test.err.Error())
+		call.Unset()
+	}
+}
+
+func (s *routerTestSuite) TestPatchKey_InvalidRequests() {
+	for _, test := range []struct {
+		contentType, body string
+		header            http.Header
+		code              int
+	}{
+		{"application/json", `{"a":1}`, nil, http.StatusUnsupportedMediaType},
+		{"application/json-patch+json", `{"op":"add"}`, nil, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op":"add","path":"/a"}]`, nil, http.StatusBadRequest},
+		{"application/merge-patch+json", `not json`, nil, http.StatusBadRequest},
+		{"application/merge-patch+json", `{"a":1}`, http.Header{"If-Match": {`"1"`}}, http.StatusBadRequest},
+		{"application/merge-patch+json", `{"a":1}`, http.Header{"If-Match": {"1"}}, http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest("PATCH", "/api/v1/keys/doc", strings.NewReader(test.body))
+		for name, values := range test.header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", test.contentType)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		assert.Equal(s.T(), test.code, resp.Code, test.body)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "JSONPatch", mock.Anything, mock.Anything)
+	s.mockStore.AssertNotCalled(s.T(), "MergePatch", mock.Anything, mock.Anything)
+}
+
+func (s *routerTestSuite) TestPatchKey_UnsupportedStore() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("PATCH", "/api/v1/keys/doc", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+	assert.Equal(s.T(), `{"error":"Store does not support patches."}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestPatchKey_InMemoryStore() {
+	router := setupRouter(store.NewNamespacedStore())
+	send := func(method, path, contentType, body string) (int, string) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code, resp.Body.String()
+	}
+
+	code, _ := send("POST", "/api/v1/ns/docs/keys/user", "application/json", `{"value":{"name":"alice","roles":["read"]}}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, body := send("PATCH", "/api/v1/ns/docs/keys/user", "application/json-patch+json",
+		`[{"op":"test","path":"/name","value":"alice"},{"op":"add","path":"/roles/-","value":"write"}]`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"value":{"name":"alice","roles":["read","write"]}}`, body)
+	code, body = send("PATCH", "/api/v1/ns/docs/keys/user", "application/merge-patch+json", `{"name":null,"active":true}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"value":{"active":true,"roles":["read","write"]}}`, body)
+	code, body = send("GET", "/api/v1/ns/docs/keys/user?path=/roles/1", "", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"value":"write"}`, body)
+
+	code, body = send("PATCH", "/api/v1/ns/docs/keys/user", "application/json-patch+json", `[{"op":"test","path":"/active","value":false}]`)
+	assert.Equal(s.T(), http.StatusConflict, code)
+	assert.Equal(s.T(), `{"error":"operation 0 (test \"/active\"): patch does not apply: test failed"}`, body)
+	code, _ = send("PATCH", "/api/v1/ns/docs/keys/missing", "application/json-patch+json", `[]`)
+	assert.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *routerTestSuite) TestIncrKey() {
+	call := s.mockStore.On("Incr", "hits").Return(int64(1), nil)
+	req, _ := http.NewRequest("POST", "/api/v1/keys/hits/incr", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":1}`, resp.Body.String())
+	s.mockStore.AssertExpectations(s.T())
 
 	call.Unset()
 }
 
+func (s *routerTestSuite) TestIncrKey_Delta() {
+	intCall := s.mockStore.On("IncrBy", "hits", int64(-5)).Return(int64(37), nil)
+	floatCall := s.mockStore.On("IncrByFloat", "rate", 1.0).Return(2.5, nil)
+
+	req, _ := http.NewRequest("POST", "/api/v1/keys/hits/incr", strings.NewReader(`{"delta":-5}`))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":37}`, resp.Body.String())
+
+	// a delta written with a fraction adds to any number
+	req, _ = http.NewRequest("POST", "/api/v1/keys/rate/incr", strings.NewReader(`{"delta":1.0}`))
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":2.5}`, resp.Body.String())
+	s.mockStore.AssertExpectations(s.T())
+
+	intCall.Unset()
+	floatCall.Unset()
+}
+
+func (s *routerTestSuite) TestIncrKey_NotANumber() {
+	call := s.mockStore.On("Incr", "name").Return(int64(0), &store.NotNumberError{Key: "name", Value: "alice", Integer: true})
+	req, _ := http.NewRequest("POST", "/api/v1/keys/name/incr", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusConflict, resp.Code)
+	assert.Equal(s.T(), `{"error":"\"name\" does not hold an integer"}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestIncrKey_StoreError() {
+	call := s.mockStore.On("Incr", "hits").Return(int64(0), errors.New("disk full"))
+	req, _ := http.NewRequest("POST", "/api/v1/keys/hits/incr", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusInternalServerError, resp.Code)
+	assert.Equal(s.T(), `{"error":"disk full"}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestIncrKey_InvalidDelta() {
+	for _, body := range []string{`{"delta":"many"}`, `{"delta":1e400}`, `not json`} {
+		req, _ := http.NewRequest("POST", "/api/v1/keys/hits/incr", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, body)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "IncrByFloat", mock.Anything, mock.Anything)
+}
+
+func (s *routerTestSuite) TestIncrKey_UnsupportedStore() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("POST", "/api/v1/keys/hits/incr", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+	assert.Equal(s.T(), `{"error":"Store does not support counters."}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestIncrKey_Concurrent() {
+	kvStore := store.NewInMemoryStore()
+	router := setupRouter(kvStore)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				req, _ := http.NewRequest("POST", "/api/v1/keys/hits/incr", strings.NewReader(`{"delta":2}`))
+				router.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(s.T(), float64(200), kvStore.Get("hits"))
+}
+
+// sendJSON serves a request with a JSON body, if any, with router.
+func sendJSON(router http.Handler, method, path, body string) (int, string) {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp.Code, resp.Body.String()
+}
+
+func (s *routerTestSuite) TestLists() {
+	router := setupRouter(store.NewNamespacedStore())
+	code, body := sendJSON(router, "POST", "/api/v1/keys/queue/list/push", `{"values":["a","b","c"]}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"length":3}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/queue/list/push", `{"values":[1,{"n":2}],"front":true}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"length":5}`, body)
+
+	code, body = sendJSON(router, "GET", "/api/v1/keys/queue/list", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"values":[{"n":2},1,"a","b","c"]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/queue/list?start=1&stop=-2", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"values":[1,"a","b"]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/queue", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"type":"list","value":[{"n":2},1,"a","b","c"]}`, body)
+
+	code, body = sendJSON(router, "POST", "/api/v1/keys/queue/list/pop", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"values":["c"]}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/queue/list/pop", `{"count":2,"front":true}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"values":[{"n":2},1]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/missing/list", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"values":[]}`, body)
+
+	for _, request := range []struct{ method, path, body string }{
+		{"POST", "/api/v1/keys/queue/list/push", `{"values":[]}`},
+		{"POST", "/api/v1/keys/queue/list/push", `not json`},
+		{"POST", "/api/v1/keys/queue/list/pop", `{"count":0}`},
+		{"GET", "/api/v1/keys/queue/list?start=first", ""},
+	} {
+		code, _ := sendJSON(router, request.method, request.path, request.body)
+		assert.Equal(s.T(), http.StatusBadRequest, code, request)
+	}
+}
+
+func (s *routerTestSuite) TestSets() {
+	router := setupRouter(store.NewNamespacedStore())
+	code, body := sendJSON(router, "POST", "/api/v1/keys/a/set/add", `{"members":["x","y","z","x"]}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"added":3}`, body)
+	sendJSON(router, "POST", "/api/v1/keys/b/set/add", `{"members":["y","z"]}`)
+	sendJSON(router, "POST", "/api/v1/keys/c/set/add", `{"members":["z"]}`)
+
+	code, body = sendJSON(router, "GET", "/api/v1/keys/a/set", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":["x","y","z"]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/a/set/intersect?with=b", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":["y","z"]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/a/set/intersect?with=b&with=c", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":["z"]}`, body)
+	code, _ = sendJSON(router, "GET", "/api/v1/keys/a/set/intersect", "")
+	assert.Equal(s.T(), http.StatusBadRequest, code)
+
+	code, body = sendJSON(router, "POST", "/api/v1/keys/a/set/remove", `{"members":["x","w"]}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"removed":1}`, body)
+	code, _ = sendJSON(router, "POST", "/api/v1/keys/a/set/remove", `{"members":[]}`)
+	assert.Equal(s.T(), http.StatusBadRequest, code)
+}
+
+func (s *routerTestSuite) TestHashes() {
+	router := setupRouter(store.NewNamespacedStore())
+	code, body := sendJSON(router, "POST", "/api/v1/keys/user/hash", `{"fields":{"name":"alice","age":30}}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"added":2}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/user/hash", `{"fields":{"age":31,"admin":true}}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"added":1}`, body)
+
+	code, body = sendJSON(router, "GET", "/api/v1/keys/user/hash", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"fields":{"admin":true,"age":31,"name":"alice"}}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/user/hash/age", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"value":31}`, body)
+
+	code, body = sendJSON(router, "DELETE", "/api/v1/keys/user/hash/age", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"deleted":1}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/user/hash/age", "")
+	assert.Equal(s.T(), http.StatusNotFound, code)
+	assert.Equal(s.T(), `{"code":"field_not_found","error":"Field not found.","field":"age","key":"user"}`, body)
+	code, _ = sendJSON(router, "POST", "/api/v1/keys/user/hash", `{"fields":{}}`)
+	assert.Equal(s.T(), http.StatusBadRequest, code)
+}
+
+func (s *routerTestSuite) TestSortedSets() {
+	router := setupRouter(store.NewNamespacedStore())
+	code, body := sendJSON(router, "POST", "/api/v1/keys/board/zset/add", `{"members":{"alice":10,"bob":20,"carol":30,"dave":40}}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"added":4}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/board/zset/add", `{"members":{"alice":50,"erin":5}}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"added":1}`, body)
+
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board/zset?stop=2&reverse=true", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":[{"member":"alice","score":50},{"member":"dave","score":40},{"member":"carol","score":30}]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board/zset/members/carol?reverse=true", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"rank":2,"score":30}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board/zset/members/mallory", "")
+	assert.Equal(s.T(), http.StatusNotFound, code)
+	assert.Equal(s.T(), `{"code":"member_not_found","error":"Member not found.","key":"board","member":"mallory"}`, body)
+
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board/zset/by-score?min=20&max=(40", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":[{"member":"bob","score":20},{"member":"carol","score":30}]}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board/zset/by-score?min=(5&limit=1", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":[{"member":"bob","score":20}]}`, body)
+
+	code, body = sendJSON(router, "POST", "/api/v1/keys/board/zset/pop", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":[{"member":"erin","score":5}]}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/board/zset/pop", `{"count":2,"max":true}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"members":[{"member":"alice","score":50},{"member":"dave","score":40}]}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/board/zset/remove", `{"members":["bob","mallory"]}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"removed":1}`, body)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"type":"zset","value":{"carol":30}}`, body)
+
+	for _, request := range []struct{ method, path, body string }{
+		{"POST", "/api/v1/keys/board/zset/add", `{"members":{}}`},
+		{"POST", "/api/v1/keys/board/zset/add", `{"members":{"alice":"high"}}`},
+		{"POST", "/api/v1/keys/board/zset/remove", `{"members":[]}`},
+		{"POST", "/api/v1/keys/board/zset/pop", `{"count":0}`},
+		{"GET", "/api/v1/keys/board/zset?start=first", ""},
+		{"GET", "/api/v1/keys/board/zset/by-score?min=low", ""},
+		{"GET", "/api/v1/keys/board/zset/by-score?max=nan", ""},
+		{"GET", "/api/v1/keys/board/zset/by-score?limit=-1", ""},
+	} {
+		code, _ := sendJSON(router, request.method, request.path, request.body)
+		assert.Equal(s.T(), http.StatusBadRequest, code, request)
+	}
+
+	sendJSON(router, "POST", "/api/v1/keys/name", `{"value":"alice"}`)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/name/zset", "")
+	assert.Equal(s.T(), http.StatusConflict, code)
+	assert.Equal(s.T(), `{"error":"\"name\" does not hold a sorted set"}`, body)
+}
+
+func (s *routerTestSuite) TestSortedSets_UnsupportedStore() {
+	router := setupRouter(basicStore{s.mockStore})
+	code, body := sendJSON(router, "GET", "/api/v1/keys/board/zset", "")
+	assert.Equal(s.T(), http.StatusNotImplemented, code)
+	assert.Equal(s.T(), `{"error":"Store does not support sorted sets."}`, body)
+}
+
+func (s *routerTestSuite) TestCollections_WrongType() {
+	router := setupRouter(store.NewNamespacedStore())
+	sendJSON(router, "POST", "/api/v1/keys/name", `{"value":"alice"}`)
+	for _, request := range []struct{ method, path, body string }{
+		{"POST", "/api/v1/keys/name/list/push", `{"values":[1]}`},
+		{"GET", "/api/v1/keys/name/list", ""},
+		{"POST", "/api/v1/keys/name/set/add", `{"members":["x"]}`},
+		{"GET", "/api/v1/keys/name/hash/field", ""},
+	} {
+		code, body := sendJSON(router, request.method, request.path, request.body)
+		assert.Equal(s.T(), http.StatusConflict, code, request)
+		assert.Contains(s.T(), body, `\"name\" does not hold a`, request)
+	}
+}
+
+func (s *routerTestSuite) TestCollections_Set() {
+	router := setupRouter(store.NewNamespacedStore())
+	code, _ := sendJSON(router, "POST", "/api/v1/keys/queue", `{"type":"list","value":["a","b"]}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, body := sendJSON(router, "POST", "/api/v1/keys/queue/list/push", `{"values":["c"]}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"length":3}`, body)
+
+	// without a type, a value shaped like a collection is a plain value
+	code, _ = sendJSON(router, "POST", "/api/v1/keys/plain", `{"value":{"$list":["a"]}}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/plain", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Equal(s.T(), `{"value":{"$list":["a"]}}`, body)
+	code, _ = sendJSON(router, "POST", "/api/v1/keys/plain/list/push", `{"values":["b"]}`)
+	assert.Equal(s.T(), http.StatusConflict, code)
+
+	code, _ = sendJSON(router, "POST", "/api/v1/keys/board", `{"type":"zset","value":{"alice":10,"bob":20}}`)
+	s.Require().Equal(http.StatusOK, code)
+	code, body = sendJSON(router, "GET", "/api/v1/keys/board/zset/members/bob", "")
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.Contains(s.T(), body, `"rank":1`)
+
+	for _, request := range []string{
+		`{"type":"list","value":[]}`,
+		`{"type":"set","value":["a",1]}`,
+		`{"type":"hash","value":["a"]}`,
+		`{"type":"zset","value":{"a":"high"}}`,
+		`{"type":"queue","value":["a"]}`,
+	} {
+		code, body := sendJSON(router, "POST", "/api/v1/keys/bad", request)
+		assert.Equal(s.T(), http.StatusBadRequest, code, request)
+		assert.Contains(s.T(), body, "invalid collection", request)
+	}
+}
+
+func (s *routerTestSuite) TestCollections_UnsupportedStore() {
+	router := setupRouter(basicStore{s.mockStore})
+	code, body := sendJSON(router, "GET", "/api/v1/keys/queue/list", "")
+	assert.Equal(s.T(), http.StatusNotImplemented, code)
+	assert.Equal(s.T(), `{"error":"Store does not support collections."}`, body)
+	code, body = sendJSON(router, "POST", "/api/v1/keys/queue", `{"type":"list","value":["a"]}`)
+	assert.Equal(s.T(), http.StatusNotImplemented, code)
+	assert.Equal(s.T(), `{"error":"Store does not support collections."}`, body)
+}
+
+func (s *routerTestSuite) TestDeleteKey() {
+	call := s.mockStore.On("Delete", "foo").Return()
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"message":"Key deleted."}`, resp.Body.String())
+
+	s.mockStore.AssertCalled(s.T(), "Delete", "foo")
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestDeleteKey_IfMatch() {
+	call := s.mockStore.On("CompareAndDelete", "foo", uint64(3)).Return(nil)
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys/foo", nil)
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"message":"Key deleted."}`, resp.Body.String())
+	s.mockStore.AssertNotCalled(s.T(), "Delete", "foo")
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestDeleteKey_PreconditionFailed() {
+	call := s.mockStore.On("CompareAndDelete", "foo", uint64(0)).Return(store.ErrVersionMismatch)
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys/foo", nil)
+	req.Header.Set("If-None-Match", "*")
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusPreconditionFailed, resp.Code)
+	s.Contains(resp.Body.String(), `"error"`)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestDeleteKey_ConditionalStoreError() {
+	call := s.mockStore.On("CompareAndDelete", "foo", uint64(3)).Return(errors.New("disk full"))
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys/foo", nil)
+	req.Header.Set("If-Match", `"3"`)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusInternalServerError, resp.Code)
+	assert.Equal(s.T(), `{"error":"disk full"}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestListKeys() {
+	call := s.mockStore.On("Scan", "", "", defaultListLimit).Return([]store.Entry{
+		{Key: "a", Value: "1", Version: 1},
+		{Key: "b", Value: "2", Version: 2},
+	}, false)
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"keys":[{"key":"a"},{"key":"b"}]}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestListKeys_Pagination() {
+	call := s.mockStore.On("Scan", "user/", "user/1", 2).Return([]store.Entry{
+		{Key: "user/2", Value: "b"},
+		{Key: "user/3", Value: map[string]any{"n": 3}},
+	}, true)
+
+	cursor := encodeCursor("user/1")
+	req, _ := http.NewRequest("GET", "/api/v1/keys?prefix=user/&limit=2&values=true&cursor="+cursor, nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.JSONEq(s.T(), `{
+		"keys": [{"key":"user/2","value":"b"},{"key":"user/3","value":{"n":3}}],
+		"next_cursor": "`+encodeCursor("user/3")+`"
+	}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestListKeys_Empty() {
+	call := s.mockStore.On("Scan", "none", "", defaultListLimit).Return([]store.Entry(nil), false)
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys?prefix=none", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"keys":[]}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestListKeys_InvalidQuery() {
+	for _, query := range []string{"limit=0", "limit=1001", "limit=ten", "cursor=!!"} {
+		req, _ := http.NewRequest("GET", "/api/v1/keys?"+query, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, query)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "Scan", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (s *routerTestSuite) TestListKeys_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("GET", "/api/v1/keys", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+func (s *routerTestSuite) TestDeleteKeys_Flush() {
+	call := s.mockStore.On("Flush").Return(3)
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys?confirm=true", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"deleted":3,"message":"Keys deleted."}`, resp.Body.String())
+	s.mockStore.AssertNotCalled(s.T(), "DeletePrefix", mock.Anything)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestDeleteKeys_Prefix() {
+	call := s.mockStore.On("DeletePrefix", "test/").Return(2)
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys?prefix=test/&confirm=true", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"deleted":2,"message":"Keys deleted."}`, resp.Body.String())
+	s.mockStore.AssertNotCalled(s.T(), "Flush")
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestDeleteKeys_RequiresConfirmation() {
+	for _, query := range []string{"", "?prefix=test/", "?confirm=false", "?confirm=yes-please"} {
+		req, _ := http.NewRequest("DELETE", "/api/v1/keys"+query, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, query)
+		s.Contains(resp.Body.String(), `"error"`)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "Flush")
+	s.mockStore.AssertNotCalled(s.T(), "DeletePrefix", mock.Anything)
+}
+
+func (s *routerTestSuite) TestDeleteKeys_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("DELETE", "/api/v1/keys?confirm=true", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+func (s *routerTestSuite) TestBatch() {
+	s.mockStore.On("MLookup", []string{"a", "b"}).Return([]any{"1", nil}, []bool{true, false})
+	s.mockStore.On("MSet", map[string]any{"a": "3", "c": float64(4), "d": nil}).Return()
+	s.mockStore.On("MDelete", []string{"b"}).Return()
+	s.mockStore.On("MLookup", []string{"a", "d"}).Return([]any{"3", nil}, []bool{true, true})
+
+	req, _ := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(`{"ops":[
+		{"op":"get","key":"a"},
+		{"op":"get","key":"b"},
+		{"op":"set","key":"a","value":"2"},
+		{"op":"set","key":"c","value":4},
+		{"op":"set","key":"a","value":"3"},
+		{"op":"set","key":"d","value":null},
+		{"op":"delete","key":"b"},
+		{"op":"get","key":"a"},
+		{"op":"get","key":"d"}
+	]}`))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.JSONEq(s.T(), `{"results":[
+		{"op":"get","key":"a","value":"1","found":true},
+		{"op":"get","key":"b","value":null,"found":false},
+		{"op":"set","key":"a"},
+		{"op":"set","key":"c"},
+		{"op":"set","key":"a"},
+		{"op":"set","key":"d"},
+		{"op":"delete","key":"b"},
+		{"op":"get","key":"a","value":"3","found":true},
+		{"op":"get","key":"d","value":null,"found":true}
+	]}`, resp.Body.String())
+	s.mockStore.AssertExpectations(s.T())
+}
+
+func (s *routerTestSuite) TestBatch_InvalidBody() {
+	for _, body := range []string{
+		`{}`,
+		`{"ops":[]}`,
+		`{"ops":[{"op":"incr","key":"a"}]}`,
+		`{"ops":[{"op":"get"}]}`,
+		`{"ops":[{"op":"set","key":"a"}]}`,
+		`{"ops":[{"op":"get","key":"a"},{"op":"set","key":"b"}]}`,
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, body)
+		s.Contains(resp.Body.String(), `"error"`)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "MLookup", mock.Anything)
+}
+
+func (s *routerTestSuite) TestBatch_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("POST", "/api/v1/batch", strings.NewReader(`{"ops":[{"op":"get","key":"a"}]}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+func (s *routerTestSuite) TestTxn() {
+	expected := store.Txn{
+		Reads: []store.TxnRead{{Key: "alice", Version: 3}, {Key: "bob", Version: 0}},
+		Writes: []store.TxnWrite{
+			{Key: "alice", Value: float64(70)},
+			{Key: "bob", Value: float64(30)},
+			{Key: "pending", Delete: true},
+			{Key: "carol", Value: nil},
+		},
+	}
+	call := s.mockStore.On("Commit", expected).Return(uint64(9), nil)
+
+	req, _ := http.NewRequest("POST", "/api/v1/txn", strings.NewReader(`{
+		"reads": [{"key":"alice","version":3},{"key":"bob","version":0}],
+		"writes": [{"key":"alice","value":70},{"key":"bob","value":30},{"key":"pending","delete":true},{"key":"carol","value":null}]
+	}`))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"message":"Transaction committed.","revision":9}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestTxn_Conflict() {
+	call := s.mockStore.On("Commit", mock.Anything).Return(uint64(0), &store.ConflictError{
+		Conflicts: []store.Conflict{{Key: "alice", ExpectedVersion: 3, ActualVersion: 5}},
+	})
+
+	req, _ := http.NewRequest("POST", "/api/v1/txn", strings.NewReader(`{
+		"reads": [{"key":"alice","version":3}],
+		"writes": [{"key":"alice","value":70}]
+	}`))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusConflict, resp.Code)
+	assert.JSONEq(s.T(), `{
+		"error": "transaction conflict on \"alice\"",
+		"conflicts": [{"key":"alice","expected_version":3,"actual_version":5}]
+	}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestTxn_InvalidBody() {
+	for _, body := range []string{
+		`{"reads":[{"key":"a"}]}`,
+		`{"reads":[{"version":1}]}`,
+		`{"writes":[{"key":"a"}]}`,
+		`{"writes":[{"key":"a","value":1,"delete":true}]}`,
+		`{"writes":[{"key":"a","value":null,"delete":true}]}`,
+		`{"writes":[{"value":1}]}`,
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/txn", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, body)
+	}
+	s.mockStore.AssertNotCalled(s.T(), "Commit", mock.Anything)
+}
+
+func (s *routerTestSuite) TestTxn_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("POST", "/api/v1/txn", strings.NewReader(`{"writes":[{"key":"a","value":1}]}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+// closedEvents returns a closed channel holding events, so a watch stream
+// sends them and then ends.
+func closedEvents(events ...store.Event) chan store.Event {
+	ch := make(chan store.Event, len(events))
+	for _, event := range events {
+		ch <- event
+	}
+	close(ch)
+	return ch
+}
+
+func (s *routerTestSuite) TestWatch() {
+	call := s.mockStore.On("Watch", mock.Anything, "user:", uint64(0)).Return(closedEvents(
+		store.Event{Type: store.EventSet, Key: "user:1", Value: "alice", Revision: 7},
+		store.Event{Type: store.EventDelete, Key: "user:1", Revision: 8},
+	), nil)
+
+	req, _ := http.NewRequest("GET", "/api/v1/watch?prefix=user:", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), "text/event-stream;charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(s.T(), "id:7.0\nevent:set\n"+`data:{"key":"user:1","revision":7,"value":"alice"}`+"\n\n"+
+		"id:8.0\nevent:delete\n"+`data:{"key":"user:1","revision":8}`+"\n\n", resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestWatch_Resume() {
+	call := s.mockStore.On("Watch", mock.Anything, "", uint64(5)).Return(closedEvents(), nil)
+
+	// from_revision names the first revision wanted
+	req, _ := http.NewRequest("GET", "/api/v1/watch?from_revision=5", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+
+	// Last-Event-ID names the last event seen, or a bare revision, all of it
+	req, _ = http.NewRequest("GET", "/api/v1/watch", nil)
+	req.Header.Set("Last-Event-ID", "4")
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+
+	s.mockStore.AssertNumberOfCalls(s.T(), "Watch", 2)
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestWatch_ResumeMidBatch() {
+	kvStore := store.NewInMemoryStore()
+	kvStore.MSet(map[string]any{"a": "1", "b": "2", "c": "3"})
+	server := httptest.NewServer(setupRouter(kvStore))
+	defer server.Close()
+
+	// watch returns the ids and keys of the first n events streamed
+	watch := func(lastEventID string, n int) (ids, keys []string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/watch", nil)
+		if lastEventID == "" {
+			req.URL.RawQuery = "from_revision=1"
+		} else {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		s.Require().NoError(err)
+		// disconnects after reading n events
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for len(keys) < n && scanner.Scan() {
+			if id, ok := strings.CutPrefix(scanner.Text(), "id:"); ok {
+				ids = append(ids, id)
+			}
+			if data, ok := strings.CutPrefix(scanner.Text(), "data:"); ok {
+				var event struct{ Key string }
+				s.Require().NoError(json.Unmarshal([]byte(data), &event))
+				keys = append(keys, event.Key)
+			}
+		}
+		return ids, keys
+	}
+
+	// the batch's events share a revision, but not an id
+	ids, keys := watch("", 2)
+	assert.Equal(s.T(), []string{"1.0", "1.1"}, ids)
+	resumedIDs, resumedKeys := watch(ids[1], 1)
+	assert.Equal(s.T(), []string{"1.2"}, resumedIDs)
+	assert.ElementsMatch(s.T(), []string{"a", "b", "c"}, append(keys, resumedKeys...))
+}
+
+func (s *routerTestSuite) TestWatch_Heartbeat() {
+	defer func(interval time.Duration) { watchHeartbeatInterval = interval }(watchHeartbeatInterval)
+	watchHeartbeatInterval = time.Millisecond
+	events := make(chan store.Event)
+	watchCall := s.mockStore.On("Watch", mock.Anything, "", uint64(0)).Return(events, nil)
+	revisionCall := s.mockStore.On("Revision").Return(uint64(12))
+	time.AfterFunc(50*time.Millisecond, func() { close(events) })
+
+	req, _ := http.NewRequest("GET", "/api/v1/watch", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Contains(s.T(), resp.Body.String(), "event:ping\n"+`data:{"revision":12}`+"\n\n")
+
+	watchCall.Unset()
+	revisionCall.Unset()
+}
+
+func (s *routerTestSuite) TestWatch_Compacted() {
+	call := s.mockStore.On("Watch", mock.Anything, "", uint64(1)).Return(nil, store.ErrCompacted)
+
+	req, _ := http.NewRequest("GET", "/api/v1/watch?from_revision=1", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusGone, resp.Code)
+	s.Contains(resp.Body.String(), `"error"`)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestWatch_InvalidQuery() {
+	for _, path := range []string{"/api/v1/watch?from_revision=-1", "/api/v1/watch?from_revision=abc"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, path)
+	}
+
+	for _, id := range []string{"abc", "4.", "4.-1", "4.x"} {
+		req, _ := http.NewRequest("GET", "/api/v1/watch", nil)
+		req.Header.Set("Last-Event-ID", id)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, id)
+	}
+
+	s.mockStore.AssertNotCalled(s.T(), "Watch", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (s *routerTestSuite) TestWatch_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("GET", "/api/v1/watch", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+func (s *routerTestSuite) TestSnapshot() {
+	call := s.mockStore.On("Snapshot", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(io.Writer).Write([]byte("snapshot bytes"))
+	}).Return(nil)
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/snapshot", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), "application/octet-stream", resp.Header().Get("Content-Type"))
+	assert.Equal(s.T(), "snapshot bytes", resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSnapshot_Error() {
+	call := s.mockStore.On("Snapshot", mock.Anything).Return(errors.New("unencodable value"))
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/snapshot", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusInternalServerError, resp.Code)
+	assert.Equal(s.T(), `{"error":"unencodable value"}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestRestore() {
+	call := s.mockStore.On("Restore", mock.Anything).Run(func(args mock.Arguments) {
+		body, _ := io.ReadAll(args.Get(0).(io.Reader))
+		assert.Equal(s.T(), "snapshot bytes", string(body))
+	}).Return(nil)
+
+	req, _ := http.NewRequest("POST", "/api/v1/admin/restore", strings.NewReader("snapshot bytes"))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"message":"Store restored."}`, resp.Body.String())
+	s.mockStore.AssertNumberOfCalls(s.T(), "Restore", 1)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestRestore_InvalidSnapshot() {
+	call := s.mockStore.On("Restore", mock.Anything).Return(fmt.Errorf("%w: checksum mismatch", store.ErrInvalidSnapshot))
+
+	req, _ := http.NewRequest("POST", "/api/v1/admin/restore", strings.NewReader("garbage"))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusBadRequest, resp.Code)
+	assert.Equal(s.T(), `{"error":"invalid snapshot: checksum mismatch"}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestSnapshot_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	for _, route := range [][2]string{{"GET", "/api/v1/admin/snapshot"}, {"POST", "/api/v1/admin/restore"}} {
+		req, _ := http.NewRequest(route[0], route[1], nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusNotImplemented, resp.Code, route[1])
+	}
+}
+
+func (s *routerTestSuite) TestStats() {
+	call := s.mockStore.On("Stats").Return(store.BoundedStats{Entries: 2, Bytes: 512, MaxEntries: 100, Evictions: 7, EvictedBytes: 1792})
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/stats", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.JSONEq(s.T(), `{"namespaces":{"default":{"entries":2,"bytes":512,"max_entries":100,"max_bytes":0,"evictions":7,"evicted_bytes":1792}}}`, resp.Body.String())
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestStats_Namespaces() {
+	namespaces := new(mockNamespacedStore)
+	teamA, defaultNamespace := new(mockStore), new(mockStore)
+	namespaces.On("Namespaces").Return([]string{"default", "team-a"})
+	namespaces.On("Namespace", "team-a").Return(teamA, nil)
+	namespaces.On("Namespace", store.DefaultNamespace).Return(defaultNamespace, nil)
+	teamA.On("Stats").Return(store.BoundedStats{Entries: 1, MaxBytes: 1024})
+	defaultNamespace.On("Stats").Return(store.BoundedStats{Entries: 3, MaxBytes: 1024, Evictions: 2})
+	router := setupRouter(namespaces)
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/stats", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.JSONEq(s.T(), `{"namespaces":{
+		"default":{"entries":3,"bytes":0,"max_entries":0,"max_bytes":1024,"evictions":2,"evicted_bytes":0},
+		"team-a":{"entries":1,"bytes":0,"max_entries":0,"max_bytes":1024,"evictions":0,"evicted_bytes":0}
+	}}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestStats_Unsupported() {
+	router := setupRouter(basicStore{s.mockStore})
+	req, _ := http.NewRequest("GET", "/api/v1/admin/stats", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+}
+
+func (s *routerTestSuite) TestLeader_ServesWrites() {
+	s.mockStore.On("Set", "foo", "bar").Return()
+	router := setupRouter(replicaStore{Store: basicStore{s.mockStore}, leader: true})
+
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	s.mockStore.AssertCalled(s.T(), "Set", "foo", "bar")
+}
+
+func (s *routerTestSuite) TestFollower_ForwardsWrites() {
+	leaderStore := new(mockStore)
+	leaderStore.On("Set", "foo", "bar").Return()
+	leaderStore.On("Delete", "foo").Return()
+	leader := httptest.NewServer(setupRouter(replicaStore{Store: basicStore{leaderStore}, leader: true}))
+	defer leader.Close()
+	// proxying needs a real connection, which a ResponseRecorder lacks
+	follower := httptest.NewServer(setupRouter(replicaStore{Store: basicStore{s.mockStore}, leaderAddr: leader.URL}))
+	defer follower.Close()
+
+	resp, err := http.Post(follower.URL+"/api/v1/keys/foo", "application/json", strings.NewReader(`{"value":"bar"}`))
+	s.Require().NoError(err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(s.T(), `{"message":"Key set."}`, string(body))
+
+	req, _ := http.NewRequest("DELETE", follower.URL+"/api/v1/keys/foo", nil)
+	resp, err = http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	leaderStore.AssertExpectations(s.T())
+	s.mockStore.AssertNotCalled(s.T(), "Set", mock.Anything, mock.Anything)
+	s.mockStore.AssertNotCalled(s.T(), "Delete", mock.Anything)
+}
+
+func (s *routerTestSuite) TestFollower_ServesReads() {
+	s.mockStore.On("Lookup", "foo").Return("bar", true)
+	router := setupRouter(replicaStore{Store: basicStore{s.mockStore}, leaderAddr: "http://leader.invalid"})
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":"bar"}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestFollower_NoLeader() {
+	router := setupRouter(replicaStore{Store: basicStore{s.mockStore}})
+
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(s.T(), `{"error":"No leader is available."}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestFollower_StrongReadNoLeader() {
+	router := setupRouter(replicaStore{Store: basicStore{s.mockStore}})
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo?consistency=strong", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusServiceUnavailable, resp.Code)
+	s.mockStore.AssertNotCalled(s.T(), "Lookup", mock.Anything)
+}
+
+func (s *routerTestSuite) TestLeader_ServesStrongReads() {
+	s.mockStore.On("Lookup", "foo").Return("bar", true)
+	router := setupRouter(replicaStore{Store: basicStore{s.mockStore}, leader: true})
+
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo?consistency=strong", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"value":"bar"}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestDeposedLeader_ForwardsStrongReads() {
+	leaderStore := new(mockStore)
+	leaderStore.On("Lookup", "foo").Return("new", true)
+	leader := httptest.NewServer(setupRouter(replicaStore{Store: basicStore{leaderStore}, leader: true}))
+	defer leader.Close()
+	deposed := httptest.NewServer(setupRouter(deposedLeaderStore{replicaStore{Store: basicStore{s.mockStore}, leader: true, leaderAddr: leader.URL}}))
+	defer deposed.Close()
+
+	// it has to confirm it still leads before serving a strong read
+	resp, err := http.Get(deposed.URL + "/api/v1/keys/foo?consistency=strong")
+	s.Require().NoError(err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(s.T(), `{"value":"new"}`, string(body))
+	s.mockStore.AssertNotCalled(s.T(), "Lookup", mock.Anything)
+}
+
+func (s *routerTestSuite) TestInvalidConsistency() {
+	req, _ := http.NewRequest("GET", "/api/v1/keys/foo?consistency=linearizable", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusBadRequest, resp.Code)
+	assert.Equal(s.T(), `{"error":"invalid consistency \"linearizable\": want eventual or strong"}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestFollower_DoesNotForwardTwice() {
+	// a node that was forwarded a write but has since lost the leadership
+	router := setupRouter(replicaStore{Store: basicStore{s.mockStore}, leaderAddr: "http://leader.invalid"})
+
+	req, _ := http.NewRequest("POST", "/api/v1/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	req.Header.Set(forwardedHeader, "true")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusServiceUnavailable, resp.Code)
+}
+
+func (s *routerTestSuite) TestFollower_LeaderUnreachable() {
+	leader := httptest.NewServer(http.NotFoundHandler())
+	leader.Close()
+	follower := httptest.NewServer(setupRouter(replicaStore{Store: basicStore{s.mockStore}, leaderAddr: leader.URL}))
+	defer follower.Close()
+
+	resp, err := http.Post(follower.URL+"/api/v1/keys/foo", "application/json", strings.NewReader(`{"value":"bar"}`))
+	s.Require().NoError(err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(s.T(), http.StatusBadGateway, resp.StatusCode)
+	s.Contains(string(body), `"error"`)
+}
+
+func (s *routerTestSuite) TestNamespacedRoutes() {
+	namespaces := new(mockNamespacedStore)
+	teamA, defaultNamespace := new(mockStore), new(mockStore)
+	namespaces.On("Namespace", "team-a").Return(teamA, nil)
+	namespaces.On("Namespace", store.DefaultNamespace).Return(defaultNamespace, nil)
+	namespaces.On("LookupNamespace", "team-a").Return(teamA, true, nil)
+	namespaces.On("LookupNamespace", store.DefaultNamespace).Return(defaultNamespace, true, nil)
+	teamA.On("GetWithVersion", "foo").Return("from team-a", uint64(1))
+	defaultNamespace.On("GetWithVersion", "foo").Return("from default", uint64(1))
+	teamA.On("Set", "foo", "bar").Return()
+	teamA.On("Scan", "", "", defaultListLimit).Return([]store.Entry{{Key: "foo"}}, false)
+	router := setupRouter(namespaces)
+
+	for path, expected := range map[string]string{
+		"/api/v1/ns/team-a/keys/foo":  `{"value":"from team-a"}`,
+		"/api/v1/ns/default/keys/foo": `{"value":"from default"}`,
+		"/api/v1/keys/foo":            `{"value":"from default"}`,
+		"/api/v1/ns/team-a/keys":      `{"keys":[{"key":"foo"}]}`,
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusOK, resp.Code, path)
+		assert.Equal(s.T(), expected, resp.Body.String(), path)
+	}
+
+	req, _ := http.NewRequest("POST", "/api/v1/ns/team-a/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	teamA.AssertCalled(s.T(), "Set", "foo", "bar")
+	defaultNamespace.AssertNotCalled(s.T(), "Set", mock.Anything, mock.Anything)
+}
+
+func (s *routerTestSuite) TestNamespacedRoutes_UnknownNamespace() {
+	namespaces := new(mockNamespacedStore)
+	teamB := new(mockStore)
+	namespaces.On("Namespace", store.DefaultNamespace).Return(new(mockStore), nil)
+	namespaces.On("LookupNamespace", "team-b").Return(nil, false, nil)
+	namespaces.On("Namespace", "team-b").Return(teamB, nil)
+	teamB.On("Set", "foo", "bar").Return()
+	router := setupRouter(namespaces)
+
+	// reading or deleting from a namespace that doesn't exist doesn't create it
+	for _, method := range []string{"GET", "DELETE"} {
+		for _, path := range []string{"/api/v1/ns/team-b/keys/foo", "/api/v1/ns/team-b/keys"} {
+			req, _ := http.NewRequest(method, path+"?confirm=true", nil)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			assert.Equal(s.T(), http.StatusNotFound, resp.Code, method+" "+path)
+			assert.Equal(s.T(), `{"code":"namespace_not_found","error":"Namespace not found.","namespace":"team-b"}`, resp.Body.String())
+		}
+	}
+	namespaces.AssertNotCalled(s.T(), "Namespace", "team-b")
+
+	// writing to it does
+	req, _ := http.NewRequest("POST", "/api/v1/ns/team-b/keys/foo", strings.NewReader(`{"value":"bar"}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	teamB.AssertCalled(s.T(), "Set", "foo", "bar")
+}
+
+func (s *routerTestSuite) TestNamespacedRoutes_InvalidNamespace() {
+	namespaces := new(mockNamespacedStore)
+	namespaces.On("Namespace", "bad.name").Return(nil, store.ErrInvalidNamespace)
+	namespaces.On("LookupNamespace", "bad.name").Return(nil, false, store.ErrInvalidNamespace)
+	router := setupRouter(namespaces)
+
+	for _, method := range []string{"GET", "POST"} {
+		req, _ := http.NewRequest(method, "/api/v1/ns/bad.name/keys/foo", strings.NewReader(`{"value":"bar"}`))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, resp.Code, method)
+		s.Contains(resp.Body.String(), `"error"`)
+	}
+}
+
+func (s *routerTestSuite) TestNamespacedRoutes_TooManyNamespaces() {
+	kvStore, err := store.NewNamespacedBoundedStore(store.BoundedOptions{MaxEntries: 10}, 1)
+	s.Require().NoError(err)
+	router := setupRouter(kvStore)
+
+	code, body := sendJSON(router, "POST", "/api/v1/ns/team-a/keys/foo", `{"value":"bar"}`)
+	assert.Equal(s.T(), http.StatusInsufficientStorage, code)
+	assert.Contains(s.T(), body, "too many namespaces")
+	code, _ = sendJSON(router, "POST", "/api/v1/keys/foo", `{"value":"bar"}`)
+	assert.Equal(s.T(), http.StatusOK, code)
+}
+
+func (s *routerTestSuite) TestNamespacedRoutes_Unsupported() {
+	// a store without namespaces only serves the default one
+	call := s.mockStore.On("GetWithVersion", "foo").Return("bar", uint64(1))
+
+	req, _ := http.NewRequest("GET", "/api/v1/ns/default/keys/foo", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+
+	req, _ = http.NewRequest("GET", "/api/v1/ns/team-a/keys/foo", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	assert.Equal(s.T(), http.StatusNotImplemented, resp.Code)
+
+	call.Unset()
+}
+
+func (s *routerTestSuite) TestListNamespaces() {
+	namespaces := new(mockNamespacedStore)
+	namespaces.On("Namespace", store.DefaultNamespace).Return(new(mockStore), nil)
+	namespaces.On("Namespaces").Return([]string{"default", "team-a"})
+	router := setupRouter(namespaces)
+
+	req, _ := http.NewRequest("GET", "/api/v1/ns", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Equal(s.T(), `{"namespaces":["default","team-a"]}`, resp.Body.String())
+}
+
+func (s *routerTestSuite) TestDropNamespace() {
+	namespaces := new(mockNamespacedStore)
+	namespaces.On("DropNamespace", "team-a").Return(true, nil)
+	namespaces.On("DropNamespace", "missing").Return(false, nil)
+	router := setupRouter(namespaces)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/v1/ns/team-a?confirm=true", http.StatusOK},
+		{"/api/v1/ns/missing?confirm=true", http.StatusNotFound},
+		{"/api/v1/ns/team-a", http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest("DELETE", tc.path, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(s.T(), tc.status, resp.Code, tc.path)
+	}
+	namespaces.AssertNumberOfCalls(s.T(), "DropNamespace", 2)
+}
+
 func TestRouterTestSuite(t *testing.T) {
 	suite.Run(t, new(routerTestSuite))
 }
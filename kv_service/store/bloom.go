@@ -0,0 +1,67 @@
+package store
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// bloomBitsPerKey sizes bloom filters for a false positive rate of about 1%.
+const bloomBitsPerKey = 10
+
+// bloomFilter is a Bloom filter over keys, which lets a lookup skip a table
+// that cannot hold the key it wants.
+type bloomFilter struct {
+	bits   []byte
+	hashes uint32 // number of bits set per key
+}
+
+func newBloomFilter(numKeys int) *bloomFilter {
+	numBits := max(numKeys*bloomBitsPerKey, 64)
+	// ln 2 * bits per key hashes minimises the false positive rate
+	hashes := uint32(max(1, min(30, bloomBitsPerKey*69/100)))
+	return &bloomFilter{bits: make([]byte, (numBits+7)/8), hashes: hashes}
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	numBits := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % numBits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain reports false only if key was never added.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	numBits := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % numBits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encode returns the filter's bits followed by its hash count.
+func (f *bloomFilter) encode() []byte {
+	return append(append([]byte(nil), f.bits...), byte(f.hashes))
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 2 {
+		return nil, errors.New("bloom filter too short")
+	}
+	return &bloomFilter{bits: data[:len(data)-1], hashes: uint32(data[len(data)-1])}, nil
+}
+
+// bloomHash derives the two hashes that are combined, as in Kirsch and
+// Mitzenmacher, into each of the filter's bit positions. The hash must be
+// stable, since filters are stored on disk.
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type bloomFilterTestSuite struct {
+	suite.Suite
+}
+
+func (s *bloomFilterTestSuite) TestNoFalseNegatives() {
+	filter := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		filter.add(fmt.Sprint("key", i))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(s.T(), filter.mayContain(fmt.Sprint("key", i)), i)
+	}
+}
+
+func (s *bloomFilterTestSuite) TestFalsePositiveRate() {
+	filter := newBloomFilter(10000)
+	for i := 0; i < 10000; i++ {
+		filter.add(fmt.Sprint("key", i))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprint("other", i)) {
+			falsePositives++
+		}
+	}
+	// ~1% at 10 bits per key
+	assert.Less(s.T(), falsePositives, 300)
+}
+
+func (s *bloomFilterTestSuite) TestEncodeRoundTrip() {
+	filter := newBloomFilter(10)
+	filter.add("a")
+	decoded, err := decodeBloomFilter(filter.encode())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), filter, decoded)
+	assert.True(s.T(), decoded.mayContain("a"))
+
+	_, err = decodeBloomFilter([]byte{1})
+	assert.Error(s.T(), err)
+}
+
+func TestBloomFilterTestSuite(t *testing.T) {
+	suite.Run(t, new(bloomFilterTestSuite))
+}
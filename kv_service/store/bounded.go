@@ -0,0 +1,220 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// BoundedStore is a Store that holds at most a budget of entries or bytes,
+// evicting keys chosen by its EvictionPolicy to stay within it.
+type BoundedStore interface {
+	Store
+	Stats() BoundedStats
+}
+
+// BoundedOptions configures a bounded store. At least one of MaxEntries and
+// MaxBytes must be set; zero means no limit.
+type BoundedOptions struct {
+	MaxEntries int
+	MaxBytes   int64 // estimated memory held by keys, values and bookkeeping; see sizeOfEntry
+	// NewPolicy creates the store's eviction policy. Defaults to NewLRUPolicy.
+	NewPolicy func() EvictionPolicy
+}
+
+// BoundedStats reports a bounded store's usage against its budget.
+type BoundedStats struct {
+	Entries      int
+	Bytes        int64
+	MaxEntries   int
+	MaxBytes     int64
+	Evictions    uint64
+	EvictedBytes uint64
+}
+
+// boundedStore is an in-memory store with a budget. Its commit path evicts
+// keys after every write that leaves it over budget.
+type boundedStore struct {
+	*inMemoryStore
+}
+
+// bound tracks a store's usage against its budget. Its counters are guarded
+// by the store's mu; policy calls are additionally serialised by policyMu,
+// since reads record accesses under the store's read lock.
+type bound struct {
+	opts         BoundedOptions
+	bytes        int64
+	evictions    uint64
+	evictedBytes uint64
+
+	policyMu sync.Mutex
+	policy   EvictionPolicy
+}
+
+// NewBoundedStore returns an in-memory store that evicts keys to stay within
+// opts' budget. Evictions are writes like any other: they take a revision
+// and are published to watchers. A single entry larger than MaxBytes is
+// evicted as soon as it is written.
+func NewBoundedStore(opts BoundedOptions) (*boundedStore, error) {
+	if opts.MaxEntries < 0 || opts.MaxBytes < 0 {
+		return nil, errors.New("bounded store: limits must not be negative")
+	}
+	if opts.MaxEntries == 0 && opts.MaxBytes == 0 {
+		return nil, errors.New("bounded store: MaxEntries or MaxBytes must be set")
+	}
+	if opts.NewPolicy == nil {
+		opts.NewPolicy = NewLRUPolicy
+	}
+	mem := NewInMemoryStore()
+	mem.bound = &bound{opts: opts, policy: opts.NewPolicy()}
+	return &boundedStore{inMemoryStore: mem}, nil
+}
+
+func (s *boundedStore) Stats() BoundedStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return BoundedStats{
+		Entries:      len(s.store),
+		Bytes:        s.bound.bytes,
+		MaxEntries:   s.bound.opts.MaxEntries,
+		MaxBytes:     s.bound.opts.MaxBytes,
+		Evictions:    s.bound.evictions,
+		EvictedBytes: s.bound.evictedBytes,
+	}
+}
+
+// over reports whether a store of entries keys exceeds the budget.
+func (b *bound) over(entries int) bool {
+	return (b.opts.MaxEntries > 0 && entries > b.opts.MaxEntries) ||
+		(b.opts.MaxBytes > 0 && b.bytes > b.opts.MaxBytes)
+}
+
+// stored accounts for key being set to value, replacing old if existed.
+func (b *bound) stored(key string, value any, old entry, existed bool) {
+	if existed {
+		b.bytes -= sizeOfEntry(key, old.value)
+	}
+	b.bytes += sizeOfEntry(key, value)
+	b.policyMu.Lock()
+	defer b.policyMu.Unlock()
+	b.policy.Add(key)
+}
+
+// resized accounts for key's value, a collection, having been changed in
+// place from before bytes, with the key, to after, or having been created
+// if before is zero.
+func (b *bound) resized(key string, before, after int64) {
+	b.bytes += after - before
+	b.policyMu.Lock()
+	defer b.policyMu.Unlock()
+	b.policy.Add(key)
+}
+
+// removed accounts for key and its value leaving the store. The policy has
+// already forgotten keys it evicted.
+func (b *bound) removed(key string, value any, evicted bool) {
+	size := sizeOfEntry(key, value)
+	b.bytes -= size
+	if evicted {
+		b.evictions++
+		b.evictedBytes += uint64(size)
+		return
+	}
+	b.policyMu.Lock()
+	defer b.policyMu.Unlock()
+	b.policy.Remove(key)
+}
+
+func (b *bound) accessed(key string) {
+	b.policyMu.Lock()
+	defer b.policyMu.Unlock()
+	b.policy.Access(key)
+}
+
+func (b *bound) victim() (string, bool) {
+	b.policyMu.Lock()
+	defer b.policyMu.Unlock()
+	return b.policy.Evict()
+}
+
+// evictOverBudget evicts keys until the store is within its budget.
+// Callers must hold mu.
+func (s *inMemoryStore) evictOverBudget() error {
+	for s.bound.over(len(s.store)) {
+		key, ok := s.bound.victim()
+		if !ok {
+			return nil
+		}
+		if _, present := s.store[key]; !present {
+			continue
+		}
+		if _, err := s.tryCommit(walRecord{Op: walOpEvict, Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch records a read of key, for eviction. Callers must hold mu, for
+// reading at least.
+func (s *inMemoryStore) touch(key string) {
+	if s.bound != nil {
+		s.bound.accessed(key)
+	}
+}
+
+// Approximate heap footprints, in bytes, on a 64-bit platform.
+const (
+	stringHeaderSize = 16
+	sliceHeaderSize  = 24
+	interfaceSize    = 16
+	mapHeaderSize    = 48
+	// mapSlotSize is a map[string]any slot (key and value headers, control
+	// byte), allowing for the table's load factor.
+	mapSlotSize = 40
+	// entryOverhead is what the store holds per key besides the key and
+	// value themselves: its map slot and entry, skip list node and eviction
+	// policy bookkeeping.
+	entryOverhead = 224
+)
+
+// sizeOfEntry estimates the memory held by key and value in a bounded store.
+func sizeOfEntry(key string, value any) int64 {
+	return entryOverhead + int64(len(key)) + sizeOf(value)
+}
+
+// sizeOf estimates the heap memory held by a value stored in an interface.
+// It follows the types encoding/json decodes into closely, short of
+// allocator rounding and spare map capacity; other types count only their
+// top-level size.
+func sizeOf(value any) int64 {
+	switch v := value.(type) {
+	case nil, bool:
+		// booleans are boxed into static storage
+		return 0
+	case float64:
+		return 8
+	case string:
+		return stringHeaderSize + int64(len(v))
+	case json.Number:
+		return stringHeaderSize + int64(len(v))
+	case []any:
+		size := int64(sliceHeaderSize + interfaceSize*cap(v))
+		for _, elem := range v {
+			size += sizeOf(elem)
+		}
+		return size
+	case map[string]any:
+		size := int64(mapHeaderSize)
+		for key, elem := range v {
+			size += mapSlotSize + int64(len(key)) + sizeOf(elem)
+		}
+		return size
+	case collection:
+		// kept up to date as the collection changes
+		return v.size()
+	default:
+		return int64(reflect.TypeOf(value).Size())
+	}
+}
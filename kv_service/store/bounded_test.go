@@ -0,0 +1,266 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type boundedStoreTestSuite struct {
+	suite.Suite
+}
+
+func (s *boundedStoreTestSuite) open(opts BoundedOptions) *boundedStore {
+	store, err := NewBoundedStore(opts)
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { store.Close() })
+	return store
+}
+
+// liveBytes sums the estimated size of every entry in store.
+func liveBytes(store *boundedStore) int64 {
+	var total int64
+	for key, e := range store.store {
+		total += sizeOfEntry(key, e.value)
+	}
+	return total
+}
+
+func (s *boundedStoreTestSuite) TestImplementsBoundedStore() {
+	store := s.open(BoundedOptions{MaxEntries: 1})
+	assert.Implements(s.T(), (*BoundedStore)(nil), store)
+	assert.Implements(s.T(), (*WatchableStore)(nil), store)
+	assert.NotImplements(s.T(), (*BoundedStore)(nil), NewInMemoryStore())
+}
+
+func (s *boundedStoreTestSuite) TestInvalidOptions() {
+	for _, opts := range []BoundedOptions{
+		{},
+		{MaxEntries: -1},
+		{MaxBytes: -1, MaxEntries: 10},
+	} {
+		_, err := NewBoundedStore(opts)
+		assert.Error(s.T(), err, "%+v", opts)
+	}
+}
+
+func (s *boundedStoreTestSuite) TestEntryBudget() {
+	store := s.open(BoundedOptions{MaxEntries: 3})
+	store.Set("a", 1)
+	store.Set("b", 2)
+	store.Set("c", 3)
+	store.Get("a") // now the most recently used
+	store.Set("d", 4)
+
+	assert.Nil(s.T(), store.Get("b"))
+	for _, key := range []string{"a", "c", "d"} {
+		assert.NotNil(s.T(), store.Get(key), key)
+	}
+	stats := store.Stats()
+	assert.Equal(s.T(), 3, stats.Entries)
+	assert.Equal(s.T(), 3, stats.MaxEntries)
+	assert.Equal(s.T(), uint64(1), stats.Evictions)
+	assert.Equal(s.T(), uint64(sizeOfEntry("b", 2)), stats.EvictedBytes)
+}
+
+func (s *boundedStoreTestSuite) TestByteBudget() {
+	value := strings.Repeat("x", 1000)
+	budget := 10 * sizeOfEntry("key-00", value)
+	store := s.open(BoundedOptions{MaxBytes: budget})
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key-%02d", i), value)
+	}
+
+	stats := store.Stats()
+	assert.Equal(s.T(), 10, stats.Entries)
+	assert.Equal(s.T(), budget, stats.Bytes)
+	assert.Equal(s.T(), uint64(90), stats.Evictions)
+	entries, _ := store.Scan("", "", 0)
+	assert.Equal(s.T(), "key-90", entries[0].Key)
+
+	// a value too big for the budget on its own doesn't stay
+	store.Set("huge", strings.Repeat("x", int(budget)))
+	assert.Nil(s.T(), store.Get("huge"))
+	assert.LessOrEqual(s.T(), store.Stats().Bytes, budget)
+}
+
+func (s *boundedStoreTestSuite) TestAccounting() {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := s.open(BoundedOptions{MaxEntries: 100})
+	store.now = clock.Now
+	store.sweepInterval = time.Millisecond
+
+	store.Set("a", "short")
+	store.Set("a", map[string]any{"longer": []any{"value", 1.0}})
+	store.MSet(map[string]any{"b": true, "c": nil, "prefix:1": 1.0, "prefix:2": 2.0})
+	store.SetWithTTL("session", "token", time.Minute)
+	assert.Equal(s.T(), liveBytes(store), store.Stats().Bytes)
+
+	store.Delete("b")
+	store.DeletePrefix("prefix:")
+	assert.Equal(s.T(), liveBytes(store), store.Stats().Bytes)
+
+	clock.Advance(time.Minute)
+	assert.Eventually(s.T(), func() bool { return store.Stats().Entries == 2 }, time.Second, time.Millisecond)
+	assert.Equal(s.T(), liveBytes(store), store.Stats().Bytes)
+
+	store.Flush()
+	assert.Equal(s.T(), BoundedStats{MaxEntries: 100}, store.Stats())
+}
+
+func (s *boundedStoreTestSuite) TestCollectionAccounting() {
+	store := s.open(BoundedOptions{MaxEntries: 100})
+	store.ListPush("list", false, "a", map[string]any{"n": 1.0}, 2.0)
+	store.ListPop("list", true, 1)
+	store.SetAdd("set", "a", "bb", "ccc")
+	store.SetRemove("set", "bb")
+	store.HashSet("hash", map[string]any{"a": "x", "b": []any{"y"}})
+	store.HashSet("hash", map[string]any{"a": "longer"})
+	store.HashDelete("hash", "b")
+	store.SortedSetAdd("board", map[string]float64{"alice": 1, "bob": 2})
+	store.SortedSetAdd("board", map[string]float64{"alice": 3})
+	store.SortedSetPop("board", false, 1)
+	assert.Equal(s.T(), liveBytes(store), store.Stats().Bytes)
+
+	// sizes kept up to date in place match those of the same collections
+	// built afresh
+	for _, key := range []string{"set", "hash", "board"} {
+		c := store.store[key].value.(collection)
+		assert.Equal(s.T(), sizeOf(importValue(c.export())), c.size(), key)
+	}
+
+	store.ListPop("list", true, 2)
+	assert.Equal(s.T(), liveBytes(store), store.Stats().Bytes)
+	assert.Equal(s.T(), 3, store.Stats().Entries)
+}
+
+func (s *boundedStoreTestSuite) TestEvictionsArePublished() {
+	store := s.open(BoundedOptions{MaxEntries: 1})
+	events, err := store.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	store.Set("a", 1)
+	store.Set("b", 2)
+
+	assert.Equal(s.T(), []Event{
+		{Type: EventSet, Key: "a", Value: 1, Revision: 1},
+		{Type: EventSet, Key: "b", Value: 2, Revision: 2},
+		{Type: EventEvict, Key: "a", Revision: 3},
+	}, []Event{<-events, <-events, <-events})
+}
+
+func (s *boundedStoreTestSuite) TestPolicies() {
+	for name, newPolicy := range map[string]func() EvictionPolicy{
+		"lru": NewLRUPolicy, "lfu": NewLFUPolicy, "random": NewRandomPolicy, "arc": NewARCPolicy,
+	} {
+		store := s.open(BoundedOptions{MaxEntries: 10, NewPolicy: newPolicy})
+		for i := 0; i < 50; i++ {
+			store.Set(fmt.Sprint(i), i)
+			store.Get(fmt.Sprint(i / 2))
+		}
+		assert.Equal(s.T(), 10, store.Stats().Entries, name)
+		assert.Equal(s.T(), uint64(40), store.Stats().Evictions, name)
+		assert.Equal(s.T(), liveBytes(store), store.Stats().Bytes, name)
+	}
+}
+
+func (s *boundedStoreTestSuite) TestNamespacedBudgets() {
+	store, err := NewNamespacedBoundedStore(BoundedOptions{MaxEntries: 2}, 2)
+	s.Require().NoError(err)
+	defer store.Close()
+	teamA, _ := store.Namespace("team-a")
+
+	// each namespace has its own budget
+	for i := 0; i < 5; i++ {
+		store.Set(fmt.Sprint(i), i)
+		teamA.Set(fmt.Sprint(i), i)
+	}
+	assert.Equal(s.T(), 2, teamA.(BoundedStore).Stats().Entries)
+	defaultSpace, _ := store.Namespace(DefaultNamespace)
+	assert.Equal(s.T(), 2, defaultSpace.(BoundedStore).Stats().Entries)
+
+	// and there can only be so many of them
+	_, err = store.Namespace("team-b")
+	assert.ErrorIs(s.T(), err, ErrTooManyNamespaces)
+	assert.Equal(s.T(), []string{DefaultNamespace, "team-a"}, store.Namespaces())
+	_, err = store.DropNamespace("team-a")
+	s.Require().NoError(err)
+	_, err = store.Namespace("team-b")
+	assert.NoError(s.T(), err)
+
+	_, err = NewNamespacedBoundedStore(BoundedOptions{}, 2)
+	assert.Error(s.T(), err)
+	_, err = NewNamespacedBoundedStore(BoundedOptions{MaxEntries: 2}, 0)
+	assert.Error(s.T(), err)
+}
+
+func (s *boundedStoreTestSuite) TestNamespacedRestoreWithinLimit() {
+	source := NewNamespacedStore()
+	defer source.Close()
+	for _, name := range []string{"team-a", "team-b"} {
+		space, _ := source.Namespace(name)
+		space.Set("key", name)
+	}
+	var snapshot bytes.Buffer
+	s.Require().NoError(source.Snapshot(&snapshot))
+
+	store, err := NewNamespacedBoundedStore(BoundedOptions{MaxEntries: 2}, 2)
+	s.Require().NoError(err)
+	defer store.Close()
+	store.Set("key", "kept")
+	err = store.Restore(&snapshot)
+	assert.ErrorIs(s.T(), err, ErrTooManyNamespaces)
+	assert.ErrorIs(s.T(), err, ErrInvalidSnapshot)
+	assert.Equal(s.T(), "kept", store.Get("key"))
+}
+
+func (s *boundedStoreTestSuite) TestSizeOf() {
+	for _, tc := range []struct {
+		value any
+		size  int64
+	}{
+		{nil, 0},
+		{true, 0},
+		{1.5, 8},
+		{"hello", 16 + 5},
+		{[]any{"a", 1.0}, 24 + 2*16 + (16 + 1) + 8},
+		{map[string]any{"k": "v"}, 48 + 40 + 1 + 16 + 1},
+		{42, 8}, // not produced by JSON decoding; counted by its type's size
+	} {
+		assert.Equal(s.T(), tc.size, sizeOf(tc.value), "%#v", tc.value)
+	}
+}
+
+// TestSizeOfMatchesHeap checks the estimate against the heap memory that
+// decoding JSON values actually retains.
+func (s *boundedStoreTestSuite) TestSizeOfMatchesHeap() {
+	const copies = 2000
+	document := []byte(`{"name":"widget","tags":["a","bb","ccc"],"price":12.5,"stock":{"warehouse-1":40,"warehouse-2":0},"active":true,"notes":"` + strings.Repeat("n", 200) + `"}`)
+
+	var before, after runtime.MemStats
+	values := make([]any, copies)
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := range values {
+		s.Require().NoError(json.Unmarshal(document, &values[i]))
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	actual := float64(after.HeapAlloc-before.HeapAlloc) / copies
+	estimated := float64(sizeOf(values[0]))
+	runtime.KeepAlive(values)
+	assert.InEpsilon(s.T(), actual, estimated, 0.2, "estimated %.0f bytes, heap holds %.0f", estimated, actual)
+}
+
+func TestBoundedStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(boundedStoreTestSuite))
+}
@@ -0,0 +1,729 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+)
+
+// CollectionStore is a Store whose values can be lists, sets and hashes,
+// changed an element at a time rather than rewritten whole. Operations are
+// type-checked: one on a key holding another kind of value fails with a
+// *WrongTypeError. A key that isn't set reads as an empty collection, and a
+// collection emptied by a pop or removal is deleted. A key's TTL is kept.
+//
+// Collections are held as typed values, a list as a deque and a set or hash
+// as a map, which are changed in place, so a change takes time in
+// proportion to the change rather than to the collection. Reads of the key
+// itself, such as Get and Scan, return a copy, as a ListValue, SetValue or
+// HashValue, and setting a key to one of those creates the collection. No
+// value decoded from JSON is one, so a plain value is never taken for a
+// collection.
+type CollectionStore interface {
+	Store
+	// ListPush adds values to the back of key's list, or one by one to its
+	// front, returning the list's new length.
+	ListPush(key string, front bool, values ...any) (int, error)
+	// ListPop removes and returns up to count values from the front or back
+	// of key's list, in the order they were removed.
+	ListPop(key string, front bool, count int) ([]any, error)
+	// ListRange returns the values of key's list from index start to stop,
+	// inclusive. Negative indexes count back from the end, -1 being the last.
+	ListRange(key string, start, stop int) ([]any, error)
+
+	SetAdd(key string, members ...string) (int, error)    // returns how many members were new
+	SetRemove(key string, members ...string) (int, error) // returns how many members were removed
+	SetMembers(key string) ([]string, error)              // in lexicographic order
+	// SetIntersect returns the members of every one of the sets at keys, in
+	// lexicographic order, reading them all at once.
+	SetIntersect(keys ...string) ([]string, error)
+
+	HashGet(key, field string) (value any, ok bool, err error) // ok is false if field is not set
+	HashGetAll(key string) (map[string]any, error)
+	HashSet(key string, fields map[string]any) (int, error) // returns how many fields were new
+	HashDelete(key string, fields ...string) (int, error)   // returns how many fields were deleted
+}
+
+// ListValue, SetValue and HashValue are copies of collections, as reads
+// return them. A SetValue's members are in lexicographic order.
+type (
+	ListValue []any
+	SetValue  []string
+	HashValue map[string]any
+)
+
+// Types of collection, as CollectionType names them.
+const (
+	listType = "list"
+	setType  = "set"
+	hashType = "hash"
+)
+
+// CollectionType returns the type of collection value is a copy of, "list",
+// "set", "hash" or, for a sorted set, "zset", or "" if it isn't one.
+func CollectionType(value any) string {
+	switch value.(type) {
+	case ListValue:
+		return listType
+	case SetValue:
+		return setType
+	case HashValue:
+		return hashType
+	case SortedSetValue:
+		return sortedSetType
+	default:
+		return ""
+	}
+}
+
+// ErrInvalidCollection is returned for decoding a collection from a value
+// that can't hold one.
+var ErrInvalidCollection = errors.New("invalid collection")
+
+// DecodeCollection returns the collection of type typ, as CollectionType
+// names it, whose elements are value, as decoded from JSON: an array of
+// values for a list, of strings for a set, an object for a hash, or an
+// object of finite scores for a sorted set. A collection holds at least one
+// element.
+func DecodeCollection(typ string, value any) (any, error) {
+	switch typ {
+	case listType:
+		if items, ok := value.([]any); ok && len(items) > 0 {
+			return ListValue(items), nil
+		}
+	case setType:
+		items, ok := value.([]any)
+		members := make([]string, len(items))
+		for i, item := range items {
+			if members[i], ok = item.(string); !ok {
+				break
+			}
+		}
+		if ok && len(members) > 0 {
+			slices.Sort(members)
+			return SetValue(slices.Compact(members)), nil
+		}
+	case hashType:
+		if fields, ok := value.(map[string]any); ok && len(fields) > 0 {
+			return HashValue(fields), nil
+		}
+	case sortedSetType:
+		members, ok := value.(map[string]any)
+		scores := make(SortedSetValue, len(members))
+		for member, value := range members {
+			score, isNumber := numberValue(value)
+			if !isNumber || math.IsNaN(score) || math.IsInf(score, 0) {
+				ok = false
+				break
+			}
+			scores[member] = score
+		}
+		if ok && len(scores) > 0 {
+			return scores, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidCollection, typ)
+	}
+	return nil, fmt.Errorf("%w: a %s can't hold %v", ErrInvalidCollection, typ, value)
+}
+
+// ErrWrongType is returned by an operation on a key whose value is of
+// another type.
+var ErrWrongType = errors.New("wrong type")
+
+// WrongTypeError is returned by a collection operation on a key holding a
+// value of another type. It matches ErrWrongType with errors.Is.
+type WrongTypeError struct {
+	Key  string
+	Want string // list, set, hash or sorted set
+}
+
+func (e *WrongTypeError) Error() string {
+	return fmt.Sprintf("%q does not hold a %s", e.Key, e.Want)
+}
+
+func (e *WrongTypeError) Unwrap() error {
+	return ErrWrongType
+}
+
+// collection is a list, set, hash or sorted set as the store holds it. It
+// is changed in place, so it never leaves the store: readers are given a
+// copy.
+type collection interface {
+	len() int
+	// size estimates the memory the collection holds, as sizeOf does for
+	// other values.
+	size() int64
+	// export returns a copy of the collection, as a ListValue, SetValue,
+	// HashValue or SortedSetValue.
+	export() any
+}
+
+// importValue returns the collection value is a copy of, or value itself
+// if it isn't one.
+func importValue(value any) any {
+	switch v := value.(type) {
+	case ListValue:
+		l := &deque{}
+		for _, item := range v {
+			l.pushBack(item)
+		}
+		return l
+	case SetValue:
+		s := newStringSet()
+		for _, member := range v {
+			s.add(member)
+		}
+		return s
+	case HashValue:
+		h := newFieldMap()
+		for field, value := range v {
+			h.set(field, value)
+		}
+		return h
+	case SortedSetValue:
+		z := newScoredSet()
+		for member, score := range v {
+			z.set(member, score)
+		}
+		return z
+	default:
+		return value
+	}
+}
+
+// exportValue returns a copy of value if it is a collection, which readers
+// mustn't share with the store, or value itself otherwise.
+func exportValue(value any) any {
+	if c, ok := value.(collection); ok {
+		return c.export()
+	}
+	return value
+}
+
+// deque is a list's values, held in a ring buffer so that values are pushed
+// and popped at either end in constant time.
+type deque struct {
+	ring   []any
+	head   int // index in ring of the first value
+	length int
+	bytes  int64 // sizeOf every value
+}
+
+func (l *deque) len() int {
+	return l.length
+}
+
+func (l *deque) size() int64 {
+	return sliceHeaderSize + interfaceSize*int64(len(l.ring)) + l.bytes
+}
+
+func (l *deque) export() any {
+	return ListValue(l.values(0, l.length))
+}
+
+// values returns a copy of n values from index start.
+func (l *deque) values(start, n int) []any {
+	values := make([]any, n)
+	for i := range values {
+		values[i] = l.ring[(l.head+start+i)%len(l.ring)]
+	}
+	return values
+}
+
+func (l *deque) pushBack(value any) {
+	l.resize(l.length + 1)
+	l.ring[(l.head+l.length)%len(l.ring)] = value
+	l.length++
+	l.bytes += sizeOf(value)
+}
+
+func (l *deque) pushFront(value any) {
+	l.resize(l.length + 1)
+	l.head = (l.head - 1 + len(l.ring)) % len(l.ring)
+	l.ring[l.head] = value
+	l.length++
+	l.bytes += sizeOf(value)
+}
+
+func (l *deque) popFront() any {
+	value := l.ring[l.head]
+	l.ring[l.head] = nil
+	l.head = (l.head + 1) % len(l.ring)
+	l.length--
+	l.bytes -= sizeOf(value)
+	l.resize(l.length)
+	return value
+}
+
+func (l *deque) popBack() any {
+	i := (l.head + l.length - 1) % len(l.ring)
+	value := l.ring[i]
+	l.ring[i] = nil
+	l.length--
+	l.bytes -= sizeOf(value)
+	l.resize(l.length)
+	return value
+}
+
+// resize makes room for n values, doubling the ring when it is full and
+// halving it when it is no more than a quarter used, so pushes and pops
+// take constant time on average and a list shrunk by pops doesn't keep its
+// largest ring.
+func (l *deque) resize(n int) {
+	capacity := len(l.ring)
+	switch {
+	case n > capacity:
+		capacity = max(2*capacity, 8)
+	case capacity > 8 && n <= capacity/4:
+		capacity /= 2
+	default:
+		return
+	}
+	ring := make([]any, capacity)
+	for i := range l.length {
+		ring[i] = l.ring[(l.head+i)%len(l.ring)]
+	}
+	l.ring, l.head = ring, 0
+}
+
+// stringSet is a set's members.
+type stringSet struct {
+	members map[string]struct{}
+	bytes   int64 // the map slots and members
+}
+
+func newStringSet() *stringSet {
+	return &stringSet{members: make(map[string]struct{})}
+}
+
+func (s *stringSet) len() int {
+	return len(s.members)
+}
+
+func (s *stringSet) size() int64 {
+	return mapHeaderSize + s.bytes
+}
+
+func (s *stringSet) export() any {
+	return SetValue(s.sorted())
+}
+
+func (s *stringSet) has(member string) bool {
+	_, ok := s.members[member]
+	return ok
+}
+
+func (s *stringSet) add(member string) {
+	if !s.has(member) {
+		s.members[member] = struct{}{}
+		s.bytes += mapSlotSize + int64(len(member))
+	}
+}
+
+func (s *stringSet) remove(member string) {
+	if s.has(member) {
+		delete(s.members, member)
+		s.bytes -= mapSlotSize + int64(len(member))
+	}
+}
+
+// sorted returns the members in lexicographic order.
+func (s *stringSet) sorted() []string {
+	members := slices.AppendSeq(make([]string, 0, len(s.members)), maps.Keys(s.members))
+	slices.Sort(members)
+	return members
+}
+
+// fieldMap is a hash's fields.
+type fieldMap struct {
+	fields map[string]any
+	bytes  int64 // the map slots, fields and values
+}
+
+func newFieldMap() *fieldMap {
+	return &fieldMap{fields: make(map[string]any)}
+}
+
+func (h *fieldMap) len() int {
+	return len(h.fields)
+}
+
+func (h *fieldMap) size() int64 {
+	return mapHeaderSize + h.bytes
+}
+
+func (h *fieldMap) export() any {
+	return HashValue(maps.Clone(h.fields))
+}
+
+func (h *fieldMap) set(field string, value any) {
+	h.delete(field)
+	h.fields[field] = value
+	h.bytes += mapSlotSize + int64(len(field)) + sizeOf(value)
+}
+
+func (h *fieldMap) delete(field string) {
+	if value, ok := h.fields[field]; ok {
+		delete(h.fields, field)
+		h.bytes -= mapSlotSize + int64(len(field)) + sizeOf(value)
+	}
+}
+
+// CollectionChange is a change to some of the elements of a collection.
+// Changes are logged, and sent to watchers and replicas, as their
+// CollectionChange rather than as the whole collection they result in, so
+// each costs time and space in proportion to the change, not to the
+// collection. A change to a key that isn't set is made to an empty
+// collection of its type, and a collection it empties is deleted.
+type CollectionChange struct {
+	Type   string         `json:"type"`             // the type of collection changed: list, set, hash or zset
+	Front  bool           `json:"front,omitempty"`  // list: pushing to or popping from the front
+	Push   []any          `json:"push,omitempty"`   // list: values to push, one at a time
+	Pop    int            `json:"pop,omitempty"`    // list: how many values to pop
+	Add    []string       `json:"add,omitempty"`    // set: members not already in it
+	Remove []string       `json:"remove,omitempty"` // set, zset: members to remove; hash: fields to delete
+	Set    map[string]any `json:"set,omitempty"`    // hash: fields to set; zset: members' new scores
+}
+
+// applyTo makes the change to c, or to a new collection if c is nil, and
+// returns the collection. The change was checked against c when it was
+// made, so c is of the change's type.
+func (change *CollectionChange) applyTo(c collection) collection {
+	switch change.Type {
+	case listType:
+		l, _ := c.(*deque)
+		if l == nil {
+			l = &deque{}
+		}
+		for _, value := range change.Push {
+			if change.Front {
+				l.pushFront(value)
+			} else {
+				l.pushBack(value)
+			}
+		}
+		for range min(change.Pop, l.length) {
+			if change.Front {
+				l.popFront()
+			} else {
+				l.popBack()
+			}
+		}
+		return l
+	case setType:
+		s, _ := c.(*stringSet)
+		if s == nil {
+			s = newStringSet()
+		}
+		for _, member := range change.Remove {
+			s.remove(member)
+		}
+		for _, member := range change.Add {
+			s.add(member)
+		}
+		return s
+	case hashType:
+		h, _ := c.(*fieldMap)
+		if h == nil {
+			h = newFieldMap()
+		}
+		for field, value := range change.Set {
+			h.set(field, value)
+		}
+		for _, field := range change.Remove {
+			h.delete(field)
+		}
+		return h
+	case sortedSetType:
+		z, _ := c.(*scoredSet)
+		if z == nil {
+			z = newScoredSet()
+		}
+		for member, value := range change.Set {
+			score, _ := numberValue(value)
+			z.set(member, score)
+		}
+		for _, member := range change.Remove {
+			z.remove(member)
+		}
+		return z
+	}
+	return c
+}
+
+func (s *inMemoryStore) ListPush(key string, front bool, values ...any) (int, error) {
+	var length int
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		l, err := listOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		length = l.len() + len(values)
+		if len(values) == 0 {
+			// pushing nothing to a missing list leaves it missing
+			return nil, nil
+		}
+		return &CollectionChange{Type: listType, Front: front, Push: slices.Clone(values)}, nil
+	})
+	return length, err
+}
+
+func (s *inMemoryStore) ListPop(key string, front bool, count int) ([]any, error) {
+	popped := []any{}
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		l, err := listOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		n := min(max(count, 0), l.len())
+		if n == 0 {
+			return nil, nil
+		}
+		if front {
+			popped = l.values(0, n)
+		} else {
+			popped = l.values(l.len()-n, n)
+			slices.Reverse(popped)
+		}
+		return &CollectionChange{Type: listType, Front: front, Pop: n}, nil
+	})
+	return popped, err
+}
+
+func (s *inMemoryStore) ListRange(key string, start, stop int) ([]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, found := s.lookupCollection(key)
+	l, err := listOf(key, e.value, found)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		start = max(l.len()+start, 0)
+	}
+	if stop < 0 {
+		stop = l.len() + stop
+	}
+	stop = min(stop, l.len()-1)
+	if start > stop {
+		return []any{}, nil
+	}
+	return l.values(start, stop-start+1), nil
+}
+
+func (s *inMemoryStore) SetAdd(key string, members ...string) (int, error) {
+	var added []string
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := setOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range slices.Compact(slices.Sorted(slices.Values(members))) {
+			if !current.has(member) {
+				added = append(added, member)
+			}
+		}
+		if len(added) == 0 {
+			return nil, nil
+		}
+		return &CollectionChange{Type: setType, Add: added}, nil
+	})
+	return len(added), err
+}
+
+func (s *inMemoryStore) SetRemove(key string, members ...string) (int, error) {
+	var removed []string
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := setOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range slices.Compact(slices.Sorted(slices.Values(members))) {
+			if current.has(member) {
+				removed = append(removed, member)
+			}
+		}
+		if len(removed) == 0 {
+			return nil, nil
+		}
+		return &CollectionChange{Type: setType, Remove: removed}, nil
+	})
+	return len(removed), err
+}
+
+func (s *inMemoryStore) SetMembers(key string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, found := s.lookupCollection(key)
+	members, err := setOf(key, e.value, found)
+	if err != nil {
+		return nil, err
+	}
+	return members.sorted(), nil
+}
+
+func (s *inMemoryStore) SetIntersect(keys ...string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return intersectSets(keys, s.lookupCollection)
+}
+
+func (s *inMemoryStore) HashGet(key, field string) (any, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, found := s.lookupCollection(key)
+	fields, err := hashOf(key, e.value, found)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := fields.fields[field]
+	return value, ok, nil
+}
+
+func (s *inMemoryStore) HashGetAll(key string) (map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, found := s.lookupCollection(key)
+	fields, err := hashOf(key, e.value, found)
+	if err != nil {
+		return nil, err
+	}
+	return maps.Clone(fields.fields), nil
+}
+
+func (s *inMemoryStore) HashSet(key string, fields map[string]any) (int, error) {
+	var added int
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := hashOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, nil
+		}
+		for field := range fields {
+			if _, ok := current.fields[field]; !ok {
+				added++
+			}
+		}
+		return &CollectionChange{Type: hashType, Set: maps.Clone(fields)}, nil
+	})
+	return added, err
+}
+
+func (s *inMemoryStore) HashDelete(key string, fields ...string) (int, error) {
+	var deleted []string
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := hashOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range slices.Compact(slices.Sorted(slices.Values(fields))) {
+			if _, ok := current.fields[field]; ok {
+				deleted = append(deleted, field)
+			}
+		}
+		if len(deleted) == 0 {
+			return nil, nil
+		}
+		return &CollectionChange{Type: hashType, Remove: deleted}, nil
+	})
+	return len(deleted), err
+}
+
+// lookupCollection is lookup for a collection operation, which counts as an
+// access of the key. Callers must hold mu, for reading at least.
+func (s *inMemoryStore) lookupCollection(key string) (entry, bool) {
+	e, found := s.lookup(key)
+	if found {
+		s.touch(key)
+	}
+	return e, found
+}
+
+// updateCollection makes the change to key's collection that change
+// returns, given the key's current value, keeping the key's TTL, or deleting
+// key if the change empties it. Nothing is written if change fails or
+// returns no change.
+func (s *inMemoryStore) updateCollection(key string, change func(value any, found bool) (*CollectionChange, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.lookup(key)
+	collectionChange, err := change(e.value, found)
+	if err != nil || collectionChange == nil {
+		return err
+	}
+	update := walRecord{Op: walOpUpdate, Key: key, Change: collectionChange}
+	if _, expired := s.store[key]; expired && !found {
+		// the change makes a new collection, not one the sweeper hasn't
+		// reaped yet
+		s.commit(walRecord{Op: walOpBatch, Ops: []walRecord{{Op: walOpExpire, Key: key}, update}})
+		return nil
+	}
+	s.commit(update)
+	return nil
+}
+
+// intersectSets returns the members of every one of the sets at keys, read
+// with lookup, in lexicographic order.
+func intersectSets(keys []string, lookup func(key string) (entry, bool)) ([]string, error) {
+	sets := make([]*stringSet, len(keys))
+	for i, key := range keys {
+		e, found := lookup(key)
+		members, err := setOf(key, e.value, found)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = members
+	}
+	if len(sets) == 0 {
+		return []string{}, nil
+	}
+	// only members of the smallest set can be in every one
+	smallest := slices.MinFunc(sets, func(a, b *stringSet) int { return a.len() - b.len() })
+	intersection := []string{}
+	for member := range smallest.members {
+		if !slices.ContainsFunc(sets, func(s *stringSet) bool { return !s.has(member) }) {
+			intersection = append(intersection, member)
+		}
+	}
+	slices.Sort(intersection)
+	return intersection, nil
+}
+
+// listOf returns the list stored at key, or an error if key holds another
+// type of value. A missing key holds an empty list.
+func listOf(key string, value any, found bool) (*deque, error) {
+	if !found {
+		return &deque{}, nil
+	}
+	if l, ok := value.(*deque); ok {
+		return l, nil
+	}
+	return nil, &WrongTypeError{Key: key, Want: "list"}
+}
+
+// setOf returns the set stored at key.
+func setOf(key string, value any, found bool) (*stringSet, error) {
+	if !found {
+		return newStringSet(), nil
+	}
+	if s, ok := value.(*stringSet); ok {
+		return s, nil
+	}
+	return nil, &WrongTypeError{Key: key, Want: "set"}
+}
+
+// hashOf returns the hash stored at key.
+func hashOf(key string, value any, found bool) (*fieldMap, error) {
+	if !found {
+		return newFieldMap(), nil
+	}
+	if h, ok := value.(*fieldMap); ok {
+		return h, nil
+	}
+	return nil, &WrongTypeError{Key: key, Want: "hash"}
+}
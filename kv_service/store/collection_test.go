@@ -0,0 +1,325 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// collectionTestSuite checks collections on every store that supports them.
+type collectionTestSuite struct {
+	suite.Suite
+	newStore func() collectionTestStore
+	store    collectionTestStore
+}
+
+type collectionTestStore interface {
+	CollectionStore
+	ExpiringVersionedStore
+	ScannableStore
+	Close() error
+}
+
+func (s *collectionTestSuite) SetupTest() {
+	s.store = s.newStore()
+}
+
+func (s *collectionTestSuite) TearDownTest() {
+	s.store.Close()
+}
+
+func (s *collectionTestSuite) TestList() {
+	length, err := s.store.ListPush("list", false, "a", "b")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, length)
+	// values pushed to the front go on one at a time, so end up reversed
+	length, err = s.store.ListPush("list", true, "y", "z")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 4, length)
+
+	values, err := s.store.ListRange("list", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"z", "y", "a", "b"}, values)
+	assert.Equal(s.T(), ListValue{"z", "y", "a", "b"}, s.store.Get("list"))
+
+	for _, test := range []struct {
+		start, stop int
+		expected    []any
+	}{
+		{1, 2, []any{"y", "a"}},
+		{-2, -1, []any{"a", "b"}},
+		{-100, 0, []any{"z"}},
+		{2, 100, []any{"a", "b"}},
+		{3, 1, []any{}},
+		{10, 20, []any{}},
+	} {
+		values, err := s.store.ListRange("list", test.start, test.stop)
+		s.Require().NoError(err)
+		assert.Equal(s.T(), test.expected, values, "%d..%d", test.start, test.stop)
+	}
+
+	popped, err := s.store.ListPop("list", true, 1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"z"}, popped)
+	popped, err = s.store.ListPop("list", false, 2)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"b", "a"}, popped)
+
+	// popping the last value deletes the list
+	popped, err = s.store.ListPop("list", false, 5)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"y"}, popped)
+	_, found := s.store.Lookup("list")
+	assert.False(s.T(), found)
+}
+
+func (s *collectionTestSuite) TestList_Missing() {
+	values, err := s.store.ListRange("missing", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{}, values)
+	popped, err := s.store.ListPop("missing", true, 1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{}, popped)
+	length, err := s.store.ListPush("missing", false)
+	s.Require().NoError(err)
+	assert.Zero(s.T(), length)
+	_, found := s.store.Lookup("missing")
+	assert.False(s.T(), found)
+}
+
+func (s *collectionTestSuite) TestSet() {
+	added, err := s.store.SetAdd("set", "b", "a", "b")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, added)
+	_, version := s.store.GetWithVersion("set")
+
+	// adding existing members changes nothing
+	added, err = s.store.SetAdd("set", "a")
+	s.Require().NoError(err)
+	assert.Zero(s.T(), added)
+	_, unchanged := s.store.GetWithVersion("set")
+	assert.Equal(s.T(), version, unchanged)
+
+	added, err = s.store.SetAdd("set", "c")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, added)
+	members, err := s.store.SetMembers("set")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"a", "b", "c"}, members)
+	assert.Equal(s.T(), SetValue{"a", "b", "c"}, s.store.Get("set"))
+
+	removed, err := s.store.SetRemove("set", "a", "missing")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, removed)
+	removed, err = s.store.SetRemove("set", "b", "c")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, removed)
+	_, found := s.store.Lookup("set")
+	assert.False(s.T(), found)
+
+	members, err = s.store.SetMembers("set")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{}, members)
+}
+
+func (s *collectionTestSuite) TestSetIntersect() {
+	s.store.SetAdd("a", "1", "2", "3", "4")
+	s.store.SetAdd("b", "2", "3", "4", "5")
+	s.store.SetAdd("c", "0", "3", "4")
+
+	members, err := s.store.SetIntersect("a", "b", "c")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"3", "4"}, members)
+	members, err = s.store.SetIntersect("a")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"1", "2", "3", "4"}, members)
+	members, err = s.store.SetIntersect("a", "missing")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{}, members)
+
+	s.store.Set("string", "x")
+	_, err = s.store.SetIntersect("a", "missing", "string")
+	assert.Equal(s.T(), &WrongTypeError{Key: "string", Want: "set"}, err)
+}
+
+func (s *collectionTestSuite) TestSetToCollection() {
+	// a copy of a collection, as reads return, sets the key to the collection
+	s.store.Set("list", ListValue{"a", "b"})
+	s.store.Set("set", SetValue{"a", "b"})
+	s.store.Set("hash", HashValue{"a": 1.0})
+	length, err := s.store.ListPush("list", false, "c")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 3, length)
+	added, err := s.store.SetAdd("set", "b", "c")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, added)
+	added, err = s.store.HashSet("hash", map[string]any{"b": 2.0})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, added)
+
+	entries, _ := s.store.Scan("", "", 0)
+	s.Require().Len(entries, 3)
+	assert.Equal(s.T(), HashValue{"a": 1.0, "b": 2.0}, entries[0].Value)
+	assert.Equal(s.T(), ListValue{"a", "b", "c"}, entries[1].Value)
+	assert.Equal(s.T(), SetValue{"a", "b", "c"}, entries[2].Value)
+}
+
+func (s *collectionTestSuite) TestPlainValuesAreNotCollections() {
+	// a JSON value shaped like a collection is still a plain value
+	s.store.Set("list", map[string]any{"$list": []any{"a"}})
+	s.store.Set("array", []any{"a"})
+	for _, key := range []string{"list", "array"} {
+		_, err := s.store.ListPush(key, false, "b")
+		assert.ErrorIs(s.T(), err, ErrWrongType, key)
+	}
+	assert.Equal(s.T(), map[string]any{"$list": []any{"a"}}, s.store.Get("list"))
+}
+
+func (s *collectionTestSuite) TestHash() {
+	added, err := s.store.HashSet("hash", map[string]any{"name": "alice", "age": 30.0})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, added)
+	added, err = s.store.HashSet("hash", map[string]any{"age": 31.0, "admin": true})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, added)
+
+	value, ok, err := s.store.HashGet("hash", "age")
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 31.0, value)
+	_, ok, err = s.store.HashGet("hash", "missing")
+	s.Require().NoError(err)
+	assert.False(s.T(), ok)
+
+	fields, err := s.store.HashGetAll("hash")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"name": "alice", "age": 31.0, "admin": true}, fields)
+	// the result is a copy
+	fields["name"] = "mallory"
+	value, _, _ = s.store.HashGet("hash", "name")
+	assert.Equal(s.T(), "alice", value)
+
+	deleted, err := s.store.HashDelete("hash", "name", "missing")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, deleted)
+	deleted, err = s.store.HashDelete("hash", "age", "admin")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, deleted)
+	_, found := s.store.Lookup("hash")
+	assert.False(s.T(), found)
+
+	fields, err = s.store.HashGetAll("hash")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{}, fields)
+}
+
+func (s *collectionTestSuite) TestWrongType() {
+	s.store.Set("string", "value")
+	s.store.Set("object", map[string]any{"a": 1.0})
+	s.store.ListPush("list", false, "a")
+	s.store.SetAdd("set", "a")
+	s.store.HashSet("hash", map[string]any{"a": 1.0})
+
+	for _, key := range []string{"string", "object", "set", "hash"} {
+		_, err := s.store.ListPush(key, false, "x")
+		assert.Equal(s.T(), &WrongTypeError{Key: key, Want: "list"}, err, key)
+		_, err = s.store.ListRange(key, 0, -1)
+		assert.ErrorIs(s.T(), err, ErrWrongType, key)
+	}
+	for _, key := range []string{"string", "object", "list", "hash"} {
+		_, err := s.store.SetAdd(key, "x")
+		assert.Equal(s.T(), &WrongTypeError{Key: key, Want: "set"}, err, key)
+		_, err = s.store.SetMembers(key)
+		assert.ErrorIs(s.T(), err, ErrWrongType, key)
+	}
+	for _, key := range []string{"string", "object", "list", "set"} {
+		_, err := s.store.HashSet(key, map[string]any{"x": 1.0})
+		assert.Equal(s.T(), &WrongTypeError{Key: key, Want: "hash"}, err, key)
+		_, _, err = s.store.HashGet(key, "a")
+		assert.ErrorIs(s.T(), err, ErrWrongType, key)
+	}
+	assert.Equal(s.T(), "value", s.store.Get("string"))
+	assert.EqualError(s.T(), &WrongTypeError{Key: "string", Want: "list"}, `"string" does not hold a list`)
+}
+
+func (s *collectionTestSuite) TestLargeList() {
+	// pushes and pops at both ends wrap around the list's ring, which grows
+	// and shrinks
+	var expected []any
+	for i := range 1000 {
+		_, err := s.store.ListPush("list", i%3 == 0, float64(i))
+		s.Require().NoError(err)
+		if i%3 == 0 {
+			expected = append([]any{float64(i)}, expected...)
+		} else {
+			expected = append(expected, float64(i))
+		}
+	}
+	values, err := s.store.ListRange("list", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), expected, values)
+
+	for i := 0; len(expected) > 10; i++ {
+		front := i%2 == 0
+		popped, err := s.store.ListPop("list", front, 7)
+		s.Require().NoError(err)
+		if front {
+			assert.Equal(s.T(), expected[:7], popped)
+			expected = expected[7:]
+		} else {
+			tail := slices.Clone(expected[len(expected)-7:])
+			slices.Reverse(tail)
+			assert.Equal(s.T(), tail, popped)
+			expected = expected[:len(expected)-7]
+		}
+	}
+	values, err = s.store.ListRange("list", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), expected, values)
+	values, err = s.store.ListRange("list", 2, 4)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), expected[2:5], values)
+}
+
+func (s *collectionTestSuite) TestExpiredCollectionIsReplaced() {
+	s.store.SetWithTTL("list", ListValue{"old"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	length, err := s.store.ListPush("list", false, "new")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, length)
+
+	entries, _ := s.store.Scan("list", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), ListValue{"new"}, entries[0].Value)
+	assert.Zero(s.T(), entries[0].ExpiresAt)
+}
+
+func (s *collectionTestSuite) TestKeepsTTL() {
+	s.store.SetWithTTL("list", ListValue{"a"}, time.Minute)
+	_, err := s.store.ListPush("list", false, "b")
+	s.Require().NoError(err)
+
+	entries, _ := s.store.Scan("list", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), ListValue{"a", "b"}, entries[0].Value)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *collectionTestSuite) TestLeavesReadValuesAlone() {
+	s.store.ListPush("list", false, "a", "b")
+	read := s.store.Get("list")
+	s.store.ListPop("list", false, 1)
+	s.store.ListPush("list", false, "c")
+	assert.Equal(s.T(), ListValue{"a", "b"}, read)
+}
+
+func TestCollectionTestSuite(t *testing.T) {
+	suite.Run(t, &collectionTestSuite{newStore: func() collectionTestStore { return NewInMemoryStore() }})
+}
+
+func TestShardedCollectionTestSuite(t *testing.T) {
+	suite.Run(t, &collectionTestSuite{newStore: func() collectionTestStore { return NewShardedStore(8) }})
+}
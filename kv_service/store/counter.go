@@ -0,0 +1,129 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CounterStore is a Store whose numeric values can be added to atomically,
+// so concurrent clients don't lose each other's updates as they would with
+// a read-modify-write. A key that isn't set counts from 0, and a key's TTL
+// is kept. Results are stored as float64, as JSON numbers are decoded.
+type CounterStore interface {
+	Store
+	Incr(key string) (int64, error) // IncrBy(key, 1)
+	// IncrBy adds delta to key's value, which must be an integer, returning
+	// the new value.
+	IncrBy(key string, delta int64) (int64, error)
+	// IncrByFloat adds delta to key's value, which may be any number,
+	// returning the new value.
+	IncrByFloat(key string, delta float64) (float64, error)
+}
+
+// maxSafeInteger is the largest integer a float64 holds exactly, and so the
+// largest magnitude of an integer counter.
+const maxSafeInteger = 1<<53 - 1
+
+// ErrNotNumber is returned by counter operations on a key whose value is
+// not a number, or, for IncrBy, not an integer.
+var ErrNotNumber = errors.New("value is not a number")
+
+// ErrOutOfRange is returned by counter operations whose result couldn't be
+// stored exactly: an integer beyond ±(2^53-1), or a float that isn't finite.
+var ErrOutOfRange = errors.New("counter out of range")
+
+// NotNumberError is returned by a counter operation on a value it can't add
+// to. It matches ErrNotNumber with errors.Is.
+type NotNumberError struct {
+	Key     string
+	Value   any
+	Integer bool // whether the operation needed an integer
+}
+
+func (e *NotNumberError) Error() string {
+	if e.Integer {
+		return fmt.Sprintf("%q does not hold an integer", e.Key)
+	}
+	return fmt.Sprintf("%q does not hold a number", e.Key)
+}
+
+func (e *NotNumberError) Unwrap() error {
+	return ErrNotNumber
+}
+
+func (s *inMemoryStore) Incr(key string) (int64, error) {
+	return s.IncrBy(key, 1)
+}
+
+func (s *inMemoryStore) IncrBy(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.lookup(key)
+	result, err := addInt(key, e.value, found, delta)
+	if err != nil {
+		return 0, err
+	}
+	s.commit(walRecord{Op: walOpSet, Key: key, Value: result, ExpiresAt: e.expiresAt})
+	return int64(result), nil
+}
+
+func (s *inMemoryStore) IncrByFloat(key string, delta float64) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.lookup(key)
+	result, err := addFloat(key, e.value, found, delta)
+	if err != nil {
+		return 0, err
+	}
+	s.commit(walRecord{Op: walOpSet, Key: key, Value: result, ExpiresAt: e.expiresAt})
+	return result, nil
+}
+
+// addInt returns key's value, which counts as 0 if not found, plus delta.
+func addInt(key string, value any, found bool, delta int64) (float64, error) {
+	var current float64
+	if found {
+		var ok bool
+		current, ok = numberValue(value)
+		if !ok || current != math.Trunc(current) {
+			return 0, &NotNumberError{Key: key, Value: exportValue(value), Integer: true}
+		}
+	}
+	result := current + float64(delta)
+	if delta < -maxSafeInteger || delta > maxSafeInteger || math.Abs(result) > maxSafeInteger {
+		return 0, fmt.Errorf("%w: %q plus %d", ErrOutOfRange, key, delta)
+	}
+	return result, nil
+}
+
+// addFloat is addInt for a delta that may have a fraction.
+func addFloat(key string, value any, found bool, delta float64) (float64, error) {
+	var current float64
+	if found {
+		var ok bool
+		if current, ok = numberValue(value); !ok {
+			return 0, &NotNumberError{Key: key, Value: exportValue(value)}
+		}
+	}
+	result := current + delta
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, fmt.Errorf("%w: %q plus %g", ErrOutOfRange, key, delta)
+	}
+	return result, nil
+}
+
+// numberValue returns value as a float64, if it is a number: a float64, as
+// decoded from JSON, or an integer set by a Go caller.
+func numberValue(value any) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// counterTestSuite checks counters on every store that supports them.
+type counterTestSuite struct {
+	suite.Suite
+	newStore func() counterTestStore
+	store    counterTestStore
+}
+
+type counterTestStore interface {
+	CounterStore
+	ExpiringVersionedStore
+	ScannableStore
+	Close() error
+}
+
+func (s *counterTestSuite) SetupTest() {
+	s.store = s.newStore()
+}
+
+func (s *counterTestSuite) TearDownTest() {
+	s.store.Close()
+}
+
+func (s *counterTestSuite) TestIncr() {
+	value, err := s.store.Incr("hits")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(1), value)
+	value, err = s.store.IncrBy("hits", 41)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(42), value)
+	value, err = s.store.IncrBy("hits", -50)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(-8), value)
+
+	// stored as JSON numbers decode
+	assert.Equal(s.T(), float64(-8), s.store.Get("hits"))
+	_, version := s.store.GetWithVersion("hits")
+	assert.NotZero(s.T(), version)
+}
+
+func (s *counterTestSuite) TestIncr_ExistingNumbers() {
+	s.store.Set("float", float64(10))
+	s.store.Set("int", 10)
+	for _, key := range []string{"float", "int"} {
+		value, err := s.store.Incr(key)
+		s.Require().NoError(err)
+		assert.Equal(s.T(), int64(11), value)
+	}
+}
+
+func (s *counterTestSuite) TestIncrByFloat() {
+	s.store.Set("rate", 1)
+	value, err := s.store.IncrByFloat("rate", 0.5)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1.5, value)
+
+	value, err = s.store.IncrByFloat("new", -0.25)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), -0.25, value)
+
+	// a fractional value is no longer an integer counter
+	_, err = s.store.Incr("rate")
+	var notNumber *NotNumberError
+	s.Require().ErrorAs(err, &notNumber)
+	assert.True(s.T(), notNumber.Integer)
+	assert.Equal(s.T(), 1.5, s.store.Get("rate"))
+}
+
+func (s *counterTestSuite) TestNotANumber() {
+	for key, value := range map[string]any{"string": "10", "null": nil, "object": map[string]any{"n": 1.0}} {
+		s.store.Set(key, value)
+		_, version := s.store.GetWithVersion(key)
+
+		_, err := s.store.Incr(key)
+		assert.ErrorIs(s.T(), err, ErrNotNumber, key)
+		_, err = s.store.IncrByFloat(key, 1)
+		var notNumber *NotNumberError
+		if assert.ErrorAs(s.T(), err, &notNumber, key) {
+			assert.Equal(s.T(), &NotNumberError{Key: key, Value: value}, notNumber)
+		}
+
+		// the value is left alone
+		_, unchanged := s.store.GetWithVersion(key)
+		assert.Equal(s.T(), version, unchanged, key)
+	}
+}
+
+func (s *counterTestSuite) TestOutOfRange() {
+	_, err := s.store.IncrBy("big", maxSafeInteger)
+	s.Require().NoError(err)
+	_, err = s.store.Incr("big")
+	assert.ErrorIs(s.T(), err, ErrOutOfRange)
+	_, err = s.store.IncrBy("other", 1<<60)
+	assert.ErrorIs(s.T(), err, ErrOutOfRange)
+	assert.Nil(s.T(), s.store.Get("other"))
+
+	s.store.Set("float", 1e308)
+	_, err = s.store.IncrByFloat("float", 1e308)
+	assert.ErrorIs(s.T(), err, ErrOutOfRange)
+	assert.Equal(s.T(), 1e308, s.store.Get("float"))
+}
+
+func (s *counterTestSuite) TestKeepsTTL() {
+	s.store.SetWithTTL("hits", 1, time.Minute)
+	_, err := s.store.Incr("hits")
+	s.Require().NoError(err)
+
+	entries, _ := s.store.Scan("hits", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), float64(2), entries[0].Value)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *counterTestSuite) TestConcurrentIncrements() {
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				s.store.Incr("hits")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(s.T(), float64(1000), s.store.Get("hits"))
+}
+
+func TestCounterTestSuite(t *testing.T) {
+	suite.Run(t, &counterTestSuite{newStore: func() counterTestStore { return NewInMemoryStore() }})
+}
+
+func TestShardedCounterTestSuite(t *testing.T) {
+	suite.Run(t, &counterTestSuite{newStore: func() counterTestStore { return NewShardedStore(8) }})
+}
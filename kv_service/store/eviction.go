@@ -0,0 +1,271 @@
+package store
+
+import (
+	"container/heap"
+	"container/list"
+	"math/rand/v2"
+)
+
+// EvictionPolicy chooses which keys a bounded store evicts when it is over
+// budget. The store serialises calls, so implementations need not be safe
+// for concurrent use.
+type EvictionPolicy interface {
+	Add(key string)    // key was written, whether or not it already existed
+	Access(key string) // key was read
+	Remove(key string) // key was deleted or expired
+	// Evict chooses a key to evict and forgets it, reporting false if the
+	// policy holds no keys.
+	Evict() (string, bool)
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently used key.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+type lruPolicy struct {
+	order *list.List // of keys; front is most recently used
+	elems map[string]*list.Element
+}
+
+func (p *lruPolicy) Add(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) Evict() (string, bool) {
+	elem := p.order.Back()
+	if elem == nil {
+		return "", false
+	}
+	key := p.order.Remove(elem).(string)
+	delete(p.elems, key)
+	return key, true
+}
+
+// NewLFUPolicy returns a policy that evicts the least frequently used key,
+// breaking ties by evicting the least recently used.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{items: make(map[string]*lfuItem)}
+}
+
+type lfuPolicy struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	tick  uint64 // logical clock for recency
+}
+
+type lfuItem struct {
+	key      string
+	uses     uint64
+	lastUsed uint64
+	index    int // position in heap
+}
+
+func (p *lfuPolicy) Add(key string) {
+	if _, ok := p.items[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.tick++
+	item := &lfuItem{key: key, uses: 1, lastUsed: p.tick}
+	p.items[key] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *lfuPolicy) Access(key string) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	item.uses++
+	item.lastUsed = p.tick
+	heap.Fix(&p.heap, item.index)
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *lfuPolicy) Evict() (string, bool) {
+	if p.heap.Len() == 0 {
+		return "", false
+	}
+	item := heap.Pop(&p.heap).(*lfuItem)
+	delete(p.items, item.key)
+	return item.key, true
+}
+
+// lfuHeap is a min-heap of items ordered by uses, then by recency.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].uses != h[j].uses {
+		return h[i].uses < h[j].uses
+	}
+	return h[i].lastUsed < h[j].lastUsed
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// NewRandomPolicy returns a policy that evicts a key chosen uniformly at random.
+func NewRandomPolicy() EvictionPolicy {
+	return &randomPolicy{index: make(map[string]int)}
+}
+
+type randomPolicy struct {
+	keys  []string
+	index map[string]int // position of each key in keys
+}
+
+func (p *randomPolicy) Add(key string) {
+	if _, ok := p.index[key]; !ok {
+		p.index[key] = len(p.keys)
+		p.keys = append(p.keys, key)
+	}
+}
+
+func (p *randomPolicy) Access(string) {}
+
+func (p *randomPolicy) Remove(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	// swap the last key into the gap
+	last := p.keys[len(p.keys)-1]
+	p.keys[i] = last
+	p.index[last] = i
+	p.keys = p.keys[:len(p.keys)-1]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy) Evict() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	key := p.keys[rand.IntN(len(p.keys))]
+	p.Remove(key)
+	return key, true
+}
+
+// NewARCPolicy returns an Adaptive Replacement Cache policy, which balances
+// evicting keys used once recently against keys used repeatedly, adapting to
+// the workload by remembering recently evicted keys.
+func NewARCPolicy() EvictionPolicy {
+	return &arcPolicy{
+		t1: list.New(), t2: list.New(), b1: list.New(), b2: list.New(),
+		where: make(map[string]arcRef),
+	}
+}
+
+// arcPolicy follows Megiddo and Modha's ARC. t1 holds keys used once since
+// they were stored and t2 keys used more than once; b1 and b2 are ghost
+// lists of keys recently evicted from each. The capacity ARC adapts within
+// is the most keys the store has held, since the budget may be in bytes.
+type arcPolicy struct {
+	t1, t2, b1, b2 *list.List // of keys; front is most recent
+	where          map[string]arcRef
+	target         int // target length of t1
+	capacity       int
+}
+
+type arcRef struct {
+	list *list.List
+	elem *list.Element
+}
+
+func (p *arcPolicy) Add(key string) {
+	ref, ok := p.where[key]
+	switch {
+	case !ok:
+		p.push(p.t1, key)
+	case ref.list == p.t1 || ref.list == p.t2:
+		p.promote(key, ref)
+	case ref.list == p.b1:
+		// a key evicted for being used once was wanted again: favour t1
+		p.target = min(p.target+max(1, p.b2.Len()/p.b1.Len()), p.capacity)
+		p.promote(key, ref)
+	case ref.list == p.b2:
+		p.target = max(p.target-max(1, p.b1.Len()/p.b2.Len()), 0)
+		p.promote(key, ref)
+	}
+	p.capacity = max(p.capacity, p.t1.Len()+p.t2.Len())
+}
+
+func (p *arcPolicy) Access(key string) {
+	if ref, ok := p.where[key]; ok && (ref.list == p.t1 || ref.list == p.t2) {
+		p.promote(key, ref)
+	}
+}
+
+func (p *arcPolicy) Remove(key string) {
+	if ref, ok := p.where[key]; ok {
+		ref.list.Remove(ref.elem)
+		delete(p.where, key)
+	}
+}
+
+func (p *arcPolicy) Evict() (string, bool) {
+	from, ghost := p.t2, p.b2
+	if p.t1.Len() > 0 && (p.t1.Len() > p.target || p.t2.Len() == 0) {
+		from, ghost = p.t1, p.b1
+	}
+	elem := from.Back()
+	if elem == nil {
+		return "", false
+	}
+	key := from.Remove(elem).(string)
+	p.push(ghost, key)
+	for _, ghost := range []*list.List{p.b1, p.b2} {
+		for ghost.Len() > p.capacity {
+			delete(p.where, ghost.Remove(ghost.Back()).(string))
+		}
+	}
+	return key, true
+}
+
+// promote moves key, found at ref, to the front of t2.
+func (p *arcPolicy) promote(key string, ref arcRef) {
+	ref.list.Remove(ref.elem)
+	p.push(p.t2, key)
+}
+
+func (p *arcPolicy) push(l *list.List, key string) {
+	p.where[key] = arcRef{list: l, elem: l.PushFront(key)}
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type evictionTestSuite struct {
+	suite.Suite
+}
+
+// drain evicts every key from policy, in the order it chooses them.
+func drain(policy EvictionPolicy) []string {
+	var keys []string
+	for key, ok := policy.Evict(); ok; key, ok = policy.Evict() {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *evictionTestSuite) TestLRU() {
+	policy := NewLRUPolicy()
+	policy.Add("a")
+	policy.Add("b")
+	policy.Add("c")
+	policy.Add("d")
+	policy.Access("a")  // reads count as use
+	policy.Add("b")     // so do writes
+	policy.Remove("c")  // removed keys are never chosen
+	policy.Access("zz") // accessing an unknown key is ignored
+
+	assert.Equal(s.T(), []string{"d", "a", "b"}, drain(policy))
+}
+
+func (s *evictionTestSuite) TestLFU() {
+	policy := NewLFUPolicy()
+	policy.Add("a")
+	policy.Add("b")
+	policy.Add("c")
+	policy.Add("d")
+	policy.Access("a")
+	policy.Access("a")
+	policy.Access("b")
+	policy.Access("d")
+	policy.Remove("c")
+
+	// fewest uses first, then least recently used among equals
+	assert.Equal(s.T(), []string{"b", "d", "a"}, drain(policy))
+}
+
+func (s *evictionTestSuite) TestRandom() {
+	policy := NewRandomPolicy()
+	for i := 0; i < 100; i++ {
+		policy.Add(fmt.Sprint(i))
+	}
+	policy.Add("0") // already held
+	policy.Remove("50")
+
+	keys := drain(policy)
+	evicted := make(map[string]bool)
+	for _, key := range keys {
+		evicted[key] = true
+	}
+	// every key held is evicted exactly once
+	assert.Len(s.T(), keys, 99)
+	assert.Len(s.T(), evicted, 99)
+	assert.NotContains(s.T(), evicted, "50")
+}
+
+func (s *evictionTestSuite) TestARC() {
+	policy := NewARCPolicy()
+	policy.Add("once")
+	policy.Add("twice")
+	policy.Access("twice")
+	policy.Remove("gone")
+
+	// keys used once go before keys used repeatedly
+	assert.Equal(s.T(), []string{"once", "twice"}, drain(policy))
+}
+
+// TestScanResistance checks the reason to choose ARC over LRU: a burst of
+// keys used only once doesn't flush out keys in repeated use.
+func (s *evictionTestSuite) TestScanResistance() {
+	const capacity = 10
+	survivors := func(policy EvictionPolicy) int {
+		held := make(map[string]bool)
+		add := func(key string) {
+			policy.Add(key)
+			held[key] = true
+			for len(held) > capacity {
+				evicted, _ := policy.Evict()
+				delete(held, evicted)
+			}
+		}
+		for round := 0; round < 3; round++ {
+			for i := 0; i < capacity/2; i++ {
+				key := fmt.Sprint("hot", i)
+				if held[key] {
+					policy.Access(key)
+				} else {
+					add(key)
+				}
+			}
+		}
+		for i := 0; i < capacity; i++ {
+			add(fmt.Sprint("scan", i))
+		}
+		hot := 0
+		for i := 0; i < capacity/2; i++ {
+			if held[fmt.Sprint("hot", i)] {
+				hot++
+			}
+		}
+		return hot
+	}
+
+	assert.Equal(s.T(), 0, survivors(NewLRUPolicy()))
+	assert.Equal(s.T(), capacity/2, survivors(NewARCPolicy()))
+	assert.Equal(s.T(), capacity/2, survivors(NewLFUPolicy()))
+}
+
+func (s *evictionTestSuite) TestARCAdapts() {
+	policy := NewARCPolicy().(*arcPolicy)
+	for i := 0; i < 4; i++ {
+		policy.Add(fmt.Sprint(i))
+	}
+	evicted, _ := policy.Evict()
+	assert.Equal(s.T(), "0", evicted)
+
+	// re-adding a key evicted from t1 grows t1's target and promotes it
+	policy.Add("0")
+	assert.Equal(s.T(), 1, policy.target)
+	assert.Equal(s.T(), 1, policy.t2.Len())
+
+	// ghosts are bounded by the most keys held
+	for i := 10; i < 100; i++ {
+		policy.Add(fmt.Sprint(i))
+		policy.Evict()
+	}
+	assert.LessOrEqual(s.T(), policy.b1.Len(), policy.capacity)
+	assert.LessOrEqual(s.T(), policy.b2.Len(), policy.capacity)
+}
+
+func TestEvictionTestSuite(t *testing.T) {
+	suite.Run(t, new(evictionTestSuite))
+}
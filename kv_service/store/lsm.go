@@ -0,0 +1,717 @@
+package store
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	lsmManifestName = "MANIFEST"
+	// lsmDefaultMemtableSize is the default LSMOptions.MemtableSize.
+	lsmDefaultMemtableSize = 4 << 20
+	// lsmCompactionFanIn is how many similarly sized tables are merged at
+	// once, and the size ratio between tiers.
+	lsmCompactionFanIn = 4
+)
+
+// LSMOptions configures an LSM store.
+type LSMOptions struct {
+	WAL WALOptions
+	// MemtableSize is roughly how many bytes of writes are buffered in memory
+	// before being flushed to a table. Zero uses 4 MiB.
+	MemtableSize int64
+}
+
+// lsmStore is a durable Store for data sets larger than memory, built as a
+// log-structured merge tree. Writes go to a write-ahead log and a sorted
+// in-memory memtable; a full memtable is flushed in the background to an
+// immutable SSTable, and similarly sized tables are merged by background
+// compaction. Reads check the memtables, then the tables from newest to
+// oldest, skipping any whose bloom filter rules the key out.
+//
+// Deletes are written as tombstones, which shadow older values until
+// compaction into the oldest table discards both. Values are stored as
+// JSON, so read back with JSON types as they are from a walStore.
+//
+// Like the other durable stores, it panics if a write can't be persisted
+// and, since Store has no way to report it, if a table can't be read.
+type lsmStore struct {
+	dir  string
+	opts LSMOptions
+
+	mu      sync.RWMutex
+	mem     *memtable  // takes writes
+	imm     *memtable  // full, and being flushed; nil if none
+	tables  []*sstable // newest first
+	log     *writeAheadLog
+	bgErr   error      // sticky; once background work fails, writes are refused
+	flushed *sync.Cond // signalled on mu when imm is flushed
+	closed  bool
+
+	nextFile atomic.Uint64
+	work     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// lsmManifest records which files make up the store. It is replaced
+// atomically, so files written by a flush or compaction only count once it
+// lists them, and files it no longer lists are leftovers.
+type lsmManifest struct {
+	NextFile uint64   `json:"next_file"`
+	Tables   []string `json:"tables"` // newest first
+	Logs     []string `json:"logs"`   // unflushed write-ahead logs, oldest first
+}
+
+// NewLSMStore opens an LSM store in dataDir, creating the directory if
+// needed and replaying any unflushed writes. Call Close to flush and
+// release it.
+func NewLSMStore(dataDir string, opts LSMOptions) (*lsmStore, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = lsmDefaultMemtableSize
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	manifest, err := readLSMManifest(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeLSMLeftovers(dataDir, manifest); err != nil {
+		return nil, err
+	}
+
+	s := &lsmStore{dir: dataDir, opts: opts, work: make(chan struct{}, 1), done: make(chan struct{})}
+	s.flushed = sync.NewCond(&s.mu)
+	s.nextFile.Store(manifest.NextFile)
+	for _, name := range manifest.Tables {
+		table, err := openSSTable(filepath.Join(dataDir, name), name)
+		if err != nil {
+			s.releaseTables(s.tables)
+			return nil, err
+		}
+		s.tables = append(s.tables, table)
+	}
+
+	logs := manifest.Logs
+	if len(logs) == 0 {
+		logs = []string{s.newFileName(".log")}
+	}
+	s.mem = newMemtable(logs)
+	for i, name := range logs {
+		log, err := openWAL(filepath.Join(dataDir, name), opts.WAL, s.mem.replay)
+		if err != nil {
+			s.releaseTables(s.tables)
+			return nil, err
+		}
+		if i < len(logs)-1 {
+			log.close()
+		} else {
+			s.log = log
+		}
+	}
+	if err := s.writeManifest(); err != nil {
+		s.log.close()
+		s.releaseTables(s.tables)
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.background()
+	// tables left uncompacted by a previous run are merged now
+	s.signal()
+	return s, nil
+}
+
+func (s *lsmStore) Set(key string, value any) {
+	s.write(walRecord{Op: walOpSet, Key: key, Value: value})
+}
+
+func (s *lsmStore) Get(key string) any {
+	value, _ := s.Lookup(key)
+	return value
+}
+
+// Lookup reads the newest record of key, from the memtables and then the
+// tables, newest first; a tombstone means the key was deleted.
+func (s *lsmStore) Lookup(key string) (any, bool) {
+	s.mu.RLock()
+	for _, m := range []*memtable{s.mem, s.imm} {
+		if m == nil {
+			continue
+		}
+		if e, ok := m.entries[key]; ok {
+			s.mu.RUnlock()
+			return e.value, !e.deleted
+		}
+	}
+	tables := s.acquireTables()
+	s.mu.RUnlock()
+	defer s.releaseTables(tables)
+
+	for _, table := range tables {
+		record, ok, err := table.get(key)
+		if err != nil {
+			panic(fmt.Errorf("lsm: reading %q: %w", key, err))
+		}
+		if !ok {
+			continue
+		}
+		if record.deleted {
+			return nil, false
+		}
+		value, err := record.decode()
+		if err != nil {
+			panic(fmt.Errorf("lsm: decoding %q: %w", key, err))
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+func (s *lsmStore) Delete(key string) {
+	s.write(walRecord{Op: walOpDelete, Key: key})
+}
+
+// Scan merges the memtables and every table, so a page costs reads from
+// each table but never more than the page's worth of blocks from one.
+// Entries carry no version, as an LSM store isn't versioned.
+func (s *lsmStore) Scan(prefix, startAfter string, limit int) ([]Entry, bool) {
+	pivot := prefix
+	if startAfter >= pivot {
+		// the smallest string sorting after startAfter
+		pivot = startAfter + "\x00"
+	}
+
+	s.mu.RLock()
+	// the mutable memtable is copied, as writes may change it mid-scan
+	sources := []lsmIterator{&sliceIterator{records: s.mem.records(pivot, prefix)}}
+	if s.imm != nil {
+		sources = append(sources, &sliceIterator{records: s.imm.records(pivot, prefix)})
+	}
+	tables := s.acquireTables()
+	s.mu.RUnlock()
+	defer s.releaseTables(tables)
+	for _, table := range tables {
+		sources = append(sources, table.seek(pivot))
+	}
+
+	var entries []Entry
+	more := false
+	it := newMergeIterator(sources)
+	for ; it.valid(); it.next() {
+		record := it.record()
+		if !strings.HasPrefix(record.key, prefix) {
+			break
+		}
+		if record.deleted {
+			continue
+		}
+		if limit > 0 && len(entries) == limit {
+			more = true
+			break
+		}
+		value, err := record.decode()
+		if err != nil {
+			panic(fmt.Errorf("lsm: decoding %q: %w", record.key, err))
+		}
+		entries = append(entries, Entry{Key: record.key, Value: value})
+	}
+	if err := it.err(); err != nil {
+		panic(fmt.Errorf("lsm: scanning %q: %w", prefix, err))
+	}
+	return entries, more
+}
+
+// Close stops background work and closes the log and tables. Writes still
+// in memtables are not flushed, but replayed from the log when the store is
+// next opened. The store must not be used afterwards.
+func (s *lsmStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.flushed.Broadcast()
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.log.close(), s.releaseTables(s.tables))
+}
+
+// write logs record and applies it to the memtable, handing the memtable
+// off to be flushed once it is full.
+func (s *lsmStore) write(record walRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// hold back writers while a second full memtable waits for the first
+	// to flush, so memory stays bounded when writes outpace the disk
+	for s.imm != nil && s.mem.size >= s.opts.MemtableSize && s.bgErr == nil && !s.closed {
+		s.flushed.Wait()
+	}
+	if s.bgErr != nil {
+		panic(s.bgErr)
+	}
+	if err := s.log.append(record); err != nil {
+		panic(fmt.Errorf("lsm: %s %q not persisted: %w", record.Op, record.Key, err))
+	}
+	s.mem.replay(record)
+	if s.mem.size >= s.opts.MemtableSize && s.imm == nil {
+		if err := s.rotate(); err != nil {
+			s.bgErr = fmt.Errorf("lsm: switching memtable: %w", err)
+		}
+	}
+}
+
+// rotate makes the full memtable immutable and starts a new one with its
+// own log, so the full one's log can be removed once it is flushed. Callers
+// must hold mu.
+func (s *lsmStore) rotate() error {
+	name := s.newFileName(".log")
+	log, err := openWAL(filepath.Join(s.dir, name), s.opts.WAL, func(walRecord) {})
+	if err != nil {
+		return err
+	}
+	full, fullLog := s.mem, s.log
+	s.imm, s.log = full, log
+	s.mem = newMemtable([]string{name})
+	if err := s.writeManifest(); err != nil {
+		s.imm, s.log, s.mem = nil, fullLog, full
+		log.close()
+		os.Remove(filepath.Join(s.dir, name))
+		return err
+	}
+	if err := fullLog.close(); err != nil {
+		return err
+	}
+	s.signal()
+	return nil
+}
+
+// signal wakes the background worker, if it isn't already due to run.
+func (s *lsmStore) signal() {
+	select {
+	case s.work <- struct{}{}:
+	default:
+	}
+}
+
+// background flushes and compacts until the store is closed. Only it
+// changes the table list, so it reads the list without locking.
+func (s *lsmStore) background() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.work:
+		case <-s.done:
+			return
+		}
+		err := s.flush()
+		for compacted := true; err == nil && compacted; {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			compacted, err = s.compact()
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.bgErr = fmt.Errorf("lsm: background work failed: %w", err)
+			s.flushed.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// flush writes the immutable memtable, if any, to a new table.
+func (s *lsmStore) flush() error {
+	s.mu.RLock()
+	imm := s.imm
+	s.mu.RUnlock()
+	if imm == nil {
+		return nil
+	}
+
+	// with no older tables there is nothing for tombstones to shadow
+	it := &sliceIterator{records: imm.records("", "")}
+	table, err := s.writeTable(it, len(imm.entries), len(s.tables) == 0)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if table != nil {
+		s.tables = append([]*sstable{table}, s.tables...)
+	}
+	s.imm = nil
+	err = s.writeManifest()
+	s.flushed.Broadcast()
+	s.mu.Unlock()
+	if err != nil {
+		// the old manifest still lists the logs, which must be kept
+		return err
+	}
+	for _, name := range imm.logs {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact merges one run of similarly sized tables, if there is one, and
+// reports whether it did.
+func (s *lsmStore) compact() (bool, error) {
+	start, n := pickCompaction(s.tables, s.opts.MemtableSize)
+	if n == 0 {
+		return false, nil
+	}
+	inputs := s.tables[start : start+n]
+	sources := make([]lsmIterator, len(inputs))
+	expected := 0
+	for i, table := range inputs {
+		sources[i] = table.seek("")
+		expected += int(table.records)
+	}
+	// tombstones only need keeping while an older table might hold the key
+	dropTombstones := start+n == len(s.tables)
+	table, err := s.writeTable(newMergeIterator(sources), expected, dropTombstones)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	tables := append([]*sstable(nil), s.tables[:start]...)
+	if table != nil {
+		tables = append(tables, table)
+	}
+	s.tables = append(tables, s.tables[start+n:]...)
+	err = s.writeManifest()
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	for _, input := range inputs {
+		input.obsolete.Store(true)
+	}
+	return true, s.releaseTables(inputs)
+}
+
+// pickCompaction returns the first run of at least lsmCompactionFanIn
+// adjacent tables in the same size tier. Merging only adjacent tables keeps
+// the list ordered by age, and merging by tier writes each record
+// O(log n) times rather than on every compaction.
+func pickCompaction(tables []*sstable, memtableSize int64) (start, n int) {
+	for i := 0; i < len(tables); {
+		tier := lsmTier(tables[i].size, memtableSize)
+		j := i + 1
+		for j < len(tables) && lsmTier(tables[j].size, memtableSize) == tier {
+			j++
+		}
+		if j-i >= lsmCompactionFanIn {
+			return i, j - i
+		}
+		i = j
+	}
+	return 0, 0
+}
+
+// lsmTier groups table sizes by powers of lsmCompactionFanIn.
+func lsmTier(size, memtableSize int64) int {
+	tier := 0
+	for limit := memtableSize; size >= limit; limit *= lsmCompactionFanIn {
+		tier++
+	}
+	return tier
+}
+
+// writeTable writes the records of it to a new table, returning nil if
+// there were none to write.
+func (s *lsmStore) writeTable(it lsmIterator, expectedKeys int, dropTombstones bool) (*sstable, error) {
+	name := s.newFileName(".sst")
+	path := filepath.Join(s.dir, name)
+	w, err := newSSTWriter(path, expectedKeys)
+	if err != nil {
+		return nil, err
+	}
+	for ; it.valid(); it.next() {
+		if dropTombstones && it.record().deleted {
+			continue
+		}
+		if err := w.add(it.record()); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if err := it.err(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if w.records == 0 {
+		w.abort()
+		return nil, nil
+	}
+	if err := w.finish(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return openSSTable(path, name)
+}
+
+func (s *lsmStore) newFileName(ext string) string {
+	return fmt.Sprintf("%06d%s", s.nextFile.Add(1), ext)
+}
+
+// writeManifest atomically replaces the manifest with the current state.
+// Callers must hold mu, or be opening the store.
+func (s *lsmStore) writeManifest() error {
+	manifest := lsmManifest{NextFile: s.nextFile.Load(), Tables: []string{}, Logs: []string{}}
+	for _, table := range s.tables {
+		manifest.Tables = append(manifest.Tables, table.name)
+	}
+	if s.imm != nil {
+		manifest.Logs = append(manifest.Logs, s.imm.logs...)
+	}
+	manifest.Logs = append(manifest.Logs, s.mem.logs...)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, lsmManifestName+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, lsmManifestName))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// persists the rename, and the entries of files the manifest now lists
+	return syncDir(s.dir)
+}
+
+func readLSMManifest(dir string) (lsmManifest, error) {
+	var manifest lsmManifest
+	data, err := os.ReadFile(filepath.Join(dir, lsmManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("lsm: unreadable manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// removeLSMLeftovers removes tables and logs the manifest doesn't list, as
+// left by a crash during a flush or compaction.
+func removeLSMLeftovers(dir string, manifest lsmManifest) error {
+	live := make(map[string]bool)
+	for _, name := range append(manifest.Tables, manifest.Logs...) {
+		live[name] = true
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		leftover := name == lsmManifestName+".tmp" ||
+			(strings.HasSuffix(name, ".sst") || strings.HasSuffix(name, ".log")) && !live[name]
+		if leftover {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return errors.Join(err, d.Close())
+}
+
+// acquireTables returns the current tables, each with a reference the
+// caller must release. Callers must hold mu.
+func (s *lsmStore) acquireTables() []*sstable {
+	tables := append([]*sstable(nil), s.tables...)
+	for _, table := range tables {
+		table.acquire()
+	}
+	return tables
+}
+
+func (s *lsmStore) releaseTables(tables []*sstable) error {
+	var errs []error
+	for _, table := range tables {
+		errs = append(errs, table.release())
+	}
+	return errors.Join(errs...)
+}
+
+// memtable holds recent writes, tombstones included, sorted by key.
+type memtable struct {
+	entries map[string]lsmRecord
+	keys    *skipList[string]
+	size    int64    // estimated, as for a BoundedStore
+	logs    []string // write-ahead logs holding these writes
+}
+
+func newMemtable(logs []string) *memtable {
+	return &memtable{entries: make(map[string]lsmRecord), keys: newSkipList(strings.Compare), logs: logs}
+}
+
+// replay applies a logged write.
+func (m *memtable) replay(record walRecord) {
+	entry := lsmRecord{key: record.Key, value: record.Value, deleted: record.Op == walOpDelete}
+	if old, ok := m.entries[record.Key]; ok {
+		m.size -= sizeOfEntry(record.Key, old.value)
+	} else {
+		m.keys.Insert(record.Key)
+	}
+	m.entries[record.Key] = entry
+	m.size += sizeOfEntry(record.Key, entry.value)
+}
+
+// records returns the records with prefix from pivot on, in order.
+func (m *memtable) records(pivot, prefix string) []lsmRecord {
+	var records []lsmRecord
+	m.keys.Ascend(pivot, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		records = append(records, m.entries[key])
+		return true
+	})
+	return records
+}
+
+// lsmIterator walks one source's records in key order.
+type lsmIterator interface {
+	valid() bool
+	record() lsmRecord
+	next()
+	err() error
+}
+
+type sliceIterator struct {
+	records []lsmRecord
+}
+
+func (it *sliceIterator) valid() bool       { return len(it.records) > 0 }
+func (it *sliceIterator) record() lsmRecord { return it.records[0] }
+func (it *sliceIterator) next()             { it.records = it.records[1:] }
+func (it *sliceIterator) err() error        { return nil }
+
+// mergeIterator merges sources, ordered newest first, into one walk over
+// every key, yielding only the newest record of each.
+type mergeIterator struct {
+	sources []lsmIterator
+	heap    mergeHeap
+	fault   error
+}
+
+func newMergeIterator(sources []lsmIterator) *mergeIterator {
+	it := &mergeIterator{sources: sources, heap: mergeHeap{sources: sources}}
+	for i, source := range sources {
+		if source.valid() {
+			it.heap.order = append(it.heap.order, i)
+		} else if err := source.err(); err != nil {
+			it.fault = err
+		}
+	}
+	heap.Init(&it.heap)
+	return it
+}
+
+func (it *mergeIterator) valid() bool {
+	return it.fault == nil && len(it.heap.order) > 0
+}
+
+func (it *mergeIterator) record() lsmRecord {
+	return it.sources[it.heap.order[0]].record()
+}
+
+// next advances past the current key in every source that has it.
+func (it *mergeIterator) next() {
+	key := it.record().key
+	for len(it.heap.order) > 0 {
+		source := it.sources[it.heap.order[0]]
+		if source.record().key != key {
+			return
+		}
+		source.next()
+		if source.valid() {
+			heap.Fix(&it.heap, 0)
+			continue
+		}
+		if err := source.err(); err != nil {
+			it.fault = err
+			return
+		}
+		heap.Pop(&it.heap)
+	}
+}
+
+func (it *mergeIterator) err() error {
+	return it.fault
+}
+
+// mergeHeap orders sources by their current key, then by age, so the
+// newest record of the smallest key is on top.
+type mergeHeap struct {
+	sources []lsmIterator
+	order   []int // indexes into sources
+}
+
+func (h mergeHeap) Len() int { return len(h.order) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[h.order[i]].record().key, h.sources[h.order[j]].record().key
+	if a != b {
+		return a < b
+	}
+	return h.order[i] < h.order[j]
+}
+
+func (h mergeHeap) Swap(i, j int) { h.order[i], h.order[j] = h.order[j], h.order[i] }
+
+func (h *mergeHeap) Push(x any) { h.order = append(h.order, x.(int)) }
+
+func (h *mergeHeap) Pop() any {
+	last := h.order[len(h.order)-1]
+	h.order = h.order[:len(h.order)-1]
+	return last
+}
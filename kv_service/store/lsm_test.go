@@ -0,0 +1,259 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type lsmStoreTestSuite struct {
+	suite.Suite
+	dataDir string
+}
+
+func (s *lsmStoreTestSuite) SetupTest() {
+	s.dataDir = s.T().TempDir()
+}
+
+// open returns a store with a small memtable, so tests flush and compact.
+func (s *lsmStoreTestSuite) open() *lsmStore {
+	store, err := NewLSMStore(s.dataDir, LSMOptions{WAL: WALOptions{SyncPolicy: SyncNever}, MemtableSize: 16 << 10})
+	s.Require().NoError(err)
+	return store
+}
+
+// settle waits for background flushing and compaction to finish.
+func (s *lsmStoreTestSuite) settle(store *lsmStore) {
+	s.Require().Eventually(func() bool {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		_, n := pickCompaction(store.tables, store.opts.MemtableSize)
+		return store.imm == nil && n == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+func (s *lsmStoreTestSuite) numTables(store *lsmStore) int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.tables)
+}
+
+func (s *lsmStoreTestSuite) TestImplementsStore() {
+	store := s.open()
+	defer store.Close()
+
+	assert.Implements(s.T(), (*Store)(nil), store)
+	assert.Implements(s.T(), (*ScannableStore)(nil), store)
+}
+
+func (s *lsmStoreTestSuite) TestSetGetDelete() {
+	store := s.open()
+	defer store.Close()
+
+	assert.Nil(s.T(), store.Get("missing"))
+	store.Set("key", "value")
+	assert.Equal(s.T(), "value", store.Get("key"))
+	store.Set("key", "new")
+	assert.Equal(s.T(), "new", store.Get("key"))
+	store.Delete("key")
+	assert.Nil(s.T(), store.Get("key"))
+	store.Delete("missing")
+	assert.Nil(s.T(), store.Get("missing"))
+}
+
+func (s *lsmStoreTestSuite) TestReadsFromTables() {
+	store := s.open()
+	defer store.Close()
+
+	for i := 0; i < 2000; i++ {
+		store.Set(fmt.Sprintf("key%04d", i), map[string]any{"i": float64(i)})
+	}
+	for i := 0; i < 2000; i += 2 {
+		store.Delete(fmt.Sprintf("key%04d", i))
+	}
+	s.settle(store)
+	assert.NotZero(s.T(), s.numTables(store))
+
+	for i := 0; i < 2000; i++ {
+		value := store.Get(fmt.Sprintf("key%04d", i))
+		if i%2 == 0 {
+			assert.Nil(s.T(), value, i)
+		} else {
+			assert.Equal(s.T(), map[string]any{"i": float64(i)}, value, i)
+		}
+	}
+}
+
+func (s *lsmStoreTestSuite) TestLookup() {
+	store := s.open()
+	defer store.Close()
+
+	store.Set("null", nil)
+	store.Set("deleted", "value")
+	store.Delete("deleted")
+	for _, settled := range []bool{false, true} {
+		if settled {
+			// read the same records back from the tables
+			for i := 0; i < 2000; i++ {
+				store.Set(fmt.Sprintf("key%04d", i), float64(i))
+			}
+			s.settle(store)
+		}
+		value, ok := store.Lookup("null")
+		assert.True(s.T(), ok, settled)
+		assert.Nil(s.T(), value, settled)
+		_, ok = store.Lookup("deleted")
+		assert.False(s.T(), ok, settled)
+		_, ok = store.Lookup("missing")
+		assert.False(s.T(), ok, settled)
+	}
+}
+
+func (s *lsmStoreTestSuite) TestCompactionBoundsTables() {
+	store := s.open()
+	defer store.Close()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 1000; i++ {
+			store.Set(fmt.Sprintf("key%04d", i), fmt.Sprint(round))
+		}
+	}
+	s.settle(store)
+	// fewer than lsmCompactionFanIn tables per tier remain
+	assert.Less(s.T(), s.numTables(store), 2*lsmCompactionFanIn)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(s.T(), "4", store.Get(fmt.Sprintf("key%04d", i)))
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.dataDir, "*.sst"))
+	s.Require().NoError(err)
+	assert.Len(s.T(), files, s.numTables(store), "replaced tables are removed")
+}
+
+func (s *lsmStoreTestSuite) TestCompactionDropsTombstones() {
+	store := s.open()
+	defer store.Close()
+
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprintf("key%04d", i), "value")
+	}
+	for i := 0; i < 1000; i++ {
+		store.Delete(fmt.Sprintf("key%04d", i))
+	}
+	// enough padding to flush the deletes and force compactions
+	for i := 0; i < 5000; i++ {
+		store.Set(fmt.Sprintf("other%04d", i), "value")
+	}
+	s.settle(store)
+
+	store.mu.RLock()
+	oldest := store.tables[len(store.tables)-1]
+	store.mu.RUnlock()
+	record, ok, err := oldest.get("key0500")
+	s.Require().NoError(err)
+	assert.False(s.T(), ok && record.deleted, "the oldest table keeps no tombstones")
+	assert.Nil(s.T(), store.Get("key0500"))
+}
+
+func (s *lsmStoreTestSuite) TestScan() {
+	store := s.open()
+	defer store.Close()
+
+	for i := 0; i < 1500; i++ {
+		store.Set(fmt.Sprintf("a/%04d", i), float64(i))
+		store.Set(fmt.Sprintf("b/%04d", i), float64(i))
+	}
+	s.settle(store)
+	// newer writes in the memtable shadow the tables
+	for i := 0; i < 1500; i += 3 {
+		store.Delete(fmt.Sprintf("a/%04d", i))
+	}
+	store.Set("a/0001", "updated")
+
+	var entries []Entry
+	startAfter := ""
+	for {
+		page, more := store.Scan("a/", startAfter, 100)
+		entries = append(entries, page...)
+		if !more {
+			break
+		}
+		startAfter = page[len(page)-1].Key
+	}
+	s.Require().Len(entries, 1000)
+	assert.Equal(s.T(), Entry{Key: "a/0001", Value: "updated"}, entries[0])
+	assert.Equal(s.T(), Entry{Key: "a/0002", Value: float64(2)}, entries[1])
+	assert.Equal(s.T(), "a/1499", entries[len(entries)-1].Key)
+	for i := 1; i < len(entries); i++ {
+		assert.Less(s.T(), entries[i-1].Key, entries[i].Key)
+	}
+
+	all, more := store.Scan("", "", 0)
+	assert.False(s.T(), more)
+	assert.Len(s.T(), all, 2500)
+}
+
+func (s *lsmStoreTestSuite) TestSurvivesRestart() {
+	store := s.open()
+	for i := 0; i < 2000; i++ {
+		store.Set(fmt.Sprintf("key%04d", i), float64(i))
+	}
+	store.Delete("key0001")
+	store.Set("object", map[string]any{"nested": []any{"a", float64(1)}})
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+	assert.Equal(s.T(), float64(1999), store.Get("key1999"))
+	assert.Equal(s.T(), float64(0), store.Get("key0000"))
+	assert.Nil(s.T(), store.Get("key0001"))
+	assert.Equal(s.T(), map[string]any{"nested": []any{"a", float64(1)}}, store.Get("object"))
+}
+
+func (s *lsmStoreTestSuite) TestRemovesLeftovers() {
+	store := s.open()
+	store.Set("key", "value")
+	s.Require().NoError(store.Close())
+
+	// as left by a crash mid-flush
+	leftover := filepath.Join(s.dataDir, "999999.sst")
+	s.Require().NoError(os.WriteFile(leftover, []byte("partial"), 0o644))
+
+	store = s.open()
+	defer store.Close()
+	assert.NoFileExists(s.T(), leftover)
+	assert.Equal(s.T(), "value", store.Get("key"))
+}
+
+func (s *lsmStoreTestSuite) TestConcurrentReadsDuringCompaction() {
+	store := s.open()
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("w%d/%04d", w, i)
+				store.Set(key, float64(i))
+				assert.Equal(s.T(), float64(i), store.Get(key))
+				if i%100 == 0 {
+					entries, _ := store.Scan(fmt.Sprintf("w%d/", w), "", 0)
+					assert.Len(s.T(), entries, i+1)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestLSMStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(lsmStoreTestSuite))
+}
@@ -0,0 +1,366 @@
+package store
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace is the namespace used by callers that don't name one.
+const DefaultNamespace = "default"
+
+// NamespacedStore holds a separate, isolated keyspace per namespace. Each
+// keyspace is a full Store, supporting whatever optional capabilities the
+// underlying implementation does.
+type NamespacedStore interface {
+	Store // operates on DefaultNamespace
+	// Namespace returns the keyspace for name, creating it on first use, for
+	// writes.
+	Namespace(name string) (Store, error)
+	// LookupNamespace returns the keyspace for name if it exists, for reads,
+	// which shouldn't leave empty namespaces behind.
+	LookupNamespace(name string) (Store, bool, error)
+	Namespaces() []string // in sorted order
+	// DropNamespace deletes name and every key in it, reporting whether it existed.
+	DropNamespace(name string) (bool, error)
+}
+
+// ErrInvalidNamespace is returned for namespace names that are not 1-64
+// letters, digits, underscores or hyphens.
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// ErrTooManyNamespaces is returned for creating a namespace in a store that
+// already holds as many as it allows.
+var ErrTooManyNamespaces = errors.New("too many namespaces")
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// namespacedStore is a NamespacedStore that opens a Store per namespace.
+type namespacedStore struct {
+	mu     sync.RWMutex
+	spaces map[string]Store
+	open   func(name string) (Store, error)
+	drop   func(name string, s Store) error
+	limit  int // most namespaces held at once, including the default; 0 for no limit
+}
+
+// NewNamespacedStore returns a NamespacedStore whose namespaces are in-memory stores.
+func NewNamespacedStore() *namespacedStore {
+	s, _ := newNamespacedStore(
+		func(string) (Store, error) { return NewInMemoryStore(), nil },
+		func(_ string, s Store) error { return closeStore(s) },
+		nil,
+	)
+	return s
+}
+
+// NewNamespacedShardedStore returns a NamespacedStore whose namespaces are
+// sharded in-memory stores with numShards shards each.
+func NewNamespacedShardedStore(numShards int) *namespacedStore {
+	s, _ := newNamespacedStore(
+		func(string) (Store, error) { return NewShardedStore(numShards), nil },
+		func(_ string, s Store) error { return closeStore(s) },
+		nil,
+	)
+	return s
+}
+
+// NewNamespacedBoundedStore returns a NamespacedStore whose namespaces are
+// bounded in-memory stores, each with its own budget of opts. It holds at
+// most maxNamespaces namespaces, including the default, so its memory is
+// bounded too, by maxNamespaces budgets. Namespaces keep separate budgets,
+// rather than sharing one, so one namespace can't evict another's keys.
+func NewNamespacedBoundedStore(opts BoundedOptions, maxNamespaces int) (*namespacedStore, error) {
+	if _, err := NewBoundedStore(opts); err != nil {
+		return nil, err
+	}
+	if maxNamespaces <= 0 {
+		return nil, errors.New("bounded store: maxNamespaces must be positive")
+	}
+	s, err := newNamespacedStore(
+		func(string) (Store, error) { return NewBoundedStore(opts) },
+		func(_ string, s Store) error { return closeStore(s) },
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.limit = maxNamespaces
+	return s, nil
+}
+
+// NewNamespacedWALStore returns a NamespacedStore whose namespaces are
+// durable write-ahead log stores. The default namespace lives in dataDir
+// itself, so data written before namespaces existed stays in it, and every
+// other namespace in its own directory under dataDir/namespaces. Existing
+// namespaces are reopened.
+func NewNamespacedWALStore(dataDir string, opts WALOptions) (*namespacedStore, error) {
+	namespaceDir := func(name string) string {
+		if name == DefaultNamespace {
+			return dataDir
+		}
+		return filepath.Join(dataDir, "namespaces", name)
+	}
+
+	existing := []string{}
+	dirs, err := os.ReadDir(filepath.Join(dataDir, "namespaces"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && namespacePattern.MatchString(dir.Name()) {
+			existing = append(existing, dir.Name())
+		}
+	}
+
+	return newNamespacedStore(
+		func(name string) (Store, error) { return NewWALStore(namespaceDir(name), opts) },
+		func(name string, s Store) error {
+			closeErr := closeStore(s)
+			if name == DefaultNamespace {
+				checkpointErr := os.Remove(filepath.Join(dataDir, checkpointFileName))
+				if errors.Is(checkpointErr, os.ErrNotExist) {
+					checkpointErr = nil
+				}
+				return errors.Join(closeErr, os.Remove(filepath.Join(dataDir, walFileName)), checkpointErr)
+			}
+			return errors.Join(closeErr, os.RemoveAll(namespaceDir(name)))
+		},
+		existing,
+	)
+}
+
+// NewNamespacedLSMStore returns a NamespacedStore whose namespaces are LSM
+// stores, each in its own directory under dataDir/lsm, apart from any write-
+// ahead log stores kept in dataDir. Existing namespaces are reopened.
+func NewNamespacedLSMStore(dataDir string, opts LSMOptions) (*namespacedStore, error) {
+	root := filepath.Join(dataDir, "lsm")
+	existing := []string{}
+	dirs, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && dir.Name() != DefaultNamespace && namespacePattern.MatchString(dir.Name()) {
+			existing = append(existing, dir.Name())
+		}
+	}
+
+	return newNamespacedStore(
+		func(name string) (Store, error) { return NewLSMStore(filepath.Join(root, name), opts) },
+		func(name string, s Store) error {
+			return errors.Join(closeStore(s), os.RemoveAll(filepath.Join(root, name)))
+		},
+		existing,
+	)
+}
+
+func newNamespacedStore(open func(string) (Store, error), drop func(string, Store) error, existing []string) (*namespacedStore, error) {
+	s := &namespacedStore{spaces: make(map[string]Store), open: open, drop: drop}
+	// the default namespace is always open, so Store methods never fail to find it
+	for _, name := range append([]string{DefaultNamespace}, existing...) {
+		if _, err := s.Namespace(name); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *namespacedStore) Set(key string, value any) {
+	s.defaultNamespace().Set(key, value)
+}
+
+func (s *namespacedStore) Get(key string) any {
+	return s.defaultNamespace().Get(key)
+}
+
+func (s *namespacedStore) Lookup(key string) (any, bool) {
+	return s.defaultNamespace().Lookup(key)
+}
+
+func (s *namespacedStore) Delete(key string) {
+	s.defaultNamespace().Delete(key)
+}
+
+func (s *namespacedStore) Namespace(name string) (Store, error) {
+	if !namespacePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidNamespace, name)
+	}
+	s.mu.RLock()
+	space, ok := s.spaces[name]
+	s.mu.RUnlock()
+	if ok {
+		return space, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if space, ok := s.spaces[name]; ok {
+		return space, nil
+	}
+	if s.limit > 0 && len(s.spaces) >= s.limit {
+		return nil, fmt.Errorf("%w: creating %q would exceed the limit of %d", ErrTooManyNamespaces, name, s.limit)
+	}
+	space, err := s.open(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening namespace %q: %w", name, err)
+	}
+	s.spaces[name] = space
+	return space, nil
+}
+
+func (s *namespacedStore) LookupNamespace(name string) (Store, bool, error) {
+	if !namespacePattern.MatchString(name) {
+		return nil, false, fmt.Errorf("%w: %q", ErrInvalidNamespace, name)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	space, ok := s.spaces[name]
+	return space, ok, nil
+}
+
+func (s *namespacedStore) Namespaces() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sortedNames()
+}
+
+// DropNamespace deletes name. Dropping the default namespace empties it,
+// since it always exists.
+func (s *namespacedStore) DropNamespace(name string) (bool, error) {
+	if !namespacePattern.MatchString(name) {
+		return false, fmt.Errorf("%w: %q", ErrInvalidNamespace, name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	space, ok := s.spaces[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.spaces, name)
+	if err := s.drop(name, space); err != nil {
+		return true, fmt.Errorf("dropping namespace %q: %w", name, err)
+	}
+	if name == DefaultNamespace {
+		space, err := s.open(name)
+		if err != nil {
+			return true, fmt.Errorf("reopening namespace %q: %w", name, err)
+		}
+		s.spaces[name] = space
+	}
+	return true, nil
+}
+
+// Snapshot writes every namespace to w. Each namespace is copied at its own
+// point in time.
+func (s *namespacedStore) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	var entries []snapshottedEntry
+	for _, name := range s.sortedNames() {
+		space, ok := s.spaces[name].(entrySnapshotter)
+		if !ok {
+			s.mu.RUnlock()
+			return fmt.Errorf("snapshot: namespace %q does not support snapshots", name)
+		}
+		namespace := name
+		if name == DefaultNamespace {
+			// unlabelled, so a snapshot of only the default namespace also
+			// restores into a store without namespaces
+			namespace = ""
+		}
+		entries = append(entries, space.snapshotEntries(namespace)...)
+	}
+	s.mu.RUnlock()
+	return writeSnapshot(w, entries, time.Now())
+}
+
+// Restore replaces every namespace with the contents of the snapshot in r.
+// Namespaces without keys in the snapshot are dropped. Each namespace is
+// restored atomically, after the whole snapshot has been validated.
+func (s *namespacedStore) Restore(r io.Reader) error {
+	entries, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	byNamespace := map[string][]snapshottedEntry{DefaultNamespace: nil}
+	for _, e := range entries {
+		name := cmp.Or(e.Namespace, DefaultNamespace)
+		if !namespacePattern.MatchString(name) {
+			return fmt.Errorf("%w: %w: %q", ErrInvalidSnapshot, ErrInvalidNamespace, name)
+		}
+		byNamespace[name] = append(byNamespace[name], e)
+	}
+	if s.limit > 0 && len(byNamespace) > s.limit {
+		return fmt.Errorf("%w: %w: %d namespaces, above the limit of %d", ErrInvalidSnapshot, ErrTooManyNamespaces, len(byNamespace), s.limit)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.sortedNames() {
+		if _, ok := byNamespace[name]; !ok {
+			space := s.spaces[name]
+			delete(s.spaces, name)
+			if err := s.drop(name, space); err != nil {
+				return fmt.Errorf("dropping namespace %q: %w", name, err)
+			}
+		}
+	}
+	for name, entries := range byNamespace {
+		space, ok := s.spaces[name]
+		if !ok {
+			if space, err = s.open(name); err != nil {
+				return fmt.Errorf("opening namespace %q: %w", name, err)
+			}
+			s.spaces[name] = space
+		}
+		restorer, ok := space.(entrySnapshotter)
+		if !ok {
+			return fmt.Errorf("restore: namespace %q does not support snapshots", name)
+		}
+		restorer.restoreEntries(entries)
+	}
+	return nil
+}
+
+// Close closes every namespace.
+func (s *namespacedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, space := range s.spaces {
+		errs = append(errs, closeStore(space))
+	}
+	return errors.Join(errs...)
+}
+
+// sortedNames returns the open namespaces in order. Callers must hold mu.
+func (s *namespacedStore) sortedNames() []string {
+	names := make([]string, 0, len(s.spaces))
+	for name := range s.spaces {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *namespacedStore) defaultNamespace() Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.spaces[DefaultNamespace]
+}
+
+// closeStore closes s if it holds resources.
+func closeStore(s Store) error {
+	if closer, ok := s.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
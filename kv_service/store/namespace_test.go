@@ -0,0 +1,224 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type namespaceTestSuite struct {
+	suite.Suite
+}
+
+func (s *namespaceTestSuite) TestIsolation() {
+	store := NewNamespacedStore()
+	defer store.Close()
+	assert.Implements(s.T(), (*NamespacedStore)(nil), store)
+
+	teamA, err := store.Namespace("team-a")
+	s.Require().NoError(err)
+	teamB, err := store.Namespace("team-b")
+	s.Require().NoError(err)
+
+	teamA.Set("test-key", "a")
+	teamB.Set("test-key", "b")
+	store.Set("test-key", "default")
+
+	assert.Equal(s.T(), "a", teamA.Get("test-key"))
+	assert.Equal(s.T(), "b", teamB.Get("test-key"))
+	assert.Equal(s.T(), "default", store.Get("test-key"))
+
+	// the same namespace is returned on every use
+	again, err := store.Namespace("team-a")
+	s.Require().NoError(err)
+	assert.Same(s.T(), teamA, again)
+
+	// keyspaces keep the capabilities of the underlying store
+	assert.Implements(s.T(), (*ScannableStore)(nil), teamA)
+
+	store.Delete("test-key")
+	assert.Nil(s.T(), store.Get("test-key"))
+	assert.Equal(s.T(), "a", teamA.Get("test-key"))
+}
+
+func (s *namespaceTestSuite) TestNamespaces() {
+	store := NewNamespacedStore()
+	defer store.Close()
+	assert.Equal(s.T(), []string{DefaultNamespace}, store.Namespaces())
+
+	_, err := store.Namespace("zeta")
+	s.Require().NoError(err)
+	_, err = store.Namespace("alpha")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"alpha", DefaultNamespace, "zeta"}, store.Namespaces())
+}
+
+func (s *namespaceTestSuite) TestLookupNamespace() {
+	store := NewNamespacedStore()
+	defer store.Close()
+
+	_, ok, err := store.LookupNamespace("team-a")
+	s.Require().NoError(err)
+	assert.False(s.T(), ok)
+	// looking a namespace up doesn't create it
+	assert.Equal(s.T(), []string{DefaultNamespace}, store.Namespaces())
+
+	teamA, err := store.Namespace("team-a")
+	s.Require().NoError(err)
+	found, ok, err := store.LookupNamespace("team-a")
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+	assert.Same(s.T(), teamA, found)
+
+	_, ok, err = store.LookupNamespace(DefaultNamespace)
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+}
+
+func (s *namespaceTestSuite) TestInvalidNamespace() {
+	store := NewNamespacedStore()
+	defer store.Close()
+
+	for _, name := range []string{"", "has space", "../escape", "dots.not.allowed", string(make([]byte, 65))} {
+		_, err := store.Namespace(name)
+		assert.ErrorIs(s.T(), err, ErrInvalidNamespace, name)
+		_, _, err = store.LookupNamespace(name)
+		assert.ErrorIs(s.T(), err, ErrInvalidNamespace, name)
+		_, err = store.DropNamespace(name)
+		assert.ErrorIs(s.T(), err, ErrInvalidNamespace, name)
+	}
+}
+
+func (s *namespaceTestSuite) TestDropNamespace() {
+	store := NewNamespacedStore()
+	defer store.Close()
+	teamA, err := store.Namespace("team-a")
+	s.Require().NoError(err)
+	teamA.Set("key", "value")
+
+	dropped, err := store.DropNamespace("team-a")
+	s.Require().NoError(err)
+	assert.True(s.T(), dropped)
+	assert.Equal(s.T(), []string{DefaultNamespace}, store.Namespaces())
+
+	dropped, err = store.DropNamespace("team-a")
+	s.Require().NoError(err)
+	assert.False(s.T(), dropped)
+
+	// recreated namespaces start empty
+	teamA, err = store.Namespace("team-a")
+	s.Require().NoError(err)
+	assert.Nil(s.T(), teamA.Get("key"))
+}
+
+func (s *namespaceTestSuite) TestDropDefaultNamespaceEmptiesIt() {
+	store := NewNamespacedStore()
+	defer store.Close()
+	store.Set("key", "value")
+
+	dropped, err := store.DropNamespace(DefaultNamespace)
+	s.Require().NoError(err)
+	assert.True(s.T(), dropped)
+	assert.Nil(s.T(), store.Get("key"))
+	assert.Equal(s.T(), []string{DefaultNamespace}, store.Namespaces())
+}
+
+func (s *namespaceTestSuite) TestWALNamespacesSurviveRestart() {
+	dataDir := s.T().TempDir()
+	opts := WALOptions{SyncPolicy: SyncNever}
+
+	// data written before namespaces existed belongs to the default namespace
+	legacy, err := NewWALStore(dataDir, opts)
+	s.Require().NoError(err)
+	legacy.Set("legacy", "value")
+	s.Require().NoError(legacy.Close())
+
+	store, err := NewNamespacedWALStore(dataDir, opts)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "value", store.Get("legacy"))
+	teamA, err := store.Namespace("team-a")
+	s.Require().NoError(err)
+	teamA.Set("key", "a")
+	_, ok, err := store.LookupNamespace("unknown")
+	s.Require().NoError(err)
+	assert.False(s.T(), ok)
+	doomed, err := store.Namespace("doomed")
+	s.Require().NoError(err)
+	doomed.Set("key", "gone")
+	_, err = store.DropNamespace("doomed")
+	s.Require().NoError(err)
+	s.Require().NoError(store.Close())
+
+	_, err = os.Stat(filepath.Join(dataDir, "namespaces", "doomed"))
+	assert.ErrorIs(s.T(), err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(dataDir, "namespaces", "unknown"))
+	assert.ErrorIs(s.T(), err, os.ErrNotExist)
+
+	store, err = NewNamespacedWALStore(dataDir, opts)
+	s.Require().NoError(err)
+	defer store.Close()
+	assert.Equal(s.T(), []string{DefaultNamespace, "team-a"}, store.Namespaces())
+	assert.Equal(s.T(), "value", store.Get("legacy"))
+	teamA, err = store.Namespace("team-a")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "a", teamA.Get("key"))
+}
+
+func (s *namespaceTestSuite) TestWALDropDefaultNamespace() {
+	dataDir := s.T().TempDir()
+	opts := WALOptions{SyncPolicy: SyncNever}
+	store, err := NewNamespacedWALStore(dataDir, opts)
+	s.Require().NoError(err)
+	store.Set("key", "value")
+	_, err = store.DropNamespace(DefaultNamespace)
+	s.Require().NoError(err)
+	store.Set("after", "value")
+	s.Require().NoError(store.Close())
+
+	store, err = NewNamespacedWALStore(dataDir, opts)
+	s.Require().NoError(err)
+	defer store.Close()
+	assert.Nil(s.T(), store.Get("key"))
+	assert.Equal(s.T(), "value", store.Get("after"))
+}
+
+func (s *namespaceTestSuite) TestLSMNamespacesSurviveRestart() {
+	dataDir := s.T().TempDir()
+	opts := LSMOptions{WAL: WALOptions{SyncPolicy: SyncNever}}
+
+	store, err := NewNamespacedLSMStore(dataDir, opts)
+	s.Require().NoError(err)
+	store.Set("key", "default")
+	teamA, err := store.Namespace("team-a")
+	s.Require().NoError(err)
+	teamA.Set("key", "a")
+	doomed, err := store.Namespace("doomed")
+	s.Require().NoError(err)
+	doomed.Set("key", "gone")
+	_, err = store.DropNamespace("doomed")
+	s.Require().NoError(err)
+	_, err = store.DropNamespace(DefaultNamespace)
+	s.Require().NoError(err)
+	store.Set("after", "value")
+	s.Require().NoError(store.Close())
+
+	_, err = os.Stat(filepath.Join(dataDir, "lsm", "doomed"))
+	assert.ErrorIs(s.T(), err, os.ErrNotExist)
+
+	store, err = NewNamespacedLSMStore(dataDir, opts)
+	s.Require().NoError(err)
+	defer store.Close()
+	assert.Equal(s.T(), []string{DefaultNamespace, "team-a"}, store.Namespaces())
+	assert.Nil(s.T(), store.Get("key"))
+	assert.Equal(s.T(), "value", store.Get("after"))
+	teamA, err = store.Namespace("team-a")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "a", teamA.Get("key"))
+}
+
+func TestNamespaceTestSuite(t *testing.T) {
+	suite.Run(t, new(namespaceTestSuite))
+}
@@ -0,0 +1,351 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// DocumentStore is a Store whose JSON values can be changed in part, each
+// patch applied atomically to the value current at the time, so clients
+// editing different parts of a value don't overwrite each other. A key's
+// TTL is kept.
+type DocumentStore interface {
+	Store
+	// JSONPatch applies a JSON Patch (RFC 6902) to key's value, returning
+	// the new value and version. Either every operation is applied or, if
+	// one fails, none is. Returns ErrKeyNotFound if key isn't set.
+	JSONPatch(key string, patch []PatchOperation) (value any, version uint64, err error)
+	// MergePatch applies a JSON Merge Patch (RFC 7396) to key's value,
+	// returning the new value and version. A key that isn't set is patched
+	// as if it were null, so it is created.
+	MergePatch(key string, patch any) (value any, version uint64, err error)
+}
+
+// PatchOperation is one operation of a JSON Patch: add, remove, replace,
+// move, copy or test. Path and From are JSON Pointers.
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// ErrInvalidPatch is returned for a JSON Patch that is malformed, such as
+// one with an unknown operation, whatever the value it is applied to.
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// ErrPatchConflict is returned for a JSON Patch that doesn't apply to the
+// value: an operation's path doesn't exist, or a test operation fails.
+var ErrPatchConflict = errors.New("patch does not apply")
+
+// UnmarshalJSON decodes an operation, requiring a value for the operations
+// that take one, so a missing value is told apart from a value of null.
+func (op *PatchOperation) UnmarshalJSON(data []byte) error {
+	type operation PatchOperation
+	var decoded struct {
+		operation
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*op = PatchOperation(decoded.operation)
+	if decoded.Value == nil {
+		if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+			return fmt.Errorf("%w: %s operation on %q has no value", ErrInvalidPatch, op.Op, op.Path)
+		}
+		return nil
+	}
+	return json.Unmarshal(decoded.Value, &op.Value)
+}
+
+func (s *inMemoryStore) JSONPatch(key string, patch []PatchOperation) (any, uint64, error) {
+	return s.update(key, func(value any, found bool) (any, error) {
+		if !found {
+			return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+		}
+		return applyJSONPatch(value, patch)
+	})
+}
+
+func (s *inMemoryStore) MergePatch(key string, patch any) (any, uint64, error) {
+	return s.update(key, func(value any, _ bool) (any, error) {
+		return mergePatch(deepCopy(value), patch), nil
+	})
+}
+
+// update sets key to the result of change, which is given the key's
+// current value, keeping the key's TTL, and returns the new value and
+// version. Nothing is written if change fails.
+func (s *inMemoryStore) update(key string, change func(value any, found bool) (any, error)) (any, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.lookup(key)
+	// a collection is patched as a copy
+	value, err := change(exportValue(e.value), found)
+	if err != nil {
+		return nil, 0, err
+	}
+	version := s.commit(walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: e.expiresAt})
+	return value, version, nil
+}
+
+// applyJSONPatch returns the result of applying patch to doc, which is left
+// unchanged, as readers may hold it.
+func applyJSONPatch(doc any, patch []PatchOperation) (any, error) {
+	doc = deepCopy(doc)
+	for i, op := range patch {
+		var err error
+		if doc, err = applyOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %q): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyOperation applies op to doc, which it may change in place.
+func applyOperation(doc any, op PatchOperation) (any, error) {
+	path, err := parsePatchPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, deepCopy(op.Value))
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		return replaceValue(doc, path, deepCopy(op.Value))
+	case "move", "copy":
+		from, err := parsePatchPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := resolveTokens(doc, from, op.From)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPatchConflict, err)
+		}
+		switch {
+		case op.Op == "copy":
+			return addValue(doc, path, deepCopy(value))
+		case slices.Equal(path, from):
+			return doc, nil
+		}
+		if len(path) > len(from) && slices.Equal(path[:len(from)], from) {
+			return nil, fmt.Errorf("%w: cannot move %q into itself", ErrInvalidPatch, op.From)
+		}
+		if doc, err = removeValue(doc, from); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "test":
+		value, err := resolveTokens(doc, path, op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPatchConflict, err)
+		}
+		if !jsonEqual(value, op.Value) {
+			return nil, fmt.Errorf("%w: test failed", ErrPatchConflict)
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q: want add, remove, replace, move, copy or test", ErrInvalidPatch, op.Op)
+	}
+}
+
+func parsePatchPointer(pointer string) ([]string, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+	return tokens, nil
+}
+
+// addValue adds value at path: a new or replaced member of an object, or an
+// element inserted into an array, where the index "-" appends.
+func addValue(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent any, token string) (any, error) {
+		switch container := parent.(type) {
+		case map[string]any:
+			container[token] = value
+			return container, nil
+		case []any:
+			index := len(container)
+			if token != "-" {
+				var err error
+				if index, err = arrayIndex(token, len(container)); err != nil {
+					return nil, err
+				}
+			}
+			return slices.Insert(container, index, value), nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+}
+
+// removeValue removes the existing value at path.
+func removeValue(doc any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole value", ErrInvalidPatch)
+	}
+	return updateParent(doc, path, func(parent any, token string) (any, error) {
+		switch container := parent.(type) {
+		case map[string]any:
+			if _, ok := container[token]; !ok {
+				return nil, ErrPathNotFound
+			}
+			delete(container, token)
+			return container, nil
+		case []any:
+			index, err := arrayIndex(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Delete(container, index, index+1), nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+}
+
+// replaceValue replaces the existing value at path.
+func replaceValue(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent any, token string) (any, error) {
+		switch container := parent.(type) {
+		case map[string]any:
+			if _, ok := container[token]; !ok {
+				return nil, ErrPathNotFound
+			}
+			container[token] = value
+			return container, nil
+		case []any:
+			index, err := arrayIndex(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			container[index] = value
+			return container, nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+}
+
+// updateParent replaces the container holding the last token of path with
+// the result of change, which is given that container and token. Missing
+// paths are reported as conflicts.
+func updateParent(doc any, path []string, change func(parent any, token string) (any, error)) (any, error) {
+	updated, err := updateAt(doc, path, change)
+	if err != nil {
+		pointer := "/" + strings.Join(path, "/")
+		if errors.Is(err, ErrPathNotFound) {
+			return nil, fmt.Errorf("%w: %w: %q", ErrPatchConflict, err, pointer)
+		}
+		return nil, err
+	}
+	return updated, nil
+}
+
+func updateAt(doc any, path []string, change func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+	child, err := childOf(doc, path[0])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := updateAt(child, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+	// doc is a copy, so it's changed in place
+	switch container := doc.(type) {
+	case map[string]any:
+		container[path[0]] = updated
+	case []any:
+		index, _ := arrayIndex(path[0], len(container)-1)
+		container[index] = updated
+	}
+	return doc, nil
+}
+
+// mergePatch merges patch into target, which it may change in place: each
+// member of an object patch is merged into target's, and a null member
+// removes target's. Any other patch replaces target.
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return deepCopy(patch)
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// deepCopy copies the objects and arrays of a decoded JSON value, so it can
+// be changed without changing value. Other values are immutable and shared.
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(v))
+		for key, member := range v {
+			copied[key] = deepCopy(member)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(v))
+		for i, element := range v {
+			copied[i] = deepCopy(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// jsonEqual reports whether a and b are equal as JSON values, so numbers
+// are compared by value whatever their Go type.
+func jsonEqual(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, member := range a {
+			other, ok := b[key]
+			if !ok || !jsonEqual(member, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, jsonEqual)
+	}
+	if x, ok := numberValue(a); ok {
+		y, ok := numberValue(b)
+		return ok && x == y
+	}
+	// values set by Go callers may be of any type
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type patchTestSuite struct {
+	suite.Suite
+	store *inMemoryStore
+}
+
+func (s *patchTestSuite) SetupTest() {
+	s.store = NewInMemoryStore()
+}
+
+func (s *patchTestSuite) TearDownTest() {
+	s.store.Close()
+}
+
+// decode decodes a JSON document, as the HTTP API does.
+func (s *patchTestSuite) decode(document string, v any) {
+	s.T().Helper()
+	s.Require().NoError(json.Unmarshal([]byte(document), v))
+}
+
+// patch sets key to doc, applies the JSON Patch to it, and returns the result.
+func (s *patchTestSuite) patch(doc, patch string) (any, error) {
+	var value any
+	s.decode(doc, &value)
+	s.store.Set("key", value)
+	var operations []PatchOperation
+	s.decode(patch, &operations)
+	result, _, err := s.store.JSONPatch("key", operations)
+	return result, err
+}
+
+func (s *patchTestSuite) assertPatched(doc, patch, expected string) {
+	s.T().Helper()
+	result, err := s.patch(doc, patch)
+	s.Require().NoError(err)
+	var want any
+	s.decode(expected, &want)
+	assert.Equal(s.T(), want, result)
+	assert.Equal(s.T(), want, s.store.Get("key"))
+}
+
+func (s *patchTestSuite) TestJSONPatch() {
+	// examples from appendix A of RFC 6902
+	s.assertPatched(`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`)
+	s.assertPatched(`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`)
+	s.assertPatched(`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`)
+	s.assertPatched(`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`)
+	s.assertPatched(`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`)
+	s.assertPatched(`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+		`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+		`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`)
+	s.assertPatched(`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`)
+	s.assertPatched(`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+		`{"baz": "qux", "foo": ["a", 2, "c"]}`)
+	s.assertPatched(`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`)
+	s.assertPatched(`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`)
+	s.assertPatched(`{"foo": null}`, `[{"op": "test", "path": "/foo", "value": null}]`, `{"foo": null}`)
+	s.assertPatched(`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`, `{"/": 9, "~1": 10}`)
+
+	s.assertPatched(`{"a": 1}`, `[{"op": "copy", "from": "/a", "path": "/b"}]`, `{"a": 1, "b": 1}`)
+	s.assertPatched(`{"a": 1}`, `[{"op": "replace", "path": "", "value": [1]}]`, `[1]`)
+	s.assertPatched(`{"a": 1}`, `[{"op": "move", "from": "/a", "path": "/a"}]`, `{"a": 1}`)
+}
+
+func (s *patchTestSuite) TestJSONPatch_Conflicts() {
+	for _, patch := range []string{
+		`[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+		`[{"op": "remove", "path": "/missing"}]`,
+		`[{"op": "replace", "path": "/foo/5", "value": 1}]`,
+		`[{"op": "add", "path": "/foo/3", "value": 1}]`,
+		`[{"op": "move", "from": "/missing", "path": "/a"}]`,
+		`[{"op": "test", "path": "/baz", "value": "bar"}]`,
+		`[{"op": "test", "path": "/foo/0", "value": "1"}]`,
+		// the first operation applies, the second doesn't, so neither is kept
+		`[{"op": "add", "path": "/new", "value": 1}, {"op": "remove", "path": "/missing"}]`,
+	} {
+		_, version := s.store.GetWithVersion("key")
+		_, err := s.patch(`{"baz": "qux", "foo": [1, 2]}`, patch)
+		assert.ErrorIs(s.T(), err, ErrPatchConflict, patch)
+		var unchanged any
+		s.decode(`{"baz": "qux", "foo": [1, 2]}`, &unchanged)
+		assert.Equal(s.T(), unchanged, s.store.Get("key"), patch)
+		_, after := s.store.GetWithVersion("key")
+		assert.Equal(s.T(), version+1, after, patch)
+	}
+}
+
+func (s *patchTestSuite) TestJSONPatch_Invalid() {
+	for _, patch := range []string{
+		`[{"op": "frobnicate", "path": "/a"}]`,
+		`[{"op": "add", "path": "a", "value": 1}]`,
+		`[{"op": "copy", "from": "/a~", "path": "/b"}]`,
+		`[{"op": "move", "from": "/a", "path": "/a/b"}]`,
+		`[{"op": "remove", "path": ""}]`,
+	} {
+		_, err := s.patch(`{"a": {}}`, patch)
+		assert.ErrorIs(s.T(), err, ErrInvalidPatch, patch)
+	}
+
+	// operations that take a value must have one, even if it is null
+	var operations []PatchOperation
+	err := json.Unmarshal([]byte(`[{"op": "add", "path": "/a"}]`), &operations)
+	assert.ErrorIs(s.T(), err, ErrInvalidPatch)
+	s.Require().NoError(json.Unmarshal([]byte(`[{"op": "add", "path": "/a", "value": null}]`), &operations))
+	assert.Equal(s.T(), []PatchOperation{{Op: "add", Path: "/a"}}, operations)
+}
+
+func (s *patchTestSuite) TestJSONPatch_KeyNotFound() {
+	_, _, err := s.store.JSONPatch("missing", []PatchOperation{{Op: "add", Path: "", Value: 1}})
+	assert.ErrorIs(s.T(), err, ErrKeyNotFound)
+	_, found := s.store.Lookup("missing")
+	assert.False(s.T(), found)
+}
+
+func (s *patchTestSuite) TestJSONPatch_LeavesReadValuesAlone() {
+	original := map[string]any{"list": []any{"a"}, "nested": map[string]any{"n": 1.0}}
+	s.store.Set("key", original)
+	read := s.store.Get("key")
+
+	_, version, err := s.store.JSONPatch("key", []PatchOperation{
+		{Op: "add", Path: "/list/-", Value: "b"},
+		{Op: "replace", Path: "/nested/n", Value: 2.0},
+	})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"list": []any{"a"}, "nested": map[string]any{"n": 1.0}}, read)
+	value, current := s.store.GetWithVersion("key")
+	assert.Equal(s.T(), version, current)
+	assert.Equal(s.T(), map[string]any{"list": []any{"a", "b"}, "nested": map[string]any{"n": 2.0}}, value)
+}
+
+func (s *patchTestSuite) TestMergePatch() {
+	// examples from appendix A of RFC 7396
+	for _, example := range []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		var target, patch, expected any
+		s.decode(example.target, &target)
+		s.decode(example.patch, &patch)
+		s.decode(example.result, &expected)
+		s.store.Set("key", target)
+
+		result, _, err := s.store.MergePatch("key", patch)
+		s.Require().NoError(err)
+		assert.Equal(s.T(), expected, result, example.patch)
+		assert.Equal(s.T(), expected, s.store.Get("key"), example.patch)
+	}
+}
+
+func (s *patchTestSuite) TestMergePatch_CreatesKey() {
+	result, version, err := s.store.MergePatch("new", map[string]any{"a": 1.0, "b": nil})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"a": 1.0}, result)
+	assert.NotZero(s.T(), version)
+	assert.Equal(s.T(), map[string]any{"a": 1.0}, s.store.Get("new"))
+}
+
+func (s *patchTestSuite) TestKeepsTTL() {
+	s.store.SetWithTTL("key", map[string]any{}, time.Minute)
+	_, _, err := s.store.MergePatch("key", map[string]any{"a": 1.0})
+	s.Require().NoError(err)
+	_, _, err = s.store.JSONPatch("key", []PatchOperation{{Op: "add", Path: "/b", Value: 2.0}})
+	s.Require().NoError(err)
+
+	entries, _ := s.store.Scan("key", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), map[string]any{"a": 1.0, "b": 2.0}, entries[0].Value)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *patchTestSuite) TestShardedStore() {
+	sharded := NewShardedStore(4)
+	defer sharded.Close()
+	assert.Implements(s.T(), (*DocumentStore)(nil), sharded)
+	sharded.Set("key", map[string]any{"a": 1.0})
+	_, _, err := sharded.JSONPatch("key", []PatchOperation{{Op: "remove", Path: "/a"}})
+	s.Require().NoError(err)
+	_, _, err = sharded.MergePatch("key", map[string]any{"b": 2.0})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"b": 2.0}, sharded.Get("key"))
+}
+
+func TestPatchTestSuite(t *testing.T) {
+	suite.Run(t, new(patchTestSuite))
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPointer is returned for a string that isn't a JSON Pointer.
+var ErrInvalidPointer = errors.New("invalid JSON pointer")
+
+// ErrPathNotFound is returned when a JSON Pointer doesn't lead to a value.
+var ErrPathNotFound = errors.New("path not found")
+
+// ResolvePointer returns the part of doc, a decoded JSON value, that the
+// JSON Pointer (RFC 6901) pointer refers to, e.g. "/a/b/0" for the first
+// element of b in a. The empty pointer refers to the whole of doc.
+func ResolvePointer(doc any, pointer string) (any, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	return resolveTokens(doc, tokens, pointer)
+}
+
+// parsePointer splits pointer into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w %q: must be empty or start with /", ErrInvalidPointer, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		// every ~ must start an escape sequence
+		if strings.Count(token, "~") != strings.Count(token, "~0")+strings.Count(token, "~1") {
+			return nil, fmt.Errorf("%w %q: ~ must be followed by 0 or 1", ErrInvalidPointer, pointer)
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func resolveTokens(doc any, tokens []string, pointer string) (any, error) {
+	for _, token := range tokens {
+		child, err := childOf(doc, token)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", err, pointer)
+		}
+		doc = child
+	}
+	return doc, nil
+}
+
+// childOf returns the member of an object, or element of an array, that
+// token refers to.
+func childOf(doc any, token string) (any, error) {
+	switch container := doc.(type) {
+	case map[string]any:
+		child, ok := container[token]
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		return child, nil
+	case []any:
+		index, err := arrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		return container[index], nil
+	case ListValue:
+		return childOf([]any(container), token)
+	case SetValue:
+		index, err := arrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		return container[index], nil
+	case HashValue:
+		return childOf(map[string]any(container), token)
+	case SortedSetValue:
+		score, ok := container[token]
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		return score, nil
+	default:
+		return nil, ErrPathNotFound
+	}
+}
+
+// arrayIndex parses token as an index of an array, which must be at most
+// maxIndex. Indexes are decimal, without leading zeros.
+func arrayIndex(token string, maxIndex int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, ErrPathNotFound
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index > maxIndex {
+		return 0, ErrPathNotFound
+	}
+	return index, nil
+}
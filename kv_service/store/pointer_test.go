@@ -0,0 +1,64 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type pointerTestSuite struct {
+	suite.Suite
+}
+
+func (s *pointerTestSuite) TestResolvePointer() {
+	// the example document of RFC 6901
+	var doc any
+	s.Require().NoError(json.Unmarshal([]byte(`{
+		"foo": ["bar", "baz"], "": 0, "a/b": 1, "c%d": 2, "e^f": 3,
+		"g|h": 4, "i\\j": 5, "k\"l": 6, " ": 7, "m~n": 8
+	}`), &doc))
+
+	for pointer, expected := range map[string]any{
+		"":       doc,
+		"/foo":   []any{"bar", "baz"},
+		"/foo/0": "bar",
+		"/":      float64(0),
+		"/a~1b":  float64(1),
+		"/c%d":   float64(2),
+		"/e^f":   float64(3),
+		"/g|h":   float64(4),
+		"/i\\j":  float64(5),
+		"/k\"l":  float64(6),
+		"/ ":     float64(7),
+		"/m~0n":  float64(8),
+	} {
+		value, err := ResolvePointer(doc, pointer)
+		s.Require().NoError(err, pointer)
+		assert.Equal(s.T(), expected, value, pointer)
+	}
+}
+
+func (s *pointerTestSuite) TestResolvePointer_NotFound() {
+	doc := map[string]any{"a": map[string]any{"b": []any{"x", "y"}}, "n": nil}
+	for _, pointer := range []string{"/missing", "/a/b/2", "/a/b/-", "/a/b/01", "/a/b/-1", "/a/b/x", "/a/b/0/deeper", "/n/child"} {
+		_, err := ResolvePointer(doc, pointer)
+		assert.ErrorIs(s.T(), err, ErrPathNotFound, pointer)
+	}
+
+	value, err := ResolvePointer(doc, "/n")
+	s.Require().NoError(err)
+	assert.Nil(s.T(), value)
+}
+
+func (s *pointerTestSuite) TestResolvePointer_Invalid() {
+	for _, pointer := range []string{"a", "/a~", "/a~2"} {
+		_, err := ResolvePointer(map[string]any{}, pointer)
+		assert.ErrorIs(s.T(), err, ErrInvalidPointer, pointer)
+	}
+}
+
+func TestPointerTestSuite(t *testing.T) {
+	suite.Run(t, new(pointerTestSuite))
+}
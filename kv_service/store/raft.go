@@ -0,0 +1,577 @@
+package store
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// defaultRaftApplyTimeout is the default RaftOptions.ApplyTimeout.
+const defaultRaftApplyTimeout = 10 * time.Second
+
+// ReplicatedStore is implemented by stores that replicate writes from a
+// single node, the leader. Writes made on any other node fail, so callers
+// should send them to the leader instead.
+type ReplicatedStore interface {
+	Store
+	IsLeader() bool
+	// LeaderAddr returns the base URL of the leader's API, if a leader is known.
+	LeaderAddr() (string, bool)
+}
+
+// LinearizableStore is a ReplicatedStore whose leader can confirm, before
+// serving a read, that it still leads and has applied every write it has
+// acknowledged, so the read sees all of them.
+type LinearizableStore interface {
+	ReplicatedStore
+	// VerifyLeader returns an error unless this node is still the leader,
+	// once it has applied every write committed before the call.
+	VerifyLeader() error
+}
+
+// RaftPeer is a node of a Raft cluster.
+type RaftPeer struct {
+	ID       string
+	RaftAddr string // host:port of the node's Raft transport
+	HTTPAddr string // base URL of the node's API, e.g. http://kv1:8080
+}
+
+// RaftOptions configures a node of a Raft cluster.
+type RaftOptions struct {
+	NodeID string
+	// Peers lists every node of the cluster, this one included. It seeds the
+	// cluster's membership when the node first starts.
+	Peers []RaftPeer
+	// DataDir holds the node's log, term and vote, and snapshots.
+	DataDir string
+	// ApplyTimeout bounds how long a write waits to be committed. Zero uses
+	// 10 seconds.
+	ApplyTimeout time.Duration
+	// LogOutput receives Raft's warnings. Nil uses stderr.
+	LogOutput io.Writer
+}
+
+// raftStore is a Store replicated across a cluster by the Raft consensus
+// protocol, which stays available while a majority of its nodes are up.
+// The nodes elect a leader, which appends every Set and Delete to the
+// replicated log; once a majority have logged a write it is applied to
+// each node's in-memory copy of the data, in log order.
+//
+// Writes block until committed and applied locally, and fail if made on a
+// follower or if a majority can't be reached in time: Set, SetWithTTL and
+// Delete, which have no error return, panic, and every other write returns
+// the error. Reads are served from the local copy, so on a follower they may
+// briefly lag the leader; VerifyLeader lets the leader serve reads that
+// can't. Each key's version is the log index of the write that set it.
+//
+// Conditions, such as a conditional write's expected version, are checked
+// as the write is applied, against the clock of the node that proposed it,
+// so every node decides alike. Counters are conditional writes of the sum,
+// retried if the key changes meanwhile. Keys are expired by the leader,
+// through the log, so they are removed at the same point on every node.
+type raftStore struct {
+	raft         *raft.Raft
+	fsm          *raftFSM
+	peers        map[raft.ServerID]RaftPeer
+	applyTimeout time.Duration
+	closers      []io.Closer
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewRaftStore starts a node of the cluster described by opts, listening
+// for its peers on its RaftAddr. A node with no state in DataDir joins the
+// cluster as configured; one with state resumes where it left off. Call
+// Close to leave.
+func NewRaftStore(opts RaftOptions) (*raftStore, error) {
+	self, err := opts.self()
+	if err != nil {
+		return nil, err
+	}
+	if opts.DataDir == "" {
+		return nil, errors.New("raft: a data directory is required")
+	}
+	if err := os.MkdirAll(opts.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	logOutput := opts.logOutput()
+
+	bolt, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(opts.DataDir, "raft.db")})
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(opts.DataDir, 2, logOutput)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", self.RaftAddr)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(self.RaftAddr, advertise, 3, 10*time.Second, logOutput)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+	s, err := newRaftStore(opts, raftConfig(opts), bolt, bolt, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		bolt.Close()
+		return nil, err
+	}
+	s.closers = append(s.closers, transport, bolt)
+	return s, nil
+}
+
+func raftConfig(opts RaftOptions) *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(opts.NodeID)
+	conf.LogOutput = opts.logOutput()
+	conf.LogLevel = "WARN"
+	return conf
+}
+
+// newRaftStore starts a node on the given storage and transport, so tests
+// can run a cluster in memory.
+func newRaftStore(opts RaftOptions, conf *raft.Config, logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore, transport raft.Transport) (*raftStore, error) {
+	if _, err := opts.self(); err != nil {
+		return nil, err
+	}
+	mem := NewInMemoryStore()
+	// the leader expires keys through the log, rather than each copy itself
+	mem.following = true
+	s := &raftStore{
+		fsm:          &raftFSM{mem: mem},
+		peers:        make(map[raft.ServerID]RaftPeer),
+		applyTimeout: opts.ApplyTimeout,
+		done:         make(chan struct{}),
+	}
+	if s.applyTimeout <= 0 {
+		s.applyTimeout = defaultRaftApplyTimeout
+	}
+	var servers []raft.Server
+	for _, peer := range opts.Peers {
+		id := raft.ServerID(peer.ID)
+		s.peers[id] = peer
+		servers = append(servers, raft.Server{ID: id, Address: raft.ServerAddress(peer.RaftAddr)})
+	}
+
+	hasState, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if s.raft, err = raft.NewRaft(conf, s.fsm, logs, stable, snapshots, transport); err != nil {
+		return nil, err
+	}
+	if !hasState {
+		// every node bootstraps the same membership, so whichever starts
+		// first, they agree on it
+		if err := s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			s.raft.Shutdown()
+			return nil, err
+		}
+	}
+	s.wg.Add(1)
+	go s.expireLoop()
+	return s, nil
+}
+
+func (s *raftStore) Set(key string, value any) {
+	s.mustApply(raftCommand{walRecord: walRecord{Op: walOpSet, Key: key, Value: value}})
+}
+
+func (s *raftStore) SetWithTTL(key string, value any, ttl time.Duration) {
+	s.mustApply(raftCommand{walRecord: walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: time.Now().Add(ttl)}})
+}
+
+func (s *raftStore) Get(key string) any {
+	return s.fsm.mem.Get(key)
+}
+
+func (s *raftStore) Lookup(key string) (any, bool) {
+	return s.fsm.mem.Lookup(key)
+}
+
+func (s *raftStore) GetWithVersion(key string) (any, uint64) {
+	return s.fsm.mem.GetWithVersion(key)
+}
+
+func (s *raftStore) Delete(key string) {
+	s.mustApply(raftCommand{walRecord: walRecord{Op: walOpDelete, Key: key}})
+}
+
+func (s *raftStore) CompareAndSwap(key string, expectedVersion uint64, value any) (uint64, error) {
+	return s.compareAndApply(key, expectedVersion, walRecord{Op: walOpSet, Key: key, Value: value})
+}
+
+func (s *raftStore) CompareAndSwapWithTTL(key string, expectedVersion uint64, value any, ttl time.Duration) (uint64, error) {
+	return s.compareAndApply(key, expectedVersion, walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: time.Now().Add(ttl)})
+}
+
+func (s *raftStore) CompareAndDelete(key string, expectedVersion uint64) error {
+	if expectedVersion == 0 {
+		// nothing to delete, but the key's absence is still checked in order
+		_, err := s.compareAndApply(key, 0, walRecord{Op: walOpBatch})
+		return err
+	}
+	_, err := s.compareAndApply(key, expectedVersion, walRecord{Op: walOpDelete, Key: key})
+	return err
+}
+
+// compareAndApply applies record if key is at expectedVersion, returning the
+// revision it was applied at.
+func (s *raftStore) compareAndApply(key string, expectedVersion uint64, record walRecord) (uint64, error) {
+	revision, err := s.apply(raftCommand{walRecord: record, Expect: []TxnRead{{Key: key, Version: expectedVersion}}})
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return 0, fmt.Errorf("%w: %q is at version %d, expected %d", ErrVersionMismatch, key, conflict.Conflicts[0].ActualVersion, expectedVersion)
+	}
+	return revision, err
+}
+
+func (s *raftStore) Commit(txn Txn) (uint64, error) {
+	record := walRecord{Op: walOpBatch}
+	for _, write := range txn.Writes {
+		if write.Delete {
+			record.Ops = append(record.Ops, walRecord{Op: walOpDelete, Key: write.Key})
+		} else {
+			record.Ops = append(record.Ops, walRecord{Op: walOpSet, Key: write.Key, Value: write.Value})
+		}
+	}
+	return s.apply(raftCommand{walRecord: record, Expect: txn.Reads})
+}
+
+func (s *raftStore) Incr(key string) (int64, error) {
+	return s.IncrBy(key, 1)
+}
+
+func (s *raftStore) IncrBy(key string, delta int64) (int64, error) {
+	result, err := s.add(key, func(value any, found bool) (float64, error) {
+		return addInt(key, value, found, delta)
+	})
+	return int64(result), err
+}
+
+func (s *raftStore) IncrByFloat(key string, delta float64) (float64, error) {
+	return s.add(key, func(value any, found bool) (float64, error) {
+		return addFloat(key, value, found, delta)
+	})
+}
+
+// add sets key to the sum sum returns for its value, keeping its TTL, as a
+// conditional write that is retried until the key doesn't change under it.
+func (s *raftStore) add(key string, sum func(value any, found bool) (float64, error)) (float64, error) {
+	for {
+		e, found := s.fsm.lookup(key)
+		result, err := sum(e.value, found)
+		if err != nil {
+			return 0, err
+		}
+		_, err = s.compareAndApply(key, e.version, walRecord{Op: walOpSet, Key: key, Value: result, ExpiresAt: e.expiresAt})
+		if !errors.Is(err, ErrVersionMismatch) {
+			return result, err
+		}
+	}
+}
+
+func (s *raftStore) Scan(prefix, startAfter string, limit int) ([]Entry, bool) {
+	return s.fsm.mem.Scan(prefix, startAfter, limit)
+}
+
+func (s *raftStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+func (s *raftStore) LeaderAddr() (string, bool) {
+	_, id := s.raft.LeaderWithID()
+	peer, ok := s.peers[id]
+	return peer.HTTPAddr, ok && peer.HTTPAddr != ""
+}
+
+// VerifyLeader checks with a majority that this node still leads, then waits
+// for it to apply every write committed so far.
+func (s *raftStore) VerifyLeader() error {
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return fmt.Errorf("raft: %w", err)
+	}
+	if err := s.raft.Barrier(s.applyTimeout).Error(); err != nil {
+		return fmt.Errorf("raft: %w", err)
+	}
+	return nil
+}
+
+// Close leaves the cluster, whose other nodes carry on if they are still a
+// majority. The store must not be used afterwards.
+func (s *raftStore) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.wg.Wait()
+	errs := []error{s.raft.Shutdown().Error()}
+	for _, closer := range s.closers {
+		errs = append(errs, closer.Close())
+	}
+	errs = append(errs, s.fsm.mem.Close())
+	return errors.Join(errs...)
+}
+
+// apply replicates command and waits for it to be applied locally, returning
+// the revision it was applied at.
+func (s *raftStore) apply(command raftCommand) (uint64, error) {
+	command.Now = time.Now()
+	data, err := json.Marshal(command)
+	if err != nil {
+		return 0, fmt.Errorf("raft: %s %q not committed: %w", command.Op, command.Key, err)
+	}
+	future := s.raft.Apply(data, s.applyTimeout)
+	if err := future.Error(); err != nil {
+		return 0, fmt.Errorf("raft: %s %q not committed: %w", command.Op, command.Key, err)
+	}
+	// committed, but refused by the FSM, e.g. for a version mismatch
+	if err, ok := future.Response().(error); ok {
+		return 0, err
+	}
+	return future.Index(), nil
+}
+
+// mustApply is apply for the writes Store gives no way to fail, which panic
+// instead; the HTTP layer's recovery middleware turns that into a 500.
+func (s *raftStore) mustApply(command raftCommand) {
+	if _, err := s.apply(command); err != nil {
+		panic(err)
+	}
+}
+
+// expireLoop has the leader expire keys whose TTL has run out.
+func (s *raftStore) expireLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(defaultSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expire()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expire proposes expiring every key past its deadline, if this node is the
+// leader. Any that fail, or that a follower holds, are retried next time.
+func (s *raftStore) expire() {
+	due := s.fsm.due(time.Now())
+	for i, next := range due {
+		if !s.IsLeader() {
+			s.fsm.schedule(due[i:]...)
+			return
+		}
+		if _, err := s.apply(raftCommand{walRecord: walRecord{Op: walOpExpire, Key: next.key, ExpiresAt: next.at}}); err != nil {
+			s.fsm.schedule(due[i:]...)
+			return
+		}
+	}
+}
+
+func (opts RaftOptions) self() (RaftPeer, error) {
+	for _, peer := range opts.Peers {
+		if peer.ID == opts.NodeID {
+			return peer, nil
+		}
+	}
+	return RaftPeer{}, fmt.Errorf("raft: node %q is not among its peers", opts.NodeID)
+}
+
+func (opts RaftOptions) logOutput() io.Writer {
+	if opts.LogOutput == nil {
+		return os.Stderr
+	}
+	return opts.LogOutput
+}
+
+// raftCommand is an entry of the replicated log: a record to apply if every
+// key in Expect is still at the version expected. Now is the clock of the
+// node that proposed it, against which keys' expiries are judged.
+type raftCommand struct {
+	walRecord
+	Expect []TxnRead `json:"expect,omitempty"`
+	Now    time.Time `json:"now,omitzero"`
+}
+
+// encodedCommand is a raftCommand as logged. raftCommand can't be encoded
+// as it is, as the JSON methods of the walRecord it embeds would take over.
+type encodedCommand struct {
+	encodedRecord
+	Expect []TxnRead `json:"expect,omitempty"`
+	Now    time.Time `json:"now,omitzero"`
+}
+
+func (c raftCommand) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodedCommand{c.walRecord.encode(), c.Expect, c.Now})
+}
+
+func (c *raftCommand) UnmarshalJSON(data []byte) error {
+	var encoded encodedCommand
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	record, err := encoded.decode()
+	if err != nil {
+		return err
+	}
+	*c = raftCommand{walRecord: record, Expect: encoded.Expect, Now: encoded.Now}
+	return nil
+}
+
+// raftFSM applies committed log entries, which are JSON-encoded raftCommands,
+// to an in-memory store. Raft calls it from one goroutine at a time.
+type raftFSM struct {
+	mem *inMemoryStore
+	// expiries holds the keys with a TTL, for the leader to expire. Guarded
+	// by mem.mu.
+	expiries expiryHeap
+}
+
+// Apply returns nil, or the error the command was refused with.
+func (f *raftFSM) Apply(l *raft.Log) any {
+	var command raftCommand
+	if err := json.Unmarshal(l.Data, &command); err != nil {
+		return err
+	}
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	var conflicts []Conflict
+	for _, read := range command.Expect {
+		if version := f.versionAt(read.Key, command.Now); version != read.Version {
+			conflicts = append(conflicts, Conflict{Key: read.Key, ExpectedVersion: read.Version, ActualVersion: version})
+		}
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	record := command.walRecord
+	switch record.Op {
+	case walOpDelete:
+		if _, ok := f.mem.store[record.Key]; !ok {
+			return nil
+		}
+	case walOpExpire:
+		// the key may since have been overwritten or given a new expiry
+		if e, ok := f.mem.store[record.Key]; !ok || !e.expiresAt.Equal(record.ExpiresAt) {
+			return nil
+		}
+	}
+	record.Revision = l.Index
+	if _, err := f.mem.tryCommit(record); err != nil {
+		return err
+	}
+	f.scheduleRecord(record)
+	return nil
+}
+
+// versionAt returns key's version, or 0 if it isn't set or had expired by
+// now. Callers must hold mem.mu.
+func (f *raftFSM) versionAt(key string, now time.Time) uint64 {
+	e, ok := f.mem.store[key]
+	if !ok || e.expired(now) {
+		return 0
+	}
+	return e.version
+}
+
+// lookup returns the live entry for key.
+func (f *raftFSM) lookup(key string) (entry, bool) {
+	f.mem.mu.RLock()
+	defer f.mem.mu.RUnlock()
+	return f.mem.lookup(key)
+}
+
+// scheduleRecord queues the keys record gives a TTL. Callers must hold mem.mu.
+func (f *raftFSM) scheduleRecord(record walRecord) {
+	if !record.ExpiresAt.IsZero() && record.Op == walOpSet {
+		heap.Push(&f.expiries, expiry{key: record.Key, at: record.ExpiresAt})
+	}
+	for _, op := range record.Ops {
+		f.scheduleRecord(op)
+	}
+}
+
+// schedule queues expiries again.
+func (f *raftFSM) schedule(expiries ...expiry) {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	for _, next := range expiries {
+		heap.Push(&f.expiries, next)
+	}
+}
+
+// due removes and returns the queued expiries that have passed, skipping
+// keys that have since been overwritten, deleted or given a new expiry.
+func (f *raftFSM) due(now time.Time) []expiry {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	var due []expiry
+	for f.expiries.Len() > 0 && !now.Before(f.expiries[0].at) {
+		next := heap.Pop(&f.expiries).(expiry)
+		if e, ok := f.mem.store[next.key]; ok && e.expiresAt.Equal(next.at) {
+			due = append(due, next)
+		}
+	}
+	return due
+}
+
+// Snapshot captures the store as checkpoint records, keeping every key's
+// version, which Raft then writes out in the background while the FSM
+// carries on applying entries.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mem.mu.RLock()
+	defer f.mem.mu.RUnlock()
+	return raftSnapshot(f.mem.checkpoint()), nil
+}
+
+// Restore replaces the store's contents with a snapshot's, versions and all,
+// so they match the other nodes'.
+func (f *raftFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	records, err := readCheckpoint(r)
+	if err != nil {
+		return fmt.Errorf("raft: restoring snapshot: %w", err)
+	}
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	f.mem.apply(walRecord{Op: walOpDeletePrefix, Revision: records[len(records)-1].Revision})
+	f.expiries = nil
+	for _, record := range records {
+		f.mem.apply(record)
+		f.scheduleRecord(record)
+	}
+	return nil
+}
+
+// raftSnapshot persists checkpoint records.
+type raftSnapshot []walRecord
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := writeCheckpoint(sink, s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (raftSnapshot) Release() {}
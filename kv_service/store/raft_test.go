@@ -0,0 +1,411 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// raftTestNode is a node of an in-process cluster, with storage that
+// outlives the node so it can be restarted.
+type raftTestNode struct {
+	opts      RaftOptions
+	logs      *raft.InmemStore
+	snapshots *raft.InmemSnapshotStore
+	transport *raft.InmemTransport
+	store     *raftStore // nil while stopped
+}
+
+type raftStoreTestSuite struct {
+	suite.Suite
+	nodes []*raftTestNode
+}
+
+func (s *raftStoreTestSuite) TearDownTest() {
+	for _, node := range s.nodes {
+		if node.store != nil {
+			node.store.Close()
+		}
+	}
+}
+
+// startCluster starts n nodes connected by in-memory transports and waits
+// for them to elect a leader.
+func (s *raftStoreTestSuite) startCluster(n int) {
+	var peers []RaftPeer
+	for i := 0; i < n; i++ {
+		id := fmt.Sprint("node", i)
+		peers = append(peers, RaftPeer{ID: id, RaftAddr: id, HTTPAddr: "http://" + id})
+	}
+	s.nodes = nil
+	for _, peer := range peers {
+		_, transport := raft.NewInmemTransport(raft.ServerAddress(peer.RaftAddr))
+		s.nodes = append(s.nodes, &raftTestNode{
+			opts:      RaftOptions{NodeID: peer.ID, Peers: peers, ApplyTimeout: time.Second, LogOutput: io.Discard},
+			logs:      raft.NewInmemStore(),
+			snapshots: raft.NewInmemSnapshotStore(),
+			transport: transport,
+		})
+	}
+	for _, node := range s.nodes {
+		for _, other := range s.nodes {
+			node.transport.Connect(other.transport.LocalAddr(), other.transport)
+		}
+		s.start(node)
+	}
+	s.leader()
+}
+
+func (s *raftStoreTestSuite) start(node *raftTestNode) {
+	conf := raftConfig(node.opts)
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	// snapshot and truncate the log often, so lagging nodes catch up from snapshots
+	conf.SnapshotThreshold = 50
+	conf.SnapshotInterval = 50 * time.Millisecond
+	conf.TrailingLogs = 10
+	var err error
+	node.store, err = newRaftStore(node.opts, conf, node.logs, node.logs, node.snapshots, node.transport)
+	s.Require().NoError(err)
+}
+
+func (s *raftStoreTestSuite) stop(node *raftTestNode) {
+	s.Require().NoError(node.store.Close())
+	node.store = nil
+}
+
+// leader waits for the running nodes to agree on a leader and returns it.
+func (s *raftStoreTestSuite) leader() *raftTestNode {
+	var leader *raftTestNode
+	s.Require().Eventually(func() bool {
+		leader = nil
+		for _, node := range s.nodes {
+			if node.store != nil && node.store.IsLeader() {
+				leader = node
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		// every running node knows who it is
+		for _, node := range s.nodes {
+			if node.store == nil {
+				continue
+			}
+			if addr, ok := node.store.LeaderAddr(); !ok || addr != "http://"+leader.opts.NodeID {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (s *raftStoreTestSuite) followers() []*raftTestNode {
+	var followers []*raftTestNode
+	for _, node := range s.nodes {
+		if node.store != nil && !node.store.IsLeader() {
+			followers = append(followers, node)
+		}
+	}
+	return followers
+}
+
+// replicated waits until every running node has key set to value.
+func (s *raftStoreTestSuite) replicated(key string, value any) {
+	s.Require().Eventually(func() bool {
+		for _, node := range s.nodes {
+			if node.store != nil && node.store.Get(key) != value {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond, key)
+}
+
+func (s *raftStoreTestSuite) TestImplementsStore() {
+	s.startCluster(1)
+	store := s.nodes[0].store
+	assert.Implements(s.T(), (*Store)(nil), store)
+	assert.Implements(s.T(), (*ScannableStore)(nil), store)
+	assert.Implements(s.T(), (*ReplicatedStore)(nil), store)
+	assert.Implements(s.T(), (*LinearizableStore)(nil), store)
+	assert.Implements(s.T(), (*ExpiringVersionedStore)(nil), store)
+	assert.Implements(s.T(), (*TransactionalStore)(nil), store)
+	assert.Implements(s.T(), (*CounterStore)(nil), store)
+}
+
+func (s *raftStoreTestSuite) TestReplicatesWrites() {
+	s.startCluster(3)
+	leader := s.leader().store
+
+	leader.Set("string", "value")
+	leader.Set("object", map[string]any{"nested": []any{"a", float64(1)}})
+	leader.Set("deleted", "value")
+	leader.Delete("deleted")
+	leader.Delete("missing")
+	leader.Set("last", "value")
+	// the leader has applied its writes once they return
+	assert.Equal(s.T(), "value", leader.Get("string"))
+	assert.Nil(s.T(), leader.Get("deleted"))
+
+	// followers apply writes in order, so have the rest once they have the last
+	s.replicated("last", "value")
+	for _, node := range s.nodes {
+		assert.Equal(s.T(), "value", node.store.Get("string"), node.opts.NodeID)
+		assert.Equal(s.T(), map[string]any{"nested": []any{"a", float64(1)}}, node.store.Get("object"), node.opts.NodeID)
+		assert.Nil(s.T(), node.store.Get("deleted"), node.opts.NodeID)
+	}
+}
+
+func (s *raftStoreTestSuite) TestVersionsAreLogIndexes() {
+	s.startCluster(3)
+	leader := s.leader().store
+	leader.Set("a", "1")
+	leader.Set("b", "2")
+	s.replicated("b", "2")
+
+	expected, _ := leader.Scan("", "", 0)
+	assert.Less(s.T(), expected[0].Version, expected[1].Version)
+	for _, node := range s.nodes {
+		entries, _ := node.store.Scan("", "", 0)
+		assert.Equal(s.T(), expected, entries, node.opts.NodeID)
+	}
+}
+
+func (s *raftStoreTestSuite) TestFollowersRejectWrites() {
+	s.startCluster(3)
+	leader := s.leader()
+	follower := s.followers()[0].store
+
+	assert.False(s.T(), follower.IsLeader())
+	addr, ok := follower.LeaderAddr()
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), "http://"+leader.opts.NodeID, addr)
+	assert.PanicsWithError(s.T(), `raft: set "key" not committed: node is not the leader`, func() {
+		follower.Set("key", "value")
+	})
+	// writes that can fail return the error instead
+	_, err := follower.CompareAndSwap("key", 0, "value")
+	assert.ErrorIs(s.T(), err, raft.ErrNotLeader)
+	_, err = follower.Incr("counter")
+	assert.ErrorIs(s.T(), err, raft.ErrNotLeader)
+}
+
+func (s *raftStoreTestSuite) TestConditionalWrites() {
+	s.startCluster(3)
+	leader := s.leader().store
+
+	version, err := leader.CompareAndSwap("key", 0, "a")
+	s.Require().NoError(err)
+	_, err = leader.CompareAndSwap("key", 0, "b")
+	assert.ErrorIs(s.T(), err, ErrVersionMismatch)
+	assert.EqualError(s.T(), err, fmt.Sprintf(`version mismatch: "key" is at version %d, expected 0`, version))
+	next, err := leader.CompareAndSwapWithTTL("key", version, "b", time.Hour)
+	s.Require().NoError(err)
+	assert.Greater(s.T(), next, version)
+	assert.ErrorIs(s.T(), leader.CompareAndDelete("key", version), ErrVersionMismatch)
+	assert.ErrorIs(s.T(), leader.CompareAndDelete("key", 0), ErrVersionMismatch)
+	s.Require().NoError(leader.CompareAndDelete("missing", 0))
+	leader.Set("last", "value")
+
+	// every node decided alike, so holds the same versions and expiries
+	s.replicated("last", "value")
+	expected, _ := leader.Scan("", "", 0)
+	s.Require().Len(expected, 2)
+	assert.Equal(s.T(), next, expected[0].Version)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Hour), expected[0].ExpiresAt, time.Minute)
+	for _, node := range s.nodes {
+		entries, _ := node.store.Scan("", "", 0)
+		assert.Equal(s.T(), expected, entries, node.opts.NodeID)
+	}
+}
+
+func (s *raftStoreTestSuite) TestTTLExpiresEverywhere() {
+	s.startCluster(3)
+	leader := s.leader().store
+	leader.SetWithTTL("key", "value", 50*time.Millisecond)
+	leader.SetWithTTL("renewed", "value", 50*time.Millisecond)
+	leader.Set("renewed", "value")
+
+	// the leader expires the key through the log, so every copy drops it
+	s.Require().Eventually(func() bool {
+		for _, node := range s.nodes {
+			node.store.fsm.mem.mu.RLock()
+			_, ok := node.store.fsm.mem.store["key"]
+			node.store.fsm.mem.mu.RUnlock()
+			if ok {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, node := range s.nodes {
+		assert.Equal(s.T(), "value", node.store.Get("renewed"), node.opts.NodeID)
+	}
+}
+
+func (s *raftStoreTestSuite) TestTransactions() {
+	s.startCluster(3)
+	leader := s.leader().store
+	leader.Set("a", "1")
+	_, version := leader.GetWithVersion("a")
+
+	var txn Txn
+	txn.Read("a", version)
+	txn.Read("b", 0)
+	txn.Set("b", "2")
+	txn.Delete("a")
+	revision, err := leader.Commit(txn)
+	s.Require().NoError(err)
+	_, bVersion := leader.GetWithVersion("b")
+	assert.Equal(s.T(), revision, bVersion)
+	assert.Nil(s.T(), leader.Get("a"))
+
+	// replaying it conflicts on both reads, and changes nothing
+	_, err = leader.Commit(txn)
+	var conflict *ConflictError
+	s.Require().ErrorAs(err, &conflict)
+	assert.Equal(s.T(), []Conflict{{Key: "a", ExpectedVersion: version}, {Key: "b", ActualVersion: bVersion}}, conflict.Conflicts)
+	s.replicated("b", "2")
+}
+
+func (s *raftStoreTestSuite) TestCounters() {
+	s.startCluster(3)
+	leader := s.leader().store
+	leader.SetWithTTL("counter", float64(10), time.Hour)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := leader.IncrBy("counter", 2)
+			assert.NoError(s.T(), err)
+		}()
+	}
+	wg.Wait()
+	result, err := leader.IncrByFloat("counter", 0.5)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 30.5, result)
+	s.replicated("counter", 30.5)
+	// the TTL is kept
+	entries, _ := leader.Scan("counter", "", 0)
+	assert.False(s.T(), entries[0].ExpiresAt.IsZero())
+
+	leader.Set("text", "value")
+	_, err = leader.Incr("text")
+	assert.ErrorIs(s.T(), err, ErrNotNumber)
+}
+
+func (s *raftStoreTestSuite) TestVerifyLeader() {
+	s.startCluster(3)
+	leader := s.leader()
+	assert.NoError(s.T(), leader.store.VerifyLeader())
+	assert.ErrorIs(s.T(), s.followers()[0].store.VerifyLeader(), raft.ErrNotLeader)
+
+	// a leader cut off from the rest can't confirm it still leads
+	for _, follower := range s.followers() {
+		s.stop(follower)
+	}
+	assert.Error(s.T(), leader.store.VerifyLeader())
+}
+
+func (s *raftStoreTestSuite) TestSurvivesLossOfMinority() {
+	s.startCluster(3)
+	leader := s.leader()
+	leader.store.Set("before", "value")
+	s.replicated("before", "value")
+
+	// the remaining two are a majority, so elect a new leader and carry on
+	s.stop(leader)
+	newLeader := s.leader()
+	assert.NotSame(s.T(), leader, newLeader)
+	assert.Equal(s.T(), "value", newLeader.store.Get("before"))
+	newLeader.store.Set("after", "value")
+	s.replicated("after", "value")
+
+	// the old leader rejoins as a follower and catches up
+	s.start(leader)
+	s.replicated("after", "value")
+	assert.False(s.T(), leader.store.IsLeader())
+}
+
+func (s *raftStoreTestSuite) TestLosingMajorityStopsWrites() {
+	s.startCluster(3)
+	leader := s.leader()
+	for _, follower := range s.followers() {
+		s.stop(follower)
+	}
+	assert.Panics(s.T(), func() { leader.store.Set("key", "value") })
+	assert.Nil(s.T(), leader.store.Get("key"))
+}
+
+func (s *raftStoreTestSuite) TestLaggingNodeCatchesUpFromSnapshot() {
+	s.startCluster(3)
+	lagging := s.followers()[0]
+	s.stop(lagging)
+
+	leader := s.leader().store
+	for i := 0; i < 200; i++ {
+		leader.Set(fmt.Sprint("key", i), float64(i))
+	}
+	// wait for the log to have been truncated past what lagging has
+	s.Require().Eventually(func() bool {
+		first, err := s.leader().logs.FirstIndex()
+		return err == nil && first > 10
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.start(lagging)
+	s.replicated("key199", float64(199))
+	entries, _ := lagging.store.Scan("key", "", 0)
+	assert.Len(s.T(), entries, 200)
+	// with the leader's versions, which conditional writes rely on
+	expected, _ := s.leader().store.Scan("key", "", 0)
+	assert.Equal(s.T(), expected, entries)
+}
+
+func (s *raftStoreTestSuite) TestDurableNodeSurvivesRestart() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	addr := listener.Addr().String()
+	listener.Close()
+	opts := RaftOptions{
+		NodeID:    "node0",
+		Peers:     []RaftPeer{{ID: "node0", RaftAddr: addr, HTTPAddr: "http://node0"}},
+		DataDir:   s.T().TempDir(),
+		LogOutput: io.Discard,
+	}
+	open := func() *raftStore {
+		store, err := NewRaftStore(opts)
+		s.Require().NoError(err)
+		s.Require().Eventually(store.IsLeader, 10*time.Second, 10*time.Millisecond)
+		return store
+	}
+
+	store := open()
+	store.Set("key", "value")
+	s.Require().NoError(store.Close())
+
+	store = open()
+	defer store.Close()
+	s.Require().Eventually(func() bool { return store.Get("key") == "value" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func (s *raftStoreTestSuite) TestRequiresSelfAmongPeers() {
+	_, err := NewRaftStore(RaftOptions{NodeID: "node0", Peers: []RaftPeer{{ID: "node1", RaftAddr: "127.0.0.1:0"}}, DataDir: s.T().TempDir()})
+	assert.EqualError(s.T(), err, `raft: node "node0" is not among its peers`)
+}
+
+func TestRaftStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(raftStoreTestSuite))
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ReplicationSource is a WatchableStore that replicas can follow.
+type ReplicationSource interface {
+	WatchableStore
+	// Checkpoint returns every live entry and the revision they are current
+	// as of, and streams every change after that revision, as Watch does.
+	Checkpoint(ctx context.Context) ([]Entry, uint64, <-chan Event, error)
+}
+
+// ReplicaStore is a read-only copy of a primary store, kept up to date by
+// loading the primary's checkpoint and then applying its changes in order.
+type ReplicaStore interface {
+	ReplicatedStore
+	ReplicationSource
+	ScannableStore
+	// Load replaces the replica's contents with a checkpoint of the primary.
+	Load(entries []Entry, revision uint64) error
+	// Apply makes the changes the primary made at revision, which must come
+	// after every revision already applied.
+	Apply(revision uint64, changes []Event) error
+	// Promote stops the replica following its primary and makes it writable,
+	// so it can take over as the primary.
+	Promote()
+}
+
+// ErrReplica is returned, or panicked with, when writing to a replica that
+// hasn't been promoted. Writes must be made on its primary.
+var ErrReplica = errors.New("writes must be made on the primary")
+
+// replicaStore is an in-memory ReplicaStore. Keys keep the versions the
+// primary gave them, so a version read from the replica can condition a
+// write made on the primary. Until it is promoted the replica doesn't
+// expire keys itself, but waits for the primary's expiries; expired keys
+// are hidden from reads in the meantime.
+type replicaStore struct {
+	*inMemoryStore
+	primaryAddr string
+}
+
+// NewReplicaStore returns an empty replica of the primary whose API is at
+// primaryAddr, e.g. http://kv1:8080.
+func NewReplicaStore(primaryAddr string) *replicaStore {
+	mem := NewInMemoryStore()
+	mem.following = true
+	return &replicaStore{inMemoryStore: mem, primaryAddr: primaryAddr}
+}
+
+func (s *replicaStore) IsLeader() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.following
+}
+
+func (s *replicaStore) LeaderAddr() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.following {
+		return "", false
+	}
+	return s.primaryAddr, true
+}
+
+func (s *replicaStore) Load(entries []Entry, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.following {
+		return errors.New("store: a promoted replica can't load a checkpoint")
+	}
+	for _, key := range s.removePrefix("") {
+		s.hub.publish(Event{Type: EventDelete, Key: key, Revision: revision})
+	}
+	for _, e := range entries {
+		s.apply(walRecord{Op: walOpSet, Key: e.Key, Value: e.Value, ExpiresAt: e.ExpiresAt, Revision: e.Version})
+	}
+	s.revision = revision
+	return nil
+}
+
+func (s *replicaStore) Apply(revision uint64, changes []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.following {
+		return errors.New("store: a promoted replica can't apply its primary's changes")
+	}
+	if revision <= s.revision {
+		return fmt.Errorf("store: revision %d already applied, at revision %d", revision, s.revision)
+	}
+	var ops []walRecord
+	for _, change := range changes {
+		op := walRecord{Key: change.Key}
+		switch change.Type {
+		case EventSet:
+			op.Op, op.Value, op.ExpiresAt = walOpSet, change.Value, change.ExpiresAt
+		case EventUpdate:
+			op.Op, op.Change = walOpUpdate, change.Change
+		case EventDelete:
+			op.Op = walOpDelete
+		case EventExpire:
+			op.Op = walOpExpire
+		case EventEvict:
+			op.Op = walOpEvict
+		default:
+			return fmt.Errorf("store: unknown change %q to %q", change.Type, change.Key)
+		}
+		ops = append(ops, op)
+	}
+	s.commit(walRecord{Op: walOpBatch, Ops: ops, Revision: revision})
+	return nil
+}
+
+// Promote makes the replica writable. Its revisions carry on from the last
+// one it applied, and it starts expiring keys itself.
+func (s *replicaStore) Promote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.following {
+		return
+	}
+	s.following = false
+	for key, e := range s.store {
+		if !e.expiresAt.IsZero() {
+			s.scheduleExpiry(key, e.expiresAt)
+		}
+	}
+}
+
+func (s *inMemoryStore) Checkpoint(ctx context.Context) ([]Entry, uint64, <-chan Event, error) {
+	// as in Watch, the read lock keeps the entries and the stream consistent
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, _ := s.scan("", "", 0)
+	events, err := s.hub.watch(ctx, "", 0, s.revision)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return entries, s.revision, events, nil
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type replicaStoreTestSuite struct {
+	suite.Suite
+	replica *replicaStore
+	clock   *fakeClock
+}
+
+func (s *replicaStoreTestSuite) SetupTest() {
+	s.replica = NewReplicaStore("http://primary")
+	s.clock = &fakeClock{now: time.Unix(0, 0)}
+	s.replica.now = s.clock.Now
+	s.replica.sweepInterval = time.Millisecond
+}
+
+func (s *replicaStoreTestSuite) TearDownTest() {
+	s.replica.Close()
+}
+
+func (s *replicaStoreTestSuite) TestImplementsStore() {
+	assert.Implements(s.T(), (*ReplicaStore)(nil), s.replica)
+	assert.Implements(s.T(), (*ScannableStore)(nil), s.replica)
+	assert.Implements(s.T(), (*VersionedStore)(nil), s.replica)
+}
+
+func (s *replicaStoreTestSuite) TestFollowsPrimary() {
+	assert.False(s.T(), s.replica.IsLeader())
+	addr, ok := s.replica.LeaderAddr()
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), "http://primary", addr)
+}
+
+func (s *replicaStoreTestSuite) TestLoadKeepsVersions() {
+	s.Require().NoError(s.replica.Apply(1, []Event{{Type: EventSet, Key: "dropped", Value: "value"}}))
+	s.Require().NoError(s.replica.Load([]Entry{
+		{Key: "a", Value: "one", Version: 3},
+		{Key: "b", Value: "two", Version: 7, ExpiresAt: time.Unix(60, 0)},
+	}, 9))
+
+	value, version := s.replica.GetWithVersion("b")
+	assert.Equal(s.T(), "two", value)
+	assert.Equal(s.T(), uint64(7), version)
+	assert.Equal(s.T(), uint64(9), s.replica.Revision())
+	entries, _ := s.replica.Scan("", "", 0)
+	assert.Equal(s.T(), []Entry{
+		{Key: "a", Value: "one", Version: 3},
+		{Key: "b", Value: "two", Version: 7, ExpiresAt: time.Unix(60, 0)},
+	}, entries)
+}
+
+func (s *replicaStoreTestSuite) TestApply() {
+	events, err := s.replica.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	s.Require().NoError(s.replica.Apply(4, []Event{
+		{Type: EventSet, Key: "a", Value: "one"},
+		{Type: EventSet, Key: "b", Value: "two"},
+	}))
+	s.Require().NoError(s.replica.Apply(6, []Event{{Type: EventDelete, Key: "a"}}))
+
+	assert.Nil(s.T(), s.replica.Get("a"))
+	value, version := s.replica.GetWithVersion("b")
+	assert.Equal(s.T(), "two", value)
+	assert.Equal(s.T(), uint64(4), version)
+	assert.Equal(s.T(), uint64(6), s.replica.Revision())
+	// the replica's own watchers see the primary's revisions
+	for _, expected := range []Event{
+		{Type: EventSet, Key: "a", Value: "one", Revision: 4},
+		{Type: EventSet, Key: "b", Value: "two", Revision: 4},
+		{Type: EventDelete, Key: "a", Revision: 6},
+	} {
+		assert.Equal(s.T(), expected, <-events)
+	}
+}
+
+func (s *replicaStoreTestSuite) TestApplyRejectsOldRevisions() {
+	s.Require().NoError(s.replica.Apply(4, []Event{{Type: EventSet, Key: "a", Value: "one"}}))
+	assert.EqualError(s.T(), s.replica.Apply(4, []Event{{Type: EventDelete, Key: "a"}}), "store: revision 4 already applied, at revision 4")
+	assert.EqualError(s.T(), s.replica.Apply(5, []Event{{Type: "rename", Key: "a"}}), `store: unknown change "rename" to "a"`)
+	assert.Equal(s.T(), "one", s.replica.Get("a"))
+}
+
+func (s *replicaStoreTestSuite) TestRejectsWritesUntilPromoted() {
+	s.Require().NoError(s.replica.Apply(1, []Event{{Type: EventSet, Key: "existing", Value: "value"}}))
+	assert.PanicsWithError(s.T(), `store: set "key" rejected: writes must be made on the primary`, func() {
+		s.replica.Set("key", "value")
+	})
+	assert.Panics(s.T(), func() { s.replica.Delete("existing") })
+	assert.Nil(s.T(), s.replica.Get("key"))
+	assert.Equal(s.T(), "value", s.replica.Get("existing"))
+}
+
+func (s *replicaStoreTestSuite) TestPromote() {
+	s.Require().NoError(s.replica.Apply(4, []Event{{Type: EventSet, Key: "a", Value: "one"}}))
+	s.replica.Promote()
+
+	assert.True(s.T(), s.replica.IsLeader())
+	_, ok := s.replica.LeaderAddr()
+	assert.False(s.T(), ok)
+	// revisions carry on from the primary's
+	version, err := s.replica.CompareAndSwap("a", 4, "two")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), uint64(5), version)
+	assert.Error(s.T(), s.replica.Apply(6, nil))
+}
+
+func (s *replicaStoreTestSuite) TestExpiresKeysOnlyOncePromoted() {
+	s.Require().NoError(s.replica.Load([]Entry{{Key: "session", Value: "token", Version: 1, ExpiresAt: time.Unix(60, 0)}}, 1))
+	events, err := s.replica.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	// expired keys are hidden, but left for the primary to expire
+	s.clock.Advance(time.Minute)
+	assert.Nil(s.T(), s.replica.Get("session"))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(s.T(), uint64(1), s.replica.Revision())
+
+	s.replica.Promote()
+	select {
+	case event := <-events:
+		assert.Equal(s.T(), Event{Type: EventExpire, Key: "session", Revision: 2}, event)
+	case <-time.After(time.Second):
+		s.FailNow("timed out waiting for the key to expire")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	store := NewInMemoryStore()
+	defer store.Close()
+	store.Set("a", "one")
+	store.Set("b", "two")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries, revision, events, err := store.Checkpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{Key: "a", Value: "one", Version: 1}, {Key: "b", Value: "two", Version: 2}}, entries)
+	assert.Equal(t, uint64(2), revision)
+
+	store.Delete("a")
+	assert.Equal(t, Event{Type: EventDelete, Key: "a", Revision: 3}, <-events)
+}
+
+func TestReplicaStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(replicaStoreTestSuite))
+}
@@ -0,0 +1,347 @@
+package store
+
+import (
+	"hash/maphash"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// shardedStore is a thread-safe, in-memory Store that spreads keys across
+// independently locked shards by hash, so writes to different keys rarely
+// contend. Each shard is an inMemoryStore; all of them draw revisions from
+// one counter, so versions are store-wide exactly as in a single store.
+//
+// Operations on one key lock only its shard. Batches, scans and bulk
+// deletes lock every shard they touch, in index order so they can't
+// deadlock, and so stay atomic.
+type shardedStore struct {
+	shards    []*inMemoryStore
+	seed      maphash.Seed
+	revisions atomic.Uint64
+}
+
+// NewShardedStore returns a store with numShards shards. A numShards below 1
+// uses four per CPU.
+func NewShardedStore(numShards int) *shardedStore {
+	if numShards < 1 {
+		numShards = 4 * runtime.GOMAXPROCS(0)
+	}
+	s := &shardedStore{shards: make([]*inMemoryStore, numShards), seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i] = NewInMemoryStore()
+		s.shards[i].revisions = &s.revisions
+		// events from separate shards could be published out of revision
+		// order, so a sharded store can't be watched and keeps no history
+		s.shards[i].hub = nil
+	}
+	return s
+}
+
+func (s *shardedStore) Set(key string, value any) {
+	s.shardFor(key).Set(key, value)
+}
+
+func (s *shardedStore) SetWithTTL(key string, value any, ttl time.Duration) {
+	s.shardFor(key).SetWithTTL(key, value, ttl)
+}
+
+func (s *shardedStore) Get(key string) any {
+	return s.shardFor(key).Get(key)
+}
+
+func (s *shardedStore) Lookup(key string) (any, bool) {
+	return s.shardFor(key).Lookup(key)
+}
+
+func (s *shardedStore) GetWithVersion(key string) (any, uint64) {
+	return s.shardFor(key).GetWithVersion(key)
+}
+
+func (s *shardedStore) Delete(key string) {
+	s.shardFor(key).Delete(key)
+}
+
+func (s *shardedStore) CompareAndSwap(key string, expectedVersion uint64, value any) (uint64, error) {
+	return s.shardFor(key).CompareAndSwap(key, expectedVersion, value)
+}
+
+func (s *shardedStore) CompareAndSwapWithTTL(key string, expectedVersion uint64, value any, ttl time.Duration) (uint64, error) {
+	return s.shardFor(key).CompareAndSwapWithTTL(key, expectedVersion, value, ttl)
+}
+
+func (s *shardedStore) CompareAndDelete(key string, expectedVersion uint64) error {
+	return s.shardFor(key).CompareAndDelete(key, expectedVersion)
+}
+
+func (s *shardedStore) Incr(key string) (int64, error) {
+	return s.shardFor(key).Incr(key)
+}
+
+func (s *shardedStore) IncrBy(key string, delta int64) (int64, error) {
+	return s.shardFor(key).IncrBy(key, delta)
+}
+
+func (s *shardedStore) IncrByFloat(key string, delta float64) (float64, error) {
+	return s.shardFor(key).IncrByFloat(key, delta)
+}
+
+func (s *shardedStore) JSONPatch(key string, patch []PatchOperation) (any, uint64, error) {
+	return s.shardFor(key).JSONPatch(key, patch)
+}
+
+func (s *shardedStore) MergePatch(key string, patch any) (any, uint64, error) {
+	return s.shardFor(key).MergePatch(key, patch)
+}
+
+func (s *shardedStore) ListPush(key string, front bool, values ...any) (int, error) {
+	return s.shardFor(key).ListPush(key, front, values...)
+}
+
+func (s *shardedStore) ListPop(key string, front bool, count int) ([]any, error) {
+	return s.shardFor(key).ListPop(key, front, count)
+}
+
+func (s *shardedStore) ListRange(key string, start, stop int) ([]any, error) {
+	return s.shardFor(key).ListRange(key, start, stop)
+}
+
+func (s *shardedStore) SetAdd(key string, members ...string) (int, error) {
+	return s.shardFor(key).SetAdd(key, members...)
+}
+
+func (s *shardedStore) SetRemove(key string, members ...string) (int, error) {
+	return s.shardFor(key).SetRemove(key, members...)
+}
+
+func (s *shardedStore) SetMembers(key string) ([]string, error) {
+	return s.shardFor(key).SetMembers(key)
+}
+
+func (s *shardedStore) SetIntersect(keys ...string) ([]string, error) {
+	shards := s.shardIndexes(keys)
+	s.rlock(shards)
+	defer s.runlock(shards)
+	return intersectSets(keys, func(key string) (entry, bool) {
+		return s.shardFor(key).lookup(key)
+	})
+}
+
+func (s *shardedStore) HashGet(key, field string) (any, bool, error) {
+	return s.shardFor(key).HashGet(key, field)
+}
+
+func (s *shardedStore) HashGetAll(key string) (map[string]any, error) {
+	return s.shardFor(key).HashGetAll(key)
+}
+
+func (s *shardedStore) HashSet(key string, fields map[string]any) (int, error) {
+	return s.shardFor(key).HashSet(key, fields)
+}
+
+func (s *shardedStore) HashDelete(key string, fields ...string) (int, error) {
+	return s.shardFor(key).HashDelete(key, fields...)
+}
+
+func (s *shardedStore) SortedSetAdd(key string, members map[string]float64) (int, error) {
+	return s.shardFor(key).SortedSetAdd(key, members)
+}
+
+func (s *shardedStore) SortedSetRemove(key string, members ...string) (int, error) {
+	return s.shardFor(key).SortedSetRemove(key, members...)
+}
+
+func (s *shardedStore) SortedSetMember(key, member string, reverse bool) (float64, int, bool, error) {
+	return s.shardFor(key).SortedSetMember(key, member, reverse)
+}
+
+func (s *shardedStore) SortedSetRange(key string, start, stop int, reverse bool) ([]ScoredMember, error) {
+	return s.shardFor(key).SortedSetRange(key, start, stop, reverse)
+}
+
+func (s *shardedStore) SortedSetRangeByScore(key string, scores ScoreRange, limit int) ([]ScoredMember, error) {
+	return s.shardFor(key).SortedSetRangeByScore(key, scores, limit)
+}
+
+func (s *shardedStore) SortedSetPop(key string, highest bool, count int) ([]ScoredMember, error) {
+	return s.shardFor(key).SortedSetPop(key, highest, count)
+}
+
+func (s *shardedStore) MGet(keys []string) []any {
+	values, _ := s.MLookup(keys)
+	return values
+}
+
+func (s *shardedStore) MLookup(keys []string) ([]any, []bool) {
+	shards := s.shardIndexes(keys)
+	s.rlock(shards)
+	defer s.runlock(shards)
+	values, found := make([]any, len(keys)), make([]bool, len(keys))
+	for i, key := range keys {
+		if e, ok := s.shardFor(key).lookup(key); ok {
+			values[i], found[i] = exportValue(e.value), true
+		}
+	}
+	return values, found
+}
+
+func (s *shardedStore) MSet(values map[string]any) {
+	if len(values) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	ops := make(map[int][]walRecord)
+	for _, key := range keys {
+		i := s.shardIndex(key)
+		ops[i] = append(ops[i], walRecord{Op: walOpSet, Key: key, Value: values[key]})
+	}
+	s.commitBatch(ops)
+}
+
+func (s *shardedStore) MDelete(keys []string) {
+	shards := s.shardIndexes(keys)
+	s.lock(shards)
+	defer s.unlock(shards)
+	ops := make(map[int][]walRecord)
+	for _, key := range keys {
+		i := s.shardIndex(key)
+		if _, ok := s.shards[i].store[key]; ok {
+			ops[i] = append(ops[i], walRecord{Op: walOpDelete, Key: key})
+		}
+	}
+	s.commitLocked(ops)
+}
+
+// Scan merges the matching keys of every shard, read under all of their
+// locks so the result is consistent.
+func (s *shardedStore) Scan(prefix, startAfter string, limit int) ([]Entry, bool) {
+	shards := s.allShards()
+	s.rlock(shards)
+	defer s.runlock(shards)
+	var entries []Entry
+	more := false
+	for _, shard := range s.shards {
+		// each shard contributes at most limit entries, and only the first
+		// limit of them all are returned
+		shardEntries, shardMore := shard.scan(prefix, startAfter, limit)
+		entries = append(entries, shardEntries...)
+		more = more || shardMore
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Key, b.Key) })
+	if limit > 0 && len(entries) > limit {
+		entries, more = entries[:limit], true
+	}
+	return entries, more
+}
+
+func (s *shardedStore) Flush() int {
+	return s.DeletePrefix("")
+}
+
+func (s *shardedStore) DeletePrefix(prefix string) int {
+	shards := s.allShards()
+	s.lock(shards)
+	defer s.unlock(shards)
+	deleted := 0
+	ops := make(map[int][]walRecord)
+	for i, shard := range s.shards {
+		live, present := shard.countPrefix(prefix)
+		deleted += live
+		if present > 0 {
+			ops[i] = []walRecord{{Op: walOpDeletePrefix, Key: prefix}}
+		}
+	}
+	s.commitLocked(ops)
+	return deleted
+}
+
+// Close stops every shard's expiry sweeper.
+func (s *shardedStore) Close() error {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+	return nil
+}
+
+// commitBatch locks the shards in ops and commits their writes together.
+func (s *shardedStore) commitBatch(ops map[int][]walRecord) {
+	shards := make([]int, 0, len(ops))
+	for i := range ops {
+		shards = append(shards, i)
+	}
+	slices.Sort(shards)
+	s.lock(shards)
+	defer s.unlock(shards)
+	s.commitLocked(ops)
+}
+
+// commitLocked commits each shard's ops as one batch, all sharing a single
+// revision, so they are one write just as in a single store. Callers must
+// hold the locks of the shards in ops.
+func (s *shardedStore) commitLocked(ops map[int][]walRecord) {
+	if len(ops) == 0 {
+		return
+	}
+	revision := s.revisions.Add(1)
+	for i, shardOps := range ops {
+		s.shards[i].commit(walRecord{Op: walOpBatch, Revision: revision, Ops: shardOps})
+	}
+}
+
+func (s *shardedStore) shardIndex(key string) int {
+	return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+func (s *shardedStore) shardFor(key string) *inMemoryStore {
+	return s.shards[s.shardIndex(key)]
+}
+
+// shardIndexes returns the distinct shards holding keys, in index order.
+func (s *shardedStore) shardIndexes(keys []string) []int {
+	shards := make([]int, 0, len(keys))
+	for _, key := range keys {
+		shards = append(shards, s.shardIndex(key))
+	}
+	slices.Sort(shards)
+	return slices.Compact(shards)
+}
+
+func (s *shardedStore) allShards() []int {
+	shards := make([]int, len(s.shards))
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+// lock write-locks shards, which must be in index order.
+func (s *shardedStore) lock(shards []int) {
+	for _, i := range shards {
+		s.shards[i].mu.Lock()
+	}
+}
+
+func (s *shardedStore) unlock(shards []int) {
+	for _, i := range shards {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// rlock read-locks shards, which must be in index order.
+func (s *shardedStore) rlock(shards []int) {
+	for _, i := range shards {
+		s.shards[i].mu.RLock()
+	}
+}
+
+func (s *shardedStore) runlock(shards []int) {
+	for _, i := range shards {
+		s.shards[i].mu.RUnlock()
+	}
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func (s *shardedStore) setClock(now func() time.Time) {
+	for _, shard := range s.shards {
+		shard.setClock(now)
+	}
+}
+
+func (s *shardedStore) setSweepInterval(interval time.Duration) {
+	for _, shard := range s.shards {
+		shard.setSweepInterval(interval)
+	}
+}
+
+func (s *shardedStore) sweep() {
+	for _, shard := range s.shards {
+		shard.sweep()
+	}
+}
+
+func (s *shardedStore) currentRevision() uint64 {
+	return s.revisions.Load()
+}
+
+func (s *shardedStore) holds(key string) bool {
+	return s.shardFor(key).holds(key)
+}
+
+func (s *shardedStore) heldKeys() int {
+	return s.sum((*inMemoryStore).heldKeys)
+}
+
+func (s *shardedStore) indexedKeys() int {
+	return s.sum((*inMemoryStore).indexedKeys)
+}
+
+func (s *shardedStore) pendingExpiries() int {
+	return s.sum((*inMemoryStore).pendingExpiries)
+}
+
+func (s *shardedStore) sum(count func(*inMemoryStore) int) int {
+	total := 0
+	for _, shard := range s.shards {
+		total += count(shard)
+	}
+	return total
+}
+
+// TestShardedStoreTestSuite runs the in-memory store's suite against a
+// sharded store, with enough shards that its keys land on several.
+func TestShardedStoreTestSuite(t *testing.T) {
+	suite.Run(t, &storeTestSuite{newStore: func() testStore { return NewShardedStore(8) }})
+}
+
+type shardedStoreTestSuite struct {
+	suite.Suite
+}
+
+func (s *shardedStoreTestSuite) TestShardCount() {
+	assert.Len(s.T(), NewShardedStore(3).shards, 3)
+	assert.NotEmpty(s.T(), NewShardedStore(0).shards)
+}
+
+func (s *shardedStoreTestSuite) TestSpreadsKeys() {
+	store := NewShardedStore(8)
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprint("key", i), i)
+	}
+	for i, shard := range store.shards {
+		// ~125 each, allowing for an uneven hash
+		assert.Greater(s.T(), shard.heldKeys(), 50, "shard %d", i)
+	}
+}
+
+func (s *shardedStoreTestSuite) TestCrossShardWritesShareRevision() {
+	store := NewShardedStore(8)
+	values := make(map[string]any)
+	for i := 0; i < 100; i++ {
+		values[fmt.Sprint("key", i)] = i
+	}
+	store.MSet(values)
+	assert.Equal(s.T(), uint64(1), store.currentRevision())
+	for key := range values {
+		_, version := store.GetWithVersion(key)
+		assert.Equal(s.T(), uint64(1), version, key)
+	}
+
+	assert.Equal(s.T(), 100, store.Flush())
+	assert.Equal(s.T(), uint64(2), store.currentRevision())
+}
+
+func (s *shardedStoreTestSuite) TestScanMergesShards() {
+	store := NewShardedStore(8)
+	var expected []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		store.Set(key, i)
+		expected = append(expected, key)
+	}
+
+	// paging through every shard visits each key once, in order
+	var keys []string
+	startAfter := ""
+	for {
+		entries, more := store.Scan("key", startAfter, 7)
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		if !more {
+			break
+		}
+		startAfter = entries[len(entries)-1].Key
+	}
+	assert.Equal(s.T(), expected, keys)
+}
+
+func (s *shardedStoreTestSuite) TestConcurrentCrossShardBatches() {
+	store := NewShardedStore(8)
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(id int) {
+			defer wg.Done()
+			values := make(map[string]any)
+			for _, key := range keys {
+				values[key] = id
+			}
+			store.MSet(values)
+		}(i)
+		go func() {
+			defer wg.Done()
+			// overlapping multi-shard locks are taken in order, so never deadlock
+			store.MDelete(keys[:3])
+			store.DeletePrefix("")
+		}()
+	}
+	wg.Wait()
+
+	values := store.MGet(keys)
+	for _, value := range values[1:] {
+		assert.Equal(s.T(), values[0], value)
+	}
+}
+
+func TestShardedStoreSpecificTestSuite(t *testing.T) {
+	suite.Run(t, new(shardedStoreTestSuite))
+}
+
+// benchmarkMixed runs parallel Gets and Sets over a fixed keyspace, with
+// writePercent of operations being Sets.
+func benchmarkMixed(b *testing.B, store Store, writePercent int) {
+	const numKeys = 10000
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", i)
+		store.Set(keys[i], i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := keys[rand.IntN(numKeys)]
+			if rand.IntN(100) < writePercent {
+				store.Set(key, i)
+			} else {
+				store.Get(key)
+			}
+		}
+	})
+}
+
+// BenchmarkStores compares the single-lock and sharded stores under
+// contention. Run with -cpu to see how each scales, e.g.
+//
+//	go test -run '^$' -bench Stores -cpu 1,4,16 ./store
+func BenchmarkStores(b *testing.B) {
+	for _, writePercent := range []int{10, 50, 90} {
+		b.Run(fmt.Sprintf("inMemory/writes=%d%%", writePercent), func(b *testing.B) {
+			benchmarkMixed(b, NewInMemoryStore(), writePercent)
+		})
+		b.Run(fmt.Sprintf("sharded/writes=%d%%", writePercent), func(b *testing.B) {
+			benchmarkMixed(b, NewShardedStore(0), writePercent)
+		})
+	}
+}
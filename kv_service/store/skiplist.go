@@ -0,0 +1,165 @@
+package store
+
+import (
+	"math/rand/v2"
+)
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25 // probability of promoting a node to the next level
+)
+
+// skipList is an ordered set of items with O(log n) expected insertion,
+// removal and seeking, by item or by rank. It is not safe for concurrent use.
+type skipList[T any] struct {
+	cmp    func(a, b T) int
+	head   *skipNode[T]
+	level  int // number of levels currently in use
+	length int
+}
+
+type skipNode[T any] struct {
+	item T
+	next []*skipNode[T]
+	// span[i] is how many items next[i] is ahead of this node, or for the
+	// last node of a level, how many items follow it, so ranks can be counted.
+	span []int
+}
+
+func newSkipList[T any](cmp func(a, b T) int) *skipList[T] {
+	return &skipList[T]{
+		cmp:   cmp,
+		head:  &skipNode[T]{next: make([]*skipNode[T], skipListMaxLevel), span: make([]int, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+func (l *skipList[T]) Len() int {
+	return l.length
+}
+
+// Insert adds item, reporting false if an equal item was already present.
+func (l *skipList[T]) Insert(item T) bool {
+	var update [skipListMaxLevel]*skipNode[T]
+	var rank [skipListMaxLevel]int // how many items precede update[i]
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		if i < l.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for node.next[i] != nil && l.cmp(node.next[i].item, item) < 0 {
+			rank[i] += node.span[i]
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	if next := node.next[0]; next != nil && l.cmp(next.item, item) == 0 {
+		return false
+	}
+
+	level := randomSkipListLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = l.head
+		l.head.span[i] = l.length
+	}
+	l.level = max(l.level, level)
+	inserted := &skipNode[T]{item: item, next: make([]*skipNode[T], level), span: make([]int, level)}
+	for i := 0; i < level; i++ {
+		inserted.next[i] = update[i].next[i]
+		update[i].next[i] = inserted
+		inserted.span[i] = update[i].span[i] - (rank[0] - rank[i])
+		update[i].span[i] = rank[0] - rank[i] + 1
+	}
+	// the levels above the new node now skip over it
+	for i := level; i < l.level; i++ {
+		update[i].span[i]++
+	}
+	l.length++
+	return true
+}
+
+// Remove deletes the item equal to item, reporting whether one was present.
+func (l *skipList[T]) Remove(item T) bool {
+	var update [skipListMaxLevel]*skipNode[T]
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && l.cmp(node.next[i].item, item) < 0 {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	removed := node.next[0]
+	if removed == nil || l.cmp(removed.item, item) != 0 {
+		return false
+	}
+	for i := 0; i < l.level; i++ {
+		if update[i].next[i] == removed {
+			update[i].span[i] += removed.span[i] - 1
+			update[i].next[i] = removed.next[i]
+		} else {
+			update[i].span[i]--
+		}
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
+
+// Ascend calls fn for each item not less than pivot, in order, until fn
+// returns false.
+func (l *skipList[T]) Ascend(pivot T, fn func(T) bool) {
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && l.cmp(node.next[i].item, pivot) < 0 {
+			node = node.next[i]
+		}
+	}
+	for node = node.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.item) {
+			return
+		}
+	}
+}
+
+// Rank returns how many items are less than item, the index it has if
+// present, and whether it is.
+func (l *skipList[T]) Rank(item T) (int, bool) {
+	rank := 0
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && l.cmp(node.next[i].item, item) < 0 {
+			rank += node.span[i]
+			node = node.next[i]
+		}
+	}
+	next := node.next[0]
+	return rank, next != nil && l.cmp(next.item, item) == 0
+}
+
+// AscendFrom calls fn for each item from the one at index start, in order,
+// until fn returns false.
+func (l *skipList[T]) AscendFrom(start int, fn func(T) bool) {
+	passed := 0
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && passed+node.span[i] <= start {
+			passed += node.span[i]
+			node = node.next[i]
+		}
+	}
+	for node = node.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.item) {
+			return
+		}
+	}
+}
+
+func randomSkipListLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type skipListTestSuite struct {
+	suite.Suite
+}
+
+func collectFrom(l *skipList[int], pivot int) []int {
+	var items []int
+	l.Ascend(pivot, func(item int) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+func (s *skipListTestSuite) TestInsertAndRemove() {
+	l := newSkipList(cmp.Compare[int])
+
+	assert.True(s.T(), l.Insert(3))
+	assert.True(s.T(), l.Insert(1))
+	assert.True(s.T(), l.Insert(2))
+	assert.False(s.T(), l.Insert(2))
+	assert.Equal(s.T(), 3, l.Len())
+	assert.Equal(s.T(), []int{1, 2, 3}, collectFrom(l, 0))
+
+	assert.True(s.T(), l.Remove(2))
+	assert.False(s.T(), l.Remove(2))
+	assert.False(s.T(), l.Remove(42))
+	assert.Equal(s.T(), 2, l.Len())
+	assert.Equal(s.T(), []int{1, 3}, collectFrom(l, 0))
+}
+
+func (s *skipListTestSuite) TestAscend() {
+	l := newSkipList(cmp.Compare[int])
+	for _, item := range []int{10, 20, 30, 40} {
+		l.Insert(item)
+	}
+
+	assert.Equal(s.T(), []int{20, 30, 40}, collectFrom(l, 20))
+	assert.Equal(s.T(), []int{30, 40}, collectFrom(l, 21))
+	assert.Empty(s.T(), collectFrom(l, 41))
+
+	// stops when fn returns false
+	var visited []int
+	l.Ascend(0, func(item int) bool {
+		visited = append(visited, item)
+		return len(visited) < 2
+	})
+	assert.Equal(s.T(), []int{10, 20}, visited)
+}
+
+func (s *skipListTestSuite) TestMatchesSortedSlice() {
+	l := newSkipList(cmp.Compare[int])
+	expected := map[int]bool{}
+	for i := 0; i < 5000; i++ {
+		item := rand.IntN(1000)
+		if rand.IntN(3) == 0 {
+			assert.Equal(s.T(), expected[item], l.Remove(item))
+			delete(expected, item)
+		} else {
+			assert.Equal(s.T(), !expected[item], l.Insert(item))
+			expected[item] = true
+		}
+	}
+
+	var sorted []int
+	for item := range expected {
+		sorted = append(sorted, item)
+	}
+	slices.Sort(sorted)
+	assert.Equal(s.T(), sorted, collectFrom(l, -1))
+	assert.Equal(s.T(), len(sorted), l.Len())
+
+	// ranks are kept through every insertion and removal
+	for item := -1; item <= 1000; item++ {
+		rank, found := l.Rank(item)
+		index, present := slices.BinarySearch(sorted, item)
+		assert.Equal(s.T(), index, rank, item)
+		assert.Equal(s.T(), present, found, item)
+	}
+	for start := 0; start <= len(sorted); start += 7 {
+		items := []int{}
+		l.AscendFrom(start, func(item int) bool {
+			items = append(items, item)
+			return true
+		})
+		assert.Equal(s.T(), sorted[start:], items, start)
+	}
+}
+
+func (s *skipListTestSuite) TestRank() {
+	l := newSkipList(cmp.Compare[int])
+	for _, item := range []int{10, 20, 30, 40} {
+		l.Insert(item)
+	}
+
+	rank, found := l.Rank(30)
+	assert.Equal(s.T(), 2, rank)
+	assert.True(s.T(), found)
+	rank, found = l.Rank(25)
+	assert.Equal(s.T(), 2, rank)
+	assert.False(s.T(), found)
+	rank, found = l.Rank(50)
+	assert.Equal(s.T(), 4, rank)
+	assert.False(s.T(), found)
+
+	var items []int
+	l.AscendFrom(1, func(item int) bool {
+		items = append(items, item)
+		return len(items) < 2
+	})
+	assert.Equal(s.T(), []int{20, 30}, items)
+	l.AscendFrom(4, func(item int) bool {
+		s.Fail("ascended past the end", item)
+		return true
+	})
+}
+
+func TestSkipListTestSuite(t *testing.T) {
+	suite.Run(t, new(skipListTestSuite))
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Snapshotter is a Store whose entire contents can be backed up and restored.
+type Snapshotter interface {
+	Store
+	// Snapshot writes every live key, its value and expiry to w.
+	Snapshot(w io.Writer) error
+	// Restore replaces the store's contents with the snapshot read from r,
+	// atomically. An invalid snapshot is rejected with ErrInvalidSnapshot
+	// before anything is changed.
+	Restore(r io.Reader) error
+}
+
+// ErrInvalidSnapshot is returned when restoring from input that is not a
+// complete, intact snapshot.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// A snapshot is a sequence of frames, as in the write-ahead log, each holding
+// a JSON-encoded snapshotRecord: a header, one entry per key in key order,
+// and a footer. The footer carries the entry count and a CRC-32C over every
+// entry payload in turn, so a snapshot cut short or spliced together is
+// rejected even though each of its frames is intact.
+//
+// Values are stored as JSON, so every type the HTTP API accepts (strings,
+// float64 numbers, booleans, null, arrays and objects) restores exactly. A
+// collection is stored as its elements, with its type, so it restores as
+// the collection.
+const (
+	snapshotFormat  = "kv-snapshot"
+	snapshotVersion = 1
+)
+
+type snapshotRecordType string
+
+const (
+	snapshotHeader snapshotRecordType = "header"
+	snapshotEntry  snapshotRecordType = "entry"
+	snapshotFooter snapshotRecordType = "footer"
+)
+
+type snapshotRecord struct {
+	Type snapshotRecordType `json:"type"`
+
+	// header
+	Format    string    `json:"format,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+
+	// entry
+	Namespace  string    `json:"namespace,omitempty"` // empty for the default namespace
+	Key        string    `json:"key,omitempty"`
+	Value      any       `json:"value,omitempty"`
+	Collection string    `json:"collection,omitempty"` // the type of collection Value holds, if it is one
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`
+
+	// footer
+	Entries  int    `json:"entries,omitempty"`
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+// snapshottedEntry is a key captured by or restored from a snapshot.
+type snapshottedEntry struct {
+	Namespace string
+	Key       string
+	Value     any
+	ExpiresAt time.Time
+}
+
+// entrySnapshotter is implemented by the stores a namespacedStore can
+// snapshot and restore.
+type entrySnapshotter interface {
+	snapshotEntries(namespace string) []snapshottedEntry
+	restoreEntries(entries []snapshottedEntry)
+}
+
+// writeSnapshot writes entries to w in the snapshot format.
+func writeSnapshot(w io.Writer, entries []snapshottedEntry, createdAt time.Time) error {
+	buffered := bufio.NewWriter(w)
+	write := func(record snapshotRecord) ([]byte, error) {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		return payload, writeFrame(buffered, payload)
+	}
+
+	if _, err := write(snapshotRecord{Type: snapshotHeader, Format: snapshotFormat, Version: snapshotVersion, CreatedAt: createdAt}); err != nil {
+		return err
+	}
+	var checksum uint32
+	for _, e := range entries {
+		payload, err := write(snapshotRecord{Type: snapshotEntry, Namespace: e.Namespace, Key: e.Key, Value: e.Value, Collection: CollectionType(e.Value), ExpiresAt: e.ExpiresAt})
+		if err != nil {
+			return fmt.Errorf("snapshot: writing %q: %w", e.Key, err)
+		}
+		checksum = crc32.Update(checksum, crcTable, payload)
+	}
+	if _, err := write(snapshotRecord{Type: snapshotFooter, Entries: len(entries), Checksum: checksum}); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// readSnapshot reads and validates a whole snapshot from r.
+func readSnapshot(r io.Reader) ([]snapshottedEntry, error) {
+	reader := bufio.NewReader(r)
+	read := func() (snapshotRecord, []byte, error) {
+		var record snapshotRecord
+		payload, err := readFrame(reader)
+		if err == io.EOF || err == errTornFrame || err == errCorruptFrame {
+			return record, nil, fmt.Errorf("%w: truncated or corrupt", ErrInvalidSnapshot)
+		}
+		if err != nil {
+			return record, nil, err
+		}
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return record, nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		return record, payload, nil
+	}
+
+	header, _, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != snapshotHeader || header.Format != snapshotFormat {
+		return nil, fmt.Errorf("%w: not a snapshot", ErrInvalidSnapshot)
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, header.Version)
+	}
+
+	var entries []snapshottedEntry
+	var checksum uint32
+	for {
+		record, payload, err := read()
+		if err != nil {
+			return nil, err
+		}
+		switch record.Type {
+		case snapshotEntry:
+			if record.Collection != "" {
+				if record.Value, err = DecodeCollection(record.Collection, record.Value); err != nil {
+					return nil, fmt.Errorf("%w: %q: %v", ErrInvalidSnapshot, record.Key, err)
+				}
+			}
+			entries = append(entries, snapshottedEntry{Namespace: record.Namespace, Key: record.Key, Value: record.Value, ExpiresAt: record.ExpiresAt})
+			checksum = crc32.Update(checksum, crcTable, payload)
+		case snapshotFooter:
+			if record.Entries != len(entries) || record.Checksum != checksum {
+				return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				return nil, fmt.Errorf("%w: data after footer", ErrInvalidSnapshot)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q record", ErrInvalidSnapshot, record.Type)
+		}
+	}
+}
+
+// Snapshot writes a point-in-time copy of the store to w. The store is only
+// locked while its entries are copied, not while they are written.
+func (s *inMemoryStore) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, s.snapshotEntries(""), s.now())
+}
+
+// Restore replaces the store's contents with the snapshot in r. The restored
+// keys are written as one batch, with a new version, so versions and watch
+// revisions keep increasing across a restore.
+func (s *inMemoryStore) Restore(r io.Reader) error {
+	entries, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Namespace != "" {
+			return fmt.Errorf("%w: holds namespace %q, which only a namespaced store can restore", ErrInvalidSnapshot, e.Namespace)
+		}
+	}
+	s.restoreEntries(entries)
+	return nil
+}
+
+// snapshotEntries copies every live entry in key order, labelled with namespace.
+func (s *inMemoryStore) snapshotEntries(namespace string) []snapshottedEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.now()
+	entries := make([]snapshottedEntry, 0, len(s.store))
+	s.keys.Ascend("", func(key string) bool {
+		if e := s.store[key]; !e.expired(now) {
+			entries = append(entries, snapshottedEntry{Namespace: namespace, Key: key, Value: exportValue(e.value), ExpiresAt: e.expiresAt})
+		}
+		return true
+	})
+	return entries
+}
+
+// restoreEntries replaces the store's contents with entries in one commit.
+// Entries that have expired since the snapshot was taken are skipped.
+func (s *inMemoryStore) restoreEntries(entries []snapshottedEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	ops := []walRecord{{Op: walOpDeletePrefix}}
+	for _, e := range entries {
+		if !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt) {
+			continue
+		}
+		ops = append(ops, walRecord{Op: walOpSet, Key: e.Key, Value: e.Value, ExpiresAt: e.ExpiresAt})
+	}
+	s.commit(walRecord{Op: walOpBatch, Ops: ops})
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type snapshotTestSuite struct {
+	suite.Suite
+}
+
+func (s *snapshotTestSuite) snapshot(store Snapshotter) []byte {
+	var buf bytes.Buffer
+	s.Require().NoError(store.Snapshot(&buf))
+	return buf.Bytes()
+}
+
+func (s *snapshotTestSuite) TestImplementsSnapshotter() {
+	assert.Implements(s.T(), (*Snapshotter)(nil), NewInMemoryStore())
+	assert.Implements(s.T(), (*Snapshotter)(nil), NewNamespacedStore())
+}
+
+func (s *snapshotTestSuite) TestRoundTrip() {
+	source := NewInMemoryStore()
+	// values as the HTTP handler decodes them
+	var object any
+	s.Require().NoError(json.Unmarshal([]byte(`{"nested":[1.5,"a",null,true],"empty":{}}`), &object))
+	source.Set("string", "value")
+	source.Set("number", float64(42))
+	source.Set("big", float64(1<<53))
+	source.Set("bool", false)
+	source.Set("null", nil)
+	source.Set("object", object)
+	source.Set("", "empty key")
+	snapshot := s.snapshot(source)
+
+	target := NewInMemoryStore()
+	target.Set("stale", "replaced by the restore")
+	s.Require().NoError(target.Restore(bytes.NewReader(snapshot)))
+
+	entries, _ := target.Scan("", "", 0)
+	sourceEntries, _ := source.Scan("", "", 0)
+	s.Require().Len(entries, len(sourceEntries))
+	for i, e := range entries {
+		assert.Equal(s.T(), sourceEntries[i].Key, e.Key)
+		assert.Equal(s.T(), sourceEntries[i].Value, e.Value, e.Key)
+	}
+	assert.Nil(s.T(), target.Get("stale"))
+}
+
+func (s *snapshotTestSuite) TestRestoreAdvancesVersions() {
+	source := NewInMemoryStore()
+	source.Set("a", "one")
+	snapshot := s.snapshot(source)
+
+	target := NewInMemoryStore()
+	target.Set("a", "x")
+	target.Set("b", "y")
+	events, err := target.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+	s.Require().NoError(target.Restore(bytes.NewReader(snapshot)))
+
+	// the restore is a single write after everything the target had seen
+	value, version := target.GetWithVersion("a")
+	assert.Equal(s.T(), "one", value)
+	assert.Equal(s.T(), uint64(3), version)
+	assert.Equal(s.T(), []Event{
+		{Type: EventDelete, Key: "a", Revision: 3},
+		{Type: EventDelete, Key: "b", Revision: 3},
+		{Type: EventSet, Key: "a", Value: "one", Revision: 3},
+	}, []Event{<-events, <-events, <-events})
+}
+
+func (s *snapshotTestSuite) TestExpiry() {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	source := NewInMemoryStore()
+	defer source.Close()
+	source.now = clock.Now
+	source.SetWithTTL("short", 1, time.Second)
+	source.SetWithTTL("long", 2, time.Hour)
+	source.SetWithTTL("gone", 3, time.Millisecond)
+	clock.Advance(time.Millisecond)
+	snapshot := s.snapshot(source)
+
+	target := NewInMemoryStore()
+	defer target.Close()
+	target.now = clock.Now
+	clock.Advance(time.Second)
+	s.Require().NoError(target.Restore(bytes.NewReader(snapshot)))
+
+	// deadlines are absolute, so keys expire when they originally would have
+	entries, _ := target.Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), Entry{Key: "long", Value: float64(2), Version: 1, ExpiresAt: entries[0].ExpiresAt}, entries[0])
+	assert.True(s.T(), time.Unix(0, 0).Add(time.Hour).Equal(entries[0].ExpiresAt))
+	clock.Advance(time.Hour)
+	assert.Nil(s.T(), target.Get("long"))
+}
+
+func (s *snapshotTestSuite) TestRejectsInvalidSnapshots() {
+	source := NewInMemoryStore()
+	source.Set("a", 1)
+	source.Set("b", 2)
+	snapshot := s.snapshot(source)
+
+	var wrongVersion bytes.Buffer
+	payload, _ := json.Marshal(snapshotRecord{Type: snapshotHeader, Format: snapshotFormat, Version: snapshotVersion + 1})
+	s.Require().NoError(writeFrame(&wrongVersion, payload))
+
+	corrupt := bytes.Clone(snapshot)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	for name, input := range map[string][]byte{
+		"empty":          nil,
+		"not a snapshot": []byte("key,value\na,1\n"),
+		"truncated":      snapshot[:len(snapshot)-1],
+		"missing footer": snapshot[:bytes.LastIndex(snapshot, []byte(`{"type":"footer"`))-frameHeaderSize],
+		"corrupt":        corrupt,
+		"trailing data":  append(bytes.Clone(snapshot), 0),
+		"wrong version":  wrongVersion.Bytes(),
+	} {
+		target := NewInMemoryStore()
+		target.Set("kept", true)
+		err := target.Restore(bytes.NewReader(input))
+		assert.ErrorIs(s.T(), err, ErrInvalidSnapshot, name)
+		// nothing is changed by a rejected restore
+		assert.Equal(s.T(), true, target.Get("kept"), name)
+	}
+}
+
+func (s *snapshotTestSuite) TestRejectsMismatchedChecksum() {
+	var valid bytes.Buffer
+	s.Require().NoError(writeSnapshot(&valid, []snapshottedEntry{{Key: "a", Value: 1.0}, {Key: "b", Value: 2.0}}, time.Time{}))
+
+	// drop an entry frame and fix up nothing else: every frame is intact, but
+	// the footer no longer matches
+	var reassembled bytes.Buffer
+	reader := bytes.NewReader(valid.Bytes())
+	for i := 0; ; i++ {
+		payload, err := readFrame(reader)
+		if err != nil {
+			break
+		}
+		if i == 1 {
+			continue
+		}
+		s.Require().NoError(writeFrame(&reassembled, payload))
+	}
+
+	err := NewInMemoryStore().Restore(&reassembled)
+	assert.ErrorIs(s.T(), err, ErrInvalidSnapshot)
+	assert.ErrorContains(s.T(), err, "checksum")
+}
+
+func (s *snapshotTestSuite) TestRestoreSurvivesRestart() {
+	source := NewInMemoryStore()
+	source.Set("a", "one")
+	snapshot := s.snapshot(source)
+
+	dataDir := s.T().TempDir()
+	store, err := NewWALStore(dataDir, WALOptions{SyncPolicy: SyncAlways})
+	s.Require().NoError(err)
+	store.Set("b", "two")
+	s.Require().NoError(store.Restore(bytes.NewReader(snapshot)))
+	s.Require().NoError(store.Close())
+
+	store, err = NewWALStore(dataDir, WALOptions{SyncPolicy: SyncAlways})
+	s.Require().NoError(err)
+	defer store.Close()
+	assert.Equal(s.T(), "one", store.Get("a"))
+	assert.Nil(s.T(), store.Get("b"))
+}
+
+func (s *snapshotTestSuite) TestNamespaces() {
+	source := NewNamespacedStore()
+	source.Set("a", "default")
+	teamA, _ := source.Namespace("team-a")
+	teamA.Set("a", "team-a")
+	snapshot := s.snapshot(source)
+
+	target := NewNamespacedStore()
+	target.Set("stale", true)
+	teamB, _ := target.Namespace("team-b")
+	teamB.Set("stale", true)
+	s.Require().NoError(target.Restore(bytes.NewReader(snapshot)))
+
+	assert.Equal(s.T(), []string{"default", "team-a"}, target.Namespaces())
+	assert.Equal(s.T(), "default", target.Get("a"))
+	assert.Nil(s.T(), target.Get("stale"))
+	restored, _ := target.Namespace("team-a")
+	assert.Equal(s.T(), "team-a", restored.Get("a"))
+
+	// a store without namespaces can't hold them
+	err := NewInMemoryStore().Restore(bytes.NewReader(snapshot))
+	assert.ErrorIs(s.T(), err, ErrInvalidSnapshot)
+}
+
+func (s *snapshotTestSuite) TestDefaultNamespaceIsPortable() {
+	source := NewInMemoryStore()
+	source.Set("a", "one")
+	target := NewNamespacedStore()
+	s.Require().NoError(target.Restore(bytes.NewReader(s.snapshot(source))))
+	assert.Equal(s.T(), "one", target.Get("a"))
+
+	back := NewInMemoryStore()
+	s.Require().NoError(back.Restore(bytes.NewReader(s.snapshot(target))))
+	assert.Equal(s.T(), "one", back.Get("a"))
+}
+
+func TestSnapshotTestSuite(t *testing.T) {
+	suite.Run(t, new(snapshotTestSuite))
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// SortedSetStore is a Store whose values can be sorted sets: string members
+// each with a score, ordered by score and then by member, so they can be
+// read a rank or a score range at a time, as leaderboards and delay queues
+// need. Like collections, operations are type-checked, a key that isn't set
+// reads as an empty sorted set, one emptied is deleted, and a key's TTL is
+// kept.
+//
+// Sorted sets are held, like collections, as typed values changed in place:
+// a map of members' scores, indexed by a skip list ordered by score, in which
+// a change moves only the members it touches. Reads of the key itself return
+// a copy, as a SortedSetValue, and setting a key to one creates the sorted
+// set.
+type SortedSetStore interface {
+	Store
+	// SortedSetAdd adds members with their scores to key's sorted set,
+	// updating the scores of those already in it, and returns how many
+	// members were new. Scores must be finite.
+	SortedSetAdd(key string, members map[string]float64) (int, error)
+	SortedSetRemove(key string, members ...string) (int, error) // returns how many members were removed
+	// SortedSetMember returns member's score in key's sorted set and its
+	// rank, its index counting from the lowest score, or with reverse, from
+	// the highest, read together. ok is false if member isn't in the set.
+	SortedSetMember(key, member string, reverse bool) (score float64, rank int, ok bool, err error)
+	// SortedSetRange returns the members of key's sorted set from rank start
+	// to stop, inclusive, from the lowest score, or with reverse, from the
+	// highest. Negative ranks count back from the end, -1 being the last.
+	SortedSetRange(key string, start, stop int, reverse bool) ([]ScoredMember, error)
+	// SortedSetRangeByScore returns the members of key's sorted set whose
+	// scores are within scores, from the lowest, up to limit of them if
+	// limit is positive.
+	SortedSetRangeByScore(key string, scores ScoreRange, limit int) ([]ScoredMember, error)
+	// SortedSetPop removes and returns up to count of the members of key's
+	// sorted set with the lowest scores, or with highest, the highest, in
+	// the order they were removed.
+	SortedSetPop(key string, highest bool, count int) ([]ScoredMember, error)
+}
+
+// ScoredMember is a member of a sorted set and its score.
+type ScoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// ScoreRange is the range of scores from Min to Max, each inclusive unless
+// marked exclusive. Either may be infinite.
+type ScoreRange struct {
+	Min, Max                   float64
+	MinExclusive, MaxExclusive bool
+}
+
+func (r ScoreRange) aboveMin(score float64) bool {
+	return score > r.Min || (score == r.Min && !r.MinExclusive)
+}
+
+func (r ScoreRange) belowMax(score float64) bool {
+	return score < r.Max || (score == r.Max && !r.MaxExclusive)
+}
+
+// SortedSetValue is a copy of a sorted set, as reads return it: its members'
+// scores.
+type SortedSetValue map[string]float64
+
+// sortedSetType is the type CollectionType names sorted sets by.
+const sortedSetType = "zset"
+
+// ErrInvalidScore is returned for a sorted set score that isn't a finite
+// number, which JSON can't represent.
+var ErrInvalidScore = errors.New("invalid score")
+
+// skipNodeSize estimates the memory a sorted set's index holds for each
+// member: a skip list node, with the 4/3 levels nodes average.
+const skipNodeSize = 96
+
+// scoredSet is a sorted set's members, with their scores, ordered by score.
+type scoredSet struct {
+	scores map[string]float64
+	order  *skipList[ScoredMember]
+	bytes  int64 // the map slots, members and index nodes
+}
+
+func newScoredSet() *scoredSet {
+	return &scoredSet{scores: make(map[string]float64), order: newSkipList(compareScoredMembers)}
+}
+
+func compareScoredMembers(a, b ScoredMember) int {
+	return cmp.Or(cmp.Compare(a.Score, b.Score), strings.Compare(a.Member, b.Member))
+}
+
+func (z *scoredSet) len() int {
+	return len(z.scores)
+}
+
+func (z *scoredSet) size() int64 {
+	return mapHeaderSize + z.bytes
+}
+
+func (z *scoredSet) export() any {
+	return SortedSetValue(maps.Clone(z.scores))
+}
+
+// set adds member with score, or moves it to score if it is already in the
+// set.
+func (z *scoredSet) set(member string, score float64) {
+	if old, ok := z.scores[member]; ok {
+		if old == score {
+			return
+		}
+		z.order.Remove(ScoredMember{Member: member, Score: old})
+	} else {
+		z.bytes += mapSlotSize + int64(len(member)) + skipNodeSize
+	}
+	z.scores[member] = score
+	z.order.Insert(ScoredMember{Member: member, Score: score})
+}
+
+func (z *scoredSet) remove(member string) {
+	if score, ok := z.scores[member]; ok {
+		delete(z.scores, member)
+		z.order.Remove(ScoredMember{Member: member, Score: score})
+		z.bytes -= mapSlotSize + int64(len(member)) + skipNodeSize
+	}
+}
+
+// ascend returns up to n members from the one at rank start, in order.
+func (z *scoredSet) ascend(start, n int) []ScoredMember {
+	if n <= 0 {
+		return []ScoredMember{}
+	}
+	members := make([]ScoredMember, 0, n)
+	z.order.AscendFrom(start, func(member ScoredMember) bool {
+		members = append(members, member)
+		return len(members) < n
+	})
+	return members
+}
+
+// sortedSetOf returns the sorted set stored at key, or an error if key
+// holds another type of value. A missing key holds an empty sorted set.
+func sortedSetOf(key string, value any, found bool) (*scoredSet, error) {
+	if !found {
+		return newScoredSet(), nil
+	}
+	if z, ok := value.(*scoredSet); ok {
+		return z, nil
+	}
+	return nil, &WrongTypeError{Key: key, Want: "sorted set"}
+}
+
+// readSortedSet calls read with the sorted set at key, under the read lock.
+func (s *inMemoryStore) readSortedSet(key string, read func(z *scoredSet)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, found := s.lookupCollection(key)
+	z, err := sortedSetOf(key, e.value, found)
+	if err != nil {
+		return err
+	}
+	read(z)
+	return nil
+}
+
+func (s *inMemoryStore) SortedSetAdd(key string, members map[string]float64) (int, error) {
+	for member, score := range members {
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			return 0, fmt.Errorf("%w: %q has score %v, want a finite number", ErrInvalidScore, member, score)
+		}
+	}
+	var added int
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := sortedSetOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		updates := make(map[string]any, len(members))
+		for member, score := range members {
+			if old, ok := current.scores[member]; !ok {
+				added++
+			} else if old == score {
+				continue
+			}
+			updates[member] = score
+		}
+		if len(updates) == 0 {
+			return nil, nil
+		}
+		return &CollectionChange{Type: sortedSetType, Set: updates}, nil
+	})
+	return added, err
+}
+
+func (s *inMemoryStore) SortedSetRemove(key string, members ...string) (int, error) {
+	var removed []string
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := sortedSetOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range slices.Compact(slices.Sorted(slices.Values(members))) {
+			if _, ok := current.scores[member]; ok {
+				removed = append(removed, member)
+			}
+		}
+		if len(removed) == 0 {
+			return nil, nil
+		}
+		return &CollectionChange{Type: sortedSetType, Remove: removed}, nil
+	})
+	return len(removed), err
+}
+
+func (s *inMemoryStore) SortedSetMember(key, member string, reverse bool) (float64, int, bool, error) {
+	var score float64
+	var rank int
+	var ok bool
+	err := s.readSortedSet(key, func(z *scoredSet) {
+		if score, ok = z.scores[member]; !ok {
+			return
+		}
+		rank, _ = z.order.Rank(ScoredMember{Member: member, Score: score})
+		if reverse {
+			rank = z.len() - 1 - rank
+		}
+	})
+	return score, rank, ok, err
+}
+
+func (s *inMemoryStore) SortedSetRange(key string, start, stop int, reverse bool) ([]ScoredMember, error) {
+	var members []ScoredMember
+	err := s.readSortedSet(key, func(z *scoredSet) {
+		length := z.len()
+		if start < 0 {
+			start = max(length+start, 0)
+		}
+		if stop < 0 {
+			stop = length + stop
+		}
+		stop = min(stop, length-1)
+		if reverse {
+			// the same ranks counted from the other end
+			start, stop = length-1-stop, length-1-start
+		}
+		members = z.ascend(start, stop-start+1)
+		if reverse {
+			slices.Reverse(members)
+		}
+	})
+	return members, err
+}
+
+func (s *inMemoryStore) SortedSetRangeByScore(key string, scores ScoreRange, limit int) ([]ScoredMember, error) {
+	members := []ScoredMember{}
+	err := s.readSortedSet(key, func(z *scoredSet) {
+		// "" sorts before every other member with the lowest score
+		z.order.Ascend(ScoredMember{Score: scores.Min}, func(member ScoredMember) bool {
+			if !scores.aboveMin(member.Score) {
+				return true
+			}
+			if !scores.belowMax(member.Score) {
+				return false
+			}
+			members = append(members, member)
+			return limit <= 0 || len(members) < limit
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (s *inMemoryStore) SortedSetPop(key string, highest bool, count int) ([]ScoredMember, error) {
+	popped := []ScoredMember{}
+	err := s.updateCollection(key, func(value any, found bool) (*CollectionChange, error) {
+		current, err := sortedSetOf(key, value, found)
+		if err != nil {
+			return nil, err
+		}
+		n := min(max(count, 0), current.len())
+		if n == 0 {
+			return nil, nil
+		}
+		if highest {
+			popped = current.ascend(current.len()-n, n)
+			slices.Reverse(popped)
+		} else {
+			popped = current.ascend(0, n)
+		}
+		removed := make([]string, len(popped))
+		for i, member := range popped {
+			removed[i] = member.Member
+		}
+		return &CollectionChange{Type: sortedSetType, Remove: removed}, nil
+	})
+	return popped, err
+}
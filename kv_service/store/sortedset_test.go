@@ -0,0 +1,302 @@
+package store
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// sortedSetTestSuite checks sorted sets on every store that supports them.
+type sortedSetTestSuite struct {
+	suite.Suite
+	newStore func() sortedSetTestStore
+	store    sortedSetTestStore
+}
+
+type sortedSetTestStore interface {
+	SortedSetStore
+	CollectionStore
+	ExpiringVersionedStore
+	ScannableStore
+	BatchStore
+	Close() error
+}
+
+func (s *sortedSetTestSuite) SetupTest() {
+	s.store = s.newStore()
+}
+
+func (s *sortedSetTestSuite) TearDownTest() {
+	s.store.Close()
+}
+
+// leaderboard adds alice, bob, carol and dave to key, scoring 10 to 40.
+func (s *sortedSetTestSuite) leaderboard(key string) {
+	added, err := s.store.SortedSetAdd(key, map[string]float64{"carol": 30, "alice": 10, "dave": 40, "bob": 20})
+	s.Require().NoError(err)
+	s.Require().Equal(4, added)
+}
+
+func (s *sortedSetTestSuite) TestAdd() {
+	s.leaderboard("board")
+	assert.Equal(s.T(), SortedSetValue{"alice": 10, "bob": 20, "carol": 30, "dave": 40}, s.store.Get("board"))
+
+	// adding an existing member updates its score
+	added, err := s.store.SortedSetAdd("board", map[string]float64{"alice": 50, "erin": 5})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, added)
+	members, err := s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"erin", 5}, {"bob", 20}, {"carol", 30}, {"dave", 40}, {"alice", 50}}, members)
+
+	// as does adding a member with its own score, without a new version
+	_, version := s.store.GetWithVersion("board")
+	added, err = s.store.SortedSetAdd("board", map[string]float64{"alice": 50})
+	s.Require().NoError(err)
+	assert.Zero(s.T(), added)
+	_, unchanged := s.store.GetWithVersion("board")
+	assert.Equal(s.T(), version, unchanged)
+}
+
+func (s *sortedSetTestSuite) TestAdd_InvalidScore() {
+	for _, score := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := s.store.SortedSetAdd("board", map[string]float64{"alice": score})
+		assert.ErrorIs(s.T(), err, ErrInvalidScore, score)
+	}
+	_, found := s.store.Lookup("board")
+	assert.False(s.T(), found)
+}
+
+func (s *sortedSetTestSuite) TestTiesOrderedByMember() {
+	_, err := s.store.SortedSetAdd("board", map[string]float64{"b": 1, "c": 1, "a": 1, "z": 0})
+	s.Require().NoError(err)
+	members, err := s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"z", 0}, {"a", 1}, {"b", 1}, {"c", 1}}, members)
+}
+
+func (s *sortedSetTestSuite) TestMember() {
+	s.leaderboard("board")
+	score, rank, ok, err := s.store.SortedSetMember("board", "carol", false)
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 30.0, score)
+	assert.Equal(s.T(), 2, rank)
+	score, rank, ok, err = s.store.SortedSetMember("board", "carol", true)
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 30.0, score)
+	assert.Equal(s.T(), 1, rank)
+
+	_, _, ok, err = s.store.SortedSetMember("board", "mallory", false)
+	s.Require().NoError(err)
+	assert.False(s.T(), ok)
+	_, _, ok, err = s.store.SortedSetMember("missing", "alice", false)
+	s.Require().NoError(err)
+	assert.False(s.T(), ok)
+}
+
+func (s *sortedSetTestSuite) TestRange() {
+	s.leaderboard("board")
+	for _, test := range []struct {
+		start, stop int
+		reverse     bool
+		expected    []string
+	}{
+		{0, -1, false, []string{"alice", "bob", "carol", "dave"}},
+		{1, 2, false, []string{"bob", "carol"}},
+		{-2, -1, false, []string{"carol", "dave"}},
+		{2, 100, false, []string{"carol", "dave"}},
+		{0, 1, true, []string{"dave", "carol"}},
+		{-1, -1, true, []string{"alice"}},
+		{-100, 100, true, []string{"dave", "carol", "bob", "alice"}},
+		{3, 1, false, []string{}},
+		{3, 1, true, []string{}},
+		{10, 20, false, []string{}},
+		{10, 20, true, []string{}},
+	} {
+		members, err := s.store.SortedSetRange("board", test.start, test.stop, test.reverse)
+		s.Require().NoError(err)
+		assert.Equal(s.T(), test.expected, memberNames(members), "%d..%d reverse %t", test.start, test.stop, test.reverse)
+	}
+
+	members, err := s.store.SortedSetRange("missing", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{}, members)
+}
+
+func (s *sortedSetTestSuite) TestRangeByScore() {
+	s.leaderboard("board")
+	for _, test := range []struct {
+		scores   ScoreRange
+		limit    int
+		expected []string
+	}{
+		{ScoreRange{Min: math.Inf(-1), Max: math.Inf(1)}, 0, []string{"alice", "bob", "carol", "dave"}},
+		{ScoreRange{Min: 20, Max: 30}, 0, []string{"bob", "carol"}},
+		{ScoreRange{Min: 20, Max: 30, MinExclusive: true}, 0, []string{"carol"}},
+		{ScoreRange{Min: 20, Max: 30, MaxExclusive: true}, 0, []string{"bob"}},
+		{ScoreRange{Min: 15, Max: 100}, 2, []string{"bob", "carol"}},
+		{ScoreRange{Min: 30, Max: 20}, 0, []string{}},
+		{ScoreRange{Min: 41, Max: 50}, 0, []string{}},
+	} {
+		members, err := s.store.SortedSetRangeByScore("board", test.scores, test.limit)
+		s.Require().NoError(err)
+		assert.Equal(s.T(), test.expected, memberNames(members), "%+v limit %d", test.scores, test.limit)
+	}
+}
+
+func (s *sortedSetTestSuite) TestRemove() {
+	s.leaderboard("board")
+	removed, err := s.store.SortedSetRemove("board", "bob", "mallory")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, removed)
+	_, rank, _, _ := s.store.SortedSetMember("board", "carol", false)
+	assert.Equal(s.T(), 1, rank)
+
+	// removing the last members deletes the sorted set
+	removed, err = s.store.SortedSetRemove("board", "alice", "carol", "dave")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 3, removed)
+	_, found := s.store.Lookup("board")
+	assert.False(s.T(), found)
+}
+
+func (s *sortedSetTestSuite) TestPop() {
+	s.leaderboard("board")
+	popped, err := s.store.SortedSetPop("board", false, 1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"alice", 10}}, popped)
+	popped, err = s.store.SortedSetPop("board", true, 2)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"dave", 40}, {"carol", 30}}, popped)
+
+	popped, err = s.store.SortedSetPop("board", true, 5)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"bob", 20}}, popped)
+	_, found := s.store.Lookup("board")
+	assert.False(s.T(), found)
+	popped, err = s.store.SortedSetPop("board", false, 1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{}, popped)
+}
+
+func (s *sortedSetTestSuite) TestSetToSortedSet() {
+	// a copy of a sorted set, as reads return, sets the key to the sorted set
+	s.store.Set("board", SortedSetValue{"a": 2, "b": 1, "c": 3})
+	members, err := s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"b", 1}, {"a", 2}, {"c", 3}}, members)
+
+	// and rewriting it replaces its members
+	s.store.MSet(map[string]any{"board": SortedSetValue{"a": 0, "c": 3, "d": 2.5}})
+	members, err = s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"a", 0}, {"d", 2.5}, {"c", 3}}, members)
+
+	s.store.SortedSetAdd("board", map[string]float64{"c": 1, "e": -1})
+	s.store.SortedSetRemove("board", "a")
+	members, err = s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"e", -1}, {"c", 1}, {"d", 2.5}}, members)
+
+	// a JSON value shaped like a sorted set is still a plain value
+	s.store.Set("board", map[string]any{"$zset": map[string]any{"a": 1.0}})
+	_, err = s.store.SortedSetRange("board", 0, -1, false)
+	assert.Equal(s.T(), &WrongTypeError{Key: "board", Want: "sorted set"}, err)
+	s.store.Delete("board")
+	members, err = s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Empty(s.T(), members)
+}
+
+func (s *sortedSetTestSuite) TestWrongType() {
+	s.store.Set("string", "value")
+	s.store.HashSet("hash", map[string]any{"a": 1.0})
+	for _, key := range []string{"string", "hash"} {
+		_, err := s.store.SortedSetAdd(key, map[string]float64{"a": 1})
+		assert.Equal(s.T(), &WrongTypeError{Key: key, Want: "sorted set"}, err, key)
+		_, _, _, err = s.store.SortedSetMember(key, "a", false)
+		assert.ErrorIs(s.T(), err, ErrWrongType, key)
+		_, err = s.store.SortedSetPop(key, false, 1)
+		assert.ErrorIs(s.T(), err, ErrWrongType, key)
+	}
+
+	s.leaderboard("board")
+	_, err := s.store.HashSet("board", map[string]any{"a": 1.0})
+	assert.ErrorIs(s.T(), err, ErrWrongType)
+}
+
+func (s *sortedSetTestSuite) TestKeepsTTL() {
+	s.store.SetWithTTL("board", SortedSetValue{"a": 1}, time.Minute)
+	_, err := s.store.SortedSetAdd("board", map[string]float64{"b": 2})
+	s.Require().NoError(err)
+
+	entries, _ := s.store.Scan("board", "", 0)
+	s.Require().Len(entries, 1)
+	assert.Equal(s.T(), SortedSetValue{"a": 1, "b": 2}, entries[0].Value)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *sortedSetTestSuite) TestLeavesReadValuesAlone() {
+	s.leaderboard("board")
+	read := s.store.Get("board")
+	s.store.SortedSetAdd("board", map[string]float64{"alice": 100})
+	s.store.SortedSetPop("board", false, 1)
+	assert.Equal(s.T(), SortedSetValue{"alice": 10, "bob": 20, "carol": 30, "dave": 40}, read)
+}
+
+func (s *sortedSetTestSuite) TestMatchesSortedSlice() {
+	expected := map[string]float64{}
+	for i := 0; i < 2000; i++ {
+		member := fmt.Sprint("m", rand.IntN(200))
+		if rand.IntN(4) == 0 {
+			s.store.SortedSetRemove("board", member)
+			delete(expected, member)
+		} else {
+			score := float64(rand.IntN(50))
+			s.store.SortedSetAdd("board", map[string]float64{member: score})
+			expected[member] = score
+		}
+	}
+
+	var sorted []ScoredMember
+	for member, score := range expected {
+		sorted = append(sorted, ScoredMember{member, score})
+	}
+	slices.SortFunc(sorted, func(a, b ScoredMember) int {
+		return cmp.Or(cmp.Compare(a.Score, b.Score), cmp.Compare(a.Member, b.Member))
+	})
+	members, err := s.store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), sorted, members)
+	for i, member := range sorted {
+		_, rank, ok, err := s.store.SortedSetMember("board", member.Member, false)
+		s.Require().NoError(err)
+		assert.True(s.T(), ok)
+		assert.Equal(s.T(), i, rank, member.Member)
+	}
+}
+
+func memberNames(members []ScoredMember) []string {
+	names := make([]string, len(members))
+	for i, member := range members {
+		names[i] = member.Member
+	}
+	return names
+}
+
+func TestSortedSetTestSuite(t *testing.T) {
+	suite.Run(t, &sortedSetTestSuite{newStore: func() sortedSetTestStore { return NewInMemoryStore() }})
+}
+
+func TestShardedSortedSetTestSuite(t *testing.T) {
+	suite.Run(t, &sortedSetTestSuite{newStore: func() sortedSetTestStore { return NewShardedStore(8) }})
+}
@@ -0,0 +1,388 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// An SSTable is an immutable file of records sorted by key:
+//
+//	data blocks   records of [key length][key][kind][value length][JSON value]
+//	              (lengths as uvarints; tombstones have no value)
+//	index block   the first key, offset and length of every data block
+//	bloom block   a bloomFilter of every key
+//	footer        offsets and lengths of the index and bloom blocks, the
+//	              record count and sstMagic, as fixed-width little-endian
+//
+// Every block is followed by its CRC-32C. Only the index and bloom filter
+// are held in memory; data blocks are read from disk as needed.
+const (
+	sstBlockSize  = 4 << 10 // target size of a data block
+	sstFooterSize = 6 * 8
+	sstMagic      = 0x6b762d7373746162 // "kv-sstab"
+	sstValue      = byte(0)
+	sstTombstone  = byte(1)
+)
+
+var errCorruptTable = errors.New("corrupt table")
+
+// lsmRecord is a key's latest write in some source: a memtable, whose
+// values are held decoded, or a table, whose values are held as JSON.
+type lsmRecord struct {
+	key     string
+	deleted bool
+	value   any    // for memtable records
+	raw     []byte // for table records; nil for tombstones
+}
+
+func (r lsmRecord) decode() (any, error) {
+	if r.raw == nil {
+		return r.value, nil
+	}
+	var value any
+	err := json.Unmarshal(r.raw, &value)
+	return value, err
+}
+
+func (r lsmRecord) encode() ([]byte, error) {
+	if r.raw != nil || r.deleted {
+		return r.raw, nil
+	}
+	return json.Marshal(r.value)
+}
+
+type sstIndexEntry struct {
+	firstKey string
+	offset   uint64
+	length   uint64 // excluding the checksum
+}
+
+// sstWriter writes an SSTable from records added in key order.
+type sstWriter struct {
+	file    *os.File
+	w       *bufio.Writer
+	offset  uint64
+	block   []byte
+	first   string // first key of block
+	index   []sstIndexEntry
+	bloom   *bloomFilter
+	records uint64
+	lastKey string
+}
+
+// newSSTWriter creates the table at path. expectedKeys sizes its bloom
+// filter; an overestimate only wastes space.
+func newSSTWriter(path string, expectedKeys int) (*sstWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{file: file, w: bufio.NewWriter(file), bloom: newBloomFilter(expectedKeys)}, nil
+}
+
+func (w *sstWriter) add(record lsmRecord) error {
+	if w.records > 0 && record.key <= w.lastKey {
+		return fmt.Errorf("sstable: key %q added out of order", record.key)
+	}
+	raw, err := record.encode()
+	if err != nil {
+		return fmt.Errorf("sstable: encoding %q: %w", record.key, err)
+	}
+	if len(w.block) == 0 {
+		w.first = record.key
+	}
+	w.block = binary.AppendUvarint(w.block, uint64(len(record.key)))
+	w.block = append(w.block, record.key...)
+	if record.deleted {
+		w.block = append(w.block, sstTombstone)
+	} else {
+		w.block = append(w.block, sstValue)
+		w.block = binary.AppendUvarint(w.block, uint64(len(raw)))
+		w.block = append(w.block, raw...)
+	}
+	w.bloom.add(record.key)
+	w.records++
+	w.lastKey = record.key
+	if len(w.block) >= sstBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.index = append(w.index, sstIndexEntry{firstKey: w.first, offset: w.offset, length: uint64(len(w.block))})
+	if err := w.writeBlock(w.block); err != nil {
+		return err
+	}
+	w.block = w.block[:0]
+	return nil
+}
+
+// writeBlock writes data and its checksum.
+func (w *sstWriter) writeBlock(data []byte) error {
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	if err := binary.Write(w.w, binary.LittleEndian, crc32.Checksum(data, crcTable)); err != nil {
+		return err
+	}
+	w.offset += uint64(len(data)) + 4
+	return nil
+}
+
+// finish writes the index, bloom filter and footer, and syncs the file.
+func (w *sstWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+	var index []byte
+	for _, entry := range w.index {
+		index = binary.AppendUvarint(index, uint64(len(entry.firstKey)))
+		index = append(index, entry.firstKey...)
+		index = binary.AppendUvarint(index, entry.offset)
+		index = binary.AppendUvarint(index, entry.length)
+	}
+	indexOffset := w.offset
+	if err := w.writeBlock(index); err != nil {
+		return err
+	}
+	bloom := w.bloom.encode()
+	bloomOffset := w.offset
+	if err := w.writeBlock(bloom); err != nil {
+		return err
+	}
+	footer := make([]byte, 0, sstFooterSize)
+	for _, field := range []uint64{indexOffset, uint64(len(index)), bloomOffset, uint64(len(bloom)), w.records, sstMagic} {
+		footer = binary.LittleEndian.AppendUint64(footer, field)
+	}
+	if _, err := w.w.Write(footer); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// abort abandons the table, removing its file.
+func (w *sstWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// sstable is an open SSTable. It is reference counted, so a table replaced
+// by compaction stays readable until lookups and scans using it finish.
+type sstable struct {
+	name     string
+	file     *os.File
+	index    []sstIndexEntry
+	bloom    *bloomFilter
+	records  uint64
+	size     int64
+	refs     atomic.Int32
+	obsolete atomic.Bool // remove the file once the last reference is released
+}
+
+func openSSTable(path, name string) (*sstable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readSSTable(file, name)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("sstable %s: %w", name, err)
+	}
+	t.refs.Store(1)
+	return t, nil
+}
+
+func readSSTable(file *os.File, name string) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstFooterSize {
+		return nil, errCorruptTable
+	}
+	footer := make([]byte, sstFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-sstFooterSize); err != nil {
+		return nil, err
+	}
+	field := func(i int) uint64 { return binary.LittleEndian.Uint64(footer[i*8:]) }
+	if field(5) != sstMagic {
+		return nil, errCorruptTable
+	}
+	t := &sstable{name: name, file: file, records: field(4), size: info.Size()}
+
+	index, err := t.readBlock(field(0), field(1))
+	if err != nil {
+		return nil, err
+	}
+	for len(index) > 0 {
+		var entry sstIndexEntry
+		var n int
+		if entry.firstKey, index, n = readLengthPrefixed(index); n <= 0 {
+			return nil, errCorruptTable
+		}
+		if entry.offset, n = binary.Uvarint(index); n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		if entry.length, n = binary.Uvarint(index); n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		t.index = append(t.index, entry)
+	}
+
+	bloom, err := t.readBlock(field(2), field(3))
+	if err != nil {
+		return nil, err
+	}
+	if t.bloom, err = decodeBloomFilter(bloom); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readBlock reads the block at offset and verifies its checksum.
+func (t *sstable) readBlock(offset, length uint64) ([]byte, error) {
+	if offset+length+4 > uint64(t.size) {
+		return nil, errCorruptTable
+	}
+	data := make([]byte, length+4)
+	if _, err := t.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data[:length], crcTable) != binary.LittleEndian.Uint32(data[length:]) {
+		return nil, errCorruptTable
+	}
+	return data[:length], nil
+}
+
+// findBlock returns the index of the block that would hold key.
+func (t *sstable) findBlock(key string) int {
+	// the last block whose first key is not after key
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].firstKey > key })
+	return max(i-1, 0)
+}
+
+// get returns the table's record for key, if it has one.
+func (t *sstable) get(key string) (lsmRecord, bool, error) {
+	if len(t.index) == 0 || !t.bloom.mayContain(key) {
+		return lsmRecord{}, false, nil
+	}
+	it := t.seek(key)
+	if it.valid() && it.record().key == key {
+		return it.record(), true, nil
+	}
+	return lsmRecord{}, false, it.err()
+}
+
+func (t *sstable) acquire() {
+	t.refs.Add(1)
+}
+
+// release drops a reference, closing the table with the last one.
+func (t *sstable) release() error {
+	if t.refs.Add(-1) > 0 {
+		return nil
+	}
+	err := t.file.Close()
+	if t.obsolete.Load() {
+		err = errors.Join(err, os.Remove(t.file.Name()))
+	}
+	return err
+}
+
+// sstIterator walks a table's records in key order.
+type sstIterator struct {
+	t     *sstable
+	block int
+	data  []byte // undecoded remainder of the current block
+	cur   lsmRecord
+	ok    bool
+	fault error
+}
+
+// seek returns an iterator positioned at the first record not before pivot.
+func (t *sstable) seek(pivot string) *sstIterator {
+	it := &sstIterator{t: t, block: t.findBlock(pivot) - 1}
+	it.next()
+	for it.ok && it.cur.key < pivot {
+		it.next()
+	}
+	return it
+}
+
+func (it *sstIterator) valid() bool       { return it.ok }
+func (it *sstIterator) record() lsmRecord { return it.cur }
+func (it *sstIterator) err() error        { return it.fault }
+
+func (it *sstIterator) next() {
+	for len(it.data) == 0 {
+		it.block++
+		if it.block >= len(it.t.index) {
+			it.ok = false
+			return
+		}
+		entry := it.t.index[it.block]
+		if it.data, it.fault = it.t.readBlock(entry.offset, entry.length); it.fault != nil {
+			it.ok = false
+			return
+		}
+	}
+	var record lsmRecord
+	var n int
+	if record.key, it.data, n = readLengthPrefixed(it.data); n <= 0 || len(it.data) == 0 {
+		it.fail()
+		return
+	}
+	kind := it.data[0]
+	it.data = it.data[1:]
+	switch kind {
+	case sstTombstone:
+		record.deleted = true
+	case sstValue:
+		var raw string
+		if raw, it.data, n = readLengthPrefixed(it.data); n <= 0 {
+			it.fail()
+			return
+		}
+		record.raw = []byte(raw)
+	default:
+		it.fail()
+		return
+	}
+	it.cur, it.ok = record, true
+}
+
+func (it *sstIterator) fail() {
+	it.fault = fmt.Errorf("sstable %s: %w", it.t.name, errCorruptTable)
+	it.ok = false
+}
+
+// readLengthPrefixed splits a uvarint length-prefixed string off data. n is
+// not positive if data is malformed.
+func readLengthPrefixed(data []byte) (string, []byte, int) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", data, -1
+	}
+	end := n + int(length)
+	return string(data[n:end]), data[end:], n
+}
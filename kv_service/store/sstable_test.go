@@ -0,0 +1,124 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type sstableTestSuite struct {
+	suite.Suite
+	path string
+}
+
+func (s *sstableTestSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), "000001.sst")
+}
+
+// write creates a table of n keys, every third a tombstone, spanning many blocks.
+func (s *sstableTestSuite) write(n int) *sstable {
+	w, err := newSSTWriter(s.path, n)
+	s.Require().NoError(err)
+	for i := 0; i < n; i++ {
+		record := lsmRecord{key: fmt.Sprintf("key%05d", i), value: map[string]any{"i": float64(i)}}
+		if i%3 == 0 {
+			record = lsmRecord{key: record.key, deleted: true}
+		}
+		s.Require().NoError(w.add(record))
+	}
+	s.Require().NoError(w.finish())
+	table, err := openSSTable(s.path, "000001.sst")
+	s.Require().NoError(err)
+	return table
+}
+
+func (s *sstableTestSuite) TestGet() {
+	table := s.write(2000)
+	defer table.release()
+	assert.Greater(s.T(), len(table.index), 1)
+	assert.Equal(s.T(), uint64(2000), table.records)
+
+	record, ok, err := table.get("key01000")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	value, err := record.decode()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"i": float64(1000)}, value)
+
+	record, ok, err = table.get("key00999")
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+	assert.True(s.T(), record.deleted)
+
+	for _, key := range []string{"a", "key02000", "key00500x", "z"} {
+		_, ok, err = table.get(key)
+		s.Require().NoError(err)
+		assert.False(s.T(), ok, key)
+	}
+}
+
+func (s *sstableTestSuite) TestSeek() {
+	table := s.write(2000)
+	defer table.release()
+
+	it := table.seek("key01500x")
+	var keys []string
+	for ; it.valid(); it.next() {
+		keys = append(keys, it.record().key)
+	}
+	s.Require().NoError(it.err())
+	assert.Len(s.T(), keys, 499)
+	assert.Equal(s.T(), "key01501", keys[0])
+	assert.Equal(s.T(), "key01999", keys[len(keys)-1])
+
+	assert.False(s.T(), table.seek("z").valid())
+	assert.Equal(s.T(), "key00000", table.seek("").record().key)
+}
+
+func (s *sstableTestSuite) TestRejectsOutOfOrderKeys() {
+	w, err := newSSTWriter(s.path, 2)
+	s.Require().NoError(err)
+	defer w.abort()
+	s.Require().NoError(w.add(lsmRecord{key: "b", value: "1"}))
+	assert.Error(s.T(), w.add(lsmRecord{key: "a", value: "2"}))
+	assert.Error(s.T(), w.add(lsmRecord{key: "b", value: "2"}))
+}
+
+func (s *sstableTestSuite) TestDetectsCorruption() {
+	s.write(2000).release()
+	data, err := os.ReadFile(s.path)
+	s.Require().NoError(err)
+
+	// a flipped bit in a data block fails its checksum when read
+	corrupt := append([]byte(nil), data...)
+	corrupt[10] ^= 1
+	s.Require().NoError(os.WriteFile(s.path, corrupt, 0o644))
+	table, err := openSSTable(s.path, "000001.sst")
+	s.Require().NoError(err)
+	_, _, err = table.get("key00001")
+	assert.ErrorIs(s.T(), err, errCorruptTable)
+	table.release()
+
+	// a truncated table has no footer
+	s.Require().NoError(os.WriteFile(s.path, data[:len(data)-1], 0o644))
+	_, err = openSSTable(s.path, "000001.sst")
+	assert.ErrorIs(s.T(), err, errCorruptTable)
+}
+
+func (s *sstableTestSuite) TestObsoleteTableRemovedOnLastRelease() {
+	table := s.write(10)
+	table.acquire()
+	table.obsolete.Store(true)
+	s.Require().NoError(table.release())
+	assert.FileExists(s.T(), s.path)
+	s.Require().NoError(table.release())
+	assert.NoFileExists(s.T(), s.path)
+}
+
+func TestSSTableTestSuite(t *testing.T) {
+	suite.Run(t, new(sstableTestSuite))
+}
@@ -1,45 +1,602 @@
 package store
 
 import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Store is a key-value store.
 type Store interface {
 	Set(key string, value any)
-	Get(key string) any // returns nil if key not found
-	Delete(key string)  // no-op if key does not exist
+	Get(key string) any                     // returns nil if key not found
+	Lookup(key string) (value any, ok bool) // ok is false if key not found, unlike a key set to nil
+	Delete(key string)                      // no-op if key does not exist
+}
+
+// ExpiringStore is a Store whose keys can be given a time to live.
+type ExpiringStore interface {
+	Store
+	// SetWithTTL sets key to value and expires it after ttl. A later Set
+	// without a TTL makes the key persistent again.
+	SetWithTTL(key string, value any, ttl time.Duration)
+}
+
+// VersionedStore is a Store that tracks a version for every key, for
+// optimistic concurrency control. Versions are taken from a store-wide
+// revision counter, so a key that is deleted and recreated never reuses one.
+// An expected version of 0 means the key must not exist.
+type VersionedStore interface {
+	Store
+	GetWithVersion(key string) (value any, version uint64) // version is 0 if key not found
+	// CompareAndSwap sets key to value if its current version is
+	// expectedVersion, returning the new version.
+	CompareAndSwap(key string, expectedVersion uint64, value any) (uint64, error)
+	// CompareAndDelete deletes key if its current version is expectedVersion.
+	CompareAndDelete(key string, expectedVersion uint64) error
+}
+
+// ExpiringVersionedStore is a VersionedStore whose conditional writes can
+// also give the key a time to live.
+type ExpiringVersionedStore interface {
+	VersionedStore
+	ExpiringStore
+	// CompareAndSwapWithTTL is CompareAndSwap, expiring key after ttl.
+	CompareAndSwapWithTTL(key string, expectedVersion uint64, value any, ttl time.Duration) (uint64, error)
+}
+
+// ScannableStore is a Store whose keys can be listed in lexicographic order.
+type ScannableStore interface {
+	Store
+	// Scan returns up to limit entries whose keys start with prefix and sort
+	// after startAfter, and whether more remain. A limit of 0 means no limit.
+	Scan(prefix, startAfter string, limit int) (entries []Entry, more bool)
+}
+
+// ClearableStore is a Store that can delete many keys in one atomic operation.
+type ClearableStore interface {
+	Store
+	Flush() int                     // deletes every key, returning how many were deleted
+	DeletePrefix(prefix string) int // deletes every key starting with prefix, returning how many were deleted
+}
+
+// BatchStore is a Store that reads or writes many keys at once, each batch
+// under a single lock acquisition so it is applied atomically.
+type BatchStore interface {
+	Store
+	MGet(keys []string) []any // values in the order of keys; nil for keys not found
+	// MLookup is MGet reporting, for each key, whether it was found, so a
+	// key set to null can be told apart from a missing one.
+	MLookup(keys []string) (values []any, found []bool)
+	MSet(values map[string]any)
+	MDelete(keys []string) // keys that do not exist are skipped
+}
+
+// Entry is a key and its value, as returned by a scan.
+type Entry struct {
+	Key       string
+	Value     any
+	Version   uint64
+	ExpiresAt time.Time // zero for keys that never expire
+}
+
+// ErrVersionMismatch is returned by conditional writes whose expected
+// version does not match the key's current version.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrKeyNotFound is returned by operations on a key's value when the key
+// isn't set.
+var ErrKeyNotFound = errors.New("key not found")
+
+// defaultSweepInterval is how often expired keys are actively reaped.
+const defaultSweepInterval = time.Second
+
+// entry is a stored value and its metadata.
+type entry struct {
+	value     any
+	version   uint64    // revision of the write that produced this value
+	expiresAt time.Time // zero for keys that never expire
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
 }
 
 // inMemoryStore is a thread-safe, in-memory implementation
 // of a Store.
+//
+// Every mutation is described by a walRecord and passed through commit, so
+// a persist hook sees exactly the changes that are applied, in order.
 type inMemoryStore struct {
-	store map[string]any
-	mu    sync.RWMutex
+	store    map[string]entry
+	keys     *skipList[string] // the keys of store, ordered for scans
+	mu       sync.RWMutex
+	revision uint64 // revision of the latest committed write
+
+	// persist, if set, is called under the write lock with every mutation
+	// before it is applied; see walStore.
+	persist func(walRecord) error
+	// revisions, if set, is a counter shared with other stores, so that
+	// revisions are unique across them; see shardedStore.
+	revisions *atomic.Uint64
+	hub       *watchHub
+	bound     *bound // nil unless the store has a budget; see NewBoundedStore
+	// following is set while the store is a replica's copy of a primary,
+	// which only takes changes the primary has already made; see replicaStore.
+	following bool
+
+	now           func() time.Time
+	expiries      expiryHeap
+	sweepInterval time.Duration
+	sweeping      bool
+	done          chan struct{}
+	wg            sync.WaitGroup
 }
 
 func NewInMemoryStore() *inMemoryStore {
-	return &inMemoryStore{store: make(map[string]any), mu: sync.RWMutex{}}
+	return &inMemoryStore{
+		store:         make(map[string]entry),
+		keys:          newSkipList(strings.Compare),
+		hub:           newWatchHub(),
+		mu:            sync.RWMutex{},
+		now:           time.Now,
+		sweepInterval: defaultSweepInterval,
+		done:          make(chan struct{}),
+	}
 }
 
 func (s *inMemoryStore) Set(key string, value any) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.store[key] = value
+	s.commit(walRecord{Op: walOpSet, Key: key, Value: value})
+}
+
+func (s *inMemoryStore) SetWithTTL(key string, value any, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commit(walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: s.now().Add(ttl)})
 }
 
 func (s *inMemoryStore) Get(key string) any {
+	value, _ := s.GetWithVersion(key)
+	return value
+}
+
+func (s *inMemoryStore) Lookup(key string) (any, bool) {
+	// every key that exists has a version
+	value, version := s.GetWithVersion(key)
+	return value, version != 0
+}
+
+func (s *inMemoryStore) GetWithVersion(key string) (any, uint64) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	value, ok := s.store[key]
+	e, ok := s.lookup(key)
 	if !ok {
-		return nil
+		return nil, 0
 	}
-	return value
+	s.touch(key)
+	return exportValue(e.value), e.version
 }
 
 func (s *inMemoryStore) Delete(key string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, ok := s.store[key]; !ok {
+		return
+	}
+	s.commit(walRecord{Op: walOpDelete, Key: key})
+}
+
+func (s *inMemoryStore) MGet(keys []string) []any {
+	values, _ := s.MLookup(keys)
+	return values
+}
+
+func (s *inMemoryStore) MLookup(keys []string) ([]any, []bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values, found := make([]any, len(keys)), make([]bool, len(keys))
+	for i, key := range keys {
+		if e, ok := s.lookup(key); ok {
+			values[i], found[i] = exportValue(e.value), true
+			s.touch(key)
+		}
+	}
+	return values, found
+}
+
+func (s *inMemoryStore) MSet(values map[string]any) {
+	if len(values) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // so the log is deterministic
+	ops := make([]walRecord, len(keys))
+	for i, key := range keys {
+		ops[i] = walRecord{Op: walOpSet, Key: key, Value: values[key]}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commit(walRecord{Op: walOpBatch, Ops: ops})
+}
+
+func (s *inMemoryStore) MDelete(keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ops []walRecord
+	for _, key := range keys {
+		if _, ok := s.store[key]; ok {
+			ops = append(ops, walRecord{Op: walOpDelete, Key: key})
+		}
+	}
+	if len(ops) > 0 {
+		s.commit(walRecord{Op: walOpBatch, Ops: ops})
+	}
+}
+
+func (s *inMemoryStore) Scan(prefix, startAfter string, limit int) ([]Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.scan(prefix, startAfter, limit)
+}
+
+// scan is Scan for callers that hold mu, for reading at least.
+func (s *inMemoryStore) scan(prefix, startAfter string, limit int) ([]Entry, bool) {
+	pivot := prefix
+	if startAfter >= pivot {
+		// the smallest string sorting after startAfter
+		pivot = startAfter + "\x00"
+	}
+	now := s.now()
+	var entries []Entry
+	more := false
+	s.keys.Ascend(pivot, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		e := s.store[key]
+		if e.expired(now) {
+			return true
+		}
+		if limit > 0 && len(entries) == limit {
+			more = true
+			return false
+		}
+		entries = append(entries, Entry{Key: key, Value: exportValue(e.value), Version: e.version, ExpiresAt: e.expiresAt})
+		return true
+	})
+	return entries, more
+}
+
+func (s *inMemoryStore) Flush() int {
+	return s.DeletePrefix("")
+}
+
+func (s *inMemoryStore) DeletePrefix(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live, present := s.countPrefix(prefix)
+	if present > 0 {
+		s.commit(walRecord{Op: walOpDeletePrefix, Key: prefix})
+	}
+	return live
+}
+
+// countPrefix counts the keys starting with prefix that are live, and that
+// are present at all, expired or not. Callers must hold mu.
+func (s *inMemoryStore) countPrefix(prefix string) (live, present int) {
+	now := s.now()
+	s.keys.Ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		present++
+		if !s.store[key].expired(now) {
+			live++
+		}
+		return true
+	})
+	return live, present
+}
+
+func (s *inMemoryStore) CompareAndSwap(key string, expectedVersion uint64, value any) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkVersion(key, expectedVersion); err != nil {
+		return 0, err
+	}
+	return s.commit(walRecord{Op: walOpSet, Key: key, Value: value}), nil
+}
+
+func (s *inMemoryStore) CompareAndSwapWithTTL(key string, expectedVersion uint64, value any, ttl time.Duration) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkVersion(key, expectedVersion); err != nil {
+		return 0, err
+	}
+	return s.commit(walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: s.now().Add(ttl)}), nil
+}
+
+func (s *inMemoryStore) CompareAndDelete(key string, expectedVersion uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkVersion(key, expectedVersion); err != nil {
+		return err
+	}
+	if expectedVersion != 0 {
+		s.commit(walRecord{Op: walOpDelete, Key: key})
+	}
+	return nil
+}
+
+// Close stops the background expiry sweeper. Expired keys are still hidden
+// from reads afterwards, but are no longer reclaimed.
+func (s *inMemoryStore) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// lookup returns the live entry for key. Callers must hold mu.
+func (s *inMemoryStore) lookup(key string) (entry, bool) {
+	e, ok := s.store[key]
+	if !ok || e.expired(s.now()) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// checkVersion reports ErrVersionMismatch unless key is at expectedVersion.
+// Callers must hold mu.
+func (s *inMemoryStore) checkVersion(key string, expectedVersion uint64) error {
+	e, _ := s.lookup(key)
+	if e.version != expectedVersion {
+		return fmt.Errorf("%w: %q is at version %d, expected %d", ErrVersionMismatch, key, e.version, expectedVersion)
+	}
+	return nil
+}
+
+// commit assigns record the next revision, persists it and applies it,
+// returning the revision. Callers must hold mu.
+//
+// Store has no error returns, so commit panics if the record cannot be
+// persisted rather than apply a write that would not survive a restart.
+// The HTTP layer's recovery middleware turns that panic into a 500.
+func (s *inMemoryStore) commit(record walRecord) uint64 {
+	revision, err := s.tryCommit(record)
+	if err != nil {
+		panic(err)
+	}
+	return revision
+}
+
+// tryCommit is commit, returning persistence failures instead of panicking.
+// A record that already has a revision, assigned by a caller committing to
+// several stores together, keeps it.
+func (s *inMemoryStore) tryCommit(record walRecord) (uint64, error) {
+	if s.following && record.Revision == 0 {
+		return 0, fmt.Errorf("store: %s %q rejected: %w", record.Op, record.Key, ErrReplica)
+	}
+	if record.Revision == 0 {
+		record.Revision = s.nextRevision()
+	}
+	if s.persist != nil {
+		if err := s.persist(record); err != nil {
+			return 0, fmt.Errorf("store: %s %q not persisted: %w", record.Op, record.Key, err)
+		}
+	}
+	s.apply(record)
+	if s.bound != nil && record.Op != walOpEvict {
+		if err := s.evictOverBudget(); err != nil {
+			return 0, err
+		}
+	}
+	return record.Revision, nil
+}
+
+func (s *inMemoryStore) nextRevision() uint64 {
+	if s.revisions != nil {
+		return s.revisions.Add(1)
+	}
+	return s.revision + 1
+}
+
+// apply makes the change described by record, which is either being committed
+// or replayed from a log, and publishes it to watchers. Callers must hold mu,
+// except during replay when the store is not yet shared.
+func (s *inMemoryStore) apply(record walRecord) {
+	switch record.Op {
+	case walOpSet:
+		old, existed := s.store[record.Key]
+		if !existed {
+			s.keys.Insert(record.Key)
+		}
+		// a copy of a collection is stored as the collection
+		value := importValue(record.Value)
+		if s.bound != nil {
+			s.bound.stored(record.Key, value, old, existed)
+		}
+		s.store[record.Key] = entry{value: value, version: record.Revision, expiresAt: record.ExpiresAt}
+		if !record.ExpiresAt.IsZero() {
+			s.scheduleExpiry(record.Key, record.ExpiresAt)
+		}
+		s.hub.publish(Event{Type: EventSet, Key: record.Key, Value: record.Value, Revision: record.Revision, ExpiresAt: record.ExpiresAt})
+	case walOpDelete:
+		if s.remove(record.Key) {
+			s.hub.publish(Event{Type: EventDelete, Key: record.Key, Revision: record.Revision})
+		}
+	case walOpExpire:
+		if s.remove(record.Key) {
+			s.hub.publish(Event{Type: EventExpire, Key: record.Key, Revision: record.Revision})
+		}
+	case walOpEvict:
+		if s.evict(record.Key) {
+			s.hub.publish(Event{Type: EventEvict, Key: record.Key, Revision: record.Revision})
+		}
+	case walOpDeletePrefix:
+		for _, key := range s.removePrefix(record.Key) {
+			s.hub.publish(Event{Type: EventDelete, Key: key, Revision: record.Revision})
+		}
+	case walOpUpdate:
+		// the collection is changed in place, and kept, TTL and all, unless
+		// the change empties it
+		e, existed := s.store[record.Key]
+		c, _ := e.value.(collection)
+		var before int64
+		if existed {
+			before = sizeOfEntry(record.Key, e.value)
+		} else {
+			s.keys.Insert(record.Key)
+		}
+		c = record.Change.applyTo(c)
+		s.store[record.Key] = entry{value: c, version: record.Revision, expiresAt: e.expiresAt}
+		if s.bound != nil {
+			s.bound.resized(record.Key, before, sizeOfEntry(record.Key, c))
+		}
+		if c.len() == 0 {
+			s.apply(walRecord{Op: walOpDelete, Key: record.Key, Revision: record.Revision})
+			break
+		}
+		s.hub.publish(Event{Type: EventUpdate, Key: record.Key, Change: record.Change, Revision: record.Revision, ExpiresAt: e.expiresAt})
+	case walOpBatch:
+		// every write in a batch shares the batch's revision
+		for _, op := range record.Ops {
+			op.Revision = record.Revision
+			s.apply(op)
+		}
+	}
+	s.revision = record.Revision
+}
+
+// remove drops key from the store and its index, reporting whether it was
+// present. Callers must hold mu.
+func (s *inMemoryStore) remove(key string) bool {
+	return s.removeEntry(key, false)
+}
+
+// evict is remove for a key the eviction policy chose. Callers must hold mu.
+func (s *inMemoryStore) evict(key string) bool {
+	return s.removeEntry(key, true)
+}
+
+func (s *inMemoryStore) removeEntry(key string, evicted bool) bool {
+	e, ok := s.store[key]
+	if !ok {
+		return false
+	}
 	delete(s.store, key)
+	s.keys.Remove(key)
+	if s.bound != nil {
+		s.bound.removed(key, e.value, evicted)
+	}
+	return true
+}
+
+// removePrefix drops every key starting with prefix, returning them.
+// Callers must hold mu.
+func (s *inMemoryStore) removePrefix(prefix string) []string {
+	var keys []string
+	s.keys.Ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if prefix == "" && s.bound == nil {
+		s.store = make(map[string]entry)
+		s.keys = newSkipList(strings.Compare)
+		s.expiries = nil
+		return keys
+	}
+	for _, key := range keys {
+		s.remove(key)
+	}
+	return keys
+}
+
+// scheduleExpiry queues key to be reaped at expiresAt. Callers must hold mu.
+func (s *inMemoryStore) scheduleExpiry(key string, expiresAt time.Time) {
+	if s.following {
+		// the primary expires keys; see replicaStore.Promote
+		return
+	}
+	heap.Push(&s.expiries, expiry{key: key, at: expiresAt})
+	if !s.sweeping {
+		// the sweeper only runs once there is something to expire
+		s.sweeping = true
+		s.wg.Add(1)
+		go s.sweepLoop()
+	}
+}
+
+func (s *inMemoryStore) sweepLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sweep expires every key whose deadline has passed. Expiring is a write,
+// logged and published to watchers like any other.
+func (s *inMemoryStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for s.expiries.Len() > 0 && !now.Before(s.expiries[0].at) {
+		next := heap.Pop(&s.expiries).(expiry)
+		// the key may since have been overwritten or given a new expiry
+		e, ok := s.store[next.key]
+		if !ok || !e.expiresAt.Equal(next.at) {
+			continue
+		}
+		if _, err := s.tryCommit(walRecord{Op: walOpExpire, Key: next.key}); err != nil {
+			// the key stays hidden from reads; retry on the next sweep
+			heap.Push(&s.expiries, next)
+			return
+		}
+	}
+}
+
+// expiry schedules key to be reaped at a point in time.
+type expiry struct {
+	key string
+	at  time.Time
+}
+
+// expiryHeap is a min-heap of expiries ordered by time.
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
 }
@@ -2,19 +2,80 @@ package store
 
 import (
 	"fmt"
+	"io"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
+// storeTestSuite checks the semantics every in-memory store shares.
 type storeTestSuite struct {
 	suite.Suite
+	newStore func() testStore
+}
+
+// testStore is a store under test by storeTestSuite, with hooks into the
+// internals the suite inspects.
+type testStore interface {
+	ExpiringVersionedStore
+	ScannableStore
+	ClearableStore
+	BatchStore
+	io.Closer
+	setClock(now func() time.Time)
+	setSweepInterval(interval time.Duration)
+	sweep()
+	currentRevision() uint64
+	holds(key string) bool // whether key is held, even if expired
+	heldKeys() int
+	indexedKeys() int
+	pendingExpiries() int
+}
+
+func (s *inMemoryStore) setClock(now func() time.Time) {
+	s.now = now
+}
+
+func (s *inMemoryStore) setSweepInterval(interval time.Duration) {
+	s.sweepInterval = interval
+}
+
+func (s *inMemoryStore) currentRevision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
+
+func (s *inMemoryStore) holds(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.store[key]
+	return ok
+}
+
+func (s *inMemoryStore) heldKeys() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.store)
+}
+
+func (s *inMemoryStore) indexedKeys() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys.Len()
+}
+
+func (s *inMemoryStore) pendingExpiries() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expiries.Len()
 }
 
 func (s *storeTestSuite) TestSet() {
-	store := NewInMemoryStore()
+	store := s.newStore()
 
 	// Test setting a string value
 	store.Set("key1", "value1")
@@ -38,7 +99,7 @@ func (s *storeTestSuite) TestSet() {
 }
 
 func (s *storeTestSuite) TestGet() {
-	store := NewInMemoryStore()
+	store := s.newStore()
 
 	// Test getting a non-existent key
 	assert.Nil(s.T(), store.Get("nonexistent"))
@@ -52,8 +113,31 @@ func (s *storeTestSuite) TestGet() {
 	assert.Nil(s.T(), store.Get("nil_key"))
 }
 
+func (s *storeTestSuite) TestLookup() {
+	store := s.newStore()
+
+	value, ok := store.Lookup("nonexistent")
+	assert.False(s.T(), ok)
+	assert.Nil(s.T(), value)
+
+	store.Set("existing", "value")
+	value, ok = store.Lookup("existing")
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), "value", value)
+
+	// a key set to nil exists, unlike a missing one
+	store.Set("nil_key", nil)
+	value, ok = store.Lookup("nil_key")
+	assert.True(s.T(), ok)
+	assert.Nil(s.T(), value)
+
+	store.Delete("nil_key")
+	_, ok = store.Lookup("nil_key")
+	assert.False(s.T(), ok)
+}
+
 func (s *storeTestSuite) TestDelete() {
-	store := NewInMemoryStore()
+	store := s.newStore()
 
 	// Test deleting a non-existent key (should be no-op)
 	store.Delete("nonexistent")
@@ -71,8 +155,408 @@ func (s *storeTestSuite) TestDelete() {
 	assert.Nil(s.T(), store.Get("to_delete"))
 }
 
+// fakeClock is a manually advanced clock for expiry tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (s *storeTestSuite) TestSetWithTTL() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	assert.Implements(s.T(), (*ExpiringStore)(nil), store)
+
+	store.SetWithTTL("session", "token", time.Minute)
+	assert.Equal(s.T(), "token", store.Get("session"))
+
+	// expired keys are hidden as soon as their deadline passes
+	clock.Advance(time.Minute)
+	assert.Nil(s.T(), store.Get("session"))
+
+	// a plain Set clears a previous TTL
+	store.SetWithTTL("persisted", "value", time.Minute)
+	store.Set("persisted", "value")
+	clock.Advance(2 * time.Minute)
+	assert.Equal(s.T(), "value", store.Get("persisted"))
+
+	// a new TTL replaces the old one
+	store.SetWithTTL("extended", "value", time.Minute)
+	store.SetWithTTL("extended", "value", time.Hour)
+	clock.Advance(2 * time.Minute)
+	assert.Equal(s.T(), "value", store.Get("extended"))
+}
+
+func (s *storeTestSuite) TestSweepReapsExpiredKeys() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	store.SetWithTTL("short", "value", time.Second)
+	store.SetWithTTL("long", "value", time.Hour)
+	store.SetWithTTL("overwritten", "value", time.Second)
+	store.Set("overwritten", "value")
+
+	clock.Advance(time.Minute)
+	store.sweep()
+
+	assert.False(s.T(), store.holds("short"))
+	assert.True(s.T(), store.holds("long"))
+	assert.True(s.T(), store.holds("overwritten"))
+	assert.Equal(s.T(), 1, store.pendingExpiries())
+}
+
+func (s *storeTestSuite) TestSweeperRunsInBackground() {
+	store := s.newStore()
+	store.setSweepInterval(time.Millisecond)
+
+	store.SetWithTTL("key", "value", time.Millisecond)
+	assert.Eventually(s.T(), func() bool { return store.heldKeys() == 0 }, time.Second, time.Millisecond)
+
+	assert.NoError(s.T(), store.Close())
+}
+
+func (s *storeTestSuite) TestVersions() {
+	store := s.newStore()
+	assert.Implements(s.T(), (*VersionedStore)(nil), store)
+
+	value, version := store.GetWithVersion("key")
+	assert.Nil(s.T(), value)
+	assert.Equal(s.T(), uint64(0), version)
+
+	store.Set("key", "a")
+	_, first := store.GetWithVersion("key")
+	store.Set("other", "b")
+	store.Set("key", "c")
+	value, second := store.GetWithVersion("key")
+	assert.Equal(s.T(), "c", value)
+	assert.Greater(s.T(), second, first)
+
+	// a recreated key never reuses an earlier version
+	store.Delete("key")
+	store.Set("key", "a")
+	_, recreated := store.GetWithVersion("key")
+	assert.Greater(s.T(), recreated, second)
+
+	// deleting a missing key is not a write
+	store.Delete("missing")
+	_, unchanged := store.GetWithVersion("key")
+	assert.Equal(s.T(), recreated, unchanged)
+}
+
+func (s *storeTestSuite) TestCompareAndSwap() {
+	store := s.newStore()
+
+	// version 0 creates only if missing
+	version, err := store.CompareAndSwap("key", 0, "a")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "a", store.Get("key"))
+
+	_, err = store.CompareAndSwap("key", 0, "b")
+	assert.ErrorIs(s.T(), err, ErrVersionMismatch)
+
+	_, err = store.CompareAndSwap("key", version+1, "b")
+	assert.ErrorIs(s.T(), err, ErrVersionMismatch)
+	assert.Equal(s.T(), "a", store.Get("key"))
+
+	next, err := store.CompareAndSwap("key", version, "b")
+	s.Require().NoError(err)
+	assert.Greater(s.T(), next, version)
+	value, current := store.GetWithVersion("key")
+	assert.Equal(s.T(), "b", value)
+	assert.Equal(s.T(), next, current)
+
+	// the first of two writers holding the same version wins
+	_, err = store.CompareAndSwap("key", version, "c")
+	assert.ErrorIs(s.T(), err, ErrVersionMismatch)
+}
+
+func (s *storeTestSuite) TestCompareAndSwap_ExpiredKey() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	store.SetWithTTL("key", "a", time.Second)
+	clock.Advance(time.Minute)
+
+	// an expired key counts as missing
+	_, err := store.CompareAndSwap("key", 0, "b")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "b", store.Get("key"))
+}
+
+func (s *storeTestSuite) TestCompareAndSwapWithTTL() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	version, err := store.CompareAndSwapWithTTL("lock", 0, "owner", time.Second)
+	s.Require().NoError(err)
+	_, err = store.CompareAndSwapWithTTL("lock", 0, "other", time.Second)
+	assert.ErrorIs(s.T(), err, ErrVersionMismatch)
+	entries, _ := store.Scan("", "", 0)
+	assert.Equal(s.T(), []Entry{{Key: "lock", Value: "owner", Version: version, ExpiresAt: time.Unix(1, 0)}}, entries)
+
+	// once it expires, the key can be taken again
+	clock.Advance(time.Minute)
+	_, err = store.CompareAndSwapWithTTL("lock", 0, "other", time.Second)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "other", store.Get("lock"))
+}
+
+func (s *storeTestSuite) TestCompareAndDelete() {
+	store := s.newStore()
+	store.Set("key", "a")
+	_, version := store.GetWithVersion("key")
+
+	assert.ErrorIs(s.T(), store.CompareAndDelete("key", 0), ErrVersionMismatch)
+	assert.ErrorIs(s.T(), store.CompareAndDelete("key", version+1), ErrVersionMismatch)
+	assert.Equal(s.T(), "a", store.Get("key"))
+
+	s.Require().NoError(store.CompareAndDelete("key", version))
+	assert.Nil(s.T(), store.Get("key"))
+
+	// version 0 succeeds on a missing key without writing anything
+	s.Require().NoError(store.CompareAndDelete("key", 0))
+	assert.ErrorIs(s.T(), store.CompareAndDelete("key", version), ErrVersionMismatch)
+}
+
+func (s *storeTestSuite) TestConcurrentCompareAndSwap() {
+	store := s.newStore()
+	store.Set("counter", 0)
+	const numGoroutines = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				value, version := store.GetWithVersion("counter")
+				if _, err := store.CompareAndSwap("counter", version, value.(int)+1); err == nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// no increment was lost
+	assert.Equal(s.T(), numGoroutines, store.Get("counter"))
+}
+
+func (s *storeTestSuite) TestScan() {
+	store := s.newStore()
+	assert.Implements(s.T(), (*ScannableStore)(nil), store)
+
+	for _, key := range []string{"user/2", "user/10", "user/1", "order/1", "user", "users"} {
+		store.Set(key, key+"-value")
+	}
+	keys := func(entries []Entry) []string {
+		var keys []string
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		return keys
+	}
+
+	// everything, in lexicographic order
+	entries, more := store.Scan("", "", 0)
+	assert.Equal(s.T(), []string{"order/1", "user", "user/1", "user/10", "user/2", "users"}, keys(entries))
+	assert.False(s.T(), more)
+	assert.Equal(s.T(), "order/1-value", entries[0].Value)
+
+	// prefix filter
+	entries, more = store.Scan("user/", "", 0)
+	assert.Equal(s.T(), []string{"user/1", "user/10", "user/2"}, keys(entries))
+	assert.False(s.T(), more)
+
+	// paging with startAfter
+	entries, more = store.Scan("user/", "", 2)
+	assert.Equal(s.T(), []string{"user/1", "user/10"}, keys(entries))
+	assert.True(s.T(), more)
+	entries, more = store.Scan("user/", "user/10", 2)
+	assert.Equal(s.T(), []string{"user/2"}, keys(entries))
+	assert.False(s.T(), more)
+
+	// a page that exactly exhausts the keys reports no more
+	entries, more = store.Scan("user/", "", 3)
+	assert.Len(s.T(), entries, 3)
+	assert.False(s.T(), more)
+
+	// startAfter before the prefix range starts at the prefix
+	entries, _ = store.Scan("user/", "a", 1)
+	assert.Equal(s.T(), []string{"user/1"}, keys(entries))
+
+	// deleted keys leave the index
+	store.Delete("user/1")
+	entries, _ = store.Scan("user/", "", 0)
+	assert.Equal(s.T(), []string{"user/10", "user/2"}, keys(entries))
+
+	entries, more = store.Scan("missing", "", 0)
+	assert.Empty(s.T(), entries)
+	assert.False(s.T(), more)
+}
+
+func (s *storeTestSuite) TestScan_SkipsExpiredKeys() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	store.Set("a", 1)
+	store.SetWithTTL("b", 2, time.Second)
+	store.Set("c", 3)
+	clock.Advance(time.Minute)
+
+	entries, more := store.Scan("", "", 1)
+	assert.Equal(s.T(), []Entry{{Key: "a", Value: 1, Version: 1}}, entries)
+	assert.True(s.T(), more)
+	entries, more = store.Scan("", "a", 0)
+	assert.Equal(s.T(), []Entry{{Key: "c", Value: 3, Version: 3}}, entries)
+	assert.False(s.T(), more)
+
+	store.sweep()
+	assert.Equal(s.T(), 2, store.indexedKeys())
+}
+
+func (s *storeTestSuite) TestScan_ReportsExpiry() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	store.Set("a", 1)
+	store.SetWithTTL("b", 2, time.Minute)
+
+	entries, _ := store.Scan("", "", 0)
+	assert.Equal(s.T(), []Entry{
+		{Key: "a", Value: 1, Version: 1},
+		{Key: "b", Value: 2, Version: 2, ExpiresAt: time.Unix(60, 0)},
+	}, entries)
+}
+
+func (s *storeTestSuite) TestDeletePrefix() {
+	store := s.newStore()
+	assert.Implements(s.T(), (*ClearableStore)(nil), store)
+
+	for _, key := range []string{"test/a", "test/b", "tests", "prod/a"} {
+		store.Set(key, "value")
+	}
+	_, before := store.GetWithVersion("prod/a")
+
+	assert.Equal(s.T(), 2, store.DeletePrefix("test/"))
+	assert.Nil(s.T(), store.Get("test/a"))
+	assert.Nil(s.T(), store.Get("test/b"))
+	assert.Equal(s.T(), "value", store.Get("tests"))
+	assert.Equal(s.T(), "value", store.Get("prod/a"))
+
+	// nothing matching is a no-op
+	assert.Equal(s.T(), 0, store.DeletePrefix("test/"))
+	assert.Equal(s.T(), before+1, store.currentRevision())
+
+	entries, _ := store.Scan("", "", 0)
+	assert.Len(s.T(), entries, 2)
+}
+
+func (s *storeTestSuite) TestFlush() {
+	store := s.newStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.setClock(clock.Now)
+
+	store.Set("a", 1)
+	store.Set("b", 2)
+	store.SetWithTTL("expired", 3, time.Second)
+	clock.Advance(time.Minute)
+
+	// expired keys are reclaimed but not counted
+	assert.Equal(s.T(), 2, store.Flush())
+	assert.Nil(s.T(), store.Get("a"))
+	assert.Equal(s.T(), 0, store.indexedKeys())
+	assert.Equal(s.T(), 0, store.heldKeys())
+
+	// the store is usable afterwards and versions keep increasing
+	store.Set("a", 4)
+	_, version := store.GetWithVersion("a")
+	assert.Equal(s.T(), uint64(5), version)
+	assert.Equal(s.T(), 1, store.Flush())
+}
+
+func (s *storeTestSuite) TestBatch() {
+	store := s.newStore()
+	assert.Implements(s.T(), (*BatchStore)(nil), store)
+
+	store.MSet(map[string]any{"a": 1, "b": "two", "c": nil})
+	assert.Equal(s.T(), []any{1, "two", nil, nil}, store.MGet([]string{"a", "b", "c", "missing"}))
+	// a key set to null is found
+	values, found := store.MLookup([]string{"a", "c", "missing"})
+	assert.Equal(s.T(), []any{1, nil, nil}, values)
+	assert.Equal(s.T(), []bool{true, true, false}, found)
+
+	// a batch is a single write, so every key shares its version
+	_, versionA := store.GetWithVersion("a")
+	_, versionB := store.GetWithVersion("b")
+	assert.Equal(s.T(), versionA, versionB)
+	assert.Equal(s.T(), uint64(1), store.currentRevision())
+
+	store.MDelete([]string{"a", "missing", "c"})
+	assert.Equal(s.T(), []any{nil, "two", nil}, store.MGet([]string{"a", "b", "c"}))
+	entries, _ := store.Scan("", "", 0)
+	assert.Len(s.T(), entries, 1)
+
+	// empty and all-missing batches are not writes
+	store.MSet(nil)
+	store.MDelete([]string{"missing"})
+	assert.Equal(s.T(), uint64(2), store.currentRevision())
+	assert.Empty(s.T(), store.MGet(nil))
+}
+
+func (s *storeTestSuite) TestConcurrentBatchesAreAtomic() {
+	store := s.newStore()
+	keys := []string{"a", "b", "c"}
+	const numWriters = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			store.MSet(map[string]any{"a": id, "b": id, "c": id})
+		}(i)
+	}
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values := store.MGet(keys)
+			// readers never see half of a batch
+			assert.Equal(s.T(), values[0], values[1])
+			assert.Equal(s.T(), values[1], values[2])
+		}()
+	}
+	wg.Wait()
+}
+
 func (s *storeTestSuite) TestConcurrentAccess() {
-	store := NewInMemoryStore()
+	store := s.newStore()
 	const numGoroutines = 100
 	const numOperations = 100
 
@@ -120,5 +604,5 @@ func (s *storeTestSuite) TestConcurrentAccess() {
 }
 
 func TestStoreTestSuite(t *testing.T) {
-	suite.Run(t, new(storeTestSuite))
+	suite.Run(t, &storeTestSuite{newStore: func() testStore { return NewInMemoryStore() }})
 }
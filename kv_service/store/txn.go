@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TransactionalStore is a Store that commits multi-key transactions atomically,
+// using optimistic concurrency control.
+type TransactionalStore interface {
+	Store
+	// Commit applies txn's writes atomically if every key in its read set is
+	// still at the version that was read, returning the revision of the
+	// commit. Otherwise nothing is applied and a *ConflictError is returned.
+	Commit(txn Txn) (uint64, error)
+}
+
+// Txn is a transaction: the versions of the keys it read and the writes to
+// apply if none of them have changed since.
+type Txn struct {
+	Reads  []TxnRead
+	Writes []TxnWrite
+}
+
+// TxnRead records the version of key a transaction observed; 0 means the
+// key did not exist.
+type TxnRead struct {
+	Key     string
+	Version uint64
+}
+
+// TxnWrite sets key to Value, or deletes it if Delete is true. Writes are
+// applied in order, so a later write to the same key wins.
+type TxnWrite struct {
+	Key    string
+	Value  any
+	Delete bool
+}
+
+// Read adds key at version to the read set.
+func (t *Txn) Read(key string, version uint64) {
+	t.Reads = append(t.Reads, TxnRead{Key: key, Version: version})
+}
+
+// Set adds a write of value to key.
+func (t *Txn) Set(key string, value any) {
+	t.Writes = append(t.Writes, TxnWrite{Key: key, Value: value})
+}
+
+// Delete adds a deletion of key.
+func (t *Txn) Delete(key string) {
+	t.Writes = append(t.Writes, TxnWrite{Key: key, Delete: true})
+}
+
+// Conflict is a key whose version changed after a transaction read it.
+type Conflict struct {
+	Key             string
+	ExpectedVersion uint64
+	ActualVersion   uint64
+}
+
+// ConflictError is returned when a transaction fails validation. It matches
+// ErrVersionMismatch with errors.Is.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	keys := make([]string, len(e.Conflicts))
+	for i, conflict := range e.Conflicts {
+		keys[i] = fmt.Sprintf("%q", conflict.Key)
+	}
+	return fmt.Sprintf("transaction conflict on %s", strings.Join(keys, ", "))
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrVersionMismatch
+}
+
+func (s *inMemoryStore) Commit(txn Txn) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conflicts []Conflict
+	for _, read := range txn.Reads {
+		e, _ := s.lookup(read.Key)
+		if e.version != read.Version {
+			conflicts = append(conflicts, Conflict{Key: read.Key, ExpectedVersion: read.Version, ActualVersion: e.version})
+		}
+	}
+	if len(conflicts) > 0 {
+		return 0, &ConflictError{Conflicts: conflicts}
+	}
+
+	var ops []walRecord
+	present := make(map[string]bool) // presence of keys already written by txn
+	for _, write := range txn.Writes {
+		if write.Delete {
+			exists, written := present[write.Key]
+			if !written {
+				_, exists = s.store[write.Key]
+			}
+			// deleting a missing key is a no-op, as with Delete
+			if exists {
+				ops = append(ops, walRecord{Op: walOpDelete, Key: write.Key})
+			}
+			present[write.Key] = false
+			continue
+		}
+		ops = append(ops, walRecord{Op: walOpSet, Key: write.Key, Value: write.Value})
+		present[write.Key] = true
+	}
+	if len(ops) == 0 {
+		// a read-only transaction validates without writing
+		return s.revision, nil
+	}
+	return s.commit(walRecord{Op: walOpBatch, Ops: ops}), nil
+}
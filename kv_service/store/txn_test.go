@@ -0,0 +1,130 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type txnTestSuite struct {
+	suite.Suite
+}
+
+func (s *txnTestSuite) TestCommit() {
+	store := NewInMemoryStore()
+	assert.Implements(s.T(), (*TransactionalStore)(nil), store)
+	store.Set("alice", 100)
+	store.Set("bob", 50)
+	_, aliceVersion := store.GetWithVersion("alice")
+	_, bobVersion := store.GetWithVersion("bob")
+
+	var txn Txn
+	txn.Read("alice", aliceVersion)
+	txn.Read("bob", bobVersion)
+	txn.Read("carol", 0)
+	txn.Set("alice", 70)
+	txn.Set("bob", 80)
+	txn.Set("carol", "new")
+	txn.Delete("carol")
+	txn.Set("dave", 1)
+	revision, err := store.Commit(txn)
+	s.Require().NoError(err)
+
+	assert.Equal(s.T(), []any{70, 80, nil, 1}, store.MGet([]string{"alice", "bob", "carol", "dave"}))
+	// every write in the transaction shares the commit revision
+	_, version := store.GetWithVersion("alice")
+	assert.Equal(s.T(), revision, version)
+	_, version = store.GetWithVersion("dave")
+	assert.Equal(s.T(), revision, version)
+}
+
+func (s *txnTestSuite) TestCommit_Conflict() {
+	store := NewInMemoryStore()
+	store.Set("alice", 100)
+	store.Set("bob", 50)
+	_, aliceVersion := store.GetWithVersion("alice")
+	_, bobVersion := store.GetWithVersion("bob")
+
+	// another writer gets in first
+	store.Set("alice", 90)
+	_, currentAlice := store.GetWithVersion("alice")
+	store.Set("carol", "exists")
+	_, carolVersion := store.GetWithVersion("carol")
+
+	var txn Txn
+	txn.Read("alice", aliceVersion)
+	txn.Read("bob", bobVersion)
+	txn.Read("carol", 0)
+	txn.Set("alice", 70)
+	txn.Set("bob", 80)
+	_, err := store.Commit(txn)
+
+	var conflictErr *ConflictError
+	s.Require().True(errors.As(err, &conflictErr))
+	assert.ErrorIs(s.T(), err, ErrVersionMismatch)
+	assert.Equal(s.T(), []Conflict{
+		{Key: "alice", ExpectedVersion: aliceVersion, ActualVersion: currentAlice},
+		{Key: "carol", ExpectedVersion: 0, ActualVersion: carolVersion},
+	}, conflictErr.Conflicts)
+	assert.Equal(s.T(), `transaction conflict on "alice", "carol"`, err.Error())
+
+	// nothing was applied
+	assert.Equal(s.T(), []any{90, 50}, store.MGet([]string{"alice", "bob"}))
+}
+
+func (s *txnTestSuite) TestCommit_ReadOnly() {
+	store := NewInMemoryStore()
+	store.Set("key", "value")
+	_, version := store.GetWithVersion("key")
+
+	var txn Txn
+	txn.Read("key", version)
+	txn.Delete("missing")
+	revision, err := store.Commit(txn)
+
+	s.Require().NoError(err)
+	assert.Equal(s.T(), version, revision)
+	assert.Equal(s.T(), version, store.revision)
+}
+
+func (s *txnTestSuite) TestConcurrentTransfersConserveTotal() {
+	store := NewInMemoryStore()
+	store.MSet(map[string]any{"a": 1000, "b": 1000})
+	const numTransfers = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < numTransfers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := "a", "b"
+			if i%2 == 0 {
+				from, to = to, from
+			}
+			for {
+				fromValue, fromVersion := store.GetWithVersion(from)
+				toValue, toVersion := store.GetWithVersion(to)
+				var txn Txn
+				txn.Read(from, fromVersion)
+				txn.Read(to, toVersion)
+				txn.Set(from, fromValue.(int)-10)
+				txn.Set(to, toValue.(int)+10)
+				if _, err := store.Commit(txn); err == nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	values := store.MGet([]string{"a", "b"})
+	assert.Equal(s.T(), 2000, values[0].(int)+values[1].(int))
+	assert.Equal(s.T(), []any{1000, 1000}, values)
+}
+
+func TestTxnTestSuite(t *testing.T) {
+	suite.Run(t, new(txnTestSuite))
+}
@@ -0,0 +1,346 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls how often the write-ahead log is fsynced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every appended record.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every WALOptions.SyncInterval.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// WALOptions configures a write-ahead log.
+type WALOptions struct {
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration // only used with SyncInterval
+	// CompactSize is the size in bytes past which a walStore compacts its
+	// log, once the log has also outgrown the store's last checkpoint; zero
+	// never compacts. The lsm engine rotates its logs as it flushes instead.
+	CompactSize int64
+}
+
+// walOp identifies the operation a log record replays.
+type walOp string
+
+const (
+	walOpSet          walOp = "set"
+	walOpDelete       walOp = "delete"
+	walOpExpire       walOp = "expire"
+	walOpEvict        walOp = "evict"
+	walOpDeletePrefix walOp = "delete_prefix" // Key holds the prefix; empty for a flush
+	walOpBatch        walOp = "batch"         // Ops are applied together, atomically
+	walOpUpdate       walOp = "update"        // Change is made to the collection at Key
+	walOpCheckpoint   walOp = "checkpoint"    // ends a checkpoint; Revision is the store's
+)
+
+// walRecord is a single logged mutation.
+type walRecord struct {
+	Op        walOp             `json:"op"`
+	Revision  uint64            `json:"revision"`
+	Key       string            `json:"key"`
+	Value     any               `json:"value,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at,omitzero"` // absolute, so replay honours the original deadline
+	Ops       []walRecord       `json:"ops,omitempty"`
+	Change    *CollectionChange `json:"change,omitempty"`
+}
+
+// encodedRecord is a walRecord as logged: with the type of a collection it
+// sets its key to, so that it decodes as the collection rather than as the
+// plain JSON value holding its elements.
+type encodedRecord struct {
+	recordFields
+	Collection string `json:"collection,omitempty"`
+}
+
+// recordFields is a walRecord without its JSON methods.
+type recordFields walRecord
+
+func (r walRecord) encode() encodedRecord {
+	return encodedRecord{recordFields(r), CollectionType(r.Value)}
+}
+
+func (e encodedRecord) decode() (walRecord, error) {
+	r := walRecord(e.recordFields)
+	if e.Collection != "" {
+		value, err := DecodeCollection(e.Collection, r.Value)
+		if err != nil {
+			return walRecord{}, err
+		}
+		r.Value = value
+	}
+	return r, nil
+}
+
+func (r walRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.encode())
+}
+
+func (r *walRecord) UnmarshalJSON(data []byte) error {
+	var encoded encodedRecord
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := encoded.decode()
+	if err != nil {
+		return err
+	}
+	*r = decoded
+	return nil
+}
+
+const (
+	// frameHeaderSize is the size of the length and checksum prefix of each frame.
+	frameHeaderSize = 8
+	// maxFrameSize is the largest payload a frame may carry, so a damaged
+	// length can't have a reader allocate gigabytes.
+	maxFrameSize = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errTornFrame    = errors.New("torn frame")
+	errCorruptFrame = errors.New("corrupt frame")
+)
+
+// writeFrame writes payload prefixed by its length and CRC-32C checksum.
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("record of %d bytes is over the %d byte limit", len(payload), maxFrameSize)
+	}
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame. It returns io.EOF at a clean
+// end of input, errTornFrame if the input ends part way through a frame, and
+// errCorruptFrame for a damaged frame.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornFrame
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxFrameSize {
+		return nil, errCorruptFrame
+	}
+	// read as it arrives rather than allocated up front, as the length may
+	// be damaged without being over the limit
+	payload, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < int(length) {
+		return nil, errTornFrame
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errCorruptFrame
+	}
+	return payload, nil
+}
+
+// writeAheadLog is an append-only file of framed, JSON-encoded records.
+type writeAheadLog struct {
+	file  *os.File
+	opts  WALOptions
+	mu    sync.Mutex
+	err   error // sticky; once an append fails the log refuses further writes
+	dirty bool  // unsynced appends, for SyncInterval
+	size  int64 // bytes of records in the file
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// openWAL opens (creating if needed) the log at path, passes every intact
+// record to apply in order, and readies the log for appending. A torn or
+// corrupt final record, as left by a crash mid-write, is truncated; damage
+// anywhere else is an error, as truncating there would lose the records
+// after it.
+func openWAL(path string, opts WALOptions, apply func(walRecord)) (*writeAheadLog, error) {
+	if opts.SyncPolicy == SyncInterval && opts.SyncInterval <= 0 {
+		return nil, fmt.Errorf("wal: sync interval must be positive, got %v", opts.SyncInterval)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := replayWAL(file, apply)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &writeAheadLog{file: file, opts: opts, size: offset, done: make(chan struct{})}
+	if opts.SyncPolicy == SyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// replayWAL applies every intact record in r and returns the offset just past
+// the last one. Only the final record may be torn or corrupt.
+func replayWAL(r io.Reader, apply func(walRecord)) (int64, error) {
+	reader := bufio.NewReader(r)
+	var offset int64
+	for {
+		payload, err := readFrame(reader)
+		if err == errCorruptFrame {
+			if _, err := reader.Peek(1); err != io.EOF {
+				return 0, fmt.Errorf("wal: corrupt record at offset %d, with more of the log after it", offset)
+			}
+		}
+		if err == io.EOF || err == errTornFrame || err == errCorruptFrame {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			// a checksummed frame that doesn't decode was not written by us
+			return 0, fmt.Errorf("wal: undecodable record at offset %d: %w", offset, err)
+		}
+		apply(record)
+		offset += int64(frameHeaderSize + len(payload))
+	}
+}
+
+// append durably (per the sync policy) writes record to the log.
+func (l *writeAheadLog) append(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if len(payload) > maxFrameSize {
+		// refused before anything is written, so the log can carry on
+		return fmt.Errorf("wal: record of %d bytes is over the %d byte limit", len(payload), maxFrameSize)
+	}
+	if err := writeFrame(l.file, payload); err != nil {
+		l.err = fmt.Errorf("wal: append failed: %w", err)
+		return l.err
+	}
+	l.size += int64(frameHeaderSize + len(payload))
+	switch l.opts.SyncPolicy {
+	case SyncAlways:
+		if err := l.file.Sync(); err != nil {
+			l.err = fmt.Errorf("wal: sync failed: %w", err)
+			return l.err
+		}
+	case SyncInterval:
+		l.dirty = true
+	}
+	return nil
+}
+
+// reset empties the log, once every record in it is in a checkpoint.
+func (l *writeAheadLog) reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		l.err = fmt.Errorf("wal: reset failed: %w", err)
+		return l.err
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		l.err = fmt.Errorf("wal: reset failed: %w", err)
+		return l.err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.err = fmt.Errorf("wal: sync failed: %w", err)
+		return l.err
+	}
+	l.size, l.dirty = 0, false
+	return nil
+}
+
+// length returns the size in bytes of the records in the log.
+func (l *writeAheadLog) length() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+func (l *writeAheadLog) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.sync()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *writeAheadLog) sync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty || l.err != nil {
+		return
+	}
+	if err := l.file.Sync(); err != nil {
+		l.err = fmt.Errorf("wal: sync failed: %w", err)
+		return
+	}
+	l.dirty = false
+}
+
+// close stops background syncing, flushes outstanding writes and closes the file.
+func (l *writeAheadLog) close() error {
+	close(l.done)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	syncErr := l.file.Sync()
+	closeErr := l.file.Close()
+	if l.err == nil {
+		l.err = errors.New("wal: closed")
+	}
+	return errors.Join(syncErr, closeErr)
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// walFileName is the name of the log file within a walStore's data directory.
+	walFileName = "wal.log"
+	// checkpointFileName is the name of the file holding a walStore's last
+	// checkpoint, which the log continues from.
+	checkpointFileName = "wal.checkpoint"
+)
+
+// walStore is a durable Store. Every mutation is appended to an on-disk
+// write-ahead log before being applied to an in-memory copy of the data,
+// and the log is replayed to rebuild that copy on startup.
+//
+// It embeds the in-memory store, whose commit path hands each mutation to
+// the log, so it supports every operation the in-memory store does.
+//
+// Once the log outgrows WALOptions.CompactSize and the last checkpoint, the
+// store is compacted: every key is written to a new checkpoint, with its
+// version and expiry, and the log is emptied. Startup loads the checkpoint
+// and replays the log after it.
+type walStore struct {
+	*inMemoryStore
+	log            *writeAheadLog
+	dataDir        string
+	opts           WALOptions
+	checkpointSize int64
+}
+
+// NewWALStore opens a durable store in dataDir, creating the directory if
+// needed and replaying any existing checkpoint and log. Call Close to flush
+// and release it.
+func NewWALStore(dataDir string, opts WALOptions) (*walStore, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	// left behind by a crash part way through compacting
+	if err := os.Remove(filepath.Join(dataDir, checkpointFileName+".tmp")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	mem := NewInMemoryStore()
+	checkpointPath := filepath.Join(dataDir, checkpointFileName)
+	checkpointRevision, err := loadCheckpoint(checkpointPath, mem.apply)
+	if err != nil {
+		return nil, err
+	}
+	// a checkpoint isn't history a watcher can resume from
+	mem.hub = newWatchHub()
+	log, err := openWAL(filepath.Join(dataDir, walFileName), opts, func(record walRecord) {
+		// a crash between writing a checkpoint and emptying the log leaves
+		// records the checkpoint already holds
+		if record.Revision > checkpointRevision {
+			mem.apply(record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &walStore{inMemoryStore: mem, log: log, dataDir: dataDir, opts: opts}
+	if info, err := os.Stat(checkpointPath); err == nil {
+		s.checkpointSize = info.Size()
+	}
+	mem.persist = s.persist
+	return s, nil
+}
+
+// persist appends record to the log, compacting first if the log is due
+// for it. The record isn't applied yet, so a checkpoint taken here holds
+// exactly the records already in the log.
+func (s *walStore) persist(record walRecord) error {
+	if size := s.log.length(); s.opts.CompactSize > 0 && size > s.opts.CompactSize && size > s.checkpointSize {
+		if err := s.compact(); err != nil {
+			return fmt.Errorf("wal: compacting: %w", err)
+		}
+	}
+	return s.log.append(record)
+}
+
+// compact writes every key to a new checkpoint and empties the log. Callers
+// must hold mu.
+func (s *walStore) compact() error {
+	size, err := saveCheckpoint(filepath.Join(s.dataDir, checkpointFileName), s.checkpoint())
+	if err != nil {
+		return err
+	}
+	s.checkpointSize = size
+	return s.log.reset()
+}
+
+// checkpoint returns records that recreate the store as it is: a set of
+// every key, at its version and with its expiry, in key order, then a
+// checkpoint record carrying the store's revision. Callers must hold mu.
+func (s *inMemoryStore) checkpoint() []walRecord {
+	records := make([]walRecord, 0, len(s.store)+1)
+	s.keys.Ascend("", func(key string) bool {
+		e := s.store[key]
+		records = append(records, walRecord{Op: walOpSet, Revision: e.version, Key: key, Value: exportValue(e.value), ExpiresAt: e.expiresAt})
+		return true
+	})
+	return append(records, walRecord{Op: walOpCheckpoint, Revision: s.revision})
+}
+
+// writeCheckpoint writes records to w as frames, returning the bytes written.
+func writeCheckpoint(w io.Writer, records []walRecord) (int64, error) {
+	buffered := bufio.NewWriter(w)
+	var size int64
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err == nil {
+			err = writeFrame(buffered, payload)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("writing checkpoint: %q: %w", record.Key, err)
+		}
+		size += int64(frameHeaderSize + len(payload))
+	}
+	return size, buffered.Flush()
+}
+
+// readCheckpoint reads the records of a checkpoint written by
+// writeCheckpoint. A checkpoint is only ever replaced whole, so any damage,
+// or a missing checkpoint record at the end, is an error.
+func readCheckpoint(r io.Reader) ([]walRecord, error) {
+	reader := bufio.NewReader(r)
+	var records []walRecord
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF || err == errTornFrame || err == errCorruptFrame {
+			return nil, errors.New("checkpoint is truncated or corrupt")
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil, fmt.Errorf("checkpoint: %w", err)
+		}
+		records = append(records, record)
+		if record.Op == walOpCheckpoint {
+			return records, nil
+		}
+	}
+}
+
+// saveCheckpoint writes records to a checkpoint file at path, replacing any
+// existing one atomically, and returns its size.
+func saveCheckpoint(path string, records []walRecord) (int64, error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	size, err := writeCheckpoint(file, records)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return size, syncDir(filepath.Dir(path))
+}
+
+// loadCheckpoint passes every record of the checkpoint file at path to apply
+// and returns the revision it was taken at, or zero if there is none.
+func loadCheckpoint(path string, apply func(walRecord)) (uint64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	records, err := readCheckpoint(file)
+	if err != nil {
+		return 0, fmt.Errorf("wal: %s: %w", path, err)
+	}
+	for _, record := range records {
+		apply(record)
+	}
+	return records[len(records)-1].Revision, nil
+}
+
+// Close flushes the log to disk and closes it. The store must not be used afterwards.
+func (s *walStore) Close() error {
+	s.mu.Lock()
+	logErr := s.log.close()
+	s.mu.Unlock()
+	return errors.Join(logErr, s.inMemoryStore.Close())
+}
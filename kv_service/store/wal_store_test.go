@@ -0,0 +1,359 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type walStoreTestSuite struct {
+	suite.Suite
+	dataDir string
+}
+
+func (s *walStoreTestSuite) SetupTest() {
+	s.dataDir = s.T().TempDir()
+}
+
+func (s *walStoreTestSuite) open() *walStore {
+	store, err := NewWALStore(s.dataDir, WALOptions{SyncPolicy: SyncAlways})
+	s.Require().NoError(err)
+	return store
+}
+
+func (s *walStoreTestSuite) TestImplementsStore() {
+	store := s.open()
+	defer store.Close()
+
+	assert.Implements(s.T(), (*Store)(nil), store)
+}
+
+func (s *walStoreTestSuite) TestSurvivesRestart() {
+	store := s.open()
+	store.Set("string", "value")
+	store.Set("number", float64(42))
+	store.Set("bool", true)
+	store.Set("object", map[string]any{"nested": []any{"a", float64(1)}})
+	store.Set("overwritten", "old")
+	store.Set("overwritten", "new")
+	store.Set("deleted", "value")
+	store.Delete("deleted")
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+
+	// values come back with the same types the JSON handler decodes
+	assert.Equal(s.T(), "value", store.Get("string"))
+	assert.Equal(s.T(), float64(42), store.Get("number"))
+	assert.Equal(s.T(), true, store.Get("bool"))
+	assert.Equal(s.T(), map[string]any{"nested": []any{"a", float64(1)}}, store.Get("object"))
+	assert.Equal(s.T(), "new", store.Get("overwritten"))
+	assert.Nil(s.T(), store.Get("deleted"))
+}
+
+func (s *walStoreTestSuite) TestTTLSurvivesRestart() {
+	store := s.open()
+	assert.Implements(s.T(), (*ExpiringStore)(nil), store)
+	store.SetWithTTL("live", "value", time.Hour)
+	store.Set("expired", "old")
+	store.SetWithTTL("expired", "value", time.Millisecond)
+	s.Require().NoError(store.Close())
+
+	time.Sleep(5 * time.Millisecond)
+	store = s.open()
+	defer store.Close()
+
+	assert.Equal(s.T(), "value", store.Get("live"))
+	assert.Nil(s.T(), store.Get("expired"))
+}
+
+func (s *walStoreTestSuite) TestVersionsSurviveRestart() {
+	store := s.open()
+	store.Set("key", "a")
+	store.Set("key", "b")
+	_, version := store.GetWithVersion("key")
+	_, err := store.CompareAndSwap("other", 0, "c")
+	s.Require().NoError(err)
+	s.Require().NoError(store.CompareAndDelete("other", version+1))
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+
+	_, replayed := store.GetWithVersion("key")
+	assert.Equal(s.T(), version, replayed)
+	assert.Nil(s.T(), store.Get("other"))
+
+	// new writes continue from the replayed revision
+	_, err = store.CompareAndSwap("key", version, "d")
+	s.Require().NoError(err)
+	_, next := store.GetWithVersion("key")
+	assert.Greater(s.T(), next, version+2)
+}
+
+func (s *walStoreTestSuite) TestBulkDeletesSurviveRestart() {
+	store := s.open()
+	store.Set("test/a", "value")
+	store.Set("test/b", "value")
+	store.Set("prod/a", "value")
+	store.DeletePrefix("test/")
+	store.Set("test/c", "value")
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	assert.Nil(s.T(), store.Get("test/a"))
+	assert.Nil(s.T(), store.Get("test/b"))
+	assert.Equal(s.T(), "value", store.Get("test/c"))
+	assert.Equal(s.T(), "value", store.Get("prod/a"))
+	store.Flush()
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+	entries, _ := store.Scan("", "", 0)
+	assert.Empty(s.T(), entries)
+}
+
+func (s *walStoreTestSuite) TestBatchesSurviveRestart() {
+	store := s.open()
+	store.MSet(map[string]any{"a": "1", "b": "2", "c": "3"})
+	store.MDelete([]string{"b"})
+	_, version := store.GetWithVersion("a")
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+	assert.Equal(s.T(), []any{"1", nil, "3"}, store.MGet([]string{"a", "b", "c"}))
+	_, replayed := store.GetWithVersion("c")
+	assert.Equal(s.T(), version, replayed)
+}
+
+func (s *walStoreTestSuite) TestTransactionsSurviveRestart() {
+	store := s.open()
+	store.Set("alice", float64(100))
+	_, version := store.GetWithVersion("alice")
+	var txn Txn
+	txn.Read("alice", version)
+	txn.Set("alice", float64(70))
+	txn.Set("bob", float64(30))
+	revision, err := store.Commit(txn)
+	s.Require().NoError(err)
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+	assert.Equal(s.T(), []any{float64(70), float64(30)}, store.MGet([]string{"alice", "bob"}))
+	_, replayed := store.GetWithVersion("bob")
+	assert.Equal(s.T(), revision, replayed)
+}
+
+func (s *walStoreTestSuite) TestCountersSurviveRestart() {
+	store := s.open()
+	_, err := store.IncrBy("hits", 5)
+	s.Require().NoError(err)
+	_, err = store.IncrByFloat("rate", 0.5)
+	s.Require().NoError(err)
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+	assert.Equal(s.T(), []any{float64(5), 0.5}, store.MGet([]string{"hits", "rate"}))
+	value, err := store.Incr("hits")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(6), value)
+}
+
+func (s *walStoreTestSuite) TestCollectionsSurviveRestart() {
+	store := s.open()
+	_, err := store.ListPush("list", false, "a", "b")
+	s.Require().NoError(err)
+	_, err = store.SetAdd("set", "x")
+	s.Require().NoError(err)
+	_, err = store.HashSet("hash", map[string]any{"field": 1.0})
+	s.Require().NoError(err)
+	// changes to existing collections are logged as deltas
+	_, err = store.ListPush("list", true, "y", "z")
+	s.Require().NoError(err)
+	_, err = store.ListPop("list", false, 1)
+	s.Require().NoError(err)
+	_, err = store.SetAdd("set", "w", "v")
+	s.Require().NoError(err)
+	_, err = store.SetRemove("set", "w")
+	s.Require().NoError(err)
+	_, err = store.HashSet("hash", map[string]any{"other": "value"})
+	s.Require().NoError(err)
+	_, err = store.HashDelete("hash", "field")
+	s.Require().NoError(err)
+	store.SetWithTTL("emptied", ListValue{"a"}, time.Hour)
+	_, err = store.ListPop("emptied", true, 1)
+	s.Require().NoError(err)
+	s.Require().NoError(store.Close())
+
+	store = s.open()
+	defer store.Close()
+	values, err := store.ListRange("list", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"z", "y", "a"}, values)
+	members, err := store.SetMembers("set")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"v", "x"}, members)
+	fields, err := store.HashGetAll("hash")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), map[string]any{"other": "value"}, fields)
+	assert.Nil(s.T(), store.Get("emptied"))
+}
+
+func (s *walStoreTestSuite) TestLogsCollectionDeltas() {
+	store := s.open()
+	_, err := store.ListPush("list", false, "a", "b", "c")
+	s.Require().NoError(err)
+	_, err = store.ListPush("list", false, "d")
+	s.Require().NoError(err)
+	_, err = store.SortedSetAdd("board", map[string]float64{"alice": 10, "bob": 20})
+	s.Require().NoError(err)
+	_, err = store.SortedSetAdd("board", map[string]float64{"bob": 5, "alice": 10})
+	s.Require().NoError(err)
+	s.Require().NoError(store.Close())
+
+	file, err := os.Open(filepath.Join(s.dataDir, walFileName))
+	s.Require().NoError(err)
+	defer file.Close()
+	var records []walRecord
+	_, err = replayWAL(file, func(record walRecord) { records = append(records, record) })
+	s.Require().NoError(err)
+	s.Require().Len(records, 4)
+	// the push is logged without the values already in the list
+	assert.Equal(s.T(), walOpUpdate, records[1].Op)
+	assert.Equal(s.T(), &CollectionChange{Type: listType, Push: []any{"d"}}, records[1].Change)
+	assert.Nil(s.T(), records[1].Value)
+	// and the add with only the member whose score changed
+	assert.Equal(s.T(), walOpUpdate, records[3].Op)
+	assert.Equal(s.T(), &CollectionChange{Type: sortedSetType, Set: map[string]any{"bob": 5.0}}, records[3].Change)
+}
+
+func (s *walStoreTestSuite) TestSortedSetsSurviveRestart() {
+	store := s.open()
+	_, err := store.SortedSetAdd("board", map[string]float64{"alice": 10, "bob": 20, "carol": 30})
+	s.Require().NoError(err)
+	_, err = store.SortedSetPop("board", true, 1)
+	s.Require().NoError(err)
+	s.Require().NoError(store.Close())
+
+	// the index is rebuilt from the log
+	store = s.open()
+	defer store.Close()
+	members, err := store.SortedSetRange("board", 0, -1, true)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"bob", 20}, {"alice", 10}}, members)
+	_, rank, ok, err := store.SortedSetMember("board", "alice", false)
+	s.Require().NoError(err)
+	assert.True(s.T(), ok)
+	assert.Zero(s.T(), rank)
+}
+
+func (s *walStoreTestSuite) TestCompaction() {
+	store, err := NewWALStore(s.dataDir, WALOptions{SyncPolicy: SyncNever, CompactSize: 1024})
+	s.Require().NoError(err)
+	for i := range 100 {
+		store.Set("counter", float64(i))
+	}
+	store.SetWithTTL("ttl", "value", time.Hour)
+	_, err = store.ListPush("list", false, "a", "b")
+	s.Require().NoError(err)
+	_, err = store.SortedSetAdd("board", map[string]float64{"alice": 10, "bob": 20})
+	s.Require().NoError(err)
+	store.Set("deleted", "value")
+	store.Delete("deleted")
+	_, version := store.GetWithVersion("counter")
+	revision := store.Revision()
+	s.Require().NoError(store.Close())
+
+	// the log was emptied into a checkpoint on the way
+	checkpoint, err := os.Stat(filepath.Join(s.dataDir, checkpointFileName))
+	s.Require().NoError(err)
+	assert.Positive(s.T(), checkpoint.Size())
+	log, err := os.Stat(filepath.Join(s.dataDir, walFileName))
+	s.Require().NoError(err)
+	assert.Less(s.T(), log.Size(), int64(2048))
+
+	store = s.open()
+	defer store.Close()
+	value, replayed := store.GetWithVersion("counter")
+	assert.Equal(s.T(), float64(99), value)
+	assert.Equal(s.T(), version, replayed)
+	assert.Equal(s.T(), revision, store.Revision())
+	entries, _ := store.Scan("ttl", "", 1)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Hour), entries[0].ExpiresAt, time.Minute)
+	values, err := store.ListRange("list", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"a", "b"}, values)
+	members, err := store.SortedSetRange("board", 0, -1, false)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []ScoredMember{{"alice", 10}, {"bob", 20}}, members)
+	assert.Nil(s.T(), store.Get("deleted"))
+
+	// the writes before the checkpoint can no longer be watched from
+	_, err = store.Watch(s.T().Context(), "", 1)
+	assert.ErrorIs(s.T(), err, ErrCompacted)
+}
+
+func (s *walStoreTestSuite) TestCheckpointWithStaleLog() {
+	store := s.open()
+	compact := func() {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		s.Require().NoError(store.compact())
+	}
+	_, err := store.ListPush("list", false, "a")
+	s.Require().NoError(err)
+	compact()
+	_, err = store.ListPush("list", false, "b")
+	s.Require().NoError(err)
+	stale, err := os.ReadFile(filepath.Join(s.dataDir, walFileName))
+	s.Require().NoError(err)
+	compact()
+	s.Require().NoError(store.Close())
+
+	// as if the store crashed after checkpointing but before emptying the
+	// log: the push the checkpoint holds isn't applied twice
+	s.Require().NoError(os.WriteFile(filepath.Join(s.dataDir, walFileName), stale, 0o644))
+	store = s.open()
+	defer store.Close()
+	values, err := store.ListRange("list", 0, -1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"a", "b"}, values)
+}
+
+func (s *walStoreTestSuite) TestCorruptCheckpoint() {
+	store, err := NewWALStore(s.dataDir, WALOptions{SyncPolicy: SyncAlways, CompactSize: 1})
+	s.Require().NoError(err)
+	store.Set("a", "1")
+	store.Set("b", "2")
+	s.Require().NoError(store.Close())
+
+	path := filepath.Join(s.dataDir, checkpointFileName)
+	data, err := os.ReadFile(path)
+	s.Require().NoError(err)
+	s.Require().NoError(os.WriteFile(path, data[:len(data)-1], 0o644))
+	_, err = NewWALStore(s.dataDir, WALOptions{SyncPolicy: SyncAlways})
+	assert.ErrorContains(s.T(), err, "truncated or corrupt")
+}
+
+func (s *walStoreTestSuite) TestWriteAfterClosePanics() {
+	store := s.open()
+	store.Set("key", "value")
+	s.Require().NoError(store.Close())
+
+	assert.Panics(s.T(), func() { store.Set("key", "value") })
+	assert.Panics(s.T(), func() { store.Delete("key") })
+}
+
+func TestWALStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(walStoreTestSuite))
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type walTestSuite struct {
+	suite.Suite
+	path string
+}
+
+func (s *walTestSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), walFileName)
+}
+
+func (s *walTestSuite) collect() []walRecord {
+	var records []walRecord
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncNever}, func(r walRecord) {
+		records = append(records, r)
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(log.close())
+	return records
+}
+
+// corrupt flips the byte at offset in the log, counting from the end if
+// offset is negative.
+func (s *walTestSuite) corrupt(offset int) {
+	data, err := os.ReadFile(s.path)
+	s.Require().NoError(err)
+	if offset < 0 {
+		offset += len(data)
+	}
+	data[offset] ^= 0xff
+	s.Require().NoError(os.WriteFile(s.path, data, 0o644))
+}
+
+func (s *walTestSuite) TestFrameRoundTrip() {
+	var buf bytes.Buffer
+	s.Require().NoError(writeFrame(&buf, []byte("hello")))
+	s.Require().NoError(writeFrame(&buf, []byte{}))
+
+	payload, err := readFrame(&buf)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []byte("hello"), payload)
+
+	payload, err = readFrame(&buf)
+	s.Require().NoError(err)
+	assert.Empty(s.T(), payload)
+
+	_, err = readFrame(&buf)
+	assert.Equal(s.T(), io.EOF, err)
+}
+
+func (s *walTestSuite) TestFrameChecksumMismatch() {
+	var buf bytes.Buffer
+	s.Require().NoError(writeFrame(&buf, []byte("hello")))
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	_, err := readFrame(bytes.NewReader(data))
+	assert.Equal(s.T(), errCorruptFrame, err)
+
+	// as opposed to one cut short
+	_, err = readFrame(bytes.NewReader(data[:len(data)-1]))
+	assert.Equal(s.T(), errTornFrame, err)
+}
+
+func (s *walTestSuite) TestAppendAndReplay() {
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncAlways}, func(walRecord) {})
+	s.Require().NoError(err)
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "a", Value: "1"}))
+	s.Require().NoError(log.append(walRecord{Op: walOpDelete, Key: "a"}))
+	s.Require().NoError(log.close())
+
+	assert.Equal(s.T(), []walRecord{
+		{Op: walOpSet, Key: "a", Value: "1"},
+		{Op: walOpDelete, Key: "a"},
+	}, s.collect())
+}
+
+func (s *walTestSuite) TestTornTailIsTruncated() {
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncAlways}, func(walRecord) {})
+	s.Require().NoError(err)
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "a", Value: "1"}))
+	s.Require().NoError(log.close())
+	intact, err := os.Stat(s.path)
+	s.Require().NoError(err)
+
+	// simulate a crash part way through writing a frame
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	s.Require().NoError(err)
+	_, err = file.Write([]byte{42, 0, 0, 0, 1, 2})
+	s.Require().NoError(err)
+	s.Require().NoError(file.Close())
+
+	assert.Equal(s.T(), []walRecord{{Op: walOpSet, Key: "a", Value: "1"}}, s.collect())
+	truncated, err := os.Stat(s.path)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), intact.Size(), truncated.Size())
+}
+
+func (s *walTestSuite) TestCorruptFinalRecordIsTruncated() {
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncAlways}, func(walRecord) {})
+	s.Require().NoError(err)
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "a", Value: "1"}))
+	intact := log.length()
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "b", Value: "2"}))
+	s.Require().NoError(log.close())
+	s.corrupt(-2)
+
+	assert.Equal(s.T(), []walRecord{{Op: walOpSet, Key: "a", Value: "1"}}, s.collect())
+	truncated, err := os.Stat(s.path)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), intact, truncated.Size())
+}
+
+func (s *walTestSuite) TestMidLogCorruptionIsAnError() {
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncAlways}, func(walRecord) {})
+	s.Require().NoError(err)
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "a", Value: "1"}))
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "b", Value: "2"}))
+	s.Require().NoError(log.close())
+	before, err := os.Stat(s.path)
+	s.Require().NoError(err)
+	s.corrupt(frameHeaderSize + 1)
+
+	// truncating would lose the intact record after the damaged one
+	_, err = openWAL(s.path, WALOptions{SyncPolicy: SyncNever}, func(walRecord) {})
+	assert.ErrorContains(s.T(), err, "corrupt record at offset 0")
+	after, err := os.Stat(s.path)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), before.Size(), after.Size())
+}
+
+func (s *walTestSuite) TestOversizedFrame() {
+	// a damaged length is rejected rather than allocated
+	header := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	_, err := readFrame(bytes.NewReader(header))
+	assert.Equal(s.T(), errCorruptFrame, err)
+
+	// and one under the limit is read only as far as the input goes
+	header = []byte{0, 0, 0, 0x3f, 0, 0, 0, 0, 1, 2}
+	_, err = readFrame(bytes.NewReader(header))
+	assert.Equal(s.T(), errTornFrame, err)
+}
+
+func (s *walTestSuite) TestSyncInterval() {
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncInterval, SyncInterval: time.Millisecond}, func(walRecord) {})
+	s.Require().NoError(err)
+	s.Require().NoError(log.append(walRecord{Op: walOpSet, Key: "a", Value: "1"}))
+
+	assert.Eventually(s.T(), func() bool {
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		return !log.dirty
+	}, time.Second, time.Millisecond)
+	s.Require().NoError(log.close())
+}
+
+func (s *walTestSuite) TestSyncIntervalMustBePositive() {
+	_, err := openWAL(s.path, WALOptions{SyncPolicy: SyncInterval}, func(walRecord) {})
+	assert.Error(s.T(), err)
+}
+
+func (s *walTestSuite) TestAppendAfterClose() {
+	log, err := openWAL(s.path, WALOptions{SyncPolicy: SyncNever}, func(walRecord) {})
+	s.Require().NoError(err)
+	s.Require().NoError(log.close())
+
+	assert.Error(s.T(), log.append(walRecord{Op: walOpSet, Key: "a"}))
+}
+
+func TestWALTestSuite(t *testing.T) {
+	suite.Run(t, new(walTestSuite))
+}
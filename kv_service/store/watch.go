@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchableStore is a Store that publishes every change to its keys.
+type WatchableStore interface {
+	Store
+	// Watch streams events for keys starting with prefix. With a
+	// fromRevision of 0 only future changes are sent; otherwise every event
+	// at or after fromRevision is replayed first, so a watcher can resume
+	// from the revision after the last event it saw. The channel is closed
+	// when ctx is done, or if the watcher falls too far behind to keep up.
+	Watch(ctx context.Context, prefix string, fromRevision uint64) (<-chan Event, error)
+	Revision() uint64 // revision of the latest change
+}
+
+// EventType is the kind of change an Event describes.
+type EventType string
+
+const (
+	EventSet    EventType = "set"
+	EventDelete EventType = "delete"
+	EventExpire EventType = "expire" // the key's TTL ran out
+	EventEvict  EventType = "evict"  // a bounded store evicted the key to stay within budget
+	// EventUpdate is a change to the elements of the collection at the key,
+	// which creates it if the key wasn't set.
+	EventUpdate EventType = "update"
+)
+
+// Event is a single change to a key. Changes made together, by a batch or
+// transaction, share a revision.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    any               // set events only
+	Change   *CollectionChange // update events only
+	Revision uint64
+	// ExpiresAt is when a set key's TTL runs out, or zero if it never expires.
+	ExpiresAt time.Time
+}
+
+// ErrCompacted is returned when resuming a watch from a revision that is
+// older than the retained event history.
+var ErrCompacted = errors.New("revision compacted")
+
+const (
+	// watchHistorySize is how many recent events, at least, are kept for
+	// resuming watchers.
+	watchHistorySize = 4096
+	// watchBufferSize is how many undelivered events a watcher may fall
+	// behind by before it is disconnected.
+	watchBufferSize = 256
+)
+
+// watchHub fans events out to watchers and keeps a bounded history of them.
+type watchHub struct {
+	mu       sync.Mutex
+	history  []Event // oldest first
+	watchers map[*watcher]struct{}
+}
+
+type watcher struct {
+	prefix string
+	events chan Event
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+// publish records event and delivers it to interested watchers. It never
+// blocks: a watcher whose buffer is full is dropped. Publishing to a nil hub,
+// for a store that can't be watched, does nothing.
+func (h *watchHub) publish(event Event) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history = append(h.history, event)
+	if len(h.history) == 2*watchHistorySize {
+		// trim in bulk so publishing stays amortised O(1), and at a revision
+		// boundary, so a revision is either replayed whole or not at all
+		trim := watchHistorySize
+		for trim < len(h.history) && h.history[trim].Revision == h.history[trim-1].Revision {
+			trim++
+		}
+		h.history = append(h.history[:0], h.history[trim:]...)
+	}
+
+	for w := range h.watchers {
+		if !strings.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			h.remove(w)
+		}
+	}
+}
+
+// watch registers a watcher and queues any history it asked to replay.
+// currentRevision must be the store's revision, held stable by the caller.
+func (h *watchHub) watch(ctx context.Context, prefix string, fromRevision, currentRevision uint64) (<-chan Event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []Event
+	if fromRevision != 0 && fromRevision <= currentRevision {
+		if len(h.history) == 0 || h.history[0].Revision > fromRevision {
+			return nil, fmt.Errorf("%w: cannot resume from revision %d", ErrCompacted, fromRevision)
+		}
+		for _, event := range h.history {
+			if event.Revision >= fromRevision && strings.HasPrefix(event.Key, prefix) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	w := &watcher{prefix: prefix, events: make(chan Event, len(backlog)+watchBufferSize)}
+	for _, event := range backlog {
+		w.events <- event
+	}
+	h.watchers[w] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(w)
+	}()
+	return w.events, nil
+}
+
+// remove closes w's channel and forgets it. Callers must hold mu.
+func (h *watchHub) remove(w *watcher) {
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+func (s *inMemoryStore) Watch(ctx context.Context, prefix string, fromRevision uint64) (<-chan Event, error) {
+	// holding the read lock keeps writes, and so publishes, out while the
+	// watcher is registered, so it misses nothing between backlog and live events
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hub.watch(ctx, prefix, fromRevision, s.revision)
+}
+
+func (s *inMemoryStore) Revision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type watchTestSuite struct {
+	suite.Suite
+}
+
+// receive reads the next n events from events, failing if they don't arrive.
+func (s *watchTestSuite) receive(events <-chan Event, n int) []Event {
+	received := make([]Event, 0, n)
+	for len(received) < n {
+		select {
+		case event, ok := <-events:
+			s.Require().True(ok, "channel closed after %d events", len(received))
+			received = append(received, event)
+		case <-time.After(time.Second):
+			s.FailNow("timed out waiting for events", "got %d of %d", len(received), n)
+		}
+	}
+	return received
+}
+
+func (s *watchTestSuite) assertClosed(events <-chan Event) {
+	select {
+	case _, ok := <-events:
+		for ok {
+			_, ok = <-events
+		}
+	case <-time.After(time.Second):
+		s.Fail("channel was not closed")
+	}
+}
+
+func (s *watchTestSuite) TestImplementsWatchableStore() {
+	assert.Implements(s.T(), (*WatchableStore)(nil), NewInMemoryStore())
+}
+
+func (s *watchTestSuite) TestLiveEvents() {
+	store := NewInMemoryStore()
+	store.Set("before", 1) // not replayed without a fromRevision
+	events, err := store.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	store.Set("a", "value")
+	store.Delete("a")
+	store.Delete("missing") // deleting nothing isn't a change
+
+	assert.Equal(s.T(), []Event{
+		{Type: EventSet, Key: "a", Value: "value", Revision: 2},
+		{Type: EventDelete, Key: "a", Revision: 3},
+	}, s.receive(events, 2))
+	assert.Equal(s.T(), uint64(3), store.Revision())
+	assert.Empty(s.T(), events)
+}
+
+func (s *watchTestSuite) TestPrefixFilter() {
+	store := NewInMemoryStore()
+	events, err := store.Watch(context.Background(), "user:", 0)
+	s.Require().NoError(err)
+
+	store.Set("order:1", "ignored")
+	store.Set("user:1", "alice")
+
+	assert.Equal(s.T(), []Event{{Type: EventSet, Key: "user:1", Value: "alice", Revision: 2}}, s.receive(events, 1))
+}
+
+func (s *watchTestSuite) TestBatchEventsShareRevision() {
+	store := NewInMemoryStore()
+	store.Set("c", 0)
+	events, err := store.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	store.MSet(map[string]any{"a": 1, "b": 2})
+	store.DeletePrefix("")
+
+	assert.Equal(s.T(), []Event{
+		{Type: EventSet, Key: "a", Value: 1, Revision: 2},
+		{Type: EventSet, Key: "b", Value: 2, Revision: 2},
+		{Type: EventDelete, Key: "a", Revision: 3},
+		{Type: EventDelete, Key: "b", Revision: 3},
+		{Type: EventDelete, Key: "c", Revision: 3},
+	}, s.receive(events, 5))
+}
+
+func (s *watchTestSuite) TestResumeFromRevision() {
+	store := NewInMemoryStore()
+	store.Set("a", 1)
+	store.Set("b", 2)
+	store.Set("a", 3)
+
+	events, err := store.Watch(context.Background(), "a", 2)
+	s.Require().NoError(err)
+	store.Set("a", 4)
+
+	// the backlog comes first, then live events, without gaps
+	assert.Equal(s.T(), []Event{
+		{Type: EventSet, Key: "a", Value: 3, Revision: 3},
+		{Type: EventSet, Key: "a", Value: 4, Revision: 4},
+	}, s.receive(events, 2))
+
+	// resuming from a revision not yet reached only waits for it
+	events, err = store.Watch(context.Background(), "", 10)
+	s.Require().NoError(err)
+	assert.Empty(s.T(), events)
+}
+
+func (s *watchTestSuite) TestResumeFromCompactedRevision() {
+	store := NewInMemoryStore()
+	for i := 0; i < 2*watchHistorySize; i++ {
+		store.Set("key", i)
+	}
+
+	_, err := store.Watch(context.Background(), "", 1)
+	assert.ErrorIs(s.T(), err, ErrCompacted)
+
+	// the most recent events are still available
+	events, err := store.Watch(context.Background(), "", store.Revision())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2*watchHistorySize-1, s.receive(events, 1)[0].Value)
+}
+
+func (s *watchTestSuite) TestCompactionKeepsRevisionsWhole() {
+	store := NewInMemoryStore()
+	for i := 0; i < watchHistorySize-1; i++ {
+		store.Set("key", i)
+	}
+	// a batch whose events straddle the point history is trimmed at
+	store.MSet(map[string]any{"a": 1, "b": 2, "c": 3})
+	batch := store.Revision()
+	for i := 0; i < watchHistorySize-2; i++ {
+		store.Set("key", i)
+	}
+
+	// the batch is dropped whole, rather than replayed in part
+	_, err := store.Watch(context.Background(), "", batch)
+	assert.ErrorIs(s.T(), err, ErrCompacted)
+	events, err := store.Watch(context.Background(), "", batch+1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), batch+1, s.receive(events, 1)[0].Revision)
+}
+
+func (s *watchTestSuite) TestCancelClosesChannel() {
+	store := NewInMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := store.Watch(ctx, "", 0)
+	s.Require().NoError(err)
+
+	cancel()
+	s.assertClosed(events)
+	store.Set("a", 1) // publishing after the watcher left must not block or panic
+}
+
+func (s *watchTestSuite) TestSlowWatcherIsDropped() {
+	store := NewInMemoryStore()
+	events, err := store.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	// writes never wait on a watcher that isn't reading
+	for i := 0; i <= watchBufferSize; i++ {
+		store.Set("key", i)
+	}
+
+	assert.Len(s.T(), s.receive(events, watchBufferSize), watchBufferSize)
+	s.assertClosed(events)
+}
+
+func (s *watchTestSuite) TestCollectionUpdateEvents() {
+	store := NewInMemoryStore()
+	events, err := store.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	// watchers are sent each change to a collection, not the collection
+	store.ListPush("list", false, "a", "b")
+	store.ListPop("list", true, 1)
+	store.ListPop("list", true, 1) // emptying it deletes it
+
+	assert.Equal(s.T(), []Event{
+		{Type: EventUpdate, Key: "list", Change: &CollectionChange{Type: "list", Push: []any{"a", "b"}}, Revision: 1},
+		{Type: EventUpdate, Key: "list", Change: &CollectionChange{Type: "list", Front: true, Pop: 1}, Revision: 2},
+		{Type: EventDelete, Key: "list", Revision: 3},
+	}, s.receive(events, 3))
+}
+
+func (s *watchTestSuite) TestExpireEvents() {
+	store := NewInMemoryStore()
+	defer store.Close()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.now = clock.Now
+	store.sweepInterval = time.Millisecond
+	events, err := store.Watch(context.Background(), "", 0)
+	s.Require().NoError(err)
+
+	store.SetWithTTL("session", "token", time.Minute)
+	clock.Advance(time.Minute)
+
+	assert.Equal(s.T(), []Event{
+		{Type: EventSet, Key: "session", Value: "token", Revision: 1, ExpiresAt: time.Unix(60, 0)},
+		{Type: EventExpire, Key: "session", Revision: 2},
+	}, s.receive(events, 2))
+}
+
+func (s *watchTestSuite) TestHistorySurvivesRestart() {
+	dataDir := s.T().TempDir()
+	store, err := NewWALStore(dataDir, WALOptions{SyncPolicy: SyncAlways})
+	s.Require().NoError(err)
+	store.Set("a", "one")
+	store.Delete("a")
+	s.Require().NoError(store.Close())
+
+	store, err = NewWALStore(dataDir, WALOptions{SyncPolicy: SyncAlways})
+	s.Require().NoError(err)
+	defer store.Close()
+
+	// replaying the log rebuilds the history, so watchers resume across restarts
+	events, err := store.Watch(context.Background(), "", 1)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []Event{
+		{Type: EventSet, Key: "a", Value: "one", Revision: 1},
+		{Type: EventDelete, Key: "a", Revision: 2},
+	}, s.receive(events, 2))
+}
+
+func TestWatchTestSuite(t *testing.T) {
+	suite.Run(t, new(watchTestSuite))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// maxWebSocketMessageSize is the largest request a WebSocket client may send.
+const maxWebSocketMessageSize = 64 << 20
+
+// websocketUpgrader upgrades requests to the WebSocket API. Its default
+// origin check rejects cross-origin requests, which a browser could
+// otherwise make with the user's cookies.
+var websocketUpgrader = websocket.Upgrader{}
+
+// websocketRequest is a message a client sends over the WebSocket API. ID
+// is any JSON value, sent back in the response so the client can match the
+// two up.
+type websocketRequest struct {
+	ID   json.RawMessage `json:"id"`
+	Op   string          `json:"op"`
+	Key  string          `json:"key"`
+	Keys []string        `json:"keys"`
+	// raw, so a value of null is told apart from a missing one
+	Value      json.RawMessage `json:"value"`
+	TTLSeconds *int64          `json:"ttl_seconds"`
+	IfVersion  *uint64         `json:"if_version"`
+}
+
+// websocketSession is one client's WebSocket connection.
+type websocketSession struct {
+	conn    *websocket.Conn
+	kvStore store.Store
+
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// subscriptions are the keys whose changes are sent to the client
+	subscriptions map[string]struct{}
+	watching      bool
+}
+
+// websocketHandler handles the WebSocket API: a connection carrying JSON
+// requests to get, set and delete keys, each answered with a response with
+// the same id, and change events for the keys the client subscribes to.
+func websocketHandler(c *gin.Context) {
+	kvStore := requestStore(c)
+	conn, err := websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxWebSocketMessageSize)
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	session := &websocketSession{conn: conn, kvStore: kvStore, subscriptions: map[string]struct{}{}}
+	go session.keepAlive(ctx)
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request websocketRequest
+		if err := json.Unmarshal(message, &request); err != nil {
+			session.send(gin.H{"id": nil, "status": http.StatusBadRequest, "error": err.Error()})
+			continue
+		}
+		response := session.handle(ctx, request)
+		response["id"] = request.ID
+		session.send(response)
+	}
+}
+
+// send writes a message to the client. Errors are left for the next read to
+// report, which ends the connection.
+func (s *websocketSession) send(message any) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.WriteJSON(message)
+}
+
+// keepAlive pings the client while it's idle, which keeps proxies from
+// timing out the connection, until ctx is done.
+func (s *websocketSession) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(watchHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(watchHeartbeatInterval))
+		}
+	}
+}
+
+// handle runs a request, returning its response.
+func (s *websocketSession) handle(ctx context.Context, request websocketRequest) gin.H {
+	switch request.Op {
+	case "get":
+		return s.get(request)
+	case "set":
+		return s.set(request)
+	case "delete":
+		return s.delete(request)
+	case "subscribe":
+		return s.subscribe(ctx, request)
+	case "unsubscribe":
+		return s.unsubscribe(request)
+	default:
+		return gin.H{"status": http.StatusBadRequest, "error": fmt.Sprintf("unknown op %q: want get, set, delete, subscribe or unsubscribe", request.Op)}
+	}
+}
+
+// checkLeader rejects writes to a follower of a replicated store, which
+// can't be forwarded to the leader as HTTP writes are.
+func (s *websocketSession) checkLeader() gin.H {
+	replicatedStore, ok := s.kvStore.(store.ReplicatedStore)
+	if !ok || replicatedStore.IsLeader() {
+		return nil
+	}
+	if leaderAddr, known := replicatedStore.LeaderAddr(); known {
+		return gin.H{"status": http.StatusMisdirectedRequest, "error": fmt.Sprintf("This node is not the leader; send writes to %s.", leaderAddr)}
+	}
+	return gin.H{"status": http.StatusServiceUnavailable, "error": "No leader is available."}
+}
+
+func (s *websocketSession) get(request websocketRequest) gin.H {
+	if request.Key == "" {
+		return gin.H{"status": http.StatusBadRequest, "error": "key is required."}
+	}
+	versionedStore, ok := s.kvStore.(store.VersionedStore)
+	if !ok {
+		value, found := s.kvStore.Lookup(request.Key)
+		if !found {
+			return gin.H{"status": http.StatusNotFound, "error": "Key not found.", "code": keyNotFoundCode}
+		}
+		return gin.H{"status": http.StatusOK, "value": value}
+	}
+	value, version := versionedStore.GetWithVersion(request.Key)
+	if version == 0 {
+		return gin.H{"status": http.StatusNotFound, "error": "Key not found.", "code": keyNotFoundCode}
+	}
+	return gin.H{"status": http.StatusOK, "value": value, "version": version}
+}
+
+// set sets a key, as the HTTP API does, with an optional ttl_seconds or
+// if_version.
+func (s *websocketSession) set(request websocketRequest) gin.H {
+	switch {
+	case request.Key == "":
+		return gin.H{"status": http.StatusBadRequest, "error": "key is required."}
+	case request.Value == nil:
+		return gin.H{"status": http.StatusBadRequest, "error": "value is required."}
+	case request.TTLSeconds != nil && *request.TTLSeconds <= 0:
+		return gin.H{"status": http.StatusBadRequest, "error": "ttl_seconds must be greater than 0."}
+	}
+	var value any
+	if err := json.Unmarshal(request.Value, &value); err != nil {
+		return gin.H{"status": http.StatusBadRequest, "error": err.Error()}
+	}
+	if response := s.checkLeader(); response != nil {
+		return response
+	}
+
+	switch {
+	case request.IfVersion != nil:
+		versionedStore, ok := s.kvStore.(store.VersionedStore)
+		if !ok {
+			return gin.H{"status": http.StatusNotImplemented, "error": "Store does not support conditional writes."}
+		}
+		var version uint64
+		var err error
+		if request.TTLSeconds != nil {
+			expiringStore, ok := s.kvStore.(store.ExpiringVersionedStore)
+			if !ok {
+				return gin.H{"status": http.StatusNotImplemented, "error": "Store does not support TTLs."}
+			}
+			version, err = expiringStore.CompareAndSwapWithTTL(request.Key, *request.IfVersion, value, time.Duration(*request.TTLSeconds)*time.Second)
+		} else {
+			version, err = versionedStore.CompareAndSwap(request.Key, *request.IfVersion, value)
+		}
+		switch {
+		case errors.Is(err, store.ErrVersionMismatch):
+			return gin.H{"status": http.StatusPreconditionFailed, "error": err.Error()}
+		case err != nil:
+			return gin.H{"status": http.StatusInternalServerError, "error": err.Error()}
+		}
+		return gin.H{"status": http.StatusOK, "version": version}
+	case request.TTLSeconds != nil:
+		expiringStore, ok := s.kvStore.(store.ExpiringStore)
+		if !ok {
+			return gin.H{"status": http.StatusNotImplemented, "error": "Store does not support TTLs."}
+		}
+		expiringStore.SetWithTTL(request.Key, value, time.Duration(*request.TTLSeconds)*time.Second)
+	default:
+		s.kvStore.Set(request.Key, value)
+	}
+	return gin.H{"status": http.StatusOK}
+}
+
+// delete deletes a key, as the HTTP API does, with an optional if_version.
+func (s *websocketSession) delete(request websocketRequest) gin.H {
+	if request.Key == "" {
+		return gin.H{"status": http.StatusBadRequest, "error": "key is required."}
+	}
+	if response := s.checkLeader(); response != nil {
+		return response
+	}
+	if request.IfVersion == nil {
+		s.kvStore.Delete(request.Key)
+		return gin.H{"status": http.StatusOK}
+	}
+	versionedStore, ok := s.kvStore.(store.VersionedStore)
+	if !ok {
+		return gin.H{"status": http.StatusNotImplemented, "error": "Store does not support conditional writes."}
+	}
+	if err := versionedStore.CompareAndDelete(request.Key, *request.IfVersion); errors.Is(err, store.ErrVersionMismatch) {
+		return gin.H{"status": http.StatusPreconditionFailed, "error": err.Error()}
+	}
+	return gin.H{"status": http.StatusOK}
+}
+
+// subscribe sends the client an event for every later change to the given
+// keys. Its response carries the current revision: every change after it
+// is sent, so a client that reads the keys after subscribing misses none.
+func (s *websocketSession) subscribe(ctx context.Context, request websocketRequest) gin.H {
+	if len(request.Keys) == 0 {
+		return gin.H{"status": http.StatusBadRequest, "error": "keys is required."}
+	}
+	watchableStore, ok := s.kvStore.(store.WatchableStore)
+	if !ok {
+		return gin.H{"status": http.StatusNotImplemented, "error": "Store does not support watching keys."}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.watching {
+		// one watch serves every subscription, filtered by key
+		events, err := watchableStore.Watch(ctx, "", 0)
+		if err != nil {
+			return gin.H{"status": http.StatusInternalServerError, "error": err.Error()}
+		}
+		s.watching = true
+		go s.notify(events)
+	}
+	for _, key := range request.Keys {
+		s.subscriptions[key] = struct{}{}
+	}
+	return gin.H{"status": http.StatusOK, "revision": watchableStore.Revision()}
+}
+
+func (s *websocketSession) unsubscribe(request websocketRequest) gin.H {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range request.Keys {
+		delete(s.subscriptions, key)
+	}
+	return gin.H{"status": http.StatusOK}
+}
+
+// notify sends the client the events for the keys it's subscribed to.
+func (s *websocketSession) notify(events <-chan store.Event) {
+	for event := range events {
+		s.mu.Lock()
+		_, subscribed := s.subscriptions[event.Key]
+		s.mu.Unlock()
+		if !subscribed {
+			continue
+		}
+		message := gin.H{"event": event.Type, "key": event.Key, "revision": event.Revision}
+		addEventValue(message, event)
+		s.send(message)
+	}
+	// the channel closes when the connection ends or the client falls too
+	// far behind, in which case it has to resubscribe and read the keys again
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "The watcher fell too far behind."), time.Now().Add(time.Second))
+	s.conn.Close()
+}
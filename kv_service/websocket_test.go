@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgraves/key-value-store/kv_service/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type websocketTestSuite struct {
+	suite.Suite
+	kvStore store.NamespacedStore
+	server  *httptest.Server
+	conn    *websocket.Conn
+}
+
+func (s *websocketTestSuite) SetupTest() {
+	s.kvStore = store.NewNamespacedStore()
+	s.serve(s.kvStore, "/api/v1/ws")
+}
+
+func (s *websocketTestSuite) TearDownTest() {
+	s.conn.Close()
+	s.server.Close()
+	s.server = nil
+}
+
+// serve serves kvStore's HTTP API and connects to the WebSocket at path.
+func (s *websocketTestSuite) serve(kvStore store.Store, path string) {
+	if s.server != nil {
+		s.TearDownTest()
+	}
+	s.server = httptest.NewServer(setupRouter(kvStore))
+	s.conn = s.dial(path)
+}
+
+func (s *websocketTestSuite) dial(path string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.server.URL, "http")+path, nil)
+	s.Require().NoError(err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// do sends request and returns the next message received.
+func (s *websocketTestSuite) do(request map[string]any) map[string]any {
+	s.Require().NoError(s.conn.WriteJSON(request))
+	return s.receive()
+}
+
+func (s *websocketTestSuite) receive() map[string]any {
+	var message map[string]any
+	s.Require().NoError(s.conn.ReadJSON(&message))
+	return message
+}
+
+func (s *websocketTestSuite) defaultKeyspace() store.Store {
+	keyspace, _ := s.kvStore.Namespace(store.DefaultNamespace)
+	return keyspace
+}
+
+func (s *websocketTestSuite) TestSetAndGet() {
+	assert.Equal(s.T(), map[string]any{"id": float64(1), "status": float64(200)},
+		s.do(map[string]any{"id": 1, "op": "set", "key": "key", "value": map[string]any{"nested": "data"}}))
+	assert.Equal(s.T(), map[string]any{"nested": "data"}, s.defaultKeyspace().Get("key"))
+
+	assert.Equal(s.T(), map[string]any{"id": "two", "status": float64(200), "value": map[string]any{"nested": "data"}, "version": float64(1)},
+		s.do(map[string]any{"id": "two", "op": "get", "key": "key"}))
+	assert.Equal(s.T(), map[string]any{"id": float64(3), "status": float64(404), "error": "Key not found.", "code": "key_not_found"},
+		s.do(map[string]any{"id": 3, "op": "get", "key": "missing"}))
+}
+
+func (s *websocketTestSuite) TestSetAndGet_Null() {
+	assert.Equal(s.T(), float64(200), s.do(map[string]any{"id": 1, "op": "set", "key": "key", "value": nil})["status"])
+	assert.Equal(s.T(), map[string]any{"id": float64(2), "status": float64(200), "value": nil, "version": float64(1)},
+		s.do(map[string]any{"id": 2, "op": "get", "key": "key"}))
+}
+
+func (s *websocketTestSuite) TestSet_TTL() {
+	assert.Equal(s.T(), float64(200), s.do(map[string]any{"id": 1, "op": "set", "key": "key", "value": "v", "ttl_seconds": 60})["status"])
+	entries, _ := s.defaultKeyspace().(store.ScannableStore).Scan("", "", 0)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+
+	assert.Equal(s.T(), map[string]any{"id": float64(2), "status": float64(400), "error": "ttl_seconds must be greater than 0."},
+		s.do(map[string]any{"id": 2, "op": "set", "key": "key", "value": "v", "ttl_seconds": 0}))
+}
+
+func (s *websocketTestSuite) TestConditionalWrites() {
+	assert.Equal(s.T(), map[string]any{"id": float64(1), "status": float64(200), "version": float64(1)},
+		s.do(map[string]any{"id": 1, "op": "set", "key": "key", "value": "one", "if_version": 0}))
+	assert.Equal(s.T(), map[string]any{"id": float64(2), "status": float64(412), "error": `version mismatch: "key" is at version 1, expected 0`},
+		s.do(map[string]any{"id": 2, "op": "set", "key": "key", "value": "two", "if_version": 0}))
+	assert.Equal(s.T(), float64(412), s.do(map[string]any{"id": 3, "op": "delete", "key": "key", "if_version": 5})["status"])
+	assert.Equal(s.T(), float64(200), s.do(map[string]any{"id": 4, "op": "delete", "key": "key", "if_version": 1})["status"])
+	assert.Nil(s.T(), s.defaultKeyspace().Get("key"))
+
+	// a conditional write can set a TTL
+	assert.Equal(s.T(), float64(200), s.do(map[string]any{"id": 5, "op": "set", "key": "key", "value": "v", "ttl_seconds": 60, "if_version": 0})["status"])
+	entries, _ := s.defaultKeyspace().(store.ScannableStore).Scan("key", "", 1)
+	s.Require().Len(entries, 1)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Minute), entries[0].ExpiresAt, 5*time.Second)
+}
+
+func (s *websocketTestSuite) TestDelete() {
+	s.defaultKeyspace().Set("key", "value")
+	assert.Equal(s.T(), map[string]any{"id": float64(1), "status": float64(200)}, s.do(map[string]any{"id": 1, "op": "delete", "key": "key"}))
+	assert.Nil(s.T(), s.defaultKeyspace().Get("key"))
+}
+
+func (s *websocketTestSuite) TestInvalidRequests() {
+	s.Require().NoError(s.conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	response := s.receive()
+	assert.Equal(s.T(), float64(400), response["status"])
+	assert.Nil(s.T(), response["id"])
+
+	assert.Equal(s.T(), `unknown op "put": want get, set, delete, subscribe or unsubscribe`, s.do(map[string]any{"id": 1, "op": "put"})["error"])
+	assert.Equal(s.T(), "key is required.", s.do(map[string]any{"id": 2, "op": "get"})["error"])
+	assert.Equal(s.T(), "value is required.", s.do(map[string]any{"id": 3, "op": "set", "key": "key"})["error"])
+	assert.Equal(s.T(), "keys is required.", s.do(map[string]any{"id": 4, "op": "subscribe"})["error"])
+}
+
+func (s *websocketTestSuite) TestSubscribe() {
+	response := s.do(map[string]any{"id": 1, "op": "subscribe", "keys": []string{"a", "b"}})
+	assert.Equal(s.T(), float64(200), response["status"])
+	assert.Equal(s.T(), float64(0), response["revision"])
+
+	s.defaultKeyspace().Set("other", "ignored")
+	s.defaultKeyspace().Set("a", "one")
+	assert.Equal(s.T(), map[string]any{"event": "set", "key": "a", "value": "one", "revision": float64(2)}, s.receive())
+	s.defaultKeyspace().Delete("a")
+	assert.Equal(s.T(), map[string]any{"event": "delete", "key": "a", "revision": float64(3)}, s.receive())
+
+	assert.Equal(s.T(), float64(200), s.do(map[string]any{"id": 2, "op": "unsubscribe", "keys": []string{"a"}})["status"])
+	s.defaultKeyspace().Set("a", "two")
+	// a write over the WebSocket notifies it too, after the write's response
+	assert.Equal(s.T(), map[string]any{"id": float64(3), "status": float64(200)}, s.do(map[string]any{"id": 3, "op": "set", "key": "b", "value": "three"}))
+	assert.Equal(s.T(), map[string]any{"event": "set", "key": "b", "value": "three", "revision": float64(5)}, s.receive())
+}
+
+func (s *websocketTestSuite) TestNamespace() {
+	conn := s.dial("/api/v1/ns/tenant/ws")
+	defer conn.Close()
+	s.Require().NoError(conn.WriteJSON(map[string]any{"id": 1, "op": "set", "key": "key", "value": "tenant value"}))
+	var response map[string]any
+	s.Require().NoError(conn.ReadJSON(&response))
+
+	tenant, _ := s.kvStore.Namespace("tenant")
+	assert.Equal(s.T(), "tenant value", tenant.Get("key"))
+	assert.Nil(s.T(), s.defaultKeyspace().Get("key"))
+}
+
+func (s *websocketTestSuite) TestCrossOriginRejected() {
+	header := http.Header{"Origin": {"https://elsewhere.example"}}
+	_, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.server.URL, "http")+"/api/v1/ws", header)
+	assert.ErrorIs(s.T(), err, websocket.ErrBadHandshake)
+	assert.Equal(s.T(), http.StatusForbidden, response.StatusCode)
+}
+
+func (s *websocketTestSuite) TestUnsupportedStore() {
+	s.serve(basicStore{store.NewInMemoryStore()}, "/api/v1/ws")
+
+	assert.Equal(s.T(), float64(404), s.do(map[string]any{"id": 1, "op": "get", "key": "key"})["status"])
+	assert.Equal(s.T(), "Store does not support TTLs.", s.do(map[string]any{"id": 2, "op": "set", "key": "key", "value": "v", "ttl_seconds": 1})["error"])
+	assert.Equal(s.T(), "Store does not support conditional writes.", s.do(map[string]any{"id": 3, "op": "delete", "key": "key", "if_version": 1})["error"])
+	assert.Equal(s.T(), "Store does not support watching keys.", s.do(map[string]any{"id": 4, "op": "subscribe", "keys": []string{"key"}})["error"])
+}
+
+func (s *websocketTestSuite) TestFollowerRejectsWrites() {
+	s.serve(replicaStore{Store: store.NewInMemoryStore(), leaderAddr: "http://leader:8080"}, "/api/v1/ws")
+
+	assert.Equal(s.T(), map[string]any{"id": float64(1), "status": float64(421), "error": "This node is not the leader; send writes to http://leader:8080."},
+		s.do(map[string]any{"id": 1, "op": "set", "key": "key", "value": "v"}))
+	assert.Equal(s.T(), float64(421), s.do(map[string]any{"id": 2, "op": "delete", "key": "key"})["status"])
+	// reads are served by the follower
+	assert.Equal(s.T(), float64(404), s.do(map[string]any{"id": 3, "op": "get", "key": "key"})["status"])
+
+	s.serve(replicaStore{Store: store.NewInMemoryStore()}, "/api/v1/ws")
+	assert.Equal(s.T(), map[string]any{"id": float64(1), "status": float64(503), "error": "No leader is available."},
+		s.do(map[string]any{"id": 1, "op": "set", "key": "key", "value": "v"}))
+}
+
+func TestWebsocketTestSuite(t *testing.T) {
+	suite.Run(t, new(websocketTestSuite))
+}
@@ -2,17 +2,30 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 )
 
+// ErrNotFound is returned by GetKey when the key is not set. A key set to
+// null is found, with a nil value.
+var ErrNotFound = errors.New("key not found")
+
+// keyNotFoundCode is the error code the KV service sends with a 404 for a
+// missing key, telling it apart from a 404 for an unknown route.
+const keyNotFoundCode = "key_not_found"
+
 // Client defines the interface for interacting with the KV service
 type Client interface {
 	SetKey(key string, value any) error
 	DeleteKey(key string) error
-	GetKey(key string) (any, error) // returns unwrapped value from response
+	GetKey(key string) (any, error) // returns unwrapped value from response, or ErrNotFound
+	SetKeys(values map[string]any) error
+	DeleteKeys(keys []string) error
+	GetKeys(keys []string) ([]any, []bool, error) // returns values in the order of keys, and whether each was found
 }
 
 // httpClient is an HTTP implementation of Client
@@ -73,6 +86,14 @@ func (c *httpClient) GetKey(key string) (any, error) {
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(response.Body)
+		if response.StatusCode == http.StatusNotFound {
+			var errorResponse struct {
+				Code string `json:"code"`
+			}
+			if json.Unmarshal(bodyBytes, &errorResponse) == nil && errorResponse.Code == keyNotFoundCode {
+				return nil, fmt.Errorf("failed to get key %q: %w", key, ErrNotFound)
+			}
+		}
 		return nil, fmt.Errorf("failed to get key: %s, response: %s", response.Status, string(bodyBytes))
 	}
 	var valueResponse struct {
@@ -84,3 +105,98 @@ func (c *httpClient) GetKey(key string) (any, error) {
 	}
 	return valueResponse.Value, nil
 }
+
+// batchOp is a single operation sent to the batch endpoint
+type batchOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"` // encoded, so a null value is still sent
+}
+
+// batchResult is the result of a single batch operation
+type batchResult struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+	Found bool   `json:"found"` // for a get, as a found value may be null
+}
+
+// batch sends ops to the batch endpoint in a single request
+func (c *httpClient) batch(ops []batchOp) ([]batchResult, error) {
+	body, err := json.Marshal(map[string]any{"ops": ops})
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.Post(fmt.Sprintf("%s/batch", c.BaseURL), "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(response.Body)
+		return nil, fmt.Errorf("failed to apply batch: %s, response: %s", response.Status, string(bodyBytes))
+	}
+	var batchResponse struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&batchResponse); err != nil {
+		return nil, err
+	}
+	if len(batchResponse.Results) != len(ops) {
+		return nil, fmt.Errorf("failed to apply batch: expected %d results, got %d", len(ops), len(batchResponse.Results))
+	}
+	return batchResponse.Results, nil
+}
+
+func (c *httpClient) SetKeys(values map[string]any) error {
+	if len(values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	ops := make([]batchOp, len(keys))
+	for i, key := range keys {
+		value, err := json.Marshal(values[key])
+		if err != nil {
+			return err
+		}
+		ops[i] = batchOp{Op: "set", Key: key, Value: value}
+	}
+	_, err := c.batch(ops)
+	return err
+}
+
+func (c *httpClient) DeleteKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ops := make([]batchOp, len(keys))
+	for i, key := range keys {
+		ops[i] = batchOp{Op: "delete", Key: key}
+	}
+	_, err := c.batch(ops)
+	return err
+}
+
+func (c *httpClient) GetKeys(keys []string) ([]any, []bool, error) {
+	if len(keys) == 0 {
+		return []any{}, []bool{}, nil
+	}
+	ops := make([]batchOp, len(keys))
+	for i, key := range keys {
+		ops[i] = batchOp{Op: "get", Key: key}
+	}
+	results, err := c.batch(ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([]any, len(results))
+	found := make([]bool, len(results))
+	for i, result := range results {
+		values[i], found[i] = result.Value, result.Found
+	}
+	return values, found, nil
+}
@@ -166,6 +166,38 @@ func (s *clientTestSuite) TestGetKey_ServerError() {
 	assert.Contains(s.T(), err.Error(), "500")
 }
 
+func (s *clientTestSuite) TestGetKey_NotFound() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Key not found.","code":"key_not_found","key":"testkey"}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	value, err := client.GetKey("testkey")
+
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+	assert.Nil(s.T(), value)
+}
+
+func (s *clientTestSuite) TestGetKey_NotFoundWithoutCode() {
+	// a 404 from something other than the KV service, such as a wrong base URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 page not found"))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	value, err := client.GetKey("testkey")
+
+	assert.Error(s.T(), err)
+	assert.NotErrorIs(s.T(), err, ErrNotFound)
+	assert.Nil(s.T(), value)
+	assert.Contains(s.T(), err.Error(), "404")
+}
+
 func (s *clientTestSuite) TestGetKey_InvalidJSON() {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -234,6 +266,121 @@ func (s *clientTestSuite) TestDeleteKey_RequestCreationError() {
 	assert.Error(s.T(), err)
 }
 
+func (s *clientTestSuite) TestSetKeys_Success() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(s.T(), "POST", r.Method)
+		assert.Equal(s.T(), "/batch", r.URL.Path)
+		assert.Equal(s.T(), "application/json", r.Header.Get("Content-Type"))
+
+		// ops are sent in key order
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), []interface{}{
+			map[string]interface{}{"op": "set", "key": "a", "value": "1"},
+			map[string]interface{}{"op": "set", "key": "b", "value": float64(2)},
+			map[string]interface{}{"op": "set", "key": "c", "value": nil},
+		}, body["ops"])
+
+		w.Write([]byte(`{"results":[{"op":"set","key":"a"},{"op":"set","key":"b"},{"op":"set","key":"c"}]}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	err := client.SetKeys(map[string]any{"b": 2, "a": "1", "c": nil})
+
+	assert.NoError(s.T(), err)
+}
+
+func (s *clientTestSuite) TestSetKeys_ServerError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	err := client.SetKeys(map[string]any{"a": "1"})
+
+	assert.Error(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "failed to apply batch")
+	assert.Contains(s.T(), err.Error(), "500")
+}
+
+func (s *clientTestSuite) TestGetKeys_Success() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), []interface{}{
+			map[string]interface{}{"op": "get", "key": "b"},
+			map[string]interface{}{"op": "get", "key": "a"},
+			map[string]interface{}{"op": "get", "key": "c"},
+		}, body["ops"])
+
+		w.Write([]byte(`{"results":[{"op":"get","key":"b","value":{"n":1},"found":true},{"op":"get","key":"a","value":null,"found":true},{"op":"get","key":"c","value":null,"found":false}]}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	values, found, err := client.GetKeys([]string{"b", "a", "c"})
+
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []any{map[string]interface{}{"n": float64(1)}, nil, nil}, values)
+	// a null value is told apart from a missing key
+	assert.Equal(s.T(), []bool{true, true, false}, found)
+}
+
+func (s *clientTestSuite) TestGetKeys_ResultCountMismatch() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	values, found, err := client.GetKeys([]string{"a"})
+
+	assert.Error(s.T(), err)
+	assert.Nil(s.T(), values)
+	assert.Nil(s.T(), found)
+}
+
+func (s *clientTestSuite) TestGetKeys_Empty() {
+	// no request is made for an empty batch
+	client := NewHTTPClient("http://invalid-url-that-does-not-exist:9999")
+	values, found, err := client.GetKeys(nil)
+
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), values)
+	assert.Empty(s.T(), found)
+}
+
+func (s *clientTestSuite) TestDeleteKeys_Success() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), []interface{}{
+			map[string]interface{}{"op": "delete", "key": "a"},
+			map[string]interface{}{"op": "delete", "key": "b"},
+		}, body["ops"])
+
+		w.Write([]byte(`{"results":[{"op":"delete","key":"a"},{"op":"delete","key":"b"}]}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL)
+	err := client.DeleteKeys([]string{"a", "b"})
+
+	assert.NoError(s.T(), err)
+}
+
+func (s *clientTestSuite) TestDeleteKeys_NetworkError() {
+	client := NewHTTPClient("http://invalid-url-that-does-not-exist:9999")
+	err := client.DeleteKeys([]string{"a"})
+
+	assert.Error(s.T(), err)
+}
+
 func TestClientTestSuite(t *testing.T) {
 	suite.Run(t, new(clientTestSuite))
 }
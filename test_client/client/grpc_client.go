@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/awgraves/key-value-store/test_client/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcTimeout bounds each call to the KV service.
+const grpcTimeout = 10 * time.Second
+
+// grpcClient is a gRPC implementation of Client
+type grpcClient struct {
+	conn   *grpc.ClientConn
+	client kvpb.KVServiceClient
+}
+
+// NewGRPCClient returns a client of the KV service's gRPC API at addr, e.g.
+// localhost:9090. The connection is made lazily, on the first call.
+func NewGRPCClient(addr string, opts ...grpc.DialOption) (*grpcClient, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{conn: conn, client: kvpb.NewKVServiceClient(conn)}, nil
+}
+
+// Close closes the connection to the KV service.
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *grpcClient) SetKey(key string, value any) error {
+	protoValue, err := structpb.NewValue(value)
+	if err != nil {
+		return fmt.Errorf("failed to set key: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	if _, err := c.client.Set(ctx, &kvpb.SetRequest{Key: key, Value: protoValue}); err != nil {
+		return fmt.Errorf("failed to set key: %w", err)
+	}
+	return nil
+}
+
+func (c *grpcClient) DeleteKey(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	if _, err := c.client.Delete(ctx, &kvpb.DeleteRequest{Key: key}); err != nil {
+		return fmt.Errorf("failed to delete key: %w", err)
+	}
+	return nil
+}
+
+func (c *grpcClient) GetKey(key string) (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	response, err := c.client.Get(ctx, &kvpb.GetRequest{Key: key})
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("failed to get key %q: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key: %w", err)
+	}
+	return response.Value.AsInterface(), nil
+}
+
+// SetKeys sets each key in turn, in key order, as the gRPC API has no batch call.
+func (c *grpcClient) SetKeys(values map[string]any) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := c.SetKey(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *grpcClient) DeleteKeys(keys []string) error {
+	for _, key := range keys {
+		if err := c.DeleteKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *grpcClient) GetKeys(keys []string) ([]any, []bool, error) {
+	values := make([]any, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		value, err := c.GetKey(key)
+		// missing keys are nil and not found, as they are from the batch endpoint
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, nil, err
+		}
+		values[i], found[i] = value, err == nil
+	}
+	return values, found, nil
+}
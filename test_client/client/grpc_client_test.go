@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/awgraves/key-value-store/test_client/kvpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeKVServer is an in-memory KVService that records the keys it was sent.
+type fakeKVServer struct {
+	kvpb.UnimplementedKVServiceServer
+	mu     sync.Mutex
+	values map[string]*structpb.Value
+	calls  []string
+	err    error
+}
+
+func (f *fakeKVServer) record(call string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	return f.err
+}
+
+func (f *fakeKVServer) Get(_ context.Context, request *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if err := f.record("get " + request.Key); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.values[request.Key]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Key not found.")
+	}
+	return &kvpb.GetResponse{Value: value}, nil
+}
+
+func (f *fakeKVServer) Set(_ context.Context, request *kvpb.SetRequest) (*kvpb.SetResponse, error) {
+	if err := f.record("set " + request.Key); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[request.Key] = request.Value
+	return &kvpb.SetResponse{}, nil
+}
+
+func (f *fakeKVServer) Delete(_ context.Context, request *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if err := f.record("delete " + request.Key); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.values, request.Key)
+	return &kvpb.DeleteResponse{}, nil
+}
+
+type grpcClientTestSuite struct {
+	suite.Suite
+	server *fakeKVServer
+	grpc   *grpc.Server
+	client *grpcClient
+}
+
+func (s *grpcClientTestSuite) SetupTest() {
+	listener := bufconn.Listen(1 << 20)
+	s.server = &fakeKVServer{values: map[string]*structpb.Value{}}
+	s.grpc = grpc.NewServer()
+	kvpb.RegisterKVServiceServer(s.grpc, s.server)
+	go s.grpc.Serve(listener)
+
+	client, err := NewGRPCClient("passthrough:///bufconn", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}))
+	s.Require().NoError(err)
+	s.client = client
+}
+
+func (s *grpcClientTestSuite) TearDownTest() {
+	s.client.Close()
+	s.grpc.Stop()
+}
+
+func (s *grpcClientTestSuite) TestNewGRPCClient() {
+	assert.Implements(s.T(), (*Client)(nil), s.client)
+}
+
+func (s *grpcClientTestSuite) TestSetAndGetKey() {
+	complexValue := map[string]any{"nested": "data", "number": 42}
+	s.Require().NoError(s.client.SetKey("key", complexValue))
+
+	value, err := s.client.GetKey("key")
+	s.Require().NoError(err)
+	// numbers come back as float64, as they do from JSON
+	assert.Equal(s.T(), map[string]any{"nested": "data", "number": float64(42)}, value)
+}
+
+func (s *grpcClientTestSuite) TestGetKey_NotFound() {
+	value, err := s.client.GetKey("missing")
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+	assert.Nil(s.T(), value)
+}
+
+func (s *grpcClientTestSuite) TestSetAndGetKey_Null() {
+	s.Require().NoError(s.client.SetKey("key", nil))
+
+	value, err := s.client.GetKey("key")
+	s.Require().NoError(err)
+	assert.Nil(s.T(), value)
+}
+
+func (s *grpcClientTestSuite) TestSetKey_UnsupportedValue() {
+	err := s.client.SetKey("key", struct{}{})
+	assert.ErrorContains(s.T(), err, "failed to set key")
+	assert.Empty(s.T(), s.server.calls)
+}
+
+func (s *grpcClientTestSuite) TestDeleteKey() {
+	s.Require().NoError(s.client.SetKey("key", "value"))
+	s.Require().NoError(s.client.DeleteKey("key"))
+
+	_, err := s.client.GetKey("key")
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+}
+
+func (s *grpcClientTestSuite) TestServerError() {
+	s.server.err = status.Error(codes.Unavailable, "No leader is available.")
+
+	assert.ErrorContains(s.T(), s.client.SetKey("key", "value"), "failed to set key")
+	assert.ErrorContains(s.T(), s.client.DeleteKey("key"), "failed to delete key")
+	_, err := s.client.GetKey("key")
+	assert.ErrorContains(s.T(), err, "failed to get key")
+	assert.Equal(s.T(), codes.Unavailable, status.Code(err))
+	assert.NotErrorIs(s.T(), err, ErrNotFound)
+}
+
+func (s *grpcClientTestSuite) TestBulkOperations() {
+	s.Require().NoError(s.client.SetKeys(map[string]any{"b": "two", "a": "one"}))
+	values, found, err := s.client.GetKeys([]string{"b", "missing", "a"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{"two", nil, "one"}, values)
+	assert.Equal(s.T(), []bool{true, false, true}, found)
+	s.Require().NoError(s.client.DeleteKeys([]string{"a", "b"}))
+
+	assert.Equal(s.T(), []string{"set a", "set b", "get b", "get missing", "get a", "delete a", "delete b"}, s.server.calls)
+}
+
+func (s *grpcClientTestSuite) TestBulkOperations_Empty() {
+	s.Require().NoError(s.client.SetKeys(map[string]any{}))
+	s.Require().NoError(s.client.DeleteKeys(nil))
+	values, found, err := s.client.GetKeys(nil)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []any{}, values)
+	assert.Equal(s.T(), []bool{}, found)
+	assert.Empty(s.T(), s.server.calls)
+}
+
+func TestGRPCClientTestSuite(t *testing.T) {
+	suite.Run(t, new(grpcClientTestSuite))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 
 	"github.com/awgraves/key-value-store/test_client/client"
@@ -15,9 +16,24 @@ func getKVServiceAPIv1BaseURL() string {
 	return "http://localhost:8080/api/v1"
 }
 
+// getKVServiceGRPCAddr returns the address of the KV service's gRPC API, if
+// the client should use it instead of the HTTP API.
+// Uses environment variable KV_SERVICE_GRPC_ADDR, e.g. "kv-service:9090".
+func getKVServiceGRPCAddr() string {
+	return os.Getenv("KV_SERVICE_GRPC_ADDR")
+}
+
 func main() {
 	kvAPIv1BaseURL := getKVServiceAPIv1BaseURL()
-	apiClient := client.NewHTTPClient(kvAPIv1BaseURL)
+	var apiClient client.Client = client.NewHTTPClient(kvAPIv1BaseURL)
+	if grpcAddr := getKVServiceGRPCAddr(); grpcAddr != "" {
+		grpcClient, err := client.NewGRPCClient(grpcAddr)
+		if err != nil {
+			log.Fatalf("failed to create gRPC client: %v", err)
+		}
+		defer grpcClient.Close()
+		apiClient = grpcClient
+	}
 
 	r := setupRouter(apiClient, kvAPIv1BaseURL)
 	r.Run(":8081")
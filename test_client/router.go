@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -8,6 +9,11 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// isNotFound reports whether err is the client's error for a missing key.
+func isNotFound(err error) bool {
+	return errors.Is(err, client.ErrNotFound)
+}
+
 // testDeletionHandler handles the test deletion endpoint
 func testDeletionHandler(client client.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -49,8 +55,12 @@ func testDeletionHandler(client client.Client) gin.HandlerFunc {
 			})
 			return
 		}
-		// check the key was deleted
+		// check the key was deleted; a service in compatibility mode returns
+		// nil for a missing key rather than ErrNotFound
 		value, err = client.GetKey(testKey)
+		if isNotFound(err) {
+			value, err = nil, nil
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"message": "Error getting test key after deletion",
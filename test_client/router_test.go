@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/awgraves/key-value-store/test_client/client"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -30,6 +32,23 @@ func (m *mockClient) GetKey(key string) (any, error) {
 	return args.Get(0), args.Error(1)
 }
 
+func (m *mockClient) SetKeys(values map[string]any) error {
+	args := m.Called(values)
+	return args.Error(0)
+}
+
+func (m *mockClient) DeleteKeys(keys []string) error {
+	args := m.Called(keys)
+	return args.Error(0)
+}
+
+func (m *mockClient) GetKeys(keys []string) ([]any, []bool, error) {
+	args := m.Called(keys)
+	values, _ := args.Get(0).([]any)
+	found, _ := args.Get(1).([]bool)
+	return values, found, args.Error(2)
+}
+
 type routerTestSuite struct {
 	suite.Suite
 	mockClient *mockClient
@@ -47,6 +66,23 @@ func (s *routerTestSuite) TestTestDeletion_Success() {
 	s.mockClient.On("SetKey", "test-key", "test-value").Return(nil)
 	s.mockClient.On("GetKey", "test-key").Return("test-value", nil).Once()
 	s.mockClient.On("DeleteKey", "test-key").Return(nil)
+	s.mockClient.On("GetKey", "test-key").Return(nil, fmt.Errorf("failed to get key: %w", client.ErrNotFound)).Once()
+
+	req, _ := http.NewRequest("GET", "/api/v1/test_deletion", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	assert.Equal(s.T(), http.StatusOK, resp.Code)
+	assert.Contains(s.T(), resp.Body.String(), "Test deletion successful")
+
+	s.mockClient.AssertExpectations(s.T())
+}
+
+func (s *routerTestSuite) TestTestDeletion_MissingKeysAsNull() {
+	// a service in compatibility mode returns null for the deleted key
+	s.mockClient.On("SetKey", "test-key", "test-value").Return(nil)
+	s.mockClient.On("GetKey", "test-key").Return("test-value", nil).Once()
+	s.mockClient.On("DeleteKey", "test-key").Return(nil)
 	s.mockClient.On("GetKey", "test-key").Return(nil, nil).Once()
 
 	req, _ := http.NewRequest("GET", "/api/v1/test_deletion", nil)